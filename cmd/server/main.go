@@ -3,8 +3,15 @@ package main
 // Main service startup entry point.
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	_ "time/tzdata" // timezones requested by clients must be available in the minimal container image
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -12,7 +19,11 @@ import (
 	"valery-datadog-datastream-demo/internal/api"
 	"valery-datadog-datastream-demo/internal/config"
 	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/metrics"
+	"valery-datadog-datastream-demo/internal/monitor"
+	"valery-datadog-datastream-demo/internal/notify"
 	"valery-datadog-datastream-demo/internal/processor"
+	"valery-datadog-datastream-demo/internal/wal"
 )
 
 var upgrader = websocket.Upgrader{
@@ -24,13 +35,61 @@ var upgrader = websocket.Upgrader{
 func main() {
 	router := gin.Default()
 
-	// Create data stream from csv file and a metric processor instance. For this demo it handles a single metric
-	dataStream := data.NewFileDataStream(config.CsvDataSetFilePath)
-	metricProcessor := processor.NewInMemoryMetricStreamProcessor()
+	// Restore metric processor from the last snapshot if there is one, otherwise start with an empty one.
+	// For this demo it handles a single metric
+	metricProcessor, snapshotMetadata := restoreMetricProcessor()
+	metricProcessor.SetQueryParallelism(config.QueryParallelism)
 
-	// Stream data into the metric processor
+	// Health metrics of the service, scraped through /metrics
+	metrics.RegisterRuntimeMetrics(metrics.Default)
+	metricProcessor.RegisterIndexMetrics(metrics.Default)
+
+	// Stream data into the metric processor, only records that came after the snapshot are replayed
+	dataStream := data.NewFileDataStreamFromOffset(config.CsvDataSetFilePath, snapshotMetadata.SourceOffset,
+		config.ProcessorShardCount)
+	fileRowsRead := metrics.Default.NewCounter("datastream_file_rows_read", "Rows read from the CSV data stream file.")
+	dataStream.OnRowRead(fileRowsRead.With().Inc)
 	dataStream.Stream(metricProcessor)
 
+	// Replay records ingested through live streams after the snapshot, from now on every accepted record is
+	// written to the log before it is indexed. Serving with records missing in the middle of the log would be
+	// silently wrong, a damaged log has to be fixed or removed by hand.
+	writeAheadLog := openWriteAheadLog(snapshotMetadata.WalSequence + 1)
+	if err := writeAheadLog.Replay(snapshotMetadata.WalSequence+1, metricProcessor.Replay); err != nil {
+		log.Fatalf("Unable to replay write-ahead log: %v", err)
+	}
+	metricProcessor.SetRecordLog(writeAheadLog)
+
+	// Keep snapshots up to date while the service is running, log segments covered by a snapshot are removed
+	snapshotter := processor.NewSnapshotter(config.SnapshotFilePath, metricProcessor, config.SnapshotInterval,
+		func() processor.SnapshotMetadata {
+			// a snapshot without the source is not restored
+			source, err := processor.ReadSnapshotSource(config.CsvDataSetFilePath)
+			if err != nil {
+				log.Printf("Unable to read CSV file: %v", err)
+			}
+			return processor.SnapshotMetadata{SourceOffset: dataStream.Offset(), Source: source}
+		})
+	snapshotter.OnSnapshot(func(metadata processor.SnapshotMetadata) error {
+		return writeAheadLog.TruncateBefore(metadata.WalSequence + 1)
+	})
+	if err := snapshotter.Snapshot(); err != nil {
+		log.Printf("Failed to write processor snapshot: %v", err)
+	}
+	snapshotter.Start()
+
+	// Notify webhooks about monitor state changes
+	notifier := newNotifier()
+
+	// Evaluate user defined monitors against the processor data
+	monitors := monitor.NewManager(metricProcessor, config.MonitorsFilePath, config.MonitorSchedulerTick,
+		config.MonitorHistoryLength)
+	if err := monitors.Load(); err != nil {
+		log.Printf("Failed to load monitors: %v", err)
+	}
+	monitors.OnStateChange(notifier.Notify)
+	monitors.Start()
+
 	// Register API endpoints
 	// getData - main flow - to fetch metrics using filters, partitioners and aggregate them
 	router.GET("/getData", func(c *gin.Context) {
@@ -42,6 +101,160 @@ func main() {
 		api.HandleGetFiltersWebSocket(metricProcessor, upgrader, c.Request, c.Writer)
 	})
 
+	// REST API - the same as getData and getFilters for clients without websocket
+	router.GET("/api/v1/query", func(c *gin.Context) {
+		api.HandleQuery(metricProcessor, c.Request, c.Writer)
+	})
+	router.POST("/api/v1/query", func(c *gin.Context) {
+		api.HandleQuery(metricProcessor, c.Request, c.Writer)
+	})
+	router.GET("/api/v1/export", func(c *gin.Context) {
+		api.HandleExport(metricProcessor, c.Request, c.Writer)
+	})
+	router.POST("/api/v1/export", func(c *gin.Context) {
+		api.HandleExport(metricProcessor, c.Request, c.Writer)
+	})
+	router.GET("/api/v1/records", func(c *gin.Context) {
+		api.HandleGetRecords(metricProcessor, c.Request, c.Writer)
+	})
+	router.GET("/api/v1/tags", func(c *gin.Context) {
+		api.HandleGetTags(metricProcessor, c.Request, c.Writer)
+	})
+
+	// Prometheus HTTP API - PromQL range queries and label lookups, so Grafana can chart the metric
+	router.GET("/api/v1/query_range", func(c *gin.Context) {
+		api.HandlePromQueryRange(metricProcessor, c.Request, c.Writer)
+	})
+	router.POST("/api/v1/query_range", func(c *gin.Context) {
+		api.HandlePromQueryRange(metricProcessor, c.Request, c.Writer)
+	})
+	router.GET("/api/v1/labels", func(c *gin.Context) {
+		api.HandlePromLabels(metricProcessor, c.Request, c.Writer)
+	})
+	router.POST("/api/v1/labels", func(c *gin.Context) {
+		api.HandlePromLabels(metricProcessor, c.Request, c.Writer)
+	})
+	router.GET("/api/v1/label/:name/values", func(c *gin.Context) {
+		api.HandlePromLabelValues(metricProcessor, c.Param("name"), c.Request, c.Writer)
+	})
+
+	// stream - Server-Sent Events of a live query, for clients behind proxies breaking websockets
+	streams := api.NewStreams(config.StreamHeartbeatInterval, config.StreamResumeWindow, config.StreamReplayLength,
+		config.MaxOpenStreams, config.MaxDetachedStreams)
+	router.GET("/api/v1/stream", func(c *gin.Context) {
+		api.HandleStream(metricProcessor, streams, c.Request, c.Writer)
+	})
+
+	// ingest - live stream of CSV data records pushed over HTTP
+	router.POST("/ingest", func(c *gin.Context) {
+		api.HandleIngest(metricProcessor, c.Request, c.Writer)
+	})
+
+	// monitors - CRUD of monitor definitions and their state history
+	router.GET("/monitors", func(c *gin.Context) {
+		api.HandleListMonitors(monitors, c.Writer)
+	})
+	router.POST("/monitors", func(c *gin.Context) {
+		api.HandleCreateMonitor(monitors, c.Request, c.Writer)
+	})
+	router.GET("/monitors/:id", func(c *gin.Context) {
+		api.HandleGetMonitor(monitors, c.Param("id"), c.Writer)
+	})
+	router.PUT("/monitors/:id", func(c *gin.Context) {
+		api.HandleUpdateMonitor(monitors, c.Param("id"), c.Request, c.Writer)
+	})
+	router.DELETE("/monitors/:id", func(c *gin.Context) {
+		api.HandleDeleteMonitor(monitors, c.Param("id"), c.Writer)
+	})
+	router.GET("/monitors/:id/history", func(c *gin.Context) {
+		api.HandleGetMonitorHistory(monitors, c.Param("id"), c.Writer)
+	})
+
+	// notifications - delivery log of webhook notifications
+	router.GET("/notifications/deliveries", func(c *gin.Context) {
+		api.HandleListDeliveries(notifier, c.Writer)
+	})
+
+	// metrics - health metrics of the service in OpenMetrics text format, for Prometheus to scrape
+	router.GET("/metrics", func(c *gin.Context) {
+		api.HandleMetrics(metrics.Default, c.Request, c.Writer)
+	})
+
 	// Start the server
-	log.Fatal(router.Run(":8080"))
+	server := &http.Server{Addr: ":8080", Handler: router}
+	server.RegisterOnShutdown(streams.Stop)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for shutdown signal, then stop the server and write the final snapshot
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down the server gracefully: %v", err)
+	}
+	monitors.Stop()
+	notifier.Stop()
+	if err := snapshotter.Stop(); err != nil {
+		log.Printf("Failed to write processor snapshot: %v", err)
+	}
+	if err := writeAheadLog.Close(); err != nil {
+		log.Printf("Failed to close write-ahead log: %v", err)
+	}
+}
+
+func restoreMetricProcessor() (*processor.InMemoryMetricStreamProcessor, processor.SnapshotMetadata) {
+	metricProcessor, snapshotMetadata, err := processor.LoadSnapshot(config.SnapshotFilePath, config.CsvDataSetFilePath,
+		config.ProcessorShardCount)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Unable to restore processor snapshot, streaming data from scratch: %v", err)
+		}
+		return processor.NewInMemoryMetricStreamProcessor(config.ProcessorShardCount), processor.SnapshotMetadata{}
+	}
+	log.Printf("Restored processor snapshot taken at %v, source offset %d",
+		snapshotMetadata.CreatedAt, snapshotMetadata.SourceOffset)
+	return metricProcessor, snapshotMetadata
+}
+
+func newNotifier() *notify.Notifier {
+	webhooks, err := notify.LoadWebhooks(config.WebhooksFilePath)
+	if err != nil {
+		log.Printf("Failed to load webhooks: %v", err)
+	}
+	notifier, err := notify.NewNotifier(webhooks, notify.Options{
+		MaxAttempts:    config.NotificationMaxAttempts,
+		InitialBackoff: config.NotificationInitialBackoff,
+		MaxBackoff:     config.NotificationMaxBackoff,
+		RequestTimeout: config.NotificationRequestTimeout,
+		DedupWindow:    config.NotificationDedupWindow,
+		LogLength:      config.NotificationDeliveryLogLength,
+	}, &http.Client{})
+	if err != nil {
+		log.Fatalf("Invalid webhooks configuration: %v", err)
+	}
+	return notifier
+}
+
+func openWriteAheadLog(minSequence uint64) *wal.Log {
+	syncPolicy, err := wal.ParseSyncPolicy(config.WalSyncPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeAheadLog, err := wal.Open(config.WalDirPath, wal.Options{
+		SegmentMaxBytes: config.WalSegmentMaxBytes,
+		SyncPolicy:      syncPolicy,
+		SyncInterval:    config.WalSyncInterval,
+		MinSequence:     minSequence,
+	})
+	if err != nil {
+		log.Fatalf("Unable to open write-ahead log: %v", err)
+	}
+	return writeAheadLog
 }
@@ -37,6 +37,85 @@ var TestGetDataRequests = []data.GetDataRequest{
 		Scale:      "Monthly",
 		Aggregator: "Avg",
 	},
+	{
+		Filters: []string{
+			"location:Chicago",
+		},
+		Scale:      "2w",
+		Timezone:   "America/Chicago",
+		WeekStart:  "ISO",
+		Aggregator: "Sum",
+	},
+	{
+		Filters:    []string{},
+		Scale:      "auto",
+		MaxPoints:  60,
+		Aggregator: "Count",
+	},
+	{
+		Filters:    []string{},
+		Scale:      "Hourly",
+		From:       1561939200000, // 2019-07-01
+		To:         1562112000000, // 2019-07-03
+		Aggregator: "Count",
+	},
+	{
+		Filters: []string{
+			"location:Washington DC",
+			"coupon_code:ELEC10",
+		},
+		Scale:      "Daily",
+		From:       1561939200000, // 2019-07-01
+		To:         1562544000000, // 2019-07-08
+		Aggregator: "Sum",
+		Fill:       "linear",
+	},
+	{
+		Filters:    []string{},
+		Scale:      "Weekly",
+		Aggregator: "Sum",
+		Functions: []data.FunctionRequest{
+			{Name: "movingAverage", Args: []float64{4}},
+			{Name: "cumsum"},
+		},
+	},
+	{
+		// coupon-used share of total spend, in percents
+		Scale: "Monthly",
+		Queries: []data.SubQueryRequest{
+			{Name: "used", Filters: []string{"coupon_status:Used"}, Aggregator: "Sum"},
+			{Name: "total", Aggregator: "Sum"},
+		},
+		Formula: "used / total * 100",
+	},
+	{
+		// week-over-week sales
+		Filters:    []string{"location:Chicago"},
+		Scale:      "Daily",
+		From:       1561939200000, // 2019-07-01
+		To:         1562544000000, // 2019-07-08
+		Aggregator: "Sum",
+		Fill:       "zero",
+		CompareTo:  "week",
+	},
+	{
+		// unusual sales days in Chicago
+		Filters:    []string{"location:Chicago"},
+		Scale:      "Daily",
+		Aggregator: "Sum",
+		Fill:       "zero",
+		Anomaly:    &data.AnomalyRequest{Algorithm: "seasonal", Season: 7},
+	},
+	{
+		// next quarter projection
+		Scale:      "Weekly",
+		Aggregator: "Sum",
+		Forecast:   &data.ForecastRequest{Points: 13, Method: "multiplicative", Season: 4},
+	},
+	{
+		// monthly spend in Chicago except women, by product category
+		Query: "sum:online.spent{location:Chicago,!gender:F} by {product_category}.rollup(sum, 1mo).fill(zero)",
+	},
 }
 
 var TestGetFiltersRequest = []data.GetFiltersRequest{
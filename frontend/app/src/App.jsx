@@ -1,4 +1,4 @@
-import React, { useState, useEffect } from "react"
+import React, { useState, useEffect, useRef } from "react"
 import Header from "./components/Header.jsx"
 import FilterInput from "./components/FilterInput.jsx"
 import FilterDropdown from "./components/FilterDropdown.jsx"
@@ -19,7 +19,7 @@ function App() {
   const [open, setOpen] = useState(false)
   const [location, setLocation] = useState("")
 
-  const scaleItems = ["Daily", "Weekly", "Monthly"]
+  const scaleItems = ["Hourly", "Daily", "Weekly", "Monthly"]
   const [currentScale, setCurrentScale] = useState(DEFAULT_SCALE)
 
   const aggregateByItems = ["Sum", "Avg", "Count"]
@@ -28,6 +28,8 @@ function App() {
   const [filters, setFilters] = useState([])
 
   const dataSocketUrl = 'ws://localhost:8080/getData'
+  // id of the latest request, responses to older requests are ignored
+  const lastRequestId = useRef(0)
   
   
   const { sendJsonMessage, readyState, lastJsonMessage } = useWebSocket(dataSocketUrl, {
@@ -39,10 +41,16 @@ function App() {
 
   useEffect(() => {
     if (readyState === ReadyState.OPEN){
+      // the previous request is stale, the server may stop working on it
+      lastRequestId.current++
       sendJsonMessage({
+        v: 1,
+        id: String(lastRequestId.current),
+        supersedes: String(lastRequestId.current - 1),
         filters: [...filters],
         scale: currentScale,
-        aggregator: currentAggregateByItem
+        aggregator: currentAggregateByItem,
+        fill: "null"
       });
     }
 
@@ -59,8 +67,15 @@ function App() {
       }
     }
 
-    if (lastJsonMessage){
-      const newData = lastJsonMessage.map(item => {
+    if (!lastJsonMessage || lastJsonMessage.id !== String(lastRequestId.current)){
+      return
+    }
+    if (lastJsonMessage.status === "error"){
+      console.log(`Request failed: ${lastJsonMessage.error.code}: ${lastJsonMessage.error.message}`)
+      return
+    }
+    if (lastJsonMessage.data && lastJsonMessage.data.dataPoints){
+      const newData = lastJsonMessage.data.dataPoints.map(item => {
         return {
           scale: getScale(item.timestamp),
           value: item.value
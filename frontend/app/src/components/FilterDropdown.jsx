@@ -21,6 +21,7 @@ export default function FilterDropdown(){
     useEffect(() => {
         if (readyState === ReadyState.OPEN){
           sendJsonMessage({
+            v: 1,
             query: inputValue
           })
         }
@@ -28,8 +29,8 @@ export default function FilterDropdown(){
       }, [open, inputValue, sendJsonMessage, readyState])
 
       useEffect(() => {
-        if (lastJsonMessage){
-          setfilterData((prev) => prev = lastJsonMessage)
+        if (lastJsonMessage && lastJsonMessage.status === "ok"){
+          setfilterData((prev) => prev = lastJsonMessage.data)
         }
     
       }, [lastJsonMessage])
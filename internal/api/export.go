@@ -0,0 +1,139 @@
+package api
+
+// GET/POST /api/v1/export - runs a getData request (also grouped) like /api/v1/query and writes the data points as
+// a table for spreadsheets and dataframes. URL parameters:
+// * format     - csv (default), ndjson or arrow
+// * timeFormat - timestamps of csv and ndjson: rfc3339 (default), epochMillis, epochSeconds or a Go time layout
+// Timestamps are in the timezone of the request, which must be an IANA name ("Local" is not). Columns are the group by tags, timestamp and value, followed by
+// the columns of the requested fill, comparison, anomaly detection and forecast.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/export"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+// Handles GET/POST /api/v1/export
+func HandleExport(metricDataProvider processor.MetricDataProvider, request *http.Request, responseWriter http.ResponseWriter) {
+	getDataReq, err := readHttpGetDataRequest(request, responseWriter)
+	if err != nil {
+		writeErrorEnvelope(responseWriter, getDataReq.Id, err)
+		return
+	}
+	options := export.Options{
+		Format:     request.URL.Query().Get("format"),
+		TimeFormat: request.URL.Query().Get("timeFormat"),
+	}
+	if options.Format == "" {
+		options.Format = export.CSV_FORMAT
+	}
+	if err := options.Validate(); err != nil {
+		writeErrorEnvelope(responseWriter, getDataReq.Id, err)
+		return
+	}
+	options.Location, err = time.LoadLocation(getDataReq.Timezone)
+	if err != nil {
+		writeErrorEnvelope(responseWriter, getDataReq.Id,
+			fmt.Errorf("%w: unknown timezone %q", processor.ErrInvalidTimezone, getDataReq.Timezone))
+		return
+	}
+	// Arrow timestamps carry the timezone name, which readers resolve on their side
+	if options.Location == time.Local {
+		writeErrorEnvelope(responseWriter, getDataReq.Id,
+			fmt.Errorf("%w: %q is the server's timezone, use an IANA name", processor.ErrInvalidTimezone, getDataReq.Timezone))
+		return
+	}
+
+	// request is cancelled when the client goes away
+	response, _, err := getData(request.Context(), metricDataProvider, getDataReq)
+	if err != nil {
+		if request.Context().Err() != nil {
+			err = fmt.Errorf("%w: client closed the connection", errCanceled)
+		}
+		writeErrorEnvelope(responseWriter, getDataReq.Id, err)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", options.ContentType())
+	responseWriter.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s%s"`, config.MetricName, options.FileExtension()))
+	responseWriter.WriteHeader(http.StatusOK)
+	// the status is sent already, failed export can only be logged
+	if err := export.Write(responseWriter, exportTable(getDataReq, response), options); err != nil {
+		log.Println("Error writing export:", err)
+	}
+}
+
+// Table of the data points, a row per data point of every group
+func exportTable(getDataReq data.GetDataRequest, response data.GetDataResponse) export.Table {
+	columns := []export.Column{}
+	for _, tagName := range getDataReq.GroupBy {
+		columns = append(columns, export.Column{Name: tagName, Type: export.STRING_COLUMN})
+	}
+	columns = append(columns,
+		export.Column{Name: "timestamp", Type: export.TIME_COLUMN},
+		export.Column{Name: "value", Type: export.FLOAT_COLUMN},
+	)
+	// optional columns, values by data point
+	optional := []struct {
+		requested bool
+		column    export.Column
+		value     func(point data.TimeDataPoint) interface{}
+	}{
+		{getDataReq.Fill != "", export.Column{Name: "filled", Type: export.BOOL_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.Filled }},
+		{getDataReq.CompareTo != "", export.Column{Name: "compareValue", Type: export.FLOAT_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.CompareValue }},
+		{getDataReq.CompareTo != "", export.Column{Name: "delta", Type: export.FLOAT_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.Delta }},
+		{getDataReq.CompareTo != "", export.Column{Name: "deltaPercent", Type: export.FLOAT_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.DeltaPercent }},
+		{getDataReq.Anomaly != nil || getDataReq.Forecast != nil, export.Column{Name: "lower", Type: export.FLOAT_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.Lower }},
+		{getDataReq.Anomaly != nil || getDataReq.Forecast != nil, export.Column{Name: "upper", Type: export.FLOAT_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.Upper }},
+		{getDataReq.Anomaly != nil, export.Column{Name: "anomalyScore", Type: export.FLOAT_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.AnomalyScore }},
+		{getDataReq.Anomaly != nil, export.Column{Name: "anomaly", Type: export.BOOL_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.Anomaly }},
+		{getDataReq.Forecast != nil, export.Column{Name: "forecast", Type: export.BOOL_COLUMN},
+			func(point data.TimeDataPoint) interface{} { return point.Forecast }},
+	}
+	values := []func(point data.TimeDataPoint) interface{}{}
+	for _, column := range optional {
+		if column.requested {
+			columns = append(columns, column.column)
+			values = append(values, column.value)
+		}
+	}
+
+	groups := response.Groups
+	if len(getDataReq.GroupBy) == 0 {
+		groups = []data.GroupDataPoints{{DataPoints: response.DataPoints}}
+	}
+	// rows are built as they are written
+	rows := func(write func([]interface{}) error) error {
+		for _, group := range groups {
+			for _, point := range group.DataPoints {
+				row := make([]interface{}, 0, len(columns))
+				for _, tagName := range getDataReq.GroupBy {
+					row = append(row, group.Group[tagName])
+				}
+				row = append(row, time.UnixMilli(point.Timestamp), point.Value)
+				for _, value := range values {
+					row = append(row, value(point))
+				}
+				if err := write(row); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return export.Table{Columns: columns, Rows: rows}
+}
@@ -0,0 +1,89 @@
+package api
+
+// Group by: getData request with groupBy tag names is answered in a single pass over the records, which are
+// grouped by the values of the tags while they are partitioned by time (see processor.GetMetricSeries). Every group
+// goes through the fill, functions, formula, comparison, anomaly detection and forecast of the request on its own.
+// Records without one of the tags are left out, as well as groups without records in the time range.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+func validateGroupBy(groupBy []string) error {
+	seen := make(map[string]bool)
+	for _, name := range groupBy {
+		if _, known := config.MetricTagsMetaData[name]; !known {
+			return fmt.Errorf("%w: unknown tag %q", errInvalidGroupBy, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("%w: tag %q is given more than once", errInvalidGroupBy, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Returns data points of every group sorted by the tag values in the group by order, a single group without tags
+// if there is no group by
+func queryGroups(
+	ctx context.Context,
+	metricDataProvider processor.MetricDataProvider,
+	filters []*data.Tag,
+	groupBy []string,
+	timeRange processor.TimeRange,
+	partitioner processor.TimePartitioner,
+	aggregator processor.Aggregator,
+) ([]data.GroupDataPoints, processor.QueryStats, error) {
+	if len(groupBy) == 0 {
+		dataPoints, stats, err := metricDataProvider.GetMetricDataPoints(ctx, filters, timeRange, partitioner, aggregator)
+		return []data.GroupDataPoints{{DataPoints: dataPoints}}, stats, err
+	}
+
+	// reject too many groups before their series are computed
+	count, err := metricDataProvider.CountMetricSeries(ctx, filters, groupBy, timeRange, config.MaxQueryGroups)
+	if err != nil {
+		return nil, processor.QueryStats{}, err
+	}
+	if count > config.MaxQueryGroups {
+		return nil, processor.QueryStats{}, fmt.Errorf("%w: more than %d groups", errInvalidGroupBy, config.MaxQueryGroups)
+	}
+
+	series, stats, err := metricDataProvider.GetMetricSeries(ctx, filters, groupBy, timeRange, partitioner, aggregator)
+	if err != nil {
+		return nil, stats, err
+	}
+	groups := []data.GroupDataPoints{}
+	for _, s := range series {
+		if hasAllTags(groupBy, s.Tags) {
+			groups = append(groups, data.GroupDataPoints{Group: s.Tags, DataPoints: s.DataPoints})
+		}
+	}
+	// records ingested in the meantime may add groups
+	if len(groups) > config.MaxQueryGroups {
+		return nil, stats, fmt.Errorf("%w: more than %d groups", errInvalidGroupBy, config.MaxQueryGroups)
+	}
+	return groups, stats, nil
+}
+
+func hasAllTags(groupBy []string, group map[string]string) bool {
+	for _, name := range groupBy {
+		if group[name] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Tag values of the group joined in the group by order, sorting by the key sorts groups by the values
+func groupKey(groupBy []string, group map[string]string) string {
+	values := make([]string, len(groupBy))
+	for i, name := range groupBy {
+		values[i] = group[name]
+	}
+	return strings.Join(values, "\x00")
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+// Provider counting the series queries
+type seriesCountingProvider struct {
+	processor.MetricDataProvider
+	queries *int
+}
+
+func (provider seriesCountingProvider) GetMetricSeries(ctx context.Context, filters []*data.Tag, groupBy []string, timeRange processor.TimeRange, timePartition processor.TimePartitioner, aggregator processor.Aggregator) ([]processor.Series, processor.QueryStats, error) {
+	*provider.queries++
+	return provider.MetricDataProvider.GetMetricSeries(ctx, filters, groupBy, timeRange, timePartition, aggregator)
+}
+
+func TestTooManyGroupsAreRejectedBeforeQuery(t *testing.T) {
+	mp := processor.NewInMemoryMetricStreamProcessor(2)
+	start := time.Date(2019, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= config.MaxQueryGroups; i++ {
+		record := testCsvRecord(i, start, 1, fmt.Sprint("Location ", i))
+		if err := mp.Process(record); err != nil {
+			t.Fatalf("Process(%v): %v", record, err)
+		}
+	}
+	queries := 0
+	client := dialGetData(t, seriesCountingProvider{MetricDataProvider: mp, queries: &queries})
+
+	for _, test := range []struct {
+		filters string
+		code    string
+		queries int
+	}{
+		{`["!location:Location 0"]`, "", 1},
+		{`[]`, data.INVALID_GROUP_BY_ERROR, 1},
+	} {
+		sendMessage(t, client, `{"id": "a", "filters": `+test.filters+`, "scale": "Daily", "aggregator": "Sum", "groupBy": ["location"]}`)
+		envelope := readEnvelope(t, client)
+		if test.code == "" && (envelope.Status != data.OK_STATUS || envelope.Error != nil) {
+			t.Errorf("%s: envelope = %+v, want data", test.filters, envelope)
+		}
+		if test.code != "" && (envelope.Error == nil || envelope.Error.Code != test.code) {
+			t.Errorf("%s: envelope = %+v, want %s error", test.filters, envelope, test.code)
+		}
+		if queries != test.queries {
+			t.Errorf("%s: %d series queries, want %d", test.filters, queries, test.queries)
+		}
+	}
+}
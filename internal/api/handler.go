@@ -4,10 +4,18 @@ package api
 // calls MetricProcessor for the main logic.
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"io"
 	"log"
 	"net/http"
+	"sort"
+	"time"
+	"valery-datadog-datastream-demo/internal/config"
 	"valery-datadog-datastream-demo/internal/data"
 	"valery-datadog-datastream-demo/internal/processor"
 )
@@ -21,10 +29,23 @@ func HandleGetDataWebSocket(
 ) {
 	ws, err := upgrader.Upgrade(responseWriter, request, nil)
 	if err != nil {
-		log.Fatal("Error upgrading to WebSocket:", err)
+		// upgrader has already responded with HTTP error
+		log.Println("Error upgrading to WebSocket:", err)
 		return
 	}
 	defer ws.Close()
+	ws.SetReadLimit(config.MaxWebsocketMessageBytes)
+	connections := websocketConnections.With(GET_DATA_ENDPOINT)
+	connections.Inc()
+	defer connections.Dec()
+	messages := websocketMessages.With(GET_DATA_ENDPOINT)
+
+	// deferred in this order: requests end before subscriptions are closed, then the connection is closed
+	writer := &wsWriter{ws: ws}
+	subs := newSubscriptions(metricDataProvider, wsSubscriptionSink{writer})
+	defer subs.closeAll()
+	requests := newInFlightRequests(config.MaxInFlightRequestsPerConnection)
+	defer requests.close()
 
 	for {
 		// Read message from client (getData request)
@@ -33,27 +54,264 @@ func HandleGetDataWebSocket(
 			log.Println("Error reading message:", err)
 			break
 		}
+		messages.Inc()
 
-		// Parse json
-		var getDataReq data.GetDataRequest
-		if err := json.Unmarshal(message, &getDataReq); err != nil {
-			log.Println("Error unmarshaling request:", err)
+		// Parse json, id of the request is sent back also when the request is invalid
+		getDataReq, err := parseGetDataRequest(message)
+		if err != nil {
+			sendError(writer, getDataReq.Id, err)
+			continue
+		}
+
+		// Cancelled request responds with CANCELED error, cancel message itself has no response
+		if getDataReq.Cancel != "" {
+			requests.cancel(getDataReq.Cancel)
+			continue
+		}
+		// Live subscriptions push data points on their own
+		if getDataReq.Unsubscribe != "" {
+			if err := subs.unsubscribe(getDataReq.Unsubscribe); err != nil {
+				sendError(writer, getDataReq.Id, err)
+				continue
+			}
+			sendResponse(writer, getDataReq.Id, nil, nil)
 			continue
 		}
 
-		// Convert apimodel -> common model entities to use them as parameters for the MetricProcessor
-		filters := data.FromRequestFilters(getDataReq.Filters)
-		partitioner := processor.FromRequestScale(getDataReq.Scale)
-		aggregator := processor.FromRequestAggregator(getDataReq.Aggregator)
+		// Queries run concurrently, so a slow query doesn't hold the following ones
+		inFlight, err := requests.start(getDataReq.Id, getDataReq.Supersedes)
+		if err != nil {
+			sendError(writer, getDataReq.Id, err)
+			continue
+		}
+		go func(getDataReq data.GetDataRequest) {
+			defer inFlight.done()
+			defer recoverRequest(writer, getDataReq.Id)
+			if getDataReq.Subscribe != "" {
+				if err := subs.subscribe(inFlight.ctx, getDataReq); err != nil {
+					sendError(writer, getDataReq.Id, inFlight.failure(err))
+				}
+				return
+			}
 
-		// Fetch data points from MetricProcessor
-		dataPoints := metricDataProvider.GetMetricDataPoints(filters, partitioner, aggregator)
+			started := time.Now()
+			response, stats, err := getData(inFlight.ctx, metricDataProvider, getDataReq)
+			if err != nil {
+				sendError(writer, getDataReq.Id, inFlight.failure(err))
+				return
+			}
 
-		// Send data points to the client
-		if err = ws.WriteJSON(dataPoints); err != nil {
-			log.Println("Error sending data points:", err)
+			// Send data points to the client
+			sendResponse(writer, getDataReq.Id, response, newResponseMeta(response, stats, started))
+		}(getDataReq)
+	}
+}
+
+// Executes getData request: single query or formula over several sub-queries, for every group if grouped.
+// Cancelled request stops between the processing steps.
+func getData(ctx context.Context, metricDataProvider processor.MetricDataProvider, getDataReq data.GetDataRequest) (data.GetDataResponse, processor.QueryStats, error) {
+	stats := processor.QueryStats{}
+	if err := validateGroupBy(getDataReq.GroupBy); err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	// Convert apimodel -> common model entities to use them as parameters for the MetricProcessor
+	timeRange, err := processor.FromRequestTimeRange(getDataReq.From, getDataReq.To)
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	// auto scale picks the interval and gap filling produces partitions for the queried time range,
+	// unbounded sides are taken from the data
+	queriedRange := timeRange.BoundedBy(metricDataProvider.GetMetricTimeRange())
+	partitioner, err := processor.FromRequestScale(getDataReq, queriedRange)
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	filler, err := processor.FromRequestFill(getDataReq.Fill)
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	functions, err := processor.FromRequestFunctions(getDataReq.Functions)
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+
+	compareShift, err := processor.FromRequestCompareTo(getDataReq.CompareTo, queriedRange, partitioner.Location())
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	anomalyDetector, err := processor.FromRequestAnomaly(getDataReq.Anomaly)
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	forecaster, err := processor.FromRequestForecast(getDataReq.Forecast)
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+
+	// Executes the request for the time range, the comparison runs it once more for the shifted range
+	execute := func(timeRange processor.TimeRange, queriedRange processor.TimeRange) ([]data.GroupDataPoints, error) {
+		query := func(subQuery data.SubQueryRequest) ([]data.GroupDataPoints, error) {
+			if subQuery.Metric != "" && subQuery.Metric != config.MetricName {
+				return nil, fmt.Errorf("%w %q", errUnknownMetric, subQuery.Metric)
+			}
+			subQueryFunctions, err := processor.FromRequestFunctions(subQuery.Functions)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := data.ValidateRequestFilters(subQuery.Filters); err != nil {
+				return nil, err
+			}
+			aggregator, err := processor.FromRequestAggregator(subQuery.Aggregator)
+			if err != nil {
+				return nil, err
+			}
+
+			// Fetch data points of every group from MetricProcessor, fill partitions without data and apply series
+			// functions
+			filters := data.FromRequestFilters(subQuery.Filters)
+			groups, queryStats, err := queryGroups(ctx, metricDataProvider, filters, getDataReq.GroupBy, timeRange, partitioner, aggregator)
+			stats.RecordsScanned += queryStats.RecordsScanned
+			if err != nil {
+				return nil, err
+			}
+			for i := range groups {
+				dataPoints, err := filler(groups[i].DataPoints, queriedRange, partitioner)
+				if err != nil {
+					return nil, err
+				}
+				groups[i].DataPoints = processor.ApplyFunctions(dataPoints, subQueryFunctions)
+			}
+			return groups, nil
+		}
+
+		var groups []data.GroupDataPoints
+		var err error
+		if len(getDataReq.Queries) == 0 && getDataReq.Formula == "" {
+			groups, err = query(data.SubQueryRequest{Filters: getDataReq.Filters, Aggregator: getDataReq.Aggregator})
+		} else {
+			groups, err = evaluateFormula(getDataReq.Queries, getDataReq.Formula, getDataReq.GroupBy, query)
+		}
+		if err != nil {
+			return nil, err
 		}
+		for i := range groups {
+			groups[i].DataPoints = processor.ApplyFunctions(groups[i].DataPoints, functions)
+		}
+		return groups, nil
 	}
+
+	groups, err := execute(timeRange, queriedRange)
+	if err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	if compareShift != nil {
+		previousGroups, err := execute(compareShift.BackRange(timeRange), compareShift.BackRange(queriedRange))
+		if err != nil {
+			return data.GetDataResponse{}, stats, err
+		}
+		previousByKey := make(map[string][]data.TimeDataPoint, len(previousGroups))
+		for _, group := range previousGroups {
+			previousByKey[groupKey(getDataReq.GroupBy, group.Group)] = group.DataPoints
+		}
+		for i, group := range groups {
+			groups[i].DataPoints = processor.CompareSeries(group.DataPoints,
+				previousByKey[groupKey(getDataReq.GroupBy, group.Group)], partitioner, *compareShift)
+		}
+	}
+	if anomalyDetector != nil {
+		for i := range groups {
+			groups[i].DataPoints = anomalyDetector(groups[i].DataPoints)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return data.GetDataResponse{}, stats, err
+	}
+	if forecaster != nil {
+		for i := range groups {
+			if len(groups[i].DataPoints) == 0 {
+				continue
+			}
+			if groups[i].DataPoints, err = forecaster(groups[i].DataPoints, partitioner); err != nil {
+				return data.GetDataResponse{}, stats, err
+			}
+		}
+	}
+
+	// request without group by has a single group
+	if len(getDataReq.GroupBy) == 0 {
+		return data.GetDataResponse{
+			Interval:   partitioner.Interval(),
+			DataPoints: groups[0].DataPoints,
+		}, stats, nil
+	}
+	return data.GetDataResponse{
+		Interval:   partitioner.Interval(),
+		DataPoints: []data.TimeDataPoint{},
+		Groups:     groups,
+	}, stats, nil
+}
+
+// Runs sub-queries the formula refers to and combines their results, group by group. Groups missing in a
+// sub-query result have no data points of the sub-query.
+func evaluateFormula(
+	subQueries []data.SubQueryRequest,
+	expression string,
+	groupBy []string,
+	query func(data.SubQueryRequest) ([]data.GroupDataPoints, error),
+) ([]data.GroupDataPoints, error) {
+	formula, err := processor.ParseFormula(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	subQueriesByName := make(map[string]data.SubQueryRequest)
+	for _, subQuery := range subQueries {
+		if _, found := subQueriesByName[subQuery.Name]; found {
+			return nil, fmt.Errorf("%w: sub-query %q is defined more than once", processor.ErrInvalidFormula, subQuery.Name)
+		}
+		subQueriesByName[subQuery.Name] = subQuery
+	}
+
+	// sub-query results by group, then by sub-query name
+	series := make(map[string]map[string][]data.TimeDataPoint)
+	groups := make(map[string]map[string]string)
+	for _, name := range formula.Variables() {
+		subQuery, found := subQueriesByName[name]
+		if !found {
+			return nil, fmt.Errorf("%w: sub-query %q is not defined", processor.ErrInvalidFormula, name)
+		}
+		subQueryGroups, err := query(subQuery)
+		if err != nil {
+			return nil, fmt.Errorf("sub-query %q: %w", name, err)
+		}
+		for _, group := range subQueryGroups {
+			key := groupKey(groupBy, group.Group)
+			if _, found := series[key]; !found {
+				series[key] = make(map[string][]data.TimeDataPoint)
+				groups[key] = group.Group
+			}
+			series[key][name] = group.DataPoints
+		}
+	}
+	// formula without sub-queries still has a single group if not grouped
+	if len(groupBy) == 0 && len(series) == 0 {
+		series[""] = map[string][]data.TimeDataPoint{}
+	}
+	if len(series) > config.MaxQueryGroups {
+		return nil, fmt.Errorf("%w: more than %d groups", errInvalidGroupBy, config.MaxQueryGroups)
+	}
+
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]data.GroupDataPoints, len(keys))
+	for i, key := range keys {
+		result[i] = data.GroupDataPoints{Group: groups[key], DataPoints: formula.Evaluate(series[key])}
+	}
+	return result, nil
 }
 
 // Handles /getFilters API call
@@ -65,32 +323,83 @@ func HandleGetFiltersWebSocket(
 ) {
 	ws, err := upgrader.Upgrade(responseWriter, request, nil)
 	if err != nil {
-		log.Fatal("Error upgrading to WebSocket:", err)
+		// upgrader has already responded with HTTP error
+		log.Println("Error upgrading to WebSocket:", err)
 		return
 	}
 	defer ws.Close()
+	ws.SetReadLimit(config.MaxWebsocketMessageBytes)
+	connections := websocketConnections.With(GET_FILTERS_ENDPOINT)
+	connections.Inc()
+	defer connections.Dec()
+	messages := websocketMessages.With(GET_FILTERS_ENDPOINT)
 
+	writer := &wsWriter{ws: ws}
 	for {
-		// Read message from client (getData request)
+		// Read message from client (getFilters request)
 		_, message, err := ws.ReadMessage()
 		if err != nil {
 			log.Println("Error reading message:", err)
 			break
 		}
+		messages.Inc()
 
 		// Parse json
 		var getFiltersReq data.GetFiltersRequest
 		if err := json.Unmarshal(message, &getFiltersReq); err != nil {
-			log.Println("Error unmarshaling request:", err)
+			sendError(writer, getFiltersReq.Id, fmt.Errorf("%w: %v", errBadRequest, err))
+			continue
+		}
+		if err := checkVersion(getFiltersReq.RequestEnvelope); err != nil {
+			sendError(writer, getFiltersReq.Id, err)
 			continue
 		}
 
 		// Fetch filters (tag name:value pairs) from MetricProcessor
 		filters := metricDataProvider.GetMetricTagFilters(getFiltersReq.Query)
 
-		// Send data points to the client
-		if err = ws.WriteJSON(filters); err != nil {
-			log.Println("Error sending data points:", err)
+		// Send filters to the client
+		sendResponse(writer, getFiltersReq.Id, filters, nil)
+	}
+}
+
+// Handles /ingest API call - HTTP push of CSV data records (same columns as the dataset file, no header).
+// Every record is processed separately, rejected records are reported back without failing the whole batch.
+// Reading stops at the body size limit, records read before stay ingested.
+func HandleIngest(
+	streamProcessor data.StreamProcessor,
+	request *http.Request,
+	responseWriter http.ResponseWriter,
+) {
+	reader := csv.NewReader(http.MaxBytesReader(responseWriter, request.Body, config.MaxIngestBodyBytes))
+	reader.FieldsPerRecord = -1
+
+	response := data.IngestResponse{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			http.Error(responseWriter, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			err = streamProcessor.Process(record)
 		}
+		if err != nil {
+			response.Rejected++
+			if len(response.Errors) < config.MaxIngestErrors {
+				response.Errors = append(response.Errors, fmt.Sprintf("record %d: %v", line, err))
+			}
+			continue
+		}
+		response.Accepted++
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(responseWriter).Encode(response); err != nil {
+		log.Println("Error sending ingest response:", err)
 	}
 }
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestIngestLimits(t *testing.T) {
+	mp := newTestProcessor(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleIngest(mp, r, w)
+	}))
+	t.Cleanup(server.Close)
+
+	// only the errors of the first rejected records are reported
+	rejected := config.MaxIngestErrors + 50
+	response, body := doRequest(t, http.MethodPost, server.URL, strings.Repeat("invalid\n", rejected), nil)
+	var ingested data.IngestResponse
+	if err := json.Unmarshal(body, &ingested); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, body %s: %v", response.StatusCode, body, err)
+	}
+	if ingested.Accepted != 0 || ingested.Rejected != rejected || len(ingested.Errors) != config.MaxIngestErrors {
+		t.Errorf("accepted %d, rejected %d, %d errors, want 0, %d, %d", ingested.Accepted, ingested.Rejected,
+			len(ingested.Errors), rejected, config.MaxIngestErrors)
+	}
+
+	response, body = doRequest(t, http.MethodPost, server.URL, `"`+strings.Repeat("a", config.MaxIngestBodyBytes), nil)
+	if response.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "too large") {
+		t.Errorf("body over the limit: status %d, body %s", response.StatusCode, body)
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+// In-flight requests of a single websocket connection. Requests are processed concurrently, up to the limit.
+// Request with id can be cancelled by the client, or superseded by a newer request (for ex. the user keeps typing
+// filters), its query then stops early. Cancelled requests count towards the limit until they end, so that the
+// queries running at a time stay within the limit.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	errCanceled        = errors.New("request cancelled")
+	errTooManyRequests = errors.New("too many requests in flight")
+)
+
+type inFlightRequests struct {
+	limit int
+
+	// cancelled when the connection is closed
+	ctx       context.Context
+	cancelAll context.CancelFunc
+
+	lock   sync.Mutex
+	active int
+	byId   map[string]*inFlightRequest // requests without id can't be cancelled
+
+	wg sync.WaitGroup
+}
+
+type inFlightRequest struct {
+	id       string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	requests *inFlightRequests
+	// why the request was cancelled, guarded by the lock of requests
+	reason error
+}
+
+func newInFlightRequests(limit int) *inFlightRequests {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &inFlightRequests{
+		limit:     limit,
+		ctx:       ctx,
+		cancelAll: cancel,
+		byId:      make(map[string]*inFlightRequest),
+	}
+}
+
+// Registers a new request, cancels the superseded one. Caller runs the request and calls done in the end.
+func (requests *inFlightRequests) start(id string, supersedes string) (*inFlightRequest, error) {
+	requests.lock.Lock()
+	defer requests.lock.Unlock()
+
+	if supersedes != "" {
+		requests.cancelLocked(supersedes, fmt.Errorf("%w: request %q was superseded by request %q", errCanceled, supersedes, id))
+	}
+	if id != "" {
+		if _, found := requests.byId[id]; found {
+			return nil, fmt.Errorf("%w: request %q is already in flight", errBadRequest, id)
+		}
+	}
+	if requests.active >= requests.limit {
+		return nil, fmt.Errorf("%w, at most %d are allowed per connection", errTooManyRequests, requests.limit)
+	}
+
+	ctx, cancel := context.WithCancel(requests.ctx)
+	request := &inFlightRequest{id: id, ctx: ctx, cancel: cancel, requests: requests}
+	if id != "" {
+		requests.byId[id] = request
+	}
+	requests.active++
+	requests.wg.Add(1)
+	return request, nil
+}
+
+// Cancels the request, unknown id is ignored: the request may have just finished
+func (requests *inFlightRequests) cancel(id string) {
+	requests.lock.Lock()
+	defer requests.lock.Unlock()
+	requests.cancelLocked(id, fmt.Errorf("%w: request %q was cancelled", errCanceled, id))
+}
+
+func (requests *inFlightRequests) cancelLocked(id string, reason error) {
+	request, found := requests.byId[id]
+	if !found {
+		return
+	}
+	// the id may be reused meanwhile, the request is counted until it is done
+	delete(requests.byId, id)
+	request.reason = reason
+	request.cancel()
+}
+
+// Cancels all requests and waits until they end, called when the connection is closed
+func (requests *inFlightRequests) close() {
+	requests.cancelAll()
+	requests.wg.Wait()
+}
+
+func (request *inFlightRequest) done() {
+	requests := request.requests
+	requests.lock.Lock()
+	if request.id != "" && requests.byId[request.id] == request {
+		delete(requests.byId, request.id)
+	}
+	requests.active--
+	requests.lock.Unlock()
+	request.cancel()
+	requests.wg.Done()
+}
+
+// Error to report for the failed request, tells why the request was cancelled if it was
+func (request *inFlightRequest) failure(err error) error {
+	if request.ctx.Err() == nil {
+		return err
+	}
+	request.requests.lock.Lock()
+	defer request.requests.lock.Unlock()
+	if request.reason != nil {
+		return request.reason
+	}
+	return fmt.Errorf("%w: connection closed", errCanceled)
+}
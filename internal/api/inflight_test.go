@@ -0,0 +1,76 @@
+package api
+
+import (
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestSupersededAndCancelledRequestsGetCanceled(t *testing.T) {
+	provider := blockingProvider{MetricDataProvider: newTestProcessor(t), started: make(chan string, 1)}
+	client := dialGetData(t, provider)
+	waitStarted := func() {
+		t.Helper()
+		select {
+		case <-provider.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocking query did not start")
+		}
+	}
+
+	sendMessage(t, client, `{"id": "1", "filters": ["location:Blocking"], "scale": "Daily", "aggregator": "Sum"}`)
+	waitStarted()
+	sendMessage(t, client, `{"id": "2", "supersedes": "1", "filters": ["location:Chicago"], "scale": "Daily", "aggregator": "Sum"}`)
+	sendMessage(t, client, `{"id": "3", "filters": ["location:Blocking"], "scale": "Daily", "aggregator": "Sum"}`)
+	waitStarted()
+	sendMessage(t, client, `{"cancel": "3"}`)
+
+	envelopes := map[string]data.ResponseEnvelope{}
+	for len(envelopes) < 3 {
+		envelope := readEnvelope(t, client)
+		if _, found := envelopes[envelope.Id]; found {
+			t.Fatalf("second response of request %q", envelope.Id)
+		}
+		envelopes[envelope.Id] = envelope
+	}
+	for _, id := range []string{"1", "3"} {
+		if envelope := envelopes[id]; envelope.Error == nil || envelope.Error.Code != data.CANCELED_ERROR {
+			t.Errorf("request %s: envelope = %+v, want CANCELED error", id, envelope)
+		}
+	}
+	if envelope := envelopes["2"]; envelope.Status != data.OK_STATUS {
+		t.Errorf("request 2: envelope = %+v, want data points", envelope)
+	}
+
+	// the id of the cancelled request can be used again
+	sendMessage(t, client, `{"id": "1", "filters": ["location:Chicago"], "scale": "Daily", "aggregator": "Sum"}`)
+	if envelope := readEnvelope(t, client); envelope.Id != "1" || envelope.Status != data.OK_STATUS {
+		t.Errorf("reused id: envelope = %+v, want data points", envelope)
+	}
+}
+
+func TestInFlightLimitCountsCancelledRequests(t *testing.T) {
+	requests := newInFlightRequests(1)
+	first, err := requests.start("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// superseded request runs until it notices the cancellation
+	if _, err := requests.start("2", "1"); err == nil {
+		t.Fatal("second request started while the superseded one is still running")
+	}
+	if first.ctx.Err() == nil || errorCode(first.failure(first.ctx.Err())) != data.CANCELED_ERROR {
+		t.Errorf("superseded request: context error %v, failure %v", first.ctx.Err(), first.failure(first.ctx.Err()))
+	}
+	first.done()
+
+	second, err := requests.start("2", "")
+	if err != nil {
+		t.Fatalf("start after the cancelled request ended: %v", err)
+	}
+	if _, err := requests.start("2", ""); errorCode(err) != data.BAD_REQUEST_ERROR {
+		t.Errorf("duplicate id: error = %v, want BAD_REQUEST", err)
+	}
+	second.done()
+	requests.close()
+}
@@ -0,0 +1,29 @@
+package api
+
+// Health metrics of the API and the /metrics endpoint exposing all metrics of the service
+
+import (
+	"log"
+	"net/http"
+	"valery-datadog-datastream-demo/internal/metrics"
+)
+
+// Websocket endpoints of the metrics
+const (
+	GET_DATA_ENDPOINT    = "getData"
+	GET_FILTERS_ENDPOINT = "getFilters"
+)
+
+var (
+	websocketConnections = metrics.Default.NewGauge("datastream_websocket_connections", "Open websocket connections.", "endpoint")
+	websocketMessages    = metrics.Default.NewCounter("datastream_websocket_messages", "Messages received over websocket connections.", "endpoint")
+)
+
+// Handles /metrics - metrics of the registry in OpenMetrics text format
+func HandleMetrics(registry *metrics.Registry, request *http.Request, responseWriter http.ResponseWriter) {
+	responseWriter.Header().Set("Content-Type", metrics.OPEN_METRICS_CONTENT_TYPE)
+	responseWriter.WriteHeader(http.StatusOK)
+	if err := registry.Write(responseWriter); err != nil {
+		log.Println("Error writing metrics:", err)
+	}
+}
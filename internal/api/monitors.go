@@ -0,0 +1,106 @@
+package api
+
+// Monitor API handlers: CRUD of monitor definitions, monitor state history and notification delivery log.
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/monitor"
+	"valery-datadog-datastream-demo/internal/notify"
+)
+
+// Handles GET /monitors
+func HandleListMonitors(monitors *monitor.Manager, responseWriter http.ResponseWriter) {
+	writeJSON(responseWriter, http.StatusOK, monitors.List())
+}
+
+// Handles GET /monitors/:id
+func HandleGetMonitor(monitors *monitor.Manager, id string, responseWriter http.ResponseWriter) {
+	m, err := monitors.Get(id)
+	if err != nil {
+		writeMonitorError(responseWriter, err)
+		return
+	}
+	writeJSON(responseWriter, http.StatusOK, m)
+}
+
+// Handles POST /monitors
+func HandleCreateMonitor(monitors *monitor.Manager, request *http.Request, responseWriter http.ResponseWriter) {
+	var definition monitor.Definition
+	if err := json.NewDecoder(request.Body).Decode(&definition); err != nil {
+		writeJSON(responseWriter, http.StatusBadRequest, data.ErrorResponse{Error: "Error unmarshaling request: " + err.Error()})
+		return
+	}
+	m, err := monitors.Create(definition)
+	if err != nil {
+		writeMonitorError(responseWriter, err)
+		return
+	}
+	writeJSON(responseWriter, http.StatusCreated, m)
+}
+
+// Handles PUT /monitors/:id
+func HandleUpdateMonitor(monitors *monitor.Manager, id string, request *http.Request, responseWriter http.ResponseWriter) {
+	var definition monitor.Definition
+	if err := json.NewDecoder(request.Body).Decode(&definition); err != nil {
+		writeJSON(responseWriter, http.StatusBadRequest, data.ErrorResponse{Error: "Error unmarshaling request: " + err.Error()})
+		return
+	}
+	m, err := monitors.Update(id, definition)
+	if err != nil {
+		writeMonitorError(responseWriter, err)
+		return
+	}
+	writeJSON(responseWriter, http.StatusOK, m)
+}
+
+// Handles DELETE /monitors/:id
+func HandleDeleteMonitor(monitors *monitor.Manager, id string, responseWriter http.ResponseWriter) {
+	if err := monitors.Delete(id); err != nil {
+		writeMonitorError(responseWriter, err)
+		return
+	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+// Handles GET /monitors/:id/history
+func HandleGetMonitorHistory(monitors *monitor.Manager, id string, responseWriter http.ResponseWriter) {
+	history, err := monitors.History(id)
+	if err != nil {
+		writeMonitorError(responseWriter, err)
+		return
+	}
+	writeJSON(responseWriter, http.StatusOK, history)
+}
+
+// Handles GET /notifications/deliveries
+func HandleListDeliveries(notifier *notify.Notifier, responseWriter http.ResponseWriter) {
+	writeJSON(responseWriter, http.StatusOK, notifier.Deliveries())
+}
+
+func writeMonitorError(responseWriter http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, monitor.ErrMonitorNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, monitor.ErrInvalidMonitor):
+		status = http.StatusBadRequest
+	default:
+		log.Println("Error handling monitor request:", err)
+	}
+	writeJSON(responseWriter, status, data.ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(responseWriter http.ResponseWriter, status int, value interface{}) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	encoder := json.NewEncoder(responseWriter)
+	// keep comparators such as "<" readable
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		log.Println("Error sending response:", err)
+	}
+}
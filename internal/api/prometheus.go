@@ -0,0 +1,186 @@
+package api
+
+// Prometheus HTTP API subset, so that Grafana (Prometheus data source) can chart the metric:
+// * GET/POST /api/v1/query_range    - PromQL range query, see processor.PromQLEngine for the supported subset
+// * GET/POST /api/v1/labels         - label names, optionally of the series matching match[] selectors
+// * GET /api/v1/label/<name>/values - label values, optionally of the series matching match[] selectors
+// The metric is named as in the dataset with "." replaced by "_" (online_spent), labels are the tags.
+// Responses and errors have the format of Prometheus.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+const (
+	PROM_SUCCESS_STATUS = "success"
+	PROM_ERROR_STATUS   = "error"
+	PROM_MATRIX_RESULT  = "matrix"
+)
+
+// Prometheus error types
+const (
+	PROM_BAD_DATA_ERROR  = "bad_data"
+	PROM_CANCELED_ERROR  = "canceled"
+	PROM_EXECUTION_ERROR = "execution"
+)
+
+// Handles GET/POST /api/v1/query_range
+func HandlePromQueryRange(metricDataProvider processor.MetricDataProvider, request *http.Request, responseWriter http.ResponseWriter) {
+	if err := request.ParseForm(); err != nil {
+		writePromError(responseWriter, fmt.Errorf("%w: %v", errBadRequest, err))
+		return
+	}
+	form := request.Form
+	start, err := parsePromTime(form, "start")
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	end, err := parsePromTime(form, "end")
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	step, err := parsePromStep(form.Get("step"))
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	if start.IsZero() || end.IsZero() {
+		writePromError(responseWriter, fmt.Errorf("%w: start and end are required", errBadRequest))
+		return
+	}
+
+	series, err := newPromQLEngine(metricDataProvider).QueryRange(request.Context(), form.Get("query"), start, end, step)
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	matrix := data.PromMatrix{ResultType: PROM_MATRIX_RESULT, Result: make([]data.PromMatrixSeries, len(series))}
+	for i, s := range series {
+		values := make([][2]interface{}, len(s.Points))
+		for j, point := range s.Points {
+			values[j] = [2]interface{}{float64(point.Timestamp.UnixMilli()) / 1000, formatPromValue(point.Value)}
+		}
+		matrix.Result[i] = data.PromMatrixSeries{Metric: s.Labels, Values: values}
+	}
+	writeJSON(responseWriter, http.StatusOK, data.PromResponse{Status: PROM_SUCCESS_STATUS, Data: matrix})
+}
+
+// Handles GET/POST /api/v1/labels
+func HandlePromLabels(metricDataProvider processor.MetricDataProvider, request *http.Request, responseWriter http.ResponseWriter) {
+	selectors, timeRange, err := parsePromSeriesMatch(request)
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	names, err := newPromQLEngine(metricDataProvider).LabelNames(request.Context(), selectors, timeRange)
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	writeJSON(responseWriter, http.StatusOK, data.PromResponse{Status: PROM_SUCCESS_STATUS, Data: names})
+}
+
+// Handles GET /api/v1/label/<name>/values
+func HandlePromLabelValues(metricDataProvider processor.MetricDataProvider, name string, request *http.Request, responseWriter http.ResponseWriter) {
+	selectors, timeRange, err := parsePromSeriesMatch(request)
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	values, err := newPromQLEngine(metricDataProvider).LabelValues(request.Context(), name, selectors, timeRange)
+	if err != nil {
+		writePromError(responseWriter, err)
+		return
+	}
+	writeJSON(responseWriter, http.StatusOK, data.PromResponse{Status: PROM_SUCCESS_STATUS, Data: values})
+}
+
+func newPromQLEngine(metricDataProvider processor.MetricDataProvider) *processor.PromQLEngine {
+	// metric names can't have dots in PromQL
+	return processor.NewPromQLEngine(metricDataProvider, strings.ReplaceAll(config.MetricName, ".", "_"))
+}
+
+// Parses match[] selectors and optional start and end of label requests
+func parsePromSeriesMatch(request *http.Request) ([]string, processor.TimeRange, error) {
+	if err := request.ParseForm(); err != nil {
+		return nil, processor.TimeRange{}, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	start, err := parsePromTime(request.Form, "start")
+	if err != nil {
+		return nil, processor.TimeRange{}, err
+	}
+	end, err := parsePromTime(request.Form, "end")
+	if err != nil {
+		return nil, processor.TimeRange{}, err
+	}
+	timeRange := processor.TimeRange{From: start}
+	if !end.IsZero() {
+		timeRange.To = end.Add(time.Nanosecond)
+	}
+	return request.Form["match[]"], timeRange, nil
+}
+
+// Times are unix seconds (with fraction) or RFC 3339, zero time if the parameter is not given
+func parsePromTime(form url.Values, name string) (time.Time, error) {
+	value := form.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.UnixMilli(int64(math.Round(seconds * 1000))), nil
+	}
+	if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return parsed, nil
+	}
+	return time.Time{}, fmt.Errorf("%w: invalid %s %q, expected unix seconds or RFC 3339 time", errBadRequest, name, value)
+}
+
+// Step is a number of seconds or a duration such as "5m"
+func parsePromStep(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	if step, err := processor.ParsePromDuration(value); err == nil && step > 0 {
+		return step, nil
+	}
+	return 0, fmt.Errorf("%w: invalid step %q, expected positive seconds or duration", errBadRequest, value)
+}
+
+func formatPromValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+}
+
+func writePromError(responseWriter http.ResponseWriter, err error) {
+	errorType, status := PROM_EXECUTION_ERROR, http.StatusUnprocessableEntity
+	switch {
+	case errors.Is(err, processor.ErrInvalidPromQL) || errors.Is(err, errBadRequest):
+		errorType, status = PROM_BAD_DATA_ERROR, http.StatusBadRequest
+	case errors.Is(err, context.Canceled):
+		errorType, status = PROM_CANCELED_ERROR, STATUS_CLIENT_CLOSED_REQUEST
+	}
+	log.Println("Error processing Prometheus API request:", err)
+	writeJSON(responseWriter, status, data.PromResponse{Status: PROM_ERROR_STATUS, ErrorType: errorType, Error: err.Error()})
+}
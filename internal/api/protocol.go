@@ -0,0 +1,194 @@
+package api
+
+// Websocket protocol: every response is wrapped into the versioned envelope carrying the id of the request, its
+// status and the error code if the request failed. Error codes are derived from the sentinel errors of the request
+// parsing and validation.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/export"
+	"valery-datadog-datastream-demo/internal/processor"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errBadRequest          = errors.New("bad request")
+	errUnsupportedVersion  = errors.New("unsupported protocol version")
+	errUnknownMetric       = errors.New("unknown metric")
+	errInvalidSubscription = errors.New("invalid subscription")
+	errInvalidGroupBy      = errors.New("invalid group by")
+	errInternal            = errors.New("internal error")
+)
+
+// Error codes by sentinel error, the first matching one is used
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{errBadRequest, data.BAD_REQUEST_ERROR},
+	{errUnsupportedVersion, data.UNSUPPORTED_VERSION_ERROR},
+	{processor.ErrInvalidQuery, data.INVALID_QUERY_ERROR},
+	{data.ErrInvalidFilter, data.INVALID_FILTER_ERROR},
+	{errInvalidGroupBy, data.INVALID_GROUP_BY_ERROR},
+	{processor.ErrUnknownAggregator, data.UNKNOWN_AGGREGATOR_ERROR},
+	{errUnknownMetric, data.UNKNOWN_METRIC_ERROR},
+	{processor.ErrInvalidTimeRange, data.INVALID_TIME_RANGE_ERROR},
+	{processor.ErrInvalidScale, data.INVALID_SCALE_ERROR},
+	{processor.ErrInvalidTimezone, data.INVALID_TIMEZONE_ERROR},
+	{processor.ErrInvalidWeekStart, data.INVALID_WEEK_START_ERROR},
+	{processor.ErrInvalidFill, data.INVALID_FILL_ERROR},
+	{processor.ErrInvalidFunction, data.INVALID_FUNCTION_ERROR},
+	{processor.ErrInvalidFormula, data.INVALID_FORMULA_ERROR},
+	{processor.ErrInvalidComparison, data.INVALID_COMPARISON_ERROR},
+	{processor.ErrInvalidAnomaly, data.INVALID_ANOMALY_ERROR},
+	{processor.ErrInvalidForecast, data.INVALID_FORECAST_ERROR},
+	{errInvalidSubscription, data.INVALID_SUBSCRIPTION_ERROR},
+	{export.ErrInvalidExport, data.INVALID_EXPORT_ERROR},
+	{errTooManyRequests, data.TOO_MANY_REQUESTS_ERROR},
+	{errTooManyStreams, data.TOO_MANY_REQUESTS_ERROR},
+	{errCanceled, data.CANCELED_ERROR},
+}
+
+func errorCode(err error) string {
+	for _, errorCode := range errorCodes {
+		if errors.Is(err, errorCode.err) {
+			return errorCode.code
+		}
+	}
+	return data.INTERNAL_ERROR
+}
+
+// Serializes writes to the websocket, which may come from the request loop and from subscriptions
+type wsWriter struct {
+	lock sync.Mutex
+	ws   *websocket.Conn
+}
+
+func (writer *wsWriter) WriteJSON(value interface{}) error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.ws.WriteJSON(value)
+}
+
+// Parses getData request, the request is returned also on error, so that its id can be reported back
+func parseGetDataRequest(message []byte) (data.GetDataRequest, error) {
+	var request data.GetDataRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		return request, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	if err := checkVersion(request.RequestEnvelope); err != nil {
+		return request, err
+	}
+	return request, compileQueryString(&request)
+}
+
+// Fills filters, aggregator, group by, scale and fill of the request from its query string. The query string
+// replaces the structured form, so the request may not have both.
+func compileQueryString(request *data.GetDataRequest) error {
+	if request.Query == "" {
+		return nil
+	}
+	if len(request.Filters) > 0 || request.Aggregator != "" || len(request.GroupBy) > 0 || len(request.Queries) > 0 {
+		return fmt.Errorf("%w: q can't be combined with filters, aggregator, groupBy or queries", errBadRequest)
+	}
+	query, err := processor.ParseQuery(request.Query)
+	if err != nil {
+		return err
+	}
+	if query.Metric != config.MetricName {
+		return fmt.Errorf("%w %q", errUnknownMetric, query.Metric)
+	}
+	if query.Scale != "" {
+		if request.Scale != "" && request.Scale != query.Scale {
+			return fmt.Errorf("%w: scale is given both by q rollup and by scale", errBadRequest)
+		}
+		request.Scale = query.Scale
+	}
+	if query.Fill != "" {
+		if request.Fill != "" && request.Fill != query.Fill {
+			return fmt.Errorf("%w: fill is given both by q and by fill", errBadRequest)
+		}
+		request.Fill = query.Fill
+	}
+	request.Filters = query.Filters
+	request.Aggregator = query.Aggregator
+	request.GroupBy = query.GroupBy
+	return nil
+}
+
+// Requests without version are taken as requests of the current version
+func checkVersion(envelope data.RequestEnvelope) error {
+	if envelope.Version != 0 && envelope.Version != data.PROTOCOL_VERSION {
+		return fmt.Errorf("%w %d, the server supports version %d", errUnsupportedVersion, envelope.Version, data.PROTOCOL_VERSION)
+	}
+	return nil
+}
+
+func newResponseEnvelope(requestId string, response interface{}, meta *data.ResponseMeta) data.ResponseEnvelope {
+	return data.ResponseEnvelope{
+		Version: data.PROTOCOL_VERSION,
+		Id:      requestId,
+		Status:  data.OK_STATUS,
+		Meta:    meta,
+		Data:    response,
+	}
+}
+
+func newErrorEnvelope(requestId string, err error) data.ResponseEnvelope {
+	code := errorCode(err)
+	if code == data.INTERNAL_ERROR {
+		log.Println("Error processing request:", err)
+	} else {
+		log.Println("Invalid request:", err)
+	}
+	return data.ResponseEnvelope{
+		Version: data.PROTOCOL_VERSION,
+		Id:      requestId,
+		Status:  data.ERROR_STATUS,
+		Error:   &data.Error{Code: code, Message: err.Error()},
+	}
+}
+
+func sendResponse(writer *wsWriter, requestId string, response interface{}, meta *data.ResponseMeta) {
+	if err := writer.WriteJSON(newResponseEnvelope(requestId, response, meta)); err != nil {
+		log.Println("Error sending response:", err)
+	}
+}
+
+// Reports failed request back to the client
+func sendError(writer *wsWriter, requestId string, err error) {
+	if err := writer.WriteJSON(newErrorEnvelope(requestId, err)); err != nil {
+		log.Println("Error sending error response:", err)
+	}
+}
+
+// Deferred by the request goroutines: a panicking request gets INTERNAL error instead of taking down the server
+func recoverRequest(writer *wsWriter, requestId string) {
+	if recovered := recover(); recovered != nil {
+		log.Printf("Request %q panicked: %v\n%s", requestId, recovered, debug.Stack())
+		sendError(writer, requestId, errInternal)
+	}
+}
+
+// Metadata of getData response, started is the time the request processing started
+func newResponseMeta(response data.GetDataResponse, stats processor.QueryStats, started time.Time) *data.ResponseMeta {
+	points := len(response.DataPoints)
+	for _, group := range response.Groups {
+		points += len(group.DataPoints)
+	}
+	return &data.ResponseMeta{
+		Interval:       response.Interval,
+		Points:         points,
+		RecordsScanned: stats.RecordsScanned,
+		DurationMs:     float64(time.Since(started).Microseconds()) / 1000,
+	}
+}
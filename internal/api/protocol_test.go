@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket writer of the server side of a connection, and the client side to read what it writes
+func newTestWsWriter(t *testing.T) (*wsWriter, *websocket.Conn) {
+	t.Helper()
+	serverSide := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		serverSide <- ws
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	ws := <-serverSide
+	t.Cleanup(func() { ws.Close() })
+	return &wsWriter{ws: ws}, client
+}
+
+func readEnvelope(t *testing.T, client *websocket.Conn) data.ResponseEnvelope {
+	t.Helper()
+	var envelope data.ResponseEnvelope
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := client.ReadJSON(&envelope); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	return envelope
+}
+
+func TestPanickingRequestGetsInternalError(t *testing.T) {
+	writer, client := newTestWsWriter(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverRequest(writer, "42")
+		var partitions []int
+		_ = partitions[1]
+	}()
+	<-done
+
+	envelope := readEnvelope(t, client)
+	if envelope.Id != "42" || envelope.Status != data.ERROR_STATUS || envelope.Error == nil ||
+		envelope.Error.Code != data.INTERNAL_ERROR {
+		t.Errorf("envelope = %+v, want INTERNAL error of request 42", envelope)
+	}
+}
+
+func TestGetDataEnvelopes(t *testing.T) {
+	client := dialGetData(t, newTestProcessor(t))
+	for _, test := range []struct {
+		message string
+		id      string
+		code    string
+	}{
+		{`{"v": 1, "id": "a", "filters": ["location:Chicago"], "scale": "Daily", "aggregator": "Sum"}`, "a", ""},
+		{`{"id": "b", "q": "sum:online.spent{location:Chicago}.rollup(sum, 1w)"}`, "b", ""},
+		{`{"v": 99, "id": "c"}`, "c", data.UNSUPPORTED_VERSION_ERROR},
+		{`{"id": "d", "scale": "11y", "aggregator": "Sum"}`, "d", data.INVALID_SCALE_ERROR},
+		{`{"id": "e", "scale": "Daily", "aggregator": "Median"}`, "e", data.UNKNOWN_AGGREGATOR_ERROR},
+		{`{"id": "f", "scale": "Daily", "timezone": "Mars/Olympus_Mons", "aggregator": "Sum"}`, "f", data.INVALID_TIMEZONE_ERROR},
+		{`{"id": "g", "q": "sum:online.spent{location:Chicago"}`, "g", data.INVALID_QUERY_ERROR},
+		{`{"id": "h", "q": "sum:other.metric{*}"}`, "h", data.UNKNOWN_METRIC_ERROR},
+		{`{"id": "i", "scale": "Daily", "aggregator": "Sum", "functions": [{"name": "movingAverage", "args": [0]}]}`, "i", data.INVALID_FUNCTION_ERROR},
+		{`{"id": 42}`, "", data.BAD_REQUEST_ERROR},
+	} {
+		sendMessage(t, client, test.message)
+		envelope := readEnvelope(t, client)
+		if envelope.Version != data.PROTOCOL_VERSION || envelope.Id != test.id {
+			t.Errorf("%s: version %d, id %q, want %d, %q", test.message, envelope.Version, envelope.Id, data.PROTOCOL_VERSION, test.id)
+		}
+		if test.code == "" {
+			if envelope.Status != data.OK_STATUS || envelope.Error != nil || envelope.Meta == nil || envelope.Meta.Points == 0 {
+				t.Errorf("%s: envelope = %+v, want data points", test.message, envelope)
+			}
+			continue
+		}
+		if envelope.Status != data.ERROR_STATUS || envelope.Error == nil || envelope.Error.Code != test.code || envelope.Data != nil {
+			t.Errorf("%s: envelope = %+v, want %s error", test.message, envelope, test.code)
+		}
+	}
+}
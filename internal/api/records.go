@@ -0,0 +1,214 @@
+package api
+
+// GET /api/v1/records - raw records behind a chart bucket. URL parameters:
+// * q or filter (repeated) - filters, the same as of /api/v1/query
+// * from, to               - time range of the bucket, epoch millis (to is exclusive)
+// * sort                   - id, timestamp (default), value or a tag name, "-" prefix sorts in descending order
+// * limit                  - page size, 100 by default
+// * cursor                 - nextCursor of the previous page
+// * fields                 - comma separated fields to return: id, timestamp, metric, value and tag names, all by
+//                            default
+// Cursors are opaque, they are bound to the filters, time range and sort of the request.
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+// Record fields besides the sort fields of the processor and tag names
+const RECORD_METRIC_FIELD = "metric"
+
+type recordsQuery struct {
+	filters   []string
+	timeRange processor.TimeRange
+	order     processor.RecordOrder
+	after     *processor.RecordKey
+	limit     int
+	fields    map[string]bool // nil if all fields are returned
+}
+
+// Position after the last record of a page and the hash of the query it belongs to
+type recordsCursor struct {
+	Key       processor.RecordKey `json:"k"`
+	QueryHash string              `json:"q"`
+}
+
+// Handles GET /api/v1/records
+func HandleGetRecords(metricDataProvider processor.MetricDataProvider, request *http.Request, responseWriter http.ResponseWriter) {
+	requestId := request.URL.Query().Get("id")
+	query, err := recordsQueryFromURL(request.URL.Query())
+	if err != nil {
+		writeErrorEnvelope(responseWriter, requestId, err)
+		return
+	}
+
+	// request is cancelled when the client goes away
+	page, err := metricDataProvider.GetMetricRecords(request.Context(), data.FromRequestFilters(query.filters),
+		query.timeRange, query.order, query.after, query.limit)
+	if err != nil {
+		if request.Context().Err() != nil {
+			err = fmt.Errorf("%w: client closed the connection", errCanceled)
+		}
+		writeErrorEnvelope(responseWriter, requestId, err)
+		return
+	}
+
+	response := data.GetRecordsResponse{Records: make([]data.RawRecord, len(page.Records)), Total: page.Total}
+	for i, record := range page.Records {
+		response.Records[i] = newRawRecord(record, query.fields)
+	}
+	if page.Next != nil {
+		response.NextCursor = encodeRecordsCursor(recordsCursor{Key: *page.Next, QueryHash: query.hash()})
+	}
+	writeCacheableEnvelope(request, responseWriter, response, newResponseEnvelope(requestId, response, nil))
+}
+
+func recordsQueryFromURL(values url.Values) (recordsQuery, error) {
+	getDataReq := data.GetDataRequest{Query: values.Get("q"), Filters: values["filter"]}
+	if err := compileQueryString(&getDataReq); err != nil {
+		return recordsQuery{}, err
+	}
+	if err := data.ValidateRequestFilters(getDataReq.Filters); err != nil {
+		return recordsQuery{}, err
+	}
+	query := recordsQuery{filters: getDataReq.Filters, limit: config.DefaultRecordsPageSize}
+
+	var from, to int64
+	for _, integer := range []struct {
+		name  string
+		value *int64
+	}{{"from", &from}, {"to", &to}} {
+		if value := values.Get(integer.name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return query, fmt.Errorf("%w: %s must be epoch millis, got %q", errBadRequest, integer.name, value)
+			}
+			*integer.value = parsed
+		}
+	}
+	timeRange, err := processor.FromRequestTimeRange(from, to)
+	if err != nil {
+		return query, err
+	}
+	query.timeRange = timeRange
+
+	sortField := values.Get("sort")
+	if sortField == "" {
+		sortField = processor.RECORD_TIMESTAMP_FIELD
+	}
+	query.order.Descending = strings.HasPrefix(sortField, "-")
+	query.order.Field = strings.TrimPrefix(sortField, "-")
+	if !isRecordField(query.order.Field) || query.order.Field == RECORD_METRIC_FIELD {
+		return query, fmt.Errorf("%w: can't sort by %q, expected id, timestamp, value or a tag name", errBadRequest, query.order.Field)
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > config.MaxRecordsPageSize {
+			return query, fmt.Errorf("%w: limit must be a number from 1 to %d, got %q", errBadRequest, config.MaxRecordsPageSize, value)
+		}
+		query.limit = limit
+	}
+
+	if value := values.Get("fields"); value != "" {
+		query.fields = make(map[string]bool)
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if !isRecordField(field) {
+				return query, fmt.Errorf("%w: unknown field %q", errBadRequest, field)
+			}
+			query.fields[field] = true
+		}
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := decodeRecordsCursor(value)
+		if err != nil {
+			return query, err
+		}
+		if cursor.QueryHash != query.hash() {
+			return query, fmt.Errorf("%w: cursor belongs to a different query", errBadRequest)
+		}
+		query.after = &cursor.Key
+	}
+	return query, nil
+}
+
+func isRecordField(field string) bool {
+	switch field {
+	case processor.RECORD_ID_FIELD, processor.RECORD_TIMESTAMP_FIELD, processor.RECORD_VALUE_FIELD, RECORD_METRIC_FIELD:
+		return true
+	}
+	_, isTag := config.MetricTagsMetaData[field]
+	return isTag
+}
+
+// Hash of the parts of the query which define the order of the records, page size and fields may change between pages
+func (query recordsQuery) hash() string {
+	hash := sha256.New()
+	for _, filter := range query.filters {
+		hash.Write([]byte(filter + "\x00"))
+	}
+	fmt.Fprintf(hash, "%d|%d|%s|%t", query.timeRange.From.UnixNano(), query.timeRange.To.UnixNano(), query.order.Field, query.order.Descending)
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+func encodeRecordsCursor(cursor recordsCursor) string {
+	// cursor always marshals
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeRecordsCursor(value string) (recordsCursor, error) {
+	var cursor recordsCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(decoded, &cursor)
+	}
+	if err != nil {
+		return cursor, fmt.Errorf("%w: invalid cursor", errBadRequest)
+	}
+	return cursor, nil
+}
+
+// Record with the requested fields, all fields if fields is nil
+func newRawRecord(record *data.MetricRecord, fields map[string]bool) data.RawRecord {
+	requested := func(field string) bool {
+		return fields == nil || fields[field]
+	}
+	raw := data.RawRecord{}
+	if requested(processor.RECORD_ID_FIELD) {
+		id := record.Id()
+		raw.Id = &id
+	}
+	if requested(processor.RECORD_TIMESTAMP_FIELD) {
+		timestamp := record.Timestamp().UnixMilli()
+		raw.Timestamp = &timestamp
+	}
+	if requested(RECORD_METRIC_FIELD) {
+		raw.Metric = record.MetricName()
+	}
+	if requested(processor.RECORD_VALUE_FIELD) {
+		value := record.MetricValue()
+		raw.Value = &value
+	}
+	for name, tag := range record.Tags() {
+		if requested(name) {
+			if raw.Tags == nil {
+				raw.Tags = make(map[string]string)
+			}
+			raw.Tags[name] = tag.Value()
+		}
+	}
+	return raw
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+
+	"github.com/gorilla/websocket"
+)
+
+var testLocations = []string{"Chicago", "New York", "California"}
+
+// CSV row of the dataset layout
+func testCsvRecord(id int, timestamp time.Time, value float64, location string) []string {
+	record := make([]string, 20)
+	record[0] = strconv.Itoa(id)
+	record[2] = "M"
+	record[3] = location
+	record[6] = timestamp.Format(time.RFC3339Nano)
+	record[9] = "Apparel"
+	record[11] = strconv.FormatFloat(value, 'f', -1, 64)
+	record[13] = "Used"
+	return record
+}
+
+// Processor with a record per location and day of January 2019
+func newTestProcessor(t *testing.T) *processor.InMemoryMetricStreamProcessor {
+	t.Helper()
+	mp := processor.NewInMemoryMetricStreamProcessor(2)
+	start := time.Date(2019, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 31; day++ {
+		for i, location := range testLocations {
+			record := testCsvRecord(day*len(testLocations)+i, start.AddDate(0, 0, day), float64(day+i), location)
+			if err := mp.Process(record); err != nil {
+				t.Fatalf("Process(%v): %v", record, err)
+			}
+		}
+	}
+	return mp
+}
+
+// Provider whose data points queries filtered by location:Blocking run until they are cancelled
+type blockingProvider struct {
+	processor.MetricDataProvider
+	started chan string
+}
+
+func (provider blockingProvider) GetMetricDataPoints(ctx context.Context, filters []*data.Tag, timeRange processor.TimeRange, timePartition processor.TimePartitioner, aggregator processor.Aggregator) ([]data.TimeDataPoint, processor.QueryStats, error) {
+	for _, filter := range filters {
+		if filter.AsFilter() == "location:Blocking" {
+			provider.started <- filter.AsFilter()
+			<-ctx.Done()
+			return nil, processor.QueryStats{}, ctx.Err()
+		}
+	}
+	return provider.MetricDataProvider.GetMetricDataPoints(ctx, filters, timeRange, timePartition, aggregator)
+}
+
+// Websocket client of the getData endpoint
+func dialGetData(t *testing.T, provider processor.MetricDataProvider) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleGetDataWebSocket(provider, websocket.Upgrader{}, r, w)
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func sendMessage(t *testing.T, client *websocket.Conn, message string) {
+	t.Helper()
+	if err := client.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+}
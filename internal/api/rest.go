@@ -0,0 +1,177 @@
+package api
+
+// Plain HTTP/JSON API, an alternative to the websocket API for scripts, curl, notebooks and health checks:
+// * GET/POST /api/v1/query - the same as getData, GET takes simple requests as URL parameters, POST takes any
+//   request as JSON body
+// * GET /api/v1/tags?q=    - the same as getFilters
+// Requests are parsed and executed the same way as websocket requests, responses are the same envelopes.
+// Results carry ETag, requests with matching If-None-Match get 304 Not Modified.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+const MAX_REQUEST_BODY_SIZE = 1 << 20
+
+// Non-standard status of requests cancelled because the client went away (nginx convention)
+const STATUS_CLIENT_CLOSED_REQUEST = 499
+
+// Handles GET/POST /api/v1/query
+func HandleQuery(metricDataProvider processor.MetricDataProvider, request *http.Request, responseWriter http.ResponseWriter) {
+	started := time.Now()
+	getDataReq, err := readHttpGetDataRequest(request, responseWriter)
+	if err != nil {
+		writeErrorEnvelope(responseWriter, getDataReq.Id, err)
+		return
+	}
+
+	// request is cancelled when the client goes away
+	response, stats, err := getData(request.Context(), metricDataProvider, getDataReq)
+	if err != nil {
+		if request.Context().Err() != nil {
+			err = fmt.Errorf("%w: client closed the connection", errCanceled)
+		}
+		writeErrorEnvelope(responseWriter, getDataReq.Id, err)
+		return
+	}
+	writeCacheableEnvelope(request, responseWriter, response,
+		newResponseEnvelope(getDataReq.Id, response, newResponseMeta(response, stats, started)))
+}
+
+// Handles GET /api/v1/tags
+func HandleGetTags(metricDataProvider processor.MetricDataProvider, request *http.Request, responseWriter http.ResponseWriter) {
+	filters := metricDataProvider.GetMetricTagFilters(request.URL.Query().Get("q"))
+	writeCacheableEnvelope(request, responseWriter, filters, newResponseEnvelope("", filters, nil))
+}
+
+// Reads getData request of POST body or GET URL parameters
+func readHttpGetDataRequest(request *http.Request, responseWriter http.ResponseWriter) (data.GetDataRequest, error) {
+	var getDataReq data.GetDataRequest
+	var err error
+	if request.Method == http.MethodPost {
+		var body []byte
+		body, err = io.ReadAll(http.MaxBytesReader(responseWriter, request.Body, MAX_REQUEST_BODY_SIZE))
+		if err != nil {
+			err = fmt.Errorf("%w: %v", errBadRequest, err)
+		} else {
+			getDataReq, err = parseGetDataRequest(body)
+		}
+	} else {
+		getDataReq, err = getDataRequestFromQuery(request.URL.Query())
+	}
+	if err == nil {
+		err = checkHttpRequest(getDataReq)
+	}
+	return getDataReq, err
+}
+
+// Builds getData request from URL parameters: q, filter (repeated), groupBy (repeated), scale, timezone, weekStart,
+// aggregator, from, to, maxPoints, fill, compareTo and id. Formulas, functions, anomaly detection and forecast need
+// POST.
+func getDataRequestFromQuery(query url.Values) (data.GetDataRequest, error) {
+	request := data.GetDataRequest{
+		RequestEnvelope: data.RequestEnvelope{Id: query.Get("id")},
+		Query:           query.Get("q"),
+		Filters:         query["filter"],
+		GroupBy:         query["groupBy"],
+		Scale:           query.Get("scale"),
+		Timezone:        query.Get("timezone"),
+		WeekStart:       query.Get("weekStart"),
+		Aggregator:      query.Get("aggregator"),
+		Fill:            query.Get("fill"),
+		CompareTo:       query.Get("compareTo"),
+	}
+
+	integers := []struct {
+		name  string
+		value *int64
+	}{
+		{"from", &request.From},
+		{"to", &request.To},
+	}
+	for _, integer := range integers {
+		if value := query.Get(integer.name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return request, fmt.Errorf("%w: %s must be epoch millis, got %q", errBadRequest, integer.name, value)
+			}
+			*integer.value = parsed
+		}
+	}
+	if value := query.Get("maxPoints"); value != "" {
+		maxPoints, err := strconv.Atoi(value)
+		if err != nil {
+			return request, fmt.Errorf("%w: maxPoints must be a number, got %q", errBadRequest, value)
+		}
+		request.MaxPoints = maxPoints
+	}
+	return request, compileQueryString(&request)
+}
+
+// Subscriptions and cancellation need a connection, they are only supported over websocket
+func checkHttpRequest(request data.GetDataRequest) error {
+	if request.Subscribe != "" || request.Unsubscribe != "" || request.Cancel != "" || request.Supersedes != "" {
+		return fmt.Errorf("%w: subscriptions and cancellation are only supported over websocket", errBadRequest)
+	}
+	return nil
+}
+
+// Writes the envelope with ETag of the result, or 304 Not Modified if the client has the same result already.
+// ETag is weak as the envelope metadata (duration) differs between identical results.
+func writeCacheableEnvelope(request *http.Request, responseWriter http.ResponseWriter, result interface{}, envelope data.ResponseEnvelope) {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		writeErrorEnvelope(responseWriter, envelope.Id, err)
+		return
+	}
+	hash := sha256.Sum256(encoded)
+	etag := `W/"` + hex.EncodeToString(hash[:16]) + `"`
+
+	responseWriter.Header().Set("ETag", etag)
+	responseWriter.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(request.Header.Get("If-None-Match"), etag) {
+		responseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(responseWriter, http.StatusOK, envelope)
+}
+
+// Weak comparison of If-None-Match entity tags
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeErrorEnvelope(responseWriter http.ResponseWriter, requestId string, err error) {
+	envelope := newErrorEnvelope(requestId, err)
+	writeJSON(responseWriter, httpStatus(envelope.Error.Code), envelope)
+}
+
+func httpStatus(errorCode string) int {
+	switch errorCode {
+	case data.INTERNAL_ERROR:
+		return http.StatusInternalServerError
+	case data.TOO_MANY_REQUESTS_ERROR:
+		return http.StatusTooManyRequests
+	case data.CANCELED_ERROR:
+		return STATUS_CLIENT_CLOSED_REQUEST
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func newTestRestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mp := newTestProcessor(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		HandleQuery(mp, r, w)
+	})
+	mux.HandleFunc("/api/v1/tags", func(w http.ResponseWriter, r *http.Request) {
+		HandleGetTags(mp, r, w)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Sends the request and returns the response with its body read
+func doRequest(t *testing.T, method string, url string, body string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, responseBody
+}
+
+func TestRestQueryNotModified(t *testing.T) {
+	server := newTestRestServer(t)
+	for _, path := range []string{
+		"/api/v1/query?" + url.Values{"filter": {"location:Chicago"}, "scale": {"Weekly"}, "aggregator": {"Sum"}}.Encode(),
+		"/api/v1/tags?q=loc",
+	} {
+		response, body := doRequest(t, http.MethodGet, server.URL+path, "", nil)
+		etag := response.Header.Get("ETag")
+		if response.StatusCode != http.StatusOK || !strings.HasPrefix(etag, `W/"`) || len(body) == 0 {
+			t.Fatalf("%s: status %d, ETag %q", path, response.StatusCode, etag)
+		}
+
+		for _, test := range []struct {
+			ifNoneMatch string
+			status      int
+		}{
+			{etag, http.StatusNotModified},
+			{strings.TrimPrefix(etag, "W/"), http.StatusNotModified},
+			{`"other", ` + etag, http.StatusNotModified},
+			{"*", http.StatusNotModified},
+			{`W/"other"`, http.StatusOK},
+		} {
+			response, body := doRequest(t, http.MethodGet, server.URL+path, "", http.Header{"If-None-Match": {test.ifNoneMatch}})
+			if response.StatusCode != test.status || response.Header.Get("ETag") != etag {
+				t.Errorf("%s, If-None-Match %s: status %d, ETag %q, want %d, %q", path, test.ifNoneMatch,
+					response.StatusCode, response.Header.Get("ETag"), test.status, etag)
+			}
+			if test.status == http.StatusNotModified && len(body) != 0 {
+				t.Errorf("%s, If-None-Match %s: body of 304 response", path, test.ifNoneMatch)
+			}
+		}
+	}
+
+	// other result, other ETag
+	response, _ := doRequest(t, http.MethodGet, server.URL+"/api/v1/tags?q=gen", "", nil)
+	first, _ := doRequest(t, http.MethodGet, server.URL+"/api/v1/tags?q=loc", "", nil)
+	if response.Header.Get("ETag") == first.Header.Get("ETag") {
+		t.Errorf("different results have the same ETag %s", response.Header.Get("ETag"))
+	}
+}
+
+func TestRestQueryErrors(t *testing.T) {
+	server := newTestRestServer(t)
+	for _, test := range []struct {
+		method string
+		query  string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "scale=11y&aggregator=Sum", "", http.StatusBadRequest, data.INVALID_SCALE_ERROR},
+		{http.MethodGet, "scale=Daily&aggregator=Sum&from=yesterday", "", http.StatusBadRequest, data.BAD_REQUEST_ERROR},
+		{http.MethodPost, "", `{"id": "s", "subscribe": "s", "scale": "Daily", "aggregator": "Sum"}`, http.StatusBadRequest, data.BAD_REQUEST_ERROR},
+		{http.MethodPost, "", `{"id": "x", "scale": "Daily", "aggregator": "Sum", "filters": ["` + strings.Repeat("a", MAX_REQUEST_BODY_SIZE) + `"]}`, http.StatusBadRequest, data.BAD_REQUEST_ERROR},
+		{http.MethodPost, "", `{"id": "f", "queries": [{"name": "a", "filters": [], "aggregator": "Sum"}], "formula": "a +", "scale": "Daily"}`, http.StatusBadRequest, data.INVALID_FORMULA_ERROR},
+	} {
+		response, body := doRequest(t, test.method, server.URL+"/api/v1/query?"+test.query, test.body, nil)
+		var envelope data.ResponseEnvelope
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			t.Fatalf("%s %s: %v", test.method, test.query, err)
+		}
+		if response.StatusCode != test.status || envelope.Error == nil || envelope.Error.Code != test.code {
+			t.Errorf("%s %s: status %d, envelope %+v, want %d %s", test.method, test.query, response.StatusCode, envelope,
+				test.status, test.code)
+		}
+	}
+}
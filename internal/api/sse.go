@@ -0,0 +1,381 @@
+package api
+
+// Server-Sent Events API for consumers behind proxies which break websockets.
+// GET /api/v1/stream takes the URL parameters of GET /api/v1/query (and pushInterval) and streams data points of
+// a live subscription to the query:
+// * "reset" event - the client drops data points it has, data is {"interval": "1d"}
+// * "point" event - new or changed data point, data is the data point
+// * "error" event - the query failed, data is the error envelope
+// Events have ids. Reconnecting client sends the id of the last received event in the Last-Event-ID header and
+// gets the events it missed, then the data points changed meanwhile. Disconnected streams are kept for a while
+// for that, streams which can't be resumed start over with a reset. Heartbeat comments keep idle connections open.
+// The number of open streams is limited, as well as the number of kept ones, the oldest are dropped first.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+const (
+	RESET_EVENT = "reset"
+	POINT_EVENT = "point"
+	ERROR_EVENT = "error"
+)
+
+var errTooManyStreams = errors.New("too many open streams")
+
+func NewStreams(heartbeatInterval time.Duration, resumeWindow time.Duration, replayLength int, maxOpen int, maxDetached int) *Streams {
+	return &Streams{
+		heartbeatInterval: heartbeatInterval,
+		resumeWindow:      resumeWindow,
+		replayLength:      replayLength,
+		maxOpen:           maxOpen,
+		maxDetached:       maxDetached,
+		detached:          make(map[string]*stream),
+		stop:              make(chan struct{}),
+	}
+}
+
+// Disconnected streams which can be resumed
+type Streams struct {
+	heartbeatInterval time.Duration
+	resumeWindow      time.Duration
+	replayLength      int
+	maxOpen           int
+	maxDetached       int
+
+	lock     sync.Mutex
+	detached map[string]*stream
+	// number of connected streams
+	open int
+
+	// closed on server shutdown, open streams end
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Stream of a subscription, it is the sink of the subscription pushes
+type stream struct {
+	id           string
+	request      data.GetDataRequest
+	replayLength int
+
+	lock sync.Mutex
+	// connection the stream is written to, nil when the client is disconnected
+	out     *sseWriter
+	lastSeq uint64
+	// the latest events, replayed to the resumed stream
+	events []streamEvent
+	// data points sent so far, by timestamp
+	points     map[int64]data.TimeDataPoint
+	detachedAt time.Time
+}
+
+type streamEvent struct {
+	seq  uint64
+	name string
+	data []byte
+}
+
+type sseWriter struct {
+	responseWriter http.ResponseWriter
+	flusher        http.Flusher
+	started        bool
+}
+
+var _ subscriptionSink = (*stream)(nil)
+
+// Handles GET /api/v1/stream
+func HandleStream(metricDataProvider processor.MetricDataProvider, streams *Streams, request *http.Request, responseWriter http.ResponseWriter) {
+	flusher, ok := responseWriter.(http.Flusher)
+	if !ok {
+		writeErrorEnvelope(responseWriter, "", errors.New("streaming is not supported by the connection"))
+		return
+	}
+	getDataReq, err := getDataRequestFromQuery(request.URL.Query())
+	if err == nil {
+		err = checkHttpRequest(getDataReq)
+	}
+	if value := request.URL.Query().Get("pushInterval"); err == nil && value != "" {
+		if getDataReq.PushInterval, err = strconv.ParseInt(value, 10, 64); err != nil {
+			err = fmt.Errorf("%w: pushInterval must be millis, got %q", errBadRequest, value)
+		}
+	}
+	if err != nil {
+		writeErrorEnvelope(responseWriter, getDataReq.Id, err)
+		return
+	}
+
+	if !streams.acquire() {
+		writeErrorEnvelope(responseWriter, getDataReq.Id, fmt.Errorf("%w, at most %d are allowed", errTooManyStreams, streams.maxOpen))
+		return
+	}
+	defer streams.release()
+
+	out := &sseWriter{responseWriter: responseWriter, flusher: flusher}
+	st, sent := streams.attach(getDataReq, request.Header.Get("Last-Event-ID"), out)
+	subs := newSubscriptions(metricDataProvider, st)
+	getDataReq.Subscribe = st.id
+	if err := subs.resume(request.Context(), getDataReq, sent); err != nil {
+		if st.started() {
+			st.fail(nil, err)
+		} else {
+			// nothing was sent yet, the request is invalid
+			writeErrorEnvelope(responseWriter, getDataReq.Id, err)
+		}
+		st.detach()
+		return
+	}
+
+	ticker := time.NewTicker(streams.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			st.heartbeat()
+		case <-request.Context().Done():
+			subs.closeAll()
+			st.detach()
+			streams.keep(st)
+			return
+		case <-streams.stop:
+			subs.closeAll()
+			st.detach()
+			return
+		}
+	}
+}
+
+// Ends open streams, so that server shutdown doesn't wait for them
+func (streams *Streams) Stop() {
+	streams.stopOnce.Do(func() {
+		close(streams.stop)
+	})
+}
+
+// Attaches the connection to the stream resumed from the last event id, or to a new stream. Returns data points
+// the client has, nil for the new stream.
+func (streams *Streams) attach(request data.GetDataRequest, lastEventId string, out *sseWriter) (*stream, map[int64]data.TimeDataPoint) {
+	streams.lock.Lock()
+	defer streams.lock.Unlock()
+	streams.removeExpired()
+
+	if streamId, seq, ok := parseEventId(lastEventId); ok {
+		if st, found := streams.detached[streamId]; found && reflect.DeepEqual(st.request, request) {
+			if points, resumed := st.resume(seq, out); resumed {
+				delete(streams.detached, streamId)
+				return st, points
+			}
+		}
+	}
+
+	st := &stream{
+		id:           newStreamId(),
+		request:      request,
+		replayLength: streams.replayLength,
+		out:          out,
+		points:       make(map[int64]data.TimeDataPoint),
+	}
+	return st, nil
+}
+
+// Takes a slot of the open streams, false if all are taken
+func (streams *Streams) acquire() bool {
+	streams.lock.Lock()
+	defer streams.lock.Unlock()
+	if streams.open >= streams.maxOpen {
+		return false
+	}
+	streams.open++
+	return true
+}
+
+func (streams *Streams) release() {
+	streams.lock.Lock()
+	defer streams.lock.Unlock()
+	streams.open--
+}
+
+// Keeps disconnected stream for resume, drops the longest detached streams over the limit
+func (streams *Streams) keep(st *stream) {
+	streams.lock.Lock()
+	defer streams.lock.Unlock()
+	streams.removeExpired()
+	for len(streams.detached) >= streams.maxDetached && len(streams.detached) > 0 {
+		streams.removeOldest()
+	}
+	if streams.maxDetached > 0 {
+		streams.detached[st.id] = st
+	}
+}
+
+func (streams *Streams) removeOldest() {
+	var oldestId string
+	var oldest time.Time
+	for id, st := range streams.detached {
+		st.lock.Lock()
+		detachedAt := st.detachedAt
+		st.lock.Unlock()
+		if oldestId == "" || detachedAt.Before(oldest) {
+			oldestId, oldest = id, detachedAt
+		}
+	}
+	delete(streams.detached, oldestId)
+}
+
+func (streams *Streams) removeExpired() {
+	now := time.Now()
+	for id, st := range streams.detached {
+		st.lock.Lock()
+		expired := now.Sub(st.detachedAt) > streams.resumeWindow
+		st.lock.Unlock()
+		if expired {
+			delete(streams.detached, id)
+		}
+	}
+}
+
+// Replays events after the last event the client has received, fails if some of them are not kept anymore
+func (st *stream) resume(lastSeq uint64, out *sseWriter) (map[int64]data.TimeDataPoint, bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if lastSeq > st.lastSeq || (len(st.events) > 0 && lastSeq+1 < st.events[0].seq) {
+		return nil, false
+	}
+	st.out = out
+	for _, event := range st.events {
+		if event.seq > lastSeq {
+			st.write(event)
+		}
+	}
+	points := make(map[int64]data.TimeDataPoint, len(st.points))
+	for timestamp, point := range st.points {
+		points[timestamp] = point
+	}
+	return points, true
+}
+
+func (st *stream) detach() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.out = nil
+	st.detachedAt = time.Now()
+}
+
+// Returns true if anything was sent to the connected client
+func (st *stream) started() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.out != nil && st.out.started
+}
+
+func (st *stream) push(sub *subscription, response data.GetDataResponse, meta *data.ResponseMeta) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if !response.Update {
+		st.points = make(map[int64]data.TimeDataPoint)
+		reset, _ := json.Marshal(map[string]string{"interval": response.Interval})
+		st.append(RESET_EVENT, reset)
+	}
+	for _, point := range response.DataPoints {
+		encoded, err := json.Marshal(point)
+		if err != nil {
+			log.Println("Error encoding data point:", err)
+			continue
+		}
+		st.points[point.Timestamp] = point
+		st.append(POINT_EVENT, encoded)
+	}
+}
+
+// Errors are not kept for the replay
+func (st *stream) fail(sub *subscription, err error) {
+	encoded, _ := json.Marshal(newErrorEnvelope(st.request.Id, err))
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.write(streamEvent{name: ERROR_EVENT, data: encoded})
+}
+
+func (st *stream) heartbeat() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.out != nil {
+		st.out.writeRaw(": heartbeat\n\n")
+	}
+}
+
+// Adds event to the replay buffer and sends it, called with the stream lock held
+func (st *stream) append(name string, encoded []byte) {
+	st.lastSeq++
+	event := streamEvent{seq: st.lastSeq, name: name, data: encoded}
+	st.events = append(st.events, event)
+	if len(st.events) > st.replayLength {
+		st.events = st.events[len(st.events)-st.replayLength:]
+	}
+	st.write(event)
+}
+
+// Sends event to the connected client, called with the stream lock held
+func (st *stream) write(event streamEvent) {
+	if st.out == nil {
+		return
+	}
+	var message strings.Builder
+	if event.seq > 0 {
+		fmt.Fprintf(&message, "id: %s-%d\n", st.id, event.seq)
+	}
+	fmt.Fprintf(&message, "event: %s\ndata: %s\n\n", event.name, event.data)
+	st.out.writeRaw(message.String())
+}
+
+// Sends SSE headers before the first message
+func (out *sseWriter) writeRaw(message string) {
+	if !out.started {
+		header := out.responseWriter.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Connection", "keep-alive")
+		// disables response buffering of nginx
+		header.Set("X-Accel-Buffering", "no")
+		out.responseWriter.WriteHeader(http.StatusOK)
+		out.started = true
+	}
+	if _, err := out.responseWriter.Write([]byte(message)); err != nil {
+		return
+	}
+	out.flusher.Flush()
+}
+
+// Event ids are "<stream id>-<sequence number>"
+func parseEventId(eventId string) (string, uint64, bool) {
+	separator := strings.LastIndex(eventId, "-")
+	if separator < 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(eventId[separator+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return eventId[:separator], seq, true
+}
+
+func newStreamId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// ids only need to differ between streams
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
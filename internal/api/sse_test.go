@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	id, name, data string
+}
+
+// Opens the stream of Chicago daily sums, resumed from lastEventId if it is given
+func openTestStream(t *testing.T, server *httptest.Server, lastEventId string) (*bufio.Reader, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		server.URL+"/api/v1/stream?filter=location:Chicago&scale=Daily&aggregator=Sum", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(response.Body), cancel
+}
+
+func readEvents(t *testing.T, reader *bufio.Reader, count int) []testEvent {
+	t.Helper()
+	events := []testEvent{}
+	event := testEvent{}
+	for len(events) < count {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event %d: %v", len(events), err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			events = append(events, event)
+			event = testEvent{}
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return events
+}
+
+// Waits until the handler of the closed connection keeps its stream
+func waitDetached(t *testing.T, streams *Streams, count int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		streams.lock.Lock()
+		detached := len(streams.detached)
+		streams.lock.Unlock()
+		if detached == count {
+			return
+		}
+	}
+	t.Fatalf("%d streams were not detached", count)
+}
+
+func TestStreamResumesAfterLastEventId(t *testing.T) {
+	mp := newTestProcessor(t)
+	streams := NewStreams(time.Hour, time.Minute, 100, 10, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleStream(mp, streams, r, w)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(streams.Stop)
+
+	// reset and a data point per day of January
+	reader, disconnect := openTestStream(t, server, "")
+	events := readEvents(t, reader, 32)
+	if events[0].name != RESET_EVENT || events[1].name != POINT_EVENT || events[31].name != POINT_EVENT {
+		t.Fatalf("events %v ... %v", events[0], events[31])
+	}
+	streamId, _, _ := parseEventId(events[0].id)
+	disconnect()
+	waitDetached(t, streams, 1)
+
+	// records of a known day and of a new day arrive while the client is away
+	start := time.Date(2019, time.January, 31, 18, 0, 0, 0, time.UTC)
+	for i, timestamp := range []time.Time{start, start.AddDate(0, 0, 1)} {
+		if err := mp.Process(testCsvRecord(1000+i, timestamp, 100, "Chicago")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// events after the 20th are replayed, then the two changed data points follow
+	reader, disconnect = openTestStream(t, server, events[19].id)
+	resumed := readEvents(t, reader, 14)
+	for i, event := range resumed {
+		if want := fmt.Sprintf("%s-%d", streamId, 21+i); event.id != want || event.name != POINT_EVENT {
+			t.Fatalf("resumed event %d = %+v, want point %s", i, event, want)
+		}
+		if i < 12 && event.data != events[20+i].data {
+			t.Errorf("replayed event %s = %s, want %s", event.id, event.data, events[20+i].data)
+		}
+	}
+	if !strings.Contains(resumed[12].data, `"timestamp":1548892800000`) || !strings.Contains(resumed[13].data, `"timestamp":1548979200000`) {
+		t.Errorf("changed data points %s, %s, want January 31 and February 1", resumed[12].data, resumed[13].data)
+	}
+	disconnect()
+	waitDetached(t, streams, 1)
+
+	// streams which can't be resumed start over
+	for _, lastEventId := range []string{"unknown-3", streamId + "-99"} {
+		reader, disconnect := openTestStream(t, server, lastEventId)
+		if event := readEvents(t, reader, 1)[0]; event.name != RESET_EVENT || strings.HasPrefix(event.id, streamId+"-") {
+			t.Errorf("Last-Event-ID %s: first event %+v, want reset of a new stream", lastEventId, event)
+		}
+		disconnect()
+	}
+}
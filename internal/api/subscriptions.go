@@ -0,0 +1,265 @@
+package api
+
+// Live getData subscriptions. Subscription is a getData request which is re-evaluated when new records matching its
+// filters come through the metric processor. The first push carries all data points, later pushes carry only
+// data points which changed since the previous push. Pushes are rate limited: records arriving in between are
+// coalesced into the next push. Pushes go to the sink of the connection: websocket or SSE stream.
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+// Receives pushes of subscriptions, pushes of a subscription come one at a time
+type subscriptionSink interface {
+	push(sub *subscription, response data.GetDataResponse, meta *data.ResponseMeta)
+	fail(sub *subscription, err error)
+}
+
+// Subscriptions of a single connection
+type subscriptions struct {
+	provider processor.MetricDataProvider
+	sink     subscriptionSink
+
+	lock   sync.Mutex
+	active map[string]*subscription
+
+	// running push loops of the subscriptions
+	wg sync.WaitGroup
+}
+
+func newSubscriptions(provider processor.MetricDataProvider, sink subscriptionSink) *subscriptions {
+	return &subscriptions{
+		provider: provider,
+		sink:     sink,
+		active:   make(map[string]*subscription),
+	}
+}
+
+// Sends subscription pushes to the websocket
+type wsSubscriptionSink struct {
+	writer *wsWriter
+}
+
+func (sink wsSubscriptionSink) push(sub *subscription, response data.GetDataResponse, meta *data.ResponseMeta) {
+	sendResponse(sink.writer, sub.request.Id, response, meta)
+}
+
+func (sink wsSubscriptionSink) fail(sub *subscription, err error) {
+	sendError(sink.writer, sub.request.Id, fmt.Errorf("subscription %s: %w", sub.id, err))
+}
+
+type subscription struct {
+	id           string
+	request      data.GetDataRequest
+	filterSets   [][]*data.Tag
+	pushInterval time.Duration
+
+	// data points sent so far, by timestamp
+	sent   map[int64]data.TimeDataPoint
+	pushed bool
+
+	changed chan struct{}
+	stop    chan struct{}
+	// cancels the push in progress when the subscription is closed
+	ctx         context.Context
+	cancel      context.CancelFunc
+	unsubscribe func()
+}
+
+// Validates the request, sends the initial data points and starts pushing updates. The initial push runs within
+// the context of the subscribe request.
+func (subs *subscriptions) subscribe(ctx context.Context, request data.GetDataRequest) error {
+	return subs.resume(ctx, request, nil)
+}
+
+// Subscribes with data points the client already has, the first push carries only data points which differ
+func (subs *subscriptions) resume(ctx context.Context, request data.GetDataRequest, sent map[int64]data.TimeDataPoint) error {
+	if len(request.GroupBy) > 0 {
+		return fmt.Errorf("%w: grouped requests can't be subscribed to", errInvalidSubscription)
+	}
+	pushInterval := config.SubscriptionMinPushInterval
+	if requested := time.Duration(request.PushInterval) * time.Millisecond; requested > pushInterval {
+		pushInterval = requested
+	}
+	sub := &subscription{
+		id:           request.Subscribe,
+		request:      request,
+		pushInterval: pushInterval,
+		sent:         make(map[int64]data.TimeDataPoint),
+		pushed:       sent != nil,
+		changed:      make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+	sub.ctx, sub.cancel = context.WithCancel(context.Background())
+	for timestamp, point := range sent {
+		sub.sent[timestamp] = point
+	}
+
+	subs.lock.Lock()
+	if _, found := subs.active[sub.id]; found {
+		subs.lock.Unlock()
+		return fmt.Errorf("%w: subscription %q already exists", errInvalidSubscription, sub.id)
+	}
+	if len(subs.active) >= config.MaxSubscriptionsPerConnection {
+		subs.lock.Unlock()
+		return fmt.Errorf("%w: too many subscriptions, at most %d are allowed per connection", errInvalidSubscription,
+			config.MaxSubscriptionsPerConnection)
+	}
+	subs.active[sub.id] = sub
+	subs.lock.Unlock()
+
+	// initial push fails for invalid requests, so the client gets an error instead of a subscription
+	if err := subs.push(ctx, sub); err != nil {
+		subs.remove(sub)
+		return err
+	}
+	// filters are valid once the initial push succeeded
+	sub.filterSets = requestFilterSets(request)
+
+	subs.lock.Lock()
+	defer subs.lock.Unlock()
+	if subs.active[sub.id] != sub {
+		// unsubscribed during the initial push
+		return nil
+	}
+	sub.unsubscribe = subs.provider.SubscribeRecords(func(metricRecord *data.MetricRecord, tags data.Tags) {
+		if sub.matches(tags) {
+			select {
+			case sub.changed <- struct{}{}:
+			default:
+				// push is already pending
+			}
+		}
+	})
+	subs.wg.Add(1)
+	go subs.run(sub)
+	return nil
+}
+
+func (subs *subscriptions) unsubscribe(id string) error {
+	subs.lock.Lock()
+	defer subs.lock.Unlock()
+	sub, found := subs.active[id]
+	if !found {
+		return fmt.Errorf("%w: subscription %q not found", errInvalidSubscription, id)
+	}
+	delete(subs.active, id)
+	sub.close()
+	return nil
+}
+
+// Removes subscription whose initial push failed, unless it was unsubscribed meanwhile
+func (subs *subscriptions) remove(sub *subscription) {
+	subs.lock.Lock()
+	defer subs.lock.Unlock()
+	if subs.active[sub.id] == sub {
+		delete(subs.active, sub.id)
+		sub.close()
+	}
+}
+
+// Stops all subscriptions and waits until their pushes end, called when the connection is closed
+func (subs *subscriptions) closeAll() {
+	subs.lock.Lock()
+	for id, sub := range subs.active {
+		sub.close()
+		delete(subs.active, id)
+	}
+	subs.lock.Unlock()
+	subs.wg.Wait()
+}
+
+// Pushes changes, at most one push per push interval
+func (subs *subscriptions) run(sub *subscription) {
+	defer subs.wg.Done()
+	for {
+		select {
+		case <-sub.changed:
+		case <-sub.stop:
+			return
+		}
+		if err := subs.push(sub.ctx, sub); err != nil {
+			if sub.ctx.Err() != nil {
+				return
+			}
+			subs.sink.fail(sub, err)
+		}
+		select {
+		case <-time.After(sub.pushInterval):
+		case <-sub.stop:
+			return
+		}
+	}
+}
+
+// Re-evaluates the request and sends data points which changed since the last push
+func (subs *subscriptions) push(ctx context.Context, sub *subscription) error {
+	started := time.Now()
+	response, stats, err := getData(ctx, subs.provider, sub.request)
+	if err != nil {
+		return err
+	}
+
+	initial := !sub.pushed
+	changed := []data.TimeDataPoint{}
+	for _, point := range response.DataPoints {
+		if sent, found := sub.sent[point.Timestamp]; !found || !reflect.DeepEqual(sent, point) {
+			changed = append(changed, point)
+			sub.sent[point.Timestamp] = point
+		}
+	}
+	if !initial && len(changed) == 0 {
+		return nil
+	}
+
+	sub.pushed = true
+	response.DataPoints = changed
+	response.SubscriptionId = sub.id
+	response.Update = !initial
+	subs.sink.push(sub, response, newResponseMeta(response, stats, started))
+	return nil
+}
+
+// Called with the subscriptions lock held
+func (sub *subscription) close() {
+	if sub.unsubscribe != nil {
+		sub.unsubscribe()
+	}
+	sub.cancel()
+	close(sub.stop)
+}
+
+// Record matches if it passes all filters of at least one filter set (the request or one of its sub-queries)
+func (sub *subscription) matches(tags data.Tags) bool {
+	for _, filters := range sub.filterSets {
+		matches := true
+		for _, filter := range filters {
+			if !filter.Matches(tags) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func requestFilterSets(request data.GetDataRequest) [][]*data.Tag {
+	if len(request.Queries) == 0 {
+		return [][]*data.Tag{data.FromRequestFilters(request.Filters)}
+	}
+	filterSets := make([][]*data.Tag, len(request.Queries))
+	for i, subQuery := range request.Queries {
+		filterSets[i] = data.FromRequestFilters(subQuery.Filters)
+	}
+	return filterSets
+}
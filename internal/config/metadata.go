@@ -2,8 +2,103 @@ package config
 
 // Configuration metadate about CSV-dataset which is used in this demo.
 
+import (
+	"runtime"
+	"time"
+)
+
 const CsvDataSetFilePath = "./data/dataset.csv"
 
+// Number of metric processor shards, ingestion and queries are executed in parallel across shards
+var ProcessorShardCount = runtime.NumCPU()
+
+// Max number of goroutines a single query may use for partitioning and aggregation
+var QueryParallelism = runtime.NumCPU()
+
+// Processor snapshot settings: snapshot is written periodically and on shutdown and restored on startup
+const (
+	SnapshotFilePath = "./data/processor.snapshot"
+	SnapshotInterval = 5 * time.Minute
+)
+
+// Write-ahead log settings for records ingested through live streams. Sync policy is one of "always", "interval"
+// or "never"
+const (
+	WalDirPath         = "./data/wal"
+	WalSegmentMaxBytes = 16 << 20
+	WalSyncPolicy      = "interval"
+	WalSyncInterval    = time.Second
+)
+
+// Special timestamp layouts for numeric unix timestamps
+const (
+	EPOCH_LAYOUT         = "epoch"
+	EPOCH_SECONDS_LAYOUT = "epoch_s"
+	EPOCH_MILLIS_LAYOUT  = "epoch_ms"
+)
+
+// Monitor settings: monitor definitions file, how often the scheduler looks for due monitors and how many state
+// changes are kept per monitor
+const (
+	MonitorsFilePath       = "./data/monitors.json"
+	MonitorSchedulerTick   = time.Second
+	MonitorHistoryLength   = 100
+	MinMonitorEvalInterval = 10 * time.Second
+)
+
+// Webhook notifications about monitor state changes: webhooks file, retries with exponential backoff, the same
+// state change of a monitor is not sent again within the de-duplication window
+const (
+	WebhooksFilePath              = "./data/webhooks.json"
+	NotificationMaxAttempts       = 5
+	NotificationInitialBackoff    = time.Second
+	NotificationMaxBackoff        = time.Minute
+	NotificationRequestTimeout    = 10 * time.Second
+	NotificationDedupWindow       = 5 * time.Minute
+	NotificationDeliveryLogLength = 500
+)
+
+// Server-Sent Events streams: interval of heartbeat comments keeping proxies from closing idle connections, how long
+// a disconnected stream can be resumed with Last-Event-ID and how many of its latest events are kept for the replay.
+// Streams over the open limit are rejected, the oldest disconnected streams are dropped over the detached limit.
+const (
+	StreamHeartbeatInterval = 15 * time.Second
+	StreamResumeWindow      = 5 * time.Minute
+	StreamReplayLength      = 1000
+	MaxOpenStreams          = 1000
+	MaxDetachedStreams      = 1000
+)
+
+// Live /ingest requests: max size of the request body and max number of rejected records reported with their errors,
+// rejected records over the limit are only counted
+const (
+	MaxIngestBodyBytes = 8 << 20
+	MaxIngestErrors    = 100
+)
+
+// Max number of groups (combinations of group by tag values) of a getData request
+const MaxQueryGroups = 100
+
+// Raw records drill-down: page size if the request doesn't give one and the max page size
+const (
+	DefaultRecordsPageSize = 100
+	MaxRecordsPageSize     = 1000
+)
+
+// Max number of getData requests processed concurrently on a single websocket connection, requests over the limit
+// are rejected
+const MaxInFlightRequestsPerConnection = 8
+
+// Max size of a message received over websocket, connections sending larger messages are closed
+const MaxWebsocketMessageBytes = 64 << 10
+
+// Live getData subscriptions: max number of subscriptions per websocket connection and the minimal interval
+// between two pushes of a subscription
+const (
+	MaxSubscriptionsPerConnection = 16
+	SubscriptionMinPushInterval   = time.Second
+)
+
 // Metadata constants
 var (
 	MetricName                 = "online.spent"
@@ -11,6 +106,14 @@ var (
 	MetricValueColumnIndex     = 11 // Avg_Price
 	MetricTimestampColumnIndex = 6  // Transation_Date
 
+	// Layouts of the timestamp column, tried in order. Besides Go time layouts numeric unix timestamps are
+	// accepted: EPOCH_SECONDS_LAYOUT, EPOCH_MILLIS_LAYOUT or EPOCH_LAYOUT which tells seconds from millis by
+	// magnitude. Live ingest sources (StatsD, HTTP push) usually send RFC3339 or epoch timestamps.
+	MetricTimestampLayouts = []string{"2006-01-02", time.RFC3339Nano, "2006-01-02 15:04:05", EPOCH_LAYOUT}
+
+	// IANA timezone of timestamps without zone offset (for ex. "2006-01-02")
+	MetricTimestampTimezone = "UTC"
+
 	MetricTagsMetaData = map[string]*CsvRecordMetaData{
 		"gender": {
 			ColumnIndex: 2,
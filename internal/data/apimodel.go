@@ -4,28 +4,259 @@ import "time"
 
 // Request / reponse protocol entities
 
+// Websocket messages are versioned. Requests carry the envelope fields next to the request fields, responses wrap
+// the result into ResponseEnvelope, so the client can match responses to requests by id and tell why a request failed.
+const PROTOCOL_VERSION = 1
+
+const (
+	OK_STATUS    = "ok"
+	ERROR_STATUS = "error"
+)
+
+// Error codes
+const (
+	BAD_REQUEST_ERROR          = "BAD_REQUEST" // malformed message or duplicate request id
+	UNSUPPORTED_VERSION_ERROR  = "UNSUPPORTED_VERSION"
+	INVALID_QUERY_ERROR        = "INVALID_QUERY" // syntax error in the query string
+	INVALID_FILTER_ERROR       = "INVALID_FILTER"
+	INVALID_GROUP_BY_ERROR     = "INVALID_GROUP_BY"
+	UNKNOWN_AGGREGATOR_ERROR   = "UNKNOWN_AGGREGATOR"
+	UNKNOWN_METRIC_ERROR       = "UNKNOWN_METRIC"
+	INVALID_TIME_RANGE_ERROR   = "INVALID_TIME_RANGE"
+	INVALID_SCALE_ERROR        = "INVALID_SCALE"
+	INVALID_TIMEZONE_ERROR     = "INVALID_TIMEZONE"   // unknown IANA timezone name
+	INVALID_WEEK_START_ERROR   = "INVALID_WEEK_START" // unknown week start day
+	INVALID_FILL_ERROR         = "INVALID_FILL"
+	INVALID_FUNCTION_ERROR     = "INVALID_FUNCTION"
+	INVALID_FORMULA_ERROR      = "INVALID_FORMULA"
+	INVALID_COMPARISON_ERROR   = "INVALID_COMPARISON"
+	INVALID_ANOMALY_ERROR      = "INVALID_ANOMALY"
+	INVALID_FORECAST_ERROR     = "INVALID_FORECAST"
+	INVALID_SUBSCRIPTION_ERROR = "INVALID_SUBSCRIPTION"
+	INVALID_EXPORT_ERROR       = "INVALID_EXPORT"    // unknown export format or time format
+	TOO_MANY_REQUESTS_ERROR    = "TOO_MANY_REQUESTS" // too many requests in flight on the connection, or too many open streams
+	CANCELED_ERROR             = "CANCELED"          // request was cancelled or superseded
+	INTERNAL_ERROR             = "INTERNAL"
+)
+
+// Envelope fields of websocket requests
+type RequestEnvelope struct {
+	Version int    `json:"v"`  // protocol version, the current version if not given
+	Id      string `json:"id"` // optional request id chosen by the client, sent back in the response
+}
+
+// Websocket response
+type ResponseEnvelope struct {
+	Version int           `json:"v"`
+	Id      string        `json:"id,omitempty"` // id of the request
+	Status  string        `json:"status"`       // ok or error
+	Error   *Error        `json:"error,omitempty"`
+	Meta    *ResponseMeta `json:"meta,omitempty"`
+	Data    interface{}   `json:"data,omitempty"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// How the getData response was produced
+type ResponseMeta struct {
+	Interval       string  `json:"interval"`       // interval data points were partitioned by
+	Points         int     `json:"points"`         // number of data points in the response
+	RecordsScanned int     `json:"recordsScanned"` // records matching filters, read to compute the response
+	DurationMs     float64 `json:"durationMs"`
+}
+
 // /getData request
 type GetDataRequest struct {
-	Filters    []string `json:"filters"` // in the format of "tagName:tagValue"
-	Scale      string   `json:"scale"`
+	RequestEnvelope
+
+	// Requests on the same connection are processed concurrently. Request in flight can be cancelled by its id,
+	// or superseded by a newer request, in both cases it fails with CANCELED error
+	Cancel     string `json:"cancel"`     // id of the request to cancel, the rest of the request is ignored
+	Supersedes string `json:"supersedes"` // id of the earlier request which is cancelled by this one
+
+	// Query string such as "avg:online.spent{location:Chicago,!gender:F} by {product_category}.rollup(sum, 1w)",
+	// an alternative to filters, aggregator and group by (also scale and fill if it has rollup and fill)
+	Query string `json:"q"`
+
+	Filters    []string `json:"filters"`   // in the format of "tagName:tagValue", "!tagName:tagValue" excludes records
+	GroupBy    []string `json:"groupBy"`   // tag names, data points are computed for every combination of their values
+	Scale      string   `json:"scale"`     // named scale (Daily, Weekly, ...) or interval such as "15m", "6h", "3d", "2w"
+	Timezone   string   `json:"timezone"`  // IANA timezone partitions are aligned in, UTC by default
+	WeekStart  string   `json:"weekStart"` // first day of the week, Sunday by default
 	Aggregator string   `json:"aggregator"`
+	From       int64    `json:"from"`      // optional time range start, epoch millis (inclusive)
+	To         int64    `json:"to"`        // optional time range end, epoch millis (exclusive)
+	MaxPoints  int      `json:"maxPoints"` // points budget of the "auto" scale
+	Fill       string   `json:"fill"`      // how to fill partitions without data: none, zero, null, previous, linear
+
+	Functions []FunctionRequest `json:"functions"` // series functions applied to data points in the given order
+
+	// Formula over named sub-queries, for ex. "a / b * 100". If sub-queries are given, filters and aggregator
+	// of the request are not used, scale, time range and fill are shared by all sub-queries
+	Queries []SubQueryRequest `json:"queries"`
+	Formula string            `json:"formula"`
+
+	// Period-over-period comparison: period, day, week, month, quarter, year or an interval such as "3d"
+	CompareTo string `json:"compareTo"`
+
+	Anomaly  *AnomalyRequest  `json:"anomaly"`  // optional anomaly detection on the result
+	Forecast *ForecastRequest `json:"forecast"` // optional forecast extending the result into the future
+
+	// Live subscription: data points are sent right away, then data points which changed are pushed as new
+	// matching records arrive, but not more often than once per push interval (millis, server limits the minimum)
+	Subscribe    string `json:"subscribe"`   // id of the new subscription, chosen by the client
+	Unsubscribe  string `json:"unsubscribe"` // id of the subscription to cancel, the rest of the request is ignored
+	PushInterval int64  `json:"pushInterval"`
+}
+
+// Anomaly detection parameters, zero values mean defaults
+type AnomalyRequest struct {
+	Algorithm string  `json:"algorithm"` // zscore (default) or seasonal
+	Window    int     `json:"window"`    // zscore: number of previous points, 20 by default
+	Season    int     `json:"season"`    // seasonal: season length in points, 7 by default (day of week on daily data)
+	Threshold float64 `json:"threshold"` // band width in standard deviations, 3 by default
+}
+
+// Holt-Winters forecast parameters, zero values mean defaults
+type ForecastRequest struct {
+	Points     int     `json:"points"`     // number of partitions to forecast
+	Method     string  `json:"method"`     // additive (default) or multiplicative seasonality
+	Season     int     `json:"season"`     // season length in points, 7 by default
+	Alpha      float64 `json:"alpha"`      // level smoothing factor, fitted if not given
+	Beta       float64 `json:"beta"`       // trend smoothing factor, fitted if not given
+	Gamma      float64 `json:"gamma"`      // seasonal smoothing factor, fitted if not given
+	Confidence float64 `json:"confidence"` // prediction interval confidence level, 0.95 by default
+}
+
+// Named sub-query of the formula
+type SubQueryRequest struct {
+	Name       string            `json:"name"`
+	Metric     string            `json:"metric"` // optional, the only metric supported is the dataset metric
+	Filters    []string          `json:"filters"`
+	Aggregator string            `json:"aggregator"`
+	Functions  []FunctionRequest `json:"functions"` // applied before the formula
+}
+
+// Series function applied to aggregated data points, for ex. {"name": "movingAverage", "args": [7]}
+type FunctionRequest struct {
+	Name string    `json:"name"`
+	Args []float64 `json:"args"`
+}
+
+// /getData response
+type GetDataResponse struct {
+	Interval   string          `json:"interval"` // interval data points were partitioned by, for ex. "1d"
+	DataPoints []TimeDataPoint `json:"dataPoints"`
+
+	// Grouped request (groupBy) has data points of every group instead
+	Groups []GroupDataPoints `json:"groups,omitempty"`
+
+	// Subscription pushes: id of the subscription, updates carry only data points changed since the last push
+	SubscriptionId string `json:"subscriptionId,omitempty"`
+	Update         bool   `json:"update,omitempty"`
+}
+
+// Data points of a combination of group by tag values
+type GroupDataPoints struct {
+	Group      map[string]string `json:"group"` // tag name -> tag value
+	DataPoints []TimeDataPoint   `json:"dataPoints"`
 }
 
 // /getFilters request
 type GetFiltersRequest struct {
+	RequestEnvelope
+
 	Query string `json:"query"`
 }
 
+// /ingest response
+type IngestResponse struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"` // errors of the first rejected records only
+}
+
+// Error response, sent back when request can't be processed
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// /api/v1/records response, a page of raw records
+type GetRecordsResponse struct {
+	Records    []RawRecord `json:"records"`
+	Total      int         `json:"total"`                // records matching the filters within the time range
+	NextCursor string      `json:"nextCursor,omitempty"` // cursor of the next page, empty on the last page
+}
+
+// Metric record with its tags, fields which were not requested are left out
+type RawRecord struct {
+	Id        *int              `json:"id,omitempty"`
+	Timestamp *int64            `json:"timestamp,omitempty"` // epoch millis
+	Metric    string            `json:"metric,omitempty"`
+	Value     *float64          `json:"value,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// Prometheus HTTP API response (/api/v1/query_range, /api/v1/labels, /api/v1/label/<name>/values)
+type PromResponse struct {
+	Status    string      `json:"status"` // success or error
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"` // bad_data, canceled, execution or internal
+	Error     string      `json:"error,omitempty"`
+}
+
+// Result of the range query
+type PromMatrix struct {
+	ResultType string             `json:"resultType"` // always matrix
+	Result     []PromMatrixSeries `json:"result"`
+}
+
+type PromMatrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"` // [unix seconds, "value"]
+}
+
 // Data points (response)
 
 func NewTimeDataPoint(timestamp time.Time, value float64) TimeDataPoint {
 	return TimeDataPoint{
 		Timestamp: timestamp.UnixMilli(),
-		Value:     value,
+		Value:     &value,
+	}
+}
+
+// Data point of the time partition without data, its value is null
+func NewEmptyTimeDataPoint(timestamp time.Time) TimeDataPoint {
+	return TimeDataPoint{
+		Timestamp: timestamp.UnixMilli(),
+		Filled:    true,
 	}
 }
 
 type TimeDataPoint struct {
-	Timestamp int64   `json:"timestamp"`
-	Value     float64 `json:"value"`
+	Timestamp int64    `json:"timestamp"`
+	Value     *float64 `json:"value"`            // nil if there is no data
+	Filled    bool     `json:"filled,omitempty"` // time partition had no data, value (if any) is filled in
+
+	// Period-over-period comparison (compareTo), value of the comparison partition and the change since it
+	CompareValue *float64 `json:"compareValue,omitempty"`
+	Delta        *float64 `json:"delta,omitempty"`
+	DeltaPercent *float64 `json:"deltaPercent,omitempty"`
+
+	// Anomaly detection: expected value band, distance from the expected value in standard deviations and
+	// whether the value is outside of the band
+	Lower        *float64 `json:"lower,omitempty"`
+	Upper        *float64 `json:"upper,omitempty"`
+	AnomalyScore *float64 `json:"anomalyScore,omitempty"`
+	Anomaly      bool     `json:"anomaly,omitempty"`
+
+	// Forecasted data point, lower and upper are bounds of its prediction interval
+	Forecast bool `json:"forecast,omitempty"`
+}
+
+func (point TimeDataPoint) HasValue() bool {
+	return point.Value != nil
 }
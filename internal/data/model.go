@@ -10,8 +10,11 @@ package data
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"valery-datadog-datastream-demo/internal/config"
 )
@@ -25,14 +28,34 @@ func FromRequestFilters(requestFilters []string) []*Tag {
 	return tags
 }
 
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Checks request filter strings are name:value pairs of known tags, optionally negated with "!"
+func ValidateRequestFilters(requestFilters []string) error {
+	for _, filter := range requestFilters {
+		name, _, found := strings.Cut(strings.TrimPrefix(filter, "!"), ":")
+		if !found {
+			return fmt.Errorf("%w: %q is not in the tagName:tagValue format", ErrInvalidFilter, filter)
+		}
+		if _, known := config.MetricTagsMetaData[name]; !known {
+			return fmt.Errorf("%w: unknown tag %q", ErrInvalidFilter, name)
+		}
+	}
+	return nil
+}
+
 // Generate metric record and tags from the CSV data record
 func FromCsvDataRecord(csvDataRecord []string) (*MetricRecord, Tags, error) {
+	if len(csvDataRecord) < csvRecordMinLength() {
+		return nil, nil, fmt.Errorf("CSV record has %d fields, expected at least %d", len(csvDataRecord), csvRecordMinLength())
+	}
+
 	id, err := parseInt(csvDataRecord[config.MetricIdColumnIndex])
 	if err != nil {
 		return nil, nil, err
 	}
 
-	timestamp, err := parseDate(csvDataRecord[config.MetricTimestampColumnIndex])
+	timestamp, err := parseTimestamp(csvDataRecord[config.MetricTimestampColumnIndex])
 	if err != nil {
 		return nil, nil, err
 	}
@@ -61,17 +84,31 @@ func FromCsvDataRecord(csvDataRecord []string) (*MetricRecord, Tags, error) {
 		timestamp: timestamp,
 		name:      config.MetricName,
 		value:     metricValue,
+		tags:      tags,
 	}, tags, nil
 }
 
 // *** Main metric data structures ***
 
-// Represent original metric data point without tags i.e. id, time, name, value
+// Create metric record from already parsed fields (used when restoring processor state)
+func NewMetricRecord(id int, timestamp time.Time, name string, value float64) *MetricRecord {
+	return &MetricRecord{
+		id:        id,
+		timestamp: timestamp,
+		name:      name,
+		value:     value,
+	}
+}
+
+// Represent original metric data point i.e. id, time, name, value and its tags. Records are not modified once
+// they are indexed.
 type MetricRecord struct {
 	id        int
 	timestamp time.Time
 	name      string
 	value     float64
+	tags      Tags
+	sequence  uint64 // ingest order within the processor, unique
 }
 
 func (metric *MetricRecord) Id() int {
@@ -90,6 +127,29 @@ func (metric *MetricRecord) MetricValue() float64 {
 	return metric.value
 }
 
+// Tags of the record by name, records have no tags for empty columns
+func (metric *MetricRecord) Tags() Tags {
+	return metric.tags
+}
+
+// Position of the record in the order records were ingested, assigned by the processor before the record is indexed
+func (metric *MetricRecord) Sequence() uint64 {
+	return metric.sequence
+}
+
+// Must not be called once the record is indexed
+func (metric *MetricRecord) SetSequence(sequence uint64) {
+	metric.sequence = sequence
+}
+
+// Adds tag to the record (used when restoring processor state), must not be called once the record is queried
+func (metric *MetricRecord) SetTag(name string, value string) {
+	if metric.tags == nil {
+		metric.tags = make(Tags)
+	}
+	metric.tags[name] = &Tag{name: name, value: value}
+}
+
 // Collection of metrics with additional matching functionality that is necessary for filtering and partitioning
 func NewMetrics() *Metrics {
 	return &Metrics{
@@ -125,18 +185,22 @@ func (metrics *Metrics) Len() int {
 
 // *** Tags ***
 
-// Create Tag from given name:value string
+// Create Tag from given name:value string, "!name:value" excludes records with the tag
 func NewTagForFiltering(keyValueStr string) *Tag {
-	keyValuePair := strings.Split(keyValueStr, ":")
+	excluded := strings.HasPrefix(keyValueStr, "!")
+	keyValuePair := strings.SplitN(strings.TrimPrefix(keyValueStr, "!"), ":", 2)
 	return &Tag{
-		name:  keyValuePair[0],
-		value: keyValuePair[1],
+		name:     keyValuePair[0],
+		value:    keyValuePair[1],
+		excluded: excluded,
 	}
 }
 
 type Tag struct {
 	name  string
 	value string
+	// filter excluding records with the tag
+	excluded bool
 }
 
 func (t *Tag) Name() string {
@@ -147,6 +211,16 @@ func (t *Tag) Value() string {
 	return t.value
 }
 
+func (t *Tag) Excluded() bool {
+	return t.excluded
+}
+
+// Whether record tags pass the filter
+func (t *Tag) Matches(tags Tags) bool {
+	tag, found := tags[t.name]
+	return (found && tag.value == t.value) != t.excluded
+}
+
 func (t *Tag) AsFilter() string {
 	return t.name + ":" + t.value
 }
@@ -156,6 +230,23 @@ type Tags map[string]*Tag
 
 // *** Helper functions ***
 
+// Number of fields CSV record must have to contain all configured columns
+func csvRecordMinLength() int {
+	maxIndex := config.MetricIdColumnIndex
+	if config.MetricValueColumnIndex > maxIndex {
+		maxIndex = config.MetricValueColumnIndex
+	}
+	if config.MetricTimestampColumnIndex > maxIndex {
+		maxIndex = config.MetricTimestampColumnIndex
+	}
+	for _, tagMetaData := range config.MetricTagsMetaData {
+		if tagMetaData.ColumnIndex > maxIndex {
+			maxIndex = tagMetaData.ColumnIndex
+		}
+	}
+	return maxIndex + 1
+}
+
 // Returns error if strField is empty
 func parseFloat64(strField string) (float64, error) {
 	if len(strField) == 0 {
@@ -176,10 +267,91 @@ func parseInt(strField string) (int, error) {
 	return strconv.Atoi(strField)
 }
 
-// Returns error if there is no data to parse
-func parseDate(strField string) (time.Time, error) {
+// Parses timestamp using configured dataset layouts, keeps full precision. Returns error if there is no data
+// to parse or none of the layouts matches
+func parseTimestamp(strField string) (time.Time, error) {
 	if len(strField) == 0 {
 		return time.Now(), errors.New("Metric timestamp field is empty")
 	}
-	return time.Parse("2006-01-02", strField)
+	location := timestampLocation()
+	for _, layout := range config.MetricTimestampLayouts {
+		var timestamp time.Time
+		var err error
+		switch layout {
+		case config.EPOCH_LAYOUT:
+			timestamp, err = parseEpoch(strField, 0)
+		case config.EPOCH_SECONDS_LAYOUT:
+			timestamp, err = parseEpoch(strField, time.Second)
+		case config.EPOCH_MILLIS_LAYOUT:
+			timestamp, err = parseEpoch(strField, time.Millisecond)
+		default:
+			timestamp, err = time.ParseInLocation(layout, strField, location)
+		}
+		if err == nil {
+			return timestamp, nil
+		}
+	}
+	return time.Now(), fmt.Errorf("Metric timestamp %q does not match any of the layouts %v", strField,
+		config.MetricTimestampLayouts)
+}
+
+// Epoch timestamps with this many seconds or more are taken for millis when the unit is not specified (the
+// threshold is year 5138 in seconds and 1973 in millis)
+const epochMillisThreshold = 100_000_000_000
+
+// Parses unix timestamp with optional fraction, for ex. "1546300800" or "1546300800.250". Zero unit means
+// seconds or millis depending on the magnitude
+func parseEpoch(strField string, unit time.Duration) (time.Time, error) {
+	intPart, fractionPart := strField, ""
+	if dotIndex := strings.IndexByte(strField, '.'); dotIndex >= 0 {
+		intPart, fractionPart = strField[:dotIndex], strField[dotIndex+1:]
+	}
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if unit == 0 {
+		unit = time.Second
+		if units >= epochMillisThreshold || units <= -epochMillisThreshold {
+			unit = time.Millisecond
+		}
+	}
+
+	// fraction of the unit, digits beyond nanosecond precision are dropped
+	var fraction time.Duration
+	if len(fractionPart) > 0 {
+		scale := unit
+		for _, digit := range fractionPart {
+			if digit < '0' || digit > '9' {
+				return time.Time{}, fmt.Errorf("invalid epoch timestamp %q", strField)
+			}
+			scale /= 10
+			fraction += time.Duration(digit-'0') * scale
+		}
+		if strings.HasPrefix(intPart, "-") {
+			fraction = -fraction
+		}
+	}
+	if unit == time.Millisecond {
+		return time.Unix(units/1000, int64(units%1000)*int64(time.Millisecond)+int64(fraction)).UTC(), nil
+	}
+	return time.Unix(units, int64(fraction)).UTC(), nil
+}
+
+var (
+	timestampLocationOnce  sync.Once
+	timestampLocationValue *time.Location
+)
+
+// Location of timestamps without zone offset, UTC if configured timezone is unknown
+func timestampLocation() *time.Location {
+	timestampLocationOnce.Do(func() {
+		location, err := time.LoadLocation(config.MetricTimestampTimezone)
+		if err != nil {
+			log.Printf("Unknown metric timestamp timezone %q, using UTC: %v", config.MetricTimestampTimezone, err)
+			location = time.UTC
+		}
+		timestampLocationValue = location
+	})
+	return timestampLocationValue
 }
@@ -10,6 +10,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 type StreamProcessor interface {
@@ -27,10 +29,35 @@ func NewFileDataStream(filePath string) DataStream {
 	return fileDataSource
 }
 
+// Creates file data stream which skips first offset records of the file (not counting the header). Used to replay
+// only the records that came after a processor snapshot. Records are handed over to the given number of workers
+// calling the processor in parallel, so the processor must be safe for concurrent use if workers > 1.
+func NewFileDataStreamFromOffset(filePath string, offset int64, workers int) *FileDataStream {
+	return &FileDataStream{
+		filePath: filePath,
+		offset:   offset,
+		workers:  workers,
+	}
+}
+
 var _ DataStream = (*FileDataStream)(nil)
 
 type FileDataStream struct {
 	filePath string
+	offset   int64 // number of records already read from the file
+	workers  int
+	// called for every row read from the file
+	onRowRead func()
+}
+
+// Returns number of records (excluding the header) that have been read from the file so far
+func (fds *FileDataStream) Offset() int64 {
+	return atomic.LoadInt64(&fds.offset)
+}
+
+// Sets the callback called for every row read from the file, must be set before streaming
+func (fds *FileDataStream) OnRowRead(callback func()) {
+	fds.onRowRead = callback
 }
 
 // Streams data into the processor
@@ -48,6 +75,33 @@ func (fds *FileDataStream) Stream(processor StreamProcessor) {
 		log.Fatalf("Unable to read header from CSV: %v", err)
 	}
 
+	// Skip records which were already streamed before
+	for skipped := int64(0); skipped < fds.Offset(); skipped++ {
+		if _, err := reader.Read(); err != nil {
+			log.Printf("CSV file has fewer records than stream offset %d: %v", fds.Offset(), err)
+			return
+		}
+	}
+
+	// Process records 1 by 1 in every worker, if any processing issues - log error
+	workers := fds.workers
+	if workers < 1 {
+		workers = 1
+	}
+	records := make(chan []string, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range records {
+				if err := processor.Process(record); err != nil {
+					log.Printf("Failed to process CSV record: %v", err)
+				}
+			}
+		}()
+	}
+
 	// Iterate through the records
 	for {
 		record, err := reader.Read()
@@ -57,12 +111,12 @@ func (fds *FileDataStream) Stream(processor StreamProcessor) {
 		if err != nil {
 			log.Fatalf("Unable to read CSV record: %v", err)
 		}
-
-		// Process records 1 by 1, if any processing issues - log error
-		err = processor.Process(record)
-
-		if err != nil {
-			log.Printf("Failed to process CSV record: %v", err)
+		atomic.AddInt64(&fds.offset, 1)
+		if fds.onRowRead != nil {
+			fds.onRowRead()
 		}
+		records <- record
 	}
+	close(records)
+	wg.Wait()
 }
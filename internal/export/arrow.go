@@ -0,0 +1,190 @@
+package export
+
+// Apache Arrow IPC streaming format (https://arrow.apache.org/docs/format/Columnar.html#ipc-streaming-format):
+// schema message, record batch messages of up to ARROW_BATCH_ROWS rows and the end-of-stream marker. Every message
+// is the continuation marker, the length of the FlatBuffers metadata, the metadata and the body with the column
+// buffers. Columns map to Arrow types:
+// * string -> Utf8
+// * time   -> Timestamp in milliseconds, with the timezone of the options
+// * float  -> Float64
+// * bool   -> Bool
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+const ARROW_BATCH_ROWS = 4096
+
+// Arrow IPC metadata constants (Schema.fbs and Message.fbs)
+const (
+	arrowMetadataVersionV5 = 4
+
+	arrowSchemaHeader      = 1
+	arrowRecordBatchHeader = 3
+
+	arrowFloatingPointType = 3
+	arrowUtf8Type          = 5
+	arrowBoolType          = 6
+	arrowTimestampType     = 10
+
+	arrowDoublePrecision = 2
+	arrowMillisecondUnit = 1
+)
+
+const arrowContinuationMarker = 0xFFFFFFFF
+
+// Buffers are padded to 8 bytes in the message body
+const arrowBufferAlignment = 8
+
+func writeArrow(writer io.Writer, table Table, options Options) error {
+	if err := writeArrowMessage(writer, arrowSchemaHeader, arrowSchema(table.Columns, options.Location), nil); err != nil {
+		return err
+	}
+	batch := make([][]interface{}, 0, ARROW_BATCH_ROWS)
+	writeBatch := func() error {
+		header, body := arrowRecordBatch(table.Columns, batch)
+		batch = batch[:0]
+		return writeArrowMessage(writer, arrowRecordBatchHeader, header, body)
+	}
+	err := table.Rows(func(row []interface{}) error {
+		if batch = append(batch, row); len(batch) == ARROW_BATCH_ROWS {
+			return writeBatch()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = writeBatch()
+	}
+	if err != nil {
+		return err
+	}
+	// end of stream
+	_, err = writer.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0})
+	return err
+}
+
+// Writes encapsulated message: continuation marker, metadata length, metadata and body
+func writeArrowMessage(writer io.Writer, headerType uint64, header *fbTable, body []byte) error {
+	message := newFbTable().
+		addScalar(0, 2, arrowMetadataVersionV5).
+		addScalar(1, 1, headerType).
+		addChild(2, header).
+		addScalar(3, 8, uint64(len(body)))
+	metadata := encodeFlatBuffer(message)
+
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prefix, arrowContinuationMarker)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(metadata)))
+	for _, part := range [][]byte{prefix, metadata, body} {
+		if _, err := writer.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func arrowSchema(columns []Column, location *time.Location) *fbTable {
+	fields := make(fbTableVector, len(columns))
+	for i, column := range columns {
+		var typeId uint64
+		arrowType := newFbTable()
+		switch column.Type {
+		case STRING_COLUMN:
+			typeId = arrowUtf8Type
+		case TIME_COLUMN:
+			typeId = arrowTimestampType
+			arrowType.addScalar(0, 2, arrowMillisecondUnit).addChild(1, fbString(location.String()))
+		case FLOAT_COLUMN:
+			typeId = arrowFloatingPointType
+			arrowType.addScalar(0, 2, arrowDoublePrecision)
+		case BOOL_COLUMN:
+			typeId = arrowBoolType
+		}
+		fields[i] = newFbTable().
+			addChild(0, fbString(column.Name)).
+			addScalar(1, 1, 1). // nullable
+			addScalar(2, 1, typeId).
+			addChild(3, arrowType).
+			addChild(5, fbTableVector{}) // no children
+	}
+	return newFbTable().
+		addScalar(0, 2, 0). // little endian
+		addChild(1, fields)
+}
+
+// Builds record batch metadata and body of the rows, column by column: validity bitmap, then the offsets and data
+// of strings or the values
+func arrowRecordBatch(columns []Column, rows [][]interface{}) (*fbTable, []byte) {
+	nodes := make(fbLongPairVector, len(columns))
+	buffers := fbLongPairVector{}
+	body := []byte{}
+	addBuffer := func(buffer []byte) {
+		buffers = append(buffers, [2]int64{int64(len(body)), int64(len(buffer))})
+		body = append(body, buffer...)
+		for len(body)%arrowBufferAlignment != 0 {
+			body = append(body, 0)
+		}
+	}
+
+	for i, column := range columns {
+		validity := make([]byte, (len(rows)+7)/8)
+		nullCount := 0
+		switch column.Type {
+		case STRING_COLUMN:
+			offsets := make([]byte, 4*(len(rows)+1))
+			data := []byte{}
+			for j, row := range rows {
+				setBit(validity, j)
+				data = append(data, row[i].(string)...)
+				binary.LittleEndian.PutUint32(offsets[4*(j+1):], uint32(len(data)))
+			}
+			addBuffer(validity)
+			addBuffer(offsets)
+			addBuffer(data)
+		case TIME_COLUMN:
+			values := make([]byte, 8*len(rows))
+			for j, row := range rows {
+				setBit(validity, j)
+				binary.LittleEndian.PutUint64(values[8*j:], uint64(row[i].(time.Time).UnixMilli()))
+			}
+			addBuffer(validity)
+			addBuffer(values)
+		case FLOAT_COLUMN:
+			values := make([]byte, 8*len(rows))
+			for j, row := range rows {
+				if value := row[i].(*float64); value != nil {
+					setBit(validity, j)
+					binary.LittleEndian.PutUint64(values[8*j:], math.Float64bits(*value))
+				} else {
+					nullCount++
+				}
+			}
+			addBuffer(validity)
+			addBuffer(values)
+		case BOOL_COLUMN:
+			values := make([]byte, (len(rows)+7)/8)
+			for j, row := range rows {
+				setBit(validity, j)
+				if row[i].(bool) {
+					setBit(values, j)
+				}
+			}
+			addBuffer(validity)
+			addBuffer(values)
+		}
+		nodes[i] = [2]int64{int64(len(rows)), int64(nullCount)}
+	}
+
+	header := newFbTable().
+		addScalar(0, 8, uint64(len(rows))).
+		addChild(1, nodes).
+		addChild(2, buffers)
+	return header, body
+}
+
+func setBit(bitmap []byte, i int) {
+	bitmap[i/8] |= 1 << (i % 8)
+}
@@ -0,0 +1,406 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// *** Reader of the Arrow IPC stream, written after the specification independently of the writer ***
+
+// FlatBuffers table: position of the table and of its vtable in the buffer
+type fbReader struct {
+	t      *testing.T
+	buf    []byte
+	pos    int
+	vtable int
+}
+
+func readFbTable(t *testing.T, buf []byte, pos int) fbReader {
+	t.Helper()
+	if pos < 0 || pos+4 > len(buf) || pos%4 != 0 {
+		t.Fatalf("table at %d is out of the buffer or not aligned", pos)
+	}
+	vtable := pos - int(int32(binary.LittleEndian.Uint32(buf[pos:])))
+	if vtable < 0 || vtable+4 > len(buf) || vtable%2 != 0 {
+		t.Fatalf("vtable of the table at %d is at %d", pos, vtable)
+	}
+	table := fbReader{t: t, buf: buf, pos: pos, vtable: vtable}
+	vtableSize, inlineSize := table.uint16(vtable), table.uint16(vtable+2)
+	if vtableSize < 4 || vtableSize%2 != 0 || vtable+vtableSize > len(buf) || pos+inlineSize > len(buf) {
+		t.Fatalf("vtable at %d has size %d, table size %d", vtable, vtableSize, inlineSize)
+	}
+	for id := 0; 4+2*id < vtableSize; id++ {
+		if offset := table.uint16(vtable + 4 + 2*id); offset != 0 && (offset < 4 || offset >= inlineSize) {
+			t.Fatalf("field %d of the table at %d has offset %d out of the table size %d", id, pos, offset, inlineSize)
+		}
+	}
+	return table
+}
+
+func (table fbReader) uint16(pos int) int {
+	return int(binary.LittleEndian.Uint16(table.buf[pos:]))
+}
+
+// Position of the field, 0 if the field is not set. Scalars must be aligned to their size.
+func (table fbReader) field(id int, size int) int {
+	if 4+2*id >= table.uint16(table.vtable) {
+		return 0
+	}
+	offset := table.uint16(table.vtable + 4 + 2*id)
+	if offset == 0 {
+		return 0
+	}
+	pos := table.pos + offset
+	if pos%size != 0 {
+		table.t.Fatalf("field %d of the table at %d is at %d, not aligned to %d", id, table.pos, pos, size)
+	}
+	return pos
+}
+
+func (table fbReader) scalar(id int, size int) uint64 {
+	pos := table.field(id, size)
+	if pos == 0 {
+		return 0
+	}
+	value := make([]byte, 8)
+	copy(value, table.buf[pos:pos+size])
+	return binary.LittleEndian.Uint64(value)
+}
+
+// Position of the referenced object, 0 if the field is not set
+func (table fbReader) ref(id int) int {
+	pos := table.field(id, 4)
+	if pos == 0 {
+		return 0
+	}
+	target := pos + int(binary.LittleEndian.Uint32(table.buf[pos:]))
+	if target >= len(table.buf) {
+		table.t.Fatalf("field %d of the table at %d refers to %d out of the buffer", id, table.pos, target)
+	}
+	return target
+}
+
+func (table fbReader) table(id int) fbReader {
+	pos := table.ref(id)
+	if pos == 0 {
+		table.t.Fatalf("table field %d of the table at %d is not set", id, table.pos)
+	}
+	return readFbTable(table.t, table.buf, pos)
+}
+
+func (table fbReader) string(id int) string {
+	pos := table.ref(id)
+	if pos == 0 {
+		return ""
+	}
+	length := int(binary.LittleEndian.Uint32(table.buf[pos:]))
+	if pos+4+length >= len(table.buf) || table.buf[pos+4+length] != 0 {
+		table.t.Fatalf("string field %d of the table at %d is not zero terminated", id, table.pos)
+	}
+	return string(table.buf[pos+4 : pos+4+length])
+}
+
+func (table fbReader) tables(id int) []fbReader {
+	pos := table.ref(id)
+	if pos == 0 {
+		table.t.Fatalf("vector field %d of the table at %d is not set", id, table.pos)
+	}
+	tables := make([]fbReader, binary.LittleEndian.Uint32(table.buf[pos:]))
+	for i := range tables {
+		element := pos + 4 + 4*i
+		tables[i] = readFbTable(table.t, table.buf, element+int(binary.LittleEndian.Uint32(table.buf[element:])))
+	}
+	return tables
+}
+
+// Vector of structs of two longs (FieldNode, Buffer), structs are aligned to 8 bytes
+func (table fbReader) longPairs(id int) [][2]int64 {
+	pos := table.ref(id)
+	if pos == 0 || (pos+4)%8 != 0 {
+		table.t.Fatalf("struct vector field %d of the table at %d is at %d, elements not aligned to 8", id, table.pos, pos)
+	}
+	pairs := make([][2]int64, binary.LittleEndian.Uint32(table.buf[pos:]))
+	for i := range pairs {
+		element := pos + 4 + 16*i
+		pairs[i] = [2]int64{int64(binary.LittleEndian.Uint64(table.buf[element:])), int64(binary.LittleEndian.Uint64(table.buf[element+8:]))}
+	}
+	return pairs
+}
+
+type arrowField struct {
+	name     string
+	typeId   uint64
+	unit     uint64 // timestamps
+	timezone string // timestamps
+	nullable bool
+}
+
+// Decodes the stream into the schema and the rows, values are of the Go types of the table rows
+func readArrowStream(t *testing.T, stream []byte) ([]arrowField, [][]interface{}, []int) {
+	t.Helper()
+	var fields []arrowField
+	rows := [][]interface{}{}
+	batchSizes := []int{}
+	for pos := 0; ; {
+		if pos+8 > len(stream) || binary.LittleEndian.Uint32(stream[pos:]) != arrowContinuationMarker {
+			t.Fatalf("no continuation marker at %d", pos)
+		}
+		metadataLength := int(int32(binary.LittleEndian.Uint32(stream[pos+4:])))
+		pos += 8
+		if metadataLength == 0 {
+			// end of stream
+			if pos != len(stream) {
+				t.Fatalf("%d bytes after the end of stream", len(stream)-pos)
+			}
+			if fields == nil {
+				t.Fatal("stream has no schema")
+			}
+			return fields, rows, batchSizes
+		}
+		if pos%8 != 0 || metadataLength%8 != 0 || pos+metadataLength > len(stream) {
+			t.Fatalf("metadata at %d of length %d is not padded to 8 bytes", pos, metadataLength)
+		}
+		metadata := stream[pos : pos+metadataLength]
+		pos += metadataLength
+
+		message := readFbTable(t, metadata, int(binary.LittleEndian.Uint32(metadata)))
+		if version := message.scalar(0, 2); version != 4 {
+			t.Fatalf("metadata version %d, want V5 (4)", version)
+		}
+		bodyLength := int(message.scalar(3, 8))
+		if bodyLength%8 != 0 || pos+bodyLength > len(stream) {
+			t.Fatalf("body at %d of length %d is not padded to 8 bytes", pos, bodyLength)
+		}
+		body := stream[pos : pos+bodyLength]
+		pos += bodyLength
+
+		header := message.table(2)
+		switch headerType := message.scalar(1, 1); headerType {
+		case 1: // Schema
+			if fields != nil {
+				t.Fatal("second schema in the stream")
+			}
+			if endianness := header.scalar(0, 2); endianness != 0 {
+				t.Fatalf("endianness %d, want little (0)", endianness)
+			}
+			fields = []arrowField{}
+			for _, field := range header.tables(1) {
+				if children := field.tables(5); len(children) != 0 {
+					t.Fatalf("field %s has %d children", field.string(0), len(children))
+				}
+				arrowType := field.table(3)
+				decoded := arrowField{name: field.string(0), typeId: field.scalar(2, 1), nullable: field.scalar(1, 1) == 1}
+				switch decoded.typeId {
+				case 3: // FloatingPoint
+					if precision := arrowType.scalar(0, 2); precision != 2 {
+						t.Fatalf("field %s has precision %d, want double (2)", decoded.name, precision)
+					}
+				case 10: // Timestamp
+					decoded.unit, decoded.timezone = arrowType.scalar(0, 2), arrowType.string(1)
+				case 5, 6: // Utf8, Bool
+				default:
+					t.Fatalf("field %s has unexpected type %d", decoded.name, decoded.typeId)
+				}
+				fields = append(fields, decoded)
+			}
+		case 3: // RecordBatch
+			if fields == nil {
+				t.Fatal("record batch before the schema")
+			}
+			length := int(header.scalar(0, 8))
+			batchSizes = append(batchSizes, length)
+			rows = append(rows, readArrowBatch(t, fields, length, header.longPairs(1), header.longPairs(2), body)...)
+		default:
+			t.Fatalf("unexpected message header type %d", headerType)
+		}
+	}
+}
+
+func readArrowBatch(t *testing.T, fields []arrowField, length int, nodes [][2]int64, buffers [][2]int64, body []byte) [][]interface{} {
+	t.Helper()
+	if len(nodes) != len(fields) {
+		t.Fatalf("%d field nodes, %d fields", len(nodes), len(fields))
+	}
+	nextBuffer := func(minLength int) []byte {
+		if len(buffers) == 0 {
+			t.Fatal("not enough buffers")
+		}
+		offset, bufferLength := int(buffers[0][0]), int(buffers[0][1])
+		buffers = buffers[1:]
+		if offset%8 != 0 || offset+bufferLength > len(body) || bufferLength < minLength {
+			t.Fatalf("buffer at %d of length %d, at least %d needed, body length %d", offset, bufferLength, minLength, len(body))
+		}
+		return body[offset : offset+bufferLength]
+	}
+	bit := func(bitmap []byte, i int) bool {
+		return bitmap[i/8]&(1<<(i%8)) != 0
+	}
+
+	rows := make([][]interface{}, length)
+	for i := range rows {
+		rows[i] = make([]interface{}, len(fields))
+	}
+	for i, field := range fields {
+		if int(nodes[i][0]) != length {
+			t.Fatalf("field %s has length %d, batch %d", field.name, nodes[i][0], length)
+		}
+		validity := nextBuffer((length + 7) / 8)
+		nullCount := 0
+		for j := 0; j < length; j++ {
+			if !bit(validity, j) {
+				nullCount++
+			}
+		}
+		if int(nodes[i][1]) != nullCount {
+			t.Fatalf("field %s has null count %d, validity bitmap has %d nulls", field.name, nodes[i][1], nullCount)
+		}
+
+		switch field.typeId {
+		case 5:
+			offsets := nextBuffer(4 * (length + 1))
+			data := nextBuffer(0)
+			for j := range rows {
+				start, end := binary.LittleEndian.Uint32(offsets[4*j:]), binary.LittleEndian.Uint32(offsets[4*j+4:])
+				if start > end || int(end) > len(data) || (j == 0 && start != 0) {
+					t.Fatalf("field %s has offsets %d-%d of row %d, data length %d", field.name, start, end, j, len(data))
+				}
+				rows[j][i] = string(data[start:end])
+			}
+		case 10:
+			values := nextBuffer(8 * length)
+			for j := range rows {
+				rows[j][i] = time.UnixMilli(int64(binary.LittleEndian.Uint64(values[8*j:]))).UTC()
+			}
+		case 3:
+			values := nextBuffer(8 * length)
+			for j := range rows {
+				var value *float64
+				if bit(validity, j) {
+					decoded := math.Float64frombits(binary.LittleEndian.Uint64(values[8*j:]))
+					value = &decoded
+				}
+				rows[j][i] = value
+			}
+		case 6:
+			values := nextBuffer((length + 7) / 8)
+			for j := range rows {
+				rows[j][i] = bit(values, j)
+			}
+		}
+	}
+	if len(buffers) != 0 {
+		t.Fatalf("%d buffers left over", len(buffers))
+	}
+	return rows
+}
+
+// *** Tests ***
+
+func testTable(rowsCount int) Table {
+	columns := []Column{
+		{Name: "location", Type: STRING_COLUMN},
+		{Name: "timestamp", Type: TIME_COLUMN},
+		{Name: "value", Type: FLOAT_COLUMN},
+		{Name: "filled", Type: BOOL_COLUMN},
+	}
+	locations := []string{"Chicago", "", "São Paulo", "New York"}
+	start := time.Date(2019, time.March, 10, 0, 0, 0, 0, time.UTC)
+	rows := make([][]interface{}, rowsCount)
+	for i := range rows {
+		var value *float64
+		if i%5 != 3 {
+			v := float64(i) * 1.25
+			value = &v
+		}
+		rows[i] = []interface{}{locations[i%len(locations)], start.Add(time.Duration(i) * time.Hour), value, i%3 == 0}
+	}
+	return Table{Columns: columns, Rows: func(row func([]interface{}) error) error {
+		for _, values := range rows {
+			if err := row(values); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+func tableRows(t *testing.T, table Table) [][]interface{} {
+	t.Helper()
+	rows := [][]interface{}{}
+	if err := table.Rows(func(row []interface{}) error {
+		rows = append(rows, row)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestWriteArrowDecodes(t *testing.T) {
+	location, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rowsCount := range []int{0, 1, 9, ARROW_BATCH_ROWS, 2*ARROW_BATCH_ROWS + 3} {
+		t.Run(fmt.Sprint(rowsCount, " rows"), func(t *testing.T) {
+			table := testTable(rowsCount)
+			var out bytes.Buffer
+			if err := Write(&out, table, Options{Format: ARROW_FORMAT, Location: location}); err != nil {
+				t.Fatal(err)
+			}
+
+			fields, rows, batchSizes := readArrowStream(t, out.Bytes())
+			wantFields := []arrowField{
+				{name: "location", typeId: 5, nullable: true},
+				{name: "timestamp", typeId: 10, unit: 1, timezone: "America/Chicago", nullable: true},
+				{name: "value", typeId: 3, nullable: true},
+				{name: "filled", typeId: 6, nullable: true},
+			}
+			if !reflect.DeepEqual(fields, wantFields) {
+				t.Errorf("schema = %+v, want %+v", fields, wantFields)
+			}
+			if !reflect.DeepEqual(rows, tableRows(t, table)) {
+				t.Errorf("decoded rows differ from the table rows")
+			}
+			for i, size := range batchSizes {
+				if size > ARROW_BATCH_ROWS || size == 0 || (i < len(batchSizes)-1 && size != ARROW_BATCH_ROWS) {
+					t.Errorf("batch sizes = %v", batchSizes)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestWriteArrowGolden(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, testTable(6), Options{Format: ARROW_FORMAT}); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "table.arrow")
+	if *update {
+		if err := os.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("output differs from %s, run the test with -update if the change is intended", golden)
+	}
+	if fields, _, _ := readArrowStream(t, want); fields[1].timezone != "UTC" {
+		t.Errorf("timezone = %q, want UTC", fields[1].timezone)
+	}
+}
@@ -0,0 +1,128 @@
+package export
+
+// Export of query results as a table, in one of the formats analysts load into spreadsheets and dataframes:
+// * csv    - header and a line per row, missing values are empty
+// * ndjson - JSON object per line, missing values are null
+// * arrow  - Apache Arrow IPC stream (record batches), which pandas and polars read without conversion
+// Rows are written as the table produces them, only the rows of an Arrow record batch are held in memory at a time.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidExport = errors.New("invalid export")
+
+// Formats
+const (
+	CSV_FORMAT    = "csv"
+	NDJSON_FORMAT = "ndjson"
+	ARROW_FORMAT  = "arrow"
+)
+
+// Named time formats of the text formats, any other format with a year ("2006") is a Go time layout
+const (
+	RFC3339_TIME_FORMAT       = "rfc3339"
+	EPOCH_MILLIS_TIME_FORMAT  = "epochMillis"
+	EPOCH_SECONDS_TIME_FORMAT = "epochSeconds"
+)
+
+// Column types and the Go types of their values in rows
+const (
+	STRING_COLUMN = "string" // string
+	TIME_COLUMN   = "time"   // time.Time
+	FLOAT_COLUMN  = "float"  // *float64, nil if there is no value
+	BOOL_COLUMN   = "bool"   // bool
+)
+
+type Column struct {
+	Name string
+	Type string
+}
+
+// Rows calls the function with every row in turn and returns its first error, rows have a value of every column
+type Table struct {
+	Columns []Column
+	Rows    func(row func([]interface{}) error) error
+}
+
+// How the table is written
+type Options struct {
+	Format     string
+	TimeFormat string         // text formats only, arrow has native timestamps
+	Location   *time.Location // timezone of the timestamps, UTC if not set
+}
+
+// Checks format and time format, so that invalid options are rejected before the query runs
+func (options Options) Validate() error {
+	switch options.Format {
+	case CSV_FORMAT, NDJSON_FORMAT, ARROW_FORMAT:
+	default:
+		return fmt.Errorf("%w: unknown format %q, expected %s, %s or %s", ErrInvalidExport, options.Format,
+			CSV_FORMAT, NDJSON_FORMAT, ARROW_FORMAT)
+	}
+	switch options.TimeFormat {
+	case "", RFC3339_TIME_FORMAT, EPOCH_MILLIS_TIME_FORMAT, EPOCH_SECONDS_TIME_FORMAT:
+	default:
+		if !strings.Contains(options.TimeFormat, "2006") {
+			return fmt.Errorf("%w: unknown time format %q, expected %s, %s, %s or a Go time layout", ErrInvalidExport,
+				options.TimeFormat, RFC3339_TIME_FORMAT, EPOCH_MILLIS_TIME_FORMAT, EPOCH_SECONDS_TIME_FORMAT)
+		}
+	}
+	return nil
+}
+
+func (options Options) ContentType() string {
+	switch options.Format {
+	case NDJSON_FORMAT:
+		return "application/x-ndjson"
+	case ARROW_FORMAT:
+		return "application/vnd.apache.arrow.stream"
+	default:
+		return "text/csv; charset=utf-8"
+	}
+}
+
+func (options Options) FileExtension() string {
+	return "." + options.Format
+}
+
+// Writes the table in the format of the options
+func Write(writer io.Writer, table Table, options Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	if options.Location == nil {
+		options.Location = time.UTC
+	}
+	switch options.Format {
+	case NDJSON_FORMAT:
+		return writeNDJSON(writer, table, options)
+	case ARROW_FORMAT:
+		return writeArrow(writer, table, options)
+	default:
+		return writeCSV(writer, table, options)
+	}
+}
+
+// Formats timestamp of the text formats, epoch times are numbers
+func formatTime(timestamp time.Time, options Options) (string, bool) {
+	switch options.TimeFormat {
+	case EPOCH_MILLIS_TIME_FORMAT:
+		return strconv.FormatInt(timestamp.UnixMilli(), 10), true
+	case EPOCH_SECONDS_TIME_FORMAT:
+		return strconv.FormatFloat(float64(timestamp.UnixMilli())/1000, 'f', -1, 64), true
+	case "", RFC3339_TIME_FORMAT:
+		return timestamp.In(options.Location).Format(time.RFC3339), false
+	default:
+		return timestamp.In(options.Location).Format(options.TimeFormat), false
+	}
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,184 @@
+package export
+
+// Minimal FlatBuffers (https://flatbuffers.dev) encoder of the Arrow IPC metadata messages, no schema compiler
+// or library needed for the handful of tables involved.
+//
+// Objects are written front to back: a table is written before the objects it refers to, offsets to them are
+// patched in once they are written (offsets of FlatBuffers point forward). Every vtable is written right before
+// its table.
+
+import "encoding/binary"
+
+// Table with scalar fields and references to other objects, field ids are the positions in the schema
+type fbTable struct {
+	fields []fbField
+}
+
+type fbField struct {
+	id    int
+	size  int    // inline size in bytes, 4 for references
+	value uint64 // scalar value
+	child fbObject
+}
+
+type fbObject interface {
+	// Writes the object and returns its position
+	write(builder *fbBuilder) int
+}
+
+type fbString string
+
+type fbTableVector []*fbTable
+
+// Vector of structs of two longs, such as FieldNode and Buffer of Arrow
+type fbLongPairVector [][2]int64
+
+type fbBuilder struct {
+	buf []byte
+}
+
+var _ fbObject = (*fbTable)(nil)
+var _ fbObject = fbString("")
+var _ fbObject = fbTableVector(nil)
+var _ fbObject = fbLongPairVector(nil)
+
+func newFbTable() *fbTable {
+	return &fbTable{}
+}
+
+func (table *fbTable) addScalar(id int, size int, value uint64) *fbTable {
+	table.fields = append(table.fields, fbField{id: id, size: size, value: value})
+	return table
+}
+
+func (table *fbTable) addChild(id int, child fbObject) *fbTable {
+	table.fields = append(table.fields, fbField{id: id, size: 4, child: child})
+	return table
+}
+
+// Encodes buffer with the root table, padded to 8 bytes
+func encodeFlatBuffer(root *fbTable) []byte {
+	builder := &fbBuilder{}
+	builder.putUint32(0)
+	builder.patchOffset(0, root.write(builder))
+	builder.pad(8)
+	return builder.buf
+}
+
+func (table *fbTable) write(builder *fbBuilder) int {
+	// inline layout: vtable offset, then fields in the order they were added, every one aligned to its size
+	slotsCount := 0
+	fieldOffsets := make([]int, len(table.fields))
+	inlineSize := 4
+	for i, field := range table.fields {
+		if field.id+1 > slotsCount {
+			slotsCount = field.id + 1
+		}
+		inlineSize = alignTo(inlineSize, field.size)
+		fieldOffsets[i] = inlineSize
+		inlineSize += field.size
+	}
+
+	// vtable ends where the table starts, 8-aligned for the long fields
+	vtableSize := 4 + 2*slotsCount
+	for (len(builder.buf)+vtableSize)%8 != 0 {
+		builder.buf = append(builder.buf, 0)
+	}
+	vtablePos := len(builder.buf)
+	slots := make([]int, slotsCount)
+	for i, field := range table.fields {
+		slots[field.id] = fieldOffsets[i]
+	}
+	builder.putUint16(vtableSize)
+	builder.putUint16(inlineSize)
+	for _, slot := range slots {
+		builder.putUint16(slot)
+	}
+
+	tablePos := len(builder.buf)
+	builder.putUint32(uint32(tablePos - vtablePos))
+	for i, field := range table.fields {
+		builder.padTo(tablePos + fieldOffsets[i])
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, field.value)
+		builder.buf = append(builder.buf, value[:field.size]...)
+	}
+	builder.padTo(tablePos + inlineSize)
+
+	for i, field := range table.fields {
+		if field.child != nil {
+			builder.patchOffset(tablePos+fieldOffsets[i], field.child.write(builder))
+		}
+	}
+	return tablePos
+}
+
+func (str fbString) write(builder *fbBuilder) int {
+	builder.pad(4)
+	pos := len(builder.buf)
+	builder.putUint32(uint32(len(str)))
+	builder.buf = append(builder.buf, str...)
+	builder.buf = append(builder.buf, 0)
+	return pos
+}
+
+func (vector fbTableVector) write(builder *fbBuilder) int {
+	builder.pad(4)
+	pos := len(builder.buf)
+	builder.putUint32(uint32(len(vector)))
+	for range vector {
+		builder.putUint32(0)
+	}
+	for i, table := range vector {
+		builder.patchOffset(pos+4+4*i, table.write(builder))
+	}
+	return pos
+}
+
+func (vector fbLongPairVector) write(builder *fbBuilder) int {
+	// elements are 8-aligned, they follow the length
+	for (len(builder.buf)+4)%8 != 0 {
+		builder.buf = append(builder.buf, 0)
+	}
+	pos := len(builder.buf)
+	builder.putUint32(uint32(len(vector)))
+	for _, pair := range vector {
+		builder.putUint64(uint64(pair[0]))
+		builder.putUint64(uint64(pair[1]))
+	}
+	return pos
+}
+
+func (builder *fbBuilder) putUint16(value int) {
+	builder.buf = append(builder.buf, 0, 0)
+	binary.LittleEndian.PutUint16(builder.buf[len(builder.buf)-2:], uint16(value))
+}
+
+func (builder *fbBuilder) putUint32(value uint32) {
+	builder.buf = append(builder.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(builder.buf[len(builder.buf)-4:], value)
+}
+
+func (builder *fbBuilder) putUint64(value uint64) {
+	builder.buf = append(builder.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(builder.buf[len(builder.buf)-8:], value)
+}
+
+// Offsets are relative to the position of the offset itself
+func (builder *fbBuilder) patchOffset(pos int, target int) {
+	binary.LittleEndian.PutUint32(builder.buf[pos:], uint32(target-pos))
+}
+
+func (builder *fbBuilder) pad(alignment int) {
+	builder.padTo(alignTo(len(builder.buf), alignment))
+}
+
+func (builder *fbBuilder) padTo(pos int) {
+	for len(builder.buf) < pos {
+		builder.buf = append(builder.buf, 0)
+	}
+}
+
+func alignTo(pos int, alignment int) int {
+	return (pos + alignment - 1) / alignment * alignment
+}
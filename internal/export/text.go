@@ -0,0 +1,102 @@
+package export
+
+// CSV and NDJSON formats
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+func writeCSV(writer io.Writer, table Table, options Options) error {
+	out := csv.NewWriter(writer)
+	header := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		header[i] = column.Name
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(table.Columns))
+	err := table.Rows(func(row []interface{}) error {
+		for i, value := range row {
+			switch value := value.(type) {
+			case string:
+				record[i] = value
+			case time.Time:
+				record[i], _ = formatTime(value, options)
+			case *float64:
+				record[i] = ""
+				if value != nil {
+					record[i] = formatFloat(*value)
+				}
+			case bool:
+				record[i] = strconv.FormatBool(value)
+			}
+		}
+		return out.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Object keys keep the column order, which encoding/json can't do for maps
+func writeNDJSON(writer io.Writer, table Table, options Options) error {
+	out := bufio.NewWriter(writer)
+	keys := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		// strings always marshal
+		encoded, _ := json.Marshal(column.Name)
+		keys[i] = string(encoded) + ":"
+	}
+
+	err := table.Rows(func(row []interface{}) error {
+		out.WriteByte('{')
+		for i, value := range row {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(keys[i])
+			switch value := value.(type) {
+			case string:
+				writeJSONString(out, value)
+			case time.Time:
+				formatted, number := formatTime(value, options)
+				if number {
+					out.WriteString(formatted)
+				} else {
+					writeJSONString(out, formatted)
+				}
+			case *float64:
+				// JSON has no NaN and infinities
+				if value == nil || math.IsNaN(*value) || math.IsInf(*value, 0) {
+					out.WriteString("null")
+				} else {
+					out.WriteString(formatFloat(*value))
+				}
+			case bool:
+				out.WriteString(strconv.FormatBool(value))
+			}
+		}
+		_, err := out.WriteString("}\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func writeJSONString(out *bufio.Writer, value string) {
+	// strings always marshal
+	encoded, _ := json.Marshal(value)
+	out.Write(encoded)
+}
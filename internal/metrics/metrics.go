@@ -0,0 +1,203 @@
+package metrics
+
+// Health metrics of the service: counters, gauges and histograms with labels, exposed in the OpenMetrics text
+// format (see openmetrics.go). Instruments are registered once, usually as package variables of the instrumented
+// package, and are safe for concurrent use. Gauge functions are evaluated on every scrape, for values which are
+// cheaper to compute on demand than to keep up to date (index sizes, runtime memory).
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	COUNTER_TYPE   = "counter"
+	GAUGE_TYPE     = "gauge"
+	HISTOGRAM_TYPE = "histogram"
+)
+
+// Histogram buckets of durations in seconds, from half a millisecond to 10 seconds
+var DurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry of the service metrics, scraped through /metrics
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+type Registry struct {
+	lock     sync.Mutex
+	families []*family
+	names    map[string]bool
+}
+
+// Sample of a gauge function
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Metric with all its label combinations
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	buckets    []float64 // histogram upper bounds, sorted, without +Inf
+
+	lock     sync.Mutex
+	children map[string]*child // by joined label values
+	// gauge function families have no children, samples are collected on scrape
+	collect func() []Sample
+}
+
+// Metric of a single label combination
+type child struct {
+	labelValues []string
+	// counter and gauge value, float64 bits
+	bits uint64
+
+	// histogram state, guarded by the lock
+	lock         sync.Mutex
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+type CounterVec struct{ family *family }
+type GaugeVec struct{ family *family }
+type HistogramVec struct{ family *family }
+
+type Counter struct{ child *child }
+type Gauge struct{ child *child }
+type Histogram struct {
+	child   *child
+	buckets []float64
+}
+
+// Registers counter, name is without the _total suffix
+func (registry *Registry) NewCounter(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{registry.register(&family{name: name, help: help, metricType: COUNTER_TYPE, labelNames: labelNames})}
+}
+
+func (registry *Registry) NewGauge(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{registry.register(&family{name: name, help: help, metricType: GAUGE_TYPE, labelNames: labelNames})}
+}
+
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{registry.register(&family{name: name, help: help, metricType: HISTOGRAM_TYPE, labelNames: labelNames, buckets: sorted})}
+}
+
+// Registers gauge computed on every scrape, samples have values of all label names
+func (registry *Registry) NewGaugeFunc(name string, help string, labelNames []string, collect func() []Sample) {
+	registry.register(&family{name: name, help: help, metricType: GAUGE_TYPE, labelNames: labelNames, collect: collect})
+}
+
+// Metric names are unique, registering one twice is a programming error
+func (registry *Registry) register(f *family) *family {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.names[f.name] {
+		panic(fmt.Sprintf("metric %q is already registered", f.name))
+	}
+	registry.names[f.name] = true
+	f.children = make(map[string]*child)
+	registry.families = append(registry.families, f)
+	return f
+}
+
+// Returns the metric of the label values, creating it on first use
+func (f *family) with(labelValues []string) *child {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %q has labels %v, got values %v", f.name, f.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\x00")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c, found := f.children[key]
+	if !found {
+		c = &child{labelValues: append([]string{}, labelValues...), bucketCounts: make([]uint64, len(f.buckets))}
+		f.children[key] = c
+	}
+	return c
+}
+
+func (vec *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{vec.family.with(labelValues)}
+}
+
+func (vec *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{vec.family.with(labelValues)}
+}
+
+func (vec *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{child: vec.family.with(labelValues), buckets: vec.family.buckets}
+}
+
+func (counter *Counter) Inc() {
+	counter.child.add(1)
+}
+
+// Counters only go up, negative values are ignored
+func (counter *Counter) Add(value float64) {
+	if value > 0 {
+		counter.child.add(value)
+	}
+}
+
+func (gauge *Gauge) Set(value float64) {
+	atomic.StoreUint64(&gauge.child.bits, math.Float64bits(value))
+}
+
+func (gauge *Gauge) Add(value float64) {
+	gauge.child.add(value)
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.child.add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.child.add(-1)
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	c := histogram.child
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, upperBound := range histogram.buckets {
+		if value <= upperBound {
+			c.bucketCounts[i]++
+			break
+		}
+	}
+	c.count++
+	c.sum += value
+}
+
+// Observes seconds elapsed since started
+func (histogram *Histogram) ObserveSince(started time.Time) {
+	histogram.Observe(time.Since(started).Seconds())
+}
+
+func (c *child) add(value float64) {
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&c.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (c *child) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
@@ -0,0 +1,113 @@
+package metrics
+
+// OpenMetrics text exposition format (https://openmetrics.io), which Prometheus scrapes:
+//
+//	# TYPE datastream_rows_ingested counter
+//	# HELP datastream_rows_ingested Rows accepted by the processor.
+//	datastream_rows_ingested_total 5000
+//	# EOF
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const OPEN_METRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Writes all metrics of the registry, label combinations are sorted
+func (registry *Registry) Write(writer io.Writer) error {
+	registry.lock.Lock()
+	families := append([]*family{}, registry.families...)
+	registry.lock.Unlock()
+
+	out := bufio.NewWriter(writer)
+	for _, f := range families {
+		out.WriteString("# TYPE " + f.name + " " + f.metricType + "\n")
+		out.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+		if f.collect != nil {
+			for _, sample := range f.collect() {
+				writeSample(out, f.name, f.labelNames, sample.LabelValues, "", "", sample.Value)
+			}
+			continue
+		}
+		for _, c := range f.sortedChildren() {
+			switch f.metricType {
+			case COUNTER_TYPE:
+				writeSample(out, f.name+"_total", f.labelNames, c.labelValues, "", "", c.value())
+			case GAUGE_TYPE:
+				writeSample(out, f.name, f.labelNames, c.labelValues, "", "", c.value())
+			case HISTOGRAM_TYPE:
+				c.lock.Lock()
+				cumulative := uint64(0)
+				for i, upperBound := range f.buckets {
+					cumulative += c.bucketCounts[i]
+					writeSample(out, f.name+"_bucket", f.labelNames, c.labelValues, "le", formatFloat(upperBound), float64(cumulative))
+				}
+				writeSample(out, f.name+"_bucket", f.labelNames, c.labelValues, "le", "+Inf", float64(c.count))
+				writeSample(out, f.name+"_count", f.labelNames, c.labelValues, "", "", float64(c.count))
+				writeSample(out, f.name+"_sum", f.labelNames, c.labelValues, "", "", c.sum)
+				c.lock.Unlock()
+			}
+		}
+	}
+	out.WriteString("# EOF\n")
+	return out.Flush()
+}
+
+func (f *family) sortedChildren() []*child {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*child, len(keys))
+	for i, key := range keys {
+		children[i] = f.children[key]
+	}
+	return children
+}
+
+// Writes sample line, extra label (histogram "le") is appended to the labels if it has a name
+func writeSample(out *bufio.Writer, name string, labelNames []string, labelValues []string, extraName string, extraValue string, value float64) {
+	out.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		labels := make([]string, 0, len(labelNames)+1)
+		for i, labelName := range labelNames {
+			labels = append(labels, labelName+`="`+escape(labelValues[i], true)+`"`)
+		}
+		if extraName != "" {
+			labels = append(labels, extraName+`="`+extraValue+`"`)
+		}
+		out.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	out.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// Escapes backslashes and new lines, and double quotes of label values
+func escape(value string, quoted bool) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	if quoted {
+		value = strings.ReplaceAll(value, `"`, `\"`)
+	}
+	return value
+}
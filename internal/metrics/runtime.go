@@ -0,0 +1,50 @@
+package metrics
+
+// Go runtime metrics: goroutines, heap and garbage collections
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Memory stats are read at most once per second, so that a scrape stops the world once
+type memStatsCache struct {
+	lock     sync.Mutex
+	stats    runtime.MemStats
+	readTime time.Time
+}
+
+func RegisterRuntimeMetrics(registry *Registry) {
+	registry.NewGaugeFunc("go_goroutines", "Number of goroutines.", nil, func() []Sample {
+		return []Sample{{Value: float64(runtime.NumGoroutine())}}
+	})
+
+	cache := &memStatsCache{}
+	memStatGauges := []struct {
+		name  string
+		help  string
+		value func(stats *runtime.MemStats) float64
+	}{
+		{"go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", func(stats *runtime.MemStats) float64 { return float64(stats.HeapAlloc) }},
+		{"go_memstats_heap_objects", "Number of allocated heap objects.", func(stats *runtime.MemStats) float64 { return float64(stats.HeapObjects) }},
+		{"go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", func(stats *runtime.MemStats) float64 { return float64(stats.Sys) }},
+		{"go_gc_cycles", "Number of completed GC cycles.", func(stats *runtime.MemStats) float64 { return float64(stats.NumGC) }},
+	}
+	for _, gauge := range memStatGauges {
+		value := gauge.value
+		registry.NewGaugeFunc(gauge.name, gauge.help, nil, func() []Sample {
+			return []Sample{{Value: cache.read(value)}}
+		})
+	}
+}
+
+func (cache *memStatsCache) read(value func(stats *runtime.MemStats) float64) float64 {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if time.Since(cache.readTime) > time.Second {
+		runtime.ReadMemStats(&cache.stats)
+		cache.readTime = time.Now()
+	}
+	return value(&cache.stats)
+}
@@ -0,0 +1,365 @@
+package monitor
+
+// Manager keeps monitors, evaluates them on schedule and records their state changes.
+//
+// Monitors are evaluated against the data in the metric processor, the evaluated window ends at the stream time -
+// the timestamp of the latest record. This way monitors follow the data as it arrives, also when the stream
+// carries historical data (as our demo dataset does).
+//
+// Monitor definitions are stored in a JSON file, so they survive restarts. States and history are kept in memory,
+// every monitor starts in NO_DATA state and is evaluated right after start.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+var ErrMonitorNotFound = errors.New("monitor not found")
+
+func NewManager(provider processor.MetricDataProvider, filePath string, tick time.Duration, historyLength int) *Manager {
+	return &Manager{
+		provider:      provider,
+		filePath:      filePath,
+		tick:          tick,
+		historyLength: historyLength,
+		monitors:      make(map[string]*monitorEntry),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+type Manager struct {
+	provider      processor.MetricDataProvider
+	filePath      string
+	tick          time.Duration
+	historyLength int
+
+	lock     sync.RWMutex
+	monitors map[string]*monitorEntry
+	lastId   int
+
+	listenersLock sync.RWMutex
+	listeners     []func(Transition)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type monitorEntry struct {
+	id       string
+	compiled *compiledMonitor
+	// incremented on every update, evaluation results of the previous definition are dropped
+	version        int
+	status         Status
+	history        []Transition
+	nextEvaluation time.Time
+}
+
+// Registers callback called on every monitor state change
+func (manager *Manager) OnStateChange(listener func(Transition)) {
+	manager.listenersLock.Lock()
+	defer manager.listenersLock.Unlock()
+	manager.listeners = append(manager.listeners, listener)
+}
+
+// Loads monitor definitions from the file, missing file means there are no monitors yet
+func (manager *Manager) Load() error {
+	content, err := os.ReadFile(manager.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var stored []storedMonitor
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return fmt.Errorf("monitors file %s: %w", manager.filePath, err)
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	for _, monitor := range stored {
+		compiled, err := compile(monitor.Definition)
+		if err != nil {
+			log.Printf("Skipping invalid monitor %s: %v", monitor.Id, err)
+			continue
+		}
+		manager.monitors[monitor.Id] = newMonitorEntry(monitor.Id, compiled)
+		if id, err := strconv.Atoi(monitor.Id); err == nil && id > manager.lastId {
+			manager.lastId = id
+		}
+	}
+	return nil
+}
+
+// Starts evaluating monitors in background
+func (manager *Manager) Start() {
+	go func() {
+		defer close(manager.done)
+		ticker := time.NewTicker(manager.tick)
+		defer ticker.Stop()
+		for {
+			manager.evaluateDue(time.Now())
+			select {
+			case <-ticker.C:
+			case <-manager.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (manager *Manager) Stop() {
+	close(manager.stop)
+	<-manager.done
+}
+
+// *** CRUD ***
+
+func (manager *Manager) Create(definition Definition) (Monitor, error) {
+	compiled, err := compile(definition)
+	if err != nil {
+		return Monitor{}, err
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.lastId++
+	entry := newMonitorEntry(strconv.Itoa(manager.lastId), compiled)
+	manager.monitors[entry.id] = entry
+	// monitors in memory are the same as in the file, the change is rolled back if the file can't be written
+	if err := manager.save(); err != nil {
+		delete(manager.monitors, entry.id)
+		return Monitor{}, err
+	}
+	return entry.monitor(), nil
+}
+
+func (manager *Manager) Update(id string, definition Definition) (Monitor, error) {
+	compiled, err := compile(definition)
+	if err != nil {
+		return Monitor{}, err
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	entry, found := manager.monitors[id]
+	if !found {
+		return Monitor{}, ErrMonitorNotFound
+	}
+	// new definition is evaluated right away, the state is kept so that hysteresis still applies
+	previous, previousNextEvaluation := entry.compiled, entry.nextEvaluation
+	entry.compiled = compiled
+	entry.version++
+	entry.nextEvaluation = time.Time{}
+	if err := manager.save(); err != nil {
+		entry.compiled, entry.nextEvaluation = previous, previousNextEvaluation
+		entry.version--
+		return Monitor{}, err
+	}
+	return entry.monitor(), nil
+}
+
+func (manager *Manager) Delete(id string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	entry, found := manager.monitors[id]
+	if !found {
+		return ErrMonitorNotFound
+	}
+	delete(manager.monitors, id)
+	if err := manager.save(); err != nil {
+		manager.monitors[id] = entry
+		return err
+	}
+	return nil
+}
+
+func (manager *Manager) Get(id string) (Monitor, error) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+	entry, found := manager.monitors[id]
+	if !found {
+		return Monitor{}, ErrMonitorNotFound
+	}
+	return entry.monitor(), nil
+}
+
+// Returns all monitors ordered by id
+func (manager *Manager) List() []Monitor {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+	monitors := make([]Monitor, 0, len(manager.monitors))
+	for _, entry := range manager.monitors {
+		monitors = append(monitors, entry.monitor())
+	}
+	sort.Slice(monitors, func(i, j int) bool {
+		return monitorIdLess(monitors[i].Id, monitors[j].Id)
+	})
+	return monitors
+}
+
+// Returns state changes of the monitor, the latest first
+func (manager *Manager) History(id string) ([]Transition, error) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+	entry, found := manager.monitors[id]
+	if !found {
+		return nil, ErrMonitorNotFound
+	}
+	history := make([]Transition, len(entry.history))
+	for i, transition := range entry.history {
+		history[len(history)-1-i] = transition
+	}
+	return history, nil
+}
+
+// *** Evaluation ***
+
+// Evaluates monitors whose evaluation time has come
+func (manager *Manager) evaluateDue(now time.Time) {
+	type dueMonitor struct {
+		id       string
+		version  int
+		compiled *compiledMonitor
+	}
+	due := []dueMonitor{}
+	manager.lock.Lock()
+	for _, entry := range manager.monitors {
+		if !entry.nextEvaluation.After(now) {
+			due = append(due, dueMonitor{entry.id, entry.version, entry.compiled})
+			entry.nextEvaluation = now.Add(entry.compiled.evaluationInterval)
+		}
+	}
+	manager.lock.Unlock()
+
+	// queries run without holding the lock, the monitor may be changed or deleted meanwhile
+	for _, monitor := range due {
+		value, windowEnd, found := manager.query(monitor.compiled)
+		manager.applyEvaluation(monitor.id, monitor.version, value, found, windowEnd, now)
+	}
+}
+
+// Aggregates monitor query over the window ending at the stream time
+func (manager *Manager) query(compiled *compiledMonitor) (float64, time.Time, bool) {
+	dataRange := manager.provider.GetMetricTimeRange()
+	if dataRange.IsEmpty() {
+		return 0, time.Time{}, false
+	}
+	window := processor.TimeRange{From: dataRange.To.Add(-compiled.window), To: dataRange.To}
+	filters := data.FromRequestFilters(compiled.Query.Filters)
+	value, found := manager.provider.GetMetricValue(filters, window, compiled.aggregator)
+	return value, window.To, found
+}
+
+func (manager *Manager) applyEvaluation(id string, version int, value float64, found bool, windowEnd time.Time, now time.Time) {
+	manager.lock.Lock()
+	entry, exists := manager.monitors[id]
+	if !exists || entry.version != version {
+		manager.lock.Unlock()
+		return
+	}
+
+	previous := entry.status.State
+	next := NO_DATA_STATE
+	entry.status.Value = nil
+	if found {
+		next = entry.compiled.Condition.nextState(previous, value)
+		entry.status.Value = &value
+	}
+	entry.status.LastEvaluatedAt = now
+	if next == previous {
+		manager.lock.Unlock()
+		return
+	}
+
+	entry.status.State = next
+	entry.status.LastChangedAt = now
+	transition := Transition{
+		MonitorId:   id,
+		MonitorName: entry.compiled.Name,
+		From:        previous,
+		To:          next,
+		Value:       entry.status.Value,
+		WindowEnd:   windowEnd,
+		Timestamp:   now,
+	}
+	entry.history = append(entry.history, transition)
+	if len(entry.history) > manager.historyLength {
+		entry.history = entry.history[len(entry.history)-manager.historyLength:]
+	}
+	manager.lock.Unlock()
+
+	log.Printf("Monitor %s %q changed state %s -> %s", id, transition.MonitorName, previous, next)
+	manager.listenersLock.RLock()
+	defer manager.listenersLock.RUnlock()
+	for _, listener := range manager.listeners {
+		listener(transition)
+	}
+}
+
+// *** Persistence ***
+
+type storedMonitor struct {
+	Id string `json:"id"`
+	Definition
+}
+
+// Writes monitor definitions to the file, callers hold the lock
+func (manager *Manager) save() error {
+	stored := make([]storedMonitor, 0, len(manager.monitors))
+	for _, entry := range manager.monitors {
+		stored = append(stored, storedMonitor{Id: entry.id, Definition: entry.compiled.Definition})
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return monitorIdLess(stored[i].Id, stored[j].Id)
+	})
+	content, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(manager.filePath), 0755); err != nil {
+		return err
+	}
+	tmpPath := manager.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, manager.filePath)
+}
+
+func newMonitorEntry(id string, compiled *compiledMonitor) *monitorEntry {
+	return &monitorEntry{
+		id:       id,
+		compiled: compiled,
+		status:   Status{State: NO_DATA_STATE},
+	}
+}
+
+func (entry *monitorEntry) monitor() Monitor {
+	return Monitor{
+		Id:         entry.id,
+		Definition: entry.compiled.Definition,
+		Status:     entry.status,
+	}
+}
+
+// Ids are sequential numbers, shorter ones go first
+func monitorIdLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,64 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+func testDefinition(name string) Definition {
+	return Definition{
+		Name:               name,
+		Query:              Query{Aggregator: processor.SUM_AGGREGATOR},
+		Condition:          Condition{Comparator: GREATER_COMPARATOR, Critical: 100},
+		Window:             "1d",
+		EvaluationInterval: "1m",
+	}
+}
+
+func TestManagerRollsBackWhenFileCantBeWritten(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "monitors.json")
+	manager := NewManager(nil, filePath, time.Second, 10)
+	created, err := manager.Create(testDefinition("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(filePath)
+
+	// the temporary file can't be written over a directory
+	if err := os.Mkdir(filePath+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Create(testDefinition("second")); err == nil {
+		t.Error("Create succeeded")
+	}
+	if _, err := manager.Update(created.Id, testDefinition("renamed")); err == nil {
+		t.Error("Update succeeded")
+	}
+	if err := manager.Delete(created.Id); err == nil {
+		t.Error("Delete succeeded")
+	}
+
+	monitors := manager.List()
+	if len(monitors) != 1 || monitors[0].Id != created.Id || monitors[0].Name != "first" {
+		t.Errorf("monitors = %+v, want only the first one", monitors)
+	}
+	if content, _ := os.ReadFile(filePath); string(content) != string(saved) {
+		t.Errorf("monitors file changed: %s", content)
+	}
+
+	// ids are not reused
+	if err := os.Remove(filePath + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	next, err := manager.Create(testDefinition("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Id == created.Id {
+		t.Errorf("id %s is reused", next.Id)
+	}
+}
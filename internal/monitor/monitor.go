@@ -0,0 +1,214 @@
+package monitor
+
+// Monitors watch a metric query and tell when it goes wrong. Monitor is defined by
+// * query     - filters and aggregator, the same as in getData requests
+// * window    - query is aggregated over the last window of data, for ex. "7d"
+// * condition - comparator with critical and optional warning thresholds, for ex. avg < 50
+// * evaluation interval - how often the monitor is evaluated
+//
+// Every evaluation puts the monitor into one of the states OK, WARN, ALERT or NO_DATA (no records in the window).
+// Thresholds have hysteresis: once a threshold is breached, the state is kept until the value crosses the recovery
+// threshold, so a value wobbling around the threshold doesn't flap the monitor state.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"valery-datadog-datastream-demo/internal/config"
+	"valery-datadog-datastream-demo/internal/data"
+	"valery-datadog-datastream-demo/internal/processor"
+)
+
+type State string
+
+const (
+	OK_STATE      State = "OK"
+	WARN_STATE    State = "WARN"
+	ALERT_STATE   State = "ALERT"
+	NO_DATA_STATE State = "NO_DATA"
+)
+
+const (
+	GREATER_COMPARATOR       = ">"
+	GREATER_EQUAL_COMPARATOR = ">="
+	LESS_COMPARATOR          = "<"
+	LESS_EQUAL_COMPARATOR    = "<="
+)
+
+var ErrInvalidMonitor = errors.New("invalid monitor")
+
+// Monitor definition, as it is created by users
+type Definition struct {
+	Name               string    `json:"name"`
+	Query              Query     `json:"query"`
+	Condition          Condition `json:"condition"`
+	Window             string    `json:"window"`             // for ex. "1h", "7d", "2w"
+	EvaluationInterval string    `json:"evaluationInterval"` // for ex. "1m", 10s at least
+}
+
+type Query struct {
+	Filters    []string `json:"filters"` // in the format of "tagName:tagValue"
+	Aggregator string   `json:"aggregator"`
+}
+
+// Value is compared with thresholds using comparator, for ex. value < critical. Recovery thresholds are the
+// hysteresis: breached threshold is recovered only when the value doesn't breach the recovery threshold,
+// by default recovery thresholds are the same as the thresholds
+type Condition struct {
+	Comparator       string   `json:"comparator"`
+	Critical         float64  `json:"critical"`
+	Warning          *float64 `json:"warning,omitempty"`
+	CriticalRecovery *float64 `json:"criticalRecovery,omitempty"`
+	WarningRecovery  *float64 `json:"warningRecovery,omitempty"`
+}
+
+// Monitor with its current status
+type Monitor struct {
+	Id string `json:"id"`
+	Definition
+	Status Status `json:"status"`
+}
+
+type Status struct {
+	State           State     `json:"state"`
+	Value           *float64  `json:"value"` // value of the last evaluation, null if there was no data
+	LastEvaluatedAt time.Time `json:"lastEvaluatedAt"`
+	LastChangedAt   time.Time `json:"lastChangedAt"`
+}
+
+// State change of the monitor
+type Transition struct {
+	MonitorId   string    `json:"monitorId"`
+	MonitorName string    `json:"monitorName"`
+	From        State     `json:"from"`
+	To          State     `json:"to"`
+	Value       *float64  `json:"value"`
+	WindowEnd   time.Time `json:"windowEnd"` // end of the evaluated data window
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// Definition parsed into the query parameters
+type compiledMonitor struct {
+	Definition
+	window             time.Duration
+	evaluationInterval time.Duration
+	aggregator         processor.Aggregator
+}
+
+func compile(definition Definition) (*compiledMonitor, error) {
+	if strings.TrimSpace(definition.Name) == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidMonitor)
+	}
+
+	window, err := parseDuration(definition.Window)
+	if err != nil {
+		return nil, fmt.Errorf("%w: window: %v", ErrInvalidMonitor, err)
+	}
+	evaluationInterval, err := parseDuration(definition.EvaluationInterval)
+	if err != nil {
+		return nil, fmt.Errorf("%w: evaluation interval: %v", ErrInvalidMonitor, err)
+	}
+	if evaluationInterval < config.MinMonitorEvalInterval {
+		return nil, fmt.Errorf("%w: evaluation interval must be at least %v", ErrInvalidMonitor, config.MinMonitorEvalInterval)
+	}
+
+	aggregator, err := processor.FromRequestAggregator(definition.Query.Aggregator)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMonitor, err)
+	}
+	if err := data.ValidateRequestFilters(definition.Query.Filters); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMonitor, err)
+	}
+
+	if err := definition.Condition.validate(); err != nil {
+		return nil, err
+	}
+
+	return &compiledMonitor{
+		Definition:         definition,
+		window:             window,
+		evaluationInterval: evaluationInterval,
+		aggregator:         aggregator,
+	}, nil
+}
+
+func (condition Condition) validate() error {
+	switch condition.Comparator {
+	case GREATER_COMPARATOR, GREATER_EQUAL_COMPARATOR, LESS_COMPARATOR, LESS_EQUAL_COMPARATOR:
+	default:
+		return fmt.Errorf("%w: unknown comparator %q", ErrInvalidMonitor, condition.Comparator)
+	}
+	// warning comes before critical, recovery thresholds are on the safe side of their thresholds
+	if condition.Warning != nil && condition.breaches(*condition.Warning, condition.Critical) {
+		return fmt.Errorf("%w: warning threshold must not breach critical threshold", ErrInvalidMonitor)
+	}
+	if condition.CriticalRecovery != nil && condition.breaches(*condition.CriticalRecovery, condition.Critical) {
+		return fmt.Errorf("%w: critical recovery threshold must not breach critical threshold", ErrInvalidMonitor)
+	}
+	if condition.WarningRecovery != nil {
+		if condition.Warning == nil {
+			return fmt.Errorf("%w: warning recovery threshold without warning threshold", ErrInvalidMonitor)
+		}
+		if condition.breaches(*condition.WarningRecovery, *condition.Warning) {
+			return fmt.Errorf("%w: warning recovery threshold must not breach warning threshold", ErrInvalidMonitor)
+		}
+	}
+	return nil
+}
+
+func (condition Condition) breaches(value float64, threshold float64) bool {
+	switch condition.Comparator {
+	case GREATER_COMPARATOR:
+		return value > threshold
+	case GREATER_EQUAL_COMPARATOR:
+		return value >= threshold
+	case LESS_COMPARATOR:
+		return value < threshold
+	default:
+		return value <= threshold
+	}
+}
+
+// Returns the next state for the evaluated value, previous state decides which thresholds apply
+func (condition Condition) nextState(previous State, value float64) State {
+	criticalRecovery := condition.Critical
+	if condition.CriticalRecovery != nil {
+		criticalRecovery = *condition.CriticalRecovery
+	}
+	if condition.breaches(value, condition.Critical) || (previous == ALERT_STATE && condition.breaches(value, criticalRecovery)) {
+		return ALERT_STATE
+	}
+
+	if condition.Warning == nil {
+		return OK_STATE
+	}
+	warningRecovery := *condition.Warning
+	if condition.WarningRecovery != nil {
+		warningRecovery = *condition.WarningRecovery
+	}
+	if condition.breaches(value, *condition.Warning) ||
+		((previous == WARN_STATE || previous == ALERT_STATE) && condition.breaches(value, warningRecovery)) {
+		return WARN_STATE
+	}
+	return OK_STATE
+}
+
+// Parses Go durations ("90s", "15m", "6h") extended with days and weeks ("7d", "2w")
+func parseDuration(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(value, suffix) {
+			count, err := strconv.Atoi(strings.TrimSuffix(value, suffix))
+			if err != nil || count < 1 {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
@@ -0,0 +1,80 @@
+package monitor
+
+import (
+	"fmt"
+	"testing"
+)
+
+func float(value float64) *float64 {
+	return &value
+}
+
+func TestConditionNextStateHysteresis(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		condition Condition
+		values    []float64
+		states    []State
+	}{
+		{
+			"without recovery thresholds",
+			Condition{Comparator: GREATER_COMPARATOR, Critical: 100, Warning: float(80)},
+			[]float64{50, 80, 81, 100, 101, 100, 81, 80},
+			[]State{OK_STATE, OK_STATE, WARN_STATE, WARN_STATE, ALERT_STATE, WARN_STATE, WARN_STATE, OK_STATE},
+		},
+		{
+			"alert is kept until the value recovers",
+			Condition{Comparator: GREATER_COMPARATOR, Critical: 100, CriticalRecovery: float(90)},
+			[]float64{101, 95, 91, 90, 95, 100, 101},
+			[]State{ALERT_STATE, ALERT_STATE, ALERT_STATE, OK_STATE, OK_STATE, OK_STATE, ALERT_STATE},
+		},
+		{
+			"alert recovers into warning",
+			Condition{Comparator: GREATER_COMPARATOR, Critical: 100, Warning: float(80), CriticalRecovery: float(90), WarningRecovery: float(70)},
+			[]float64{101, 90, 75, 70, 75, 81, 75},
+			[]State{ALERT_STATE, WARN_STATE, WARN_STATE, OK_STATE, OK_STATE, WARN_STATE, WARN_STATE},
+		},
+		{
+			"less comparator",
+			Condition{Comparator: LESS_EQUAL_COMPARATOR, Critical: 10, Warning: float(20), CriticalRecovery: float(15), WarningRecovery: float(25)},
+			[]float64{30, 20, 24, 25, 26, 10, 15, 16},
+			[]State{OK_STATE, WARN_STATE, WARN_STATE, WARN_STATE, OK_STATE, ALERT_STATE, ALERT_STATE, WARN_STATE},
+		},
+		{
+			"greater or equal comparator recovers below the recovery threshold",
+			Condition{Comparator: GREATER_EQUAL_COMPARATOR, Critical: 100, CriticalRecovery: float(90)},
+			[]float64{100, 90, 89.9},
+			[]State{ALERT_STATE, ALERT_STATE, OK_STATE},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.condition.validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			state := NO_DATA_STATE
+			for i, value := range test.values {
+				next := test.condition.nextState(state, value)
+				if next != test.states[i] {
+					t.Errorf("%v -> %v: state = %s, want %s", state, value, next, test.states[i])
+				}
+				state = next
+			}
+		})
+	}
+}
+
+func TestConditionValidateRecoveryThresholds(t *testing.T) {
+	for _, condition := range []Condition{
+		{Comparator: GREATER_COMPARATOR, Critical: 100, CriticalRecovery: float(110)},
+		{Comparator: GREATER_COMPARATOR, Critical: 100, Warning: float(120)},
+		{Comparator: LESS_COMPARATOR, Critical: 10, Warning: float(20), WarningRecovery: float(15)},
+		{Comparator: GREATER_COMPARATOR, Critical: 100, WarningRecovery: float(50)},
+		{Comparator: "==", Critical: 100},
+	} {
+		t.Run(fmt.Sprintf("%+v", condition), func(t *testing.T) {
+			if err := condition.validate(); err == nil {
+				t.Error("validate succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package notify
+
+// Delivery of monitor state change notifications to webhooks.
+//
+// Every webhook gets a JSON payload rendered from its template (text/template over monitor.Transition, the
+// default payload is used if there is no template). Deliveries are asynchronous and retried with exponential
+// backoff on network errors, 429 and 5xx responses. Notifications are de-duplicated:
+// * every notification has an id sent in the Idempotency-Key header, so receivers can drop retried duplicates
+// * the same state change of the same monitor is not sent to a webhook again within the de-duplication window
+//   after it was delivered (flapping monitor doesn't flood the chat), failed deliveries don't suppress the next ones
+// Outcome of every delivery is kept in a bounded delivery log.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"valery-datadog-datastream-demo/internal/monitor"
+)
+
+const (
+	DELIVERED_STATUS    = "delivered"
+	FAILED_STATUS       = "failed"
+	DEDUPLICATED_STATUS = "deduplicated"
+	PENDING_STATUS      = "pending"
+)
+
+const defaultPayloadTemplate = `{
+  "monitorId": {{json .MonitorId}},
+  "monitorName": {{json .MonitorName}},
+  "from": {{json .From}},
+  "to": {{json .To}},
+  "value": {{json .Value}},
+  "windowEnd": {{json .WindowEnd}},
+  "timestamp": {{json .Timestamp}},
+  "text": {{json (printf "Monitor %s is %s (was %s)" .MonitorName .To .From)}}
+}`
+
+// Webhook configuration
+type Webhook struct {
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`
+	Template string            `json:"template"` // payload template, default payload if empty
+	Headers  map[string]string `json:"headers"`
+	States   []monitor.State   `json:"states"` // notify only about changes into these states, all if empty
+}
+
+type Options struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	RequestTimeout time.Duration
+	DedupWindow    time.Duration
+	LogLength      int
+}
+
+// Delivery log entry
+type Delivery struct {
+	Id          string        `json:"id"` // notification id, the same for all webhooks
+	Webhook     string        `json:"webhook"`
+	MonitorId   string        `json:"monitorId"`
+	From        monitor.State `json:"from"`
+	To          monitor.State `json:"to"`
+	Status      string        `json:"status"`
+	Attempts    int           `json:"attempts"`
+	StatusCode  int           `json:"statusCode,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	CompletedAt *time.Time    `json:"completedAt,omitempty"`
+
+	dedupKey string
+}
+
+// Loads webhooks from JSON file, missing file means there are no webhooks
+func LoadWebhooks(filePath string) ([]Webhook, error) {
+	content, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []Webhook
+	if err := json.Unmarshal(content, &webhooks); err != nil {
+		return nil, fmt.Errorf("webhooks file %s: %w", filePath, err)
+	}
+	return webhooks, nil
+}
+
+func NewNotifier(webhooks []Webhook, options Options, client *http.Client) (*Notifier, error) {
+	compiled := make([]compiledWebhook, len(webhooks))
+	for i, webhook := range webhooks {
+		if webhook.Name == "" || webhook.URL == "" {
+			return nil, fmt.Errorf("webhook %d: name and url are required", i)
+		}
+		payloadTemplate := webhook.Template
+		if payloadTemplate == "" {
+			payloadTemplate = defaultPayloadTemplate
+		}
+		parsed, err := template.New(webhook.Name).Funcs(templateFuncs).Parse(payloadTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", webhook.Name, err)
+		}
+		compiled[i] = compiledWebhook{Webhook: webhook, template: parsed}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Notifier{
+		webhooks:     compiled,
+		options:      options,
+		client:       client,
+		lastNotified: make(map[string]time.Time),
+		ctx:          ctx,
+		cancel:       cancel,
+	}, nil
+}
+
+type Notifier struct {
+	webhooks []compiledWebhook
+	options  Options
+	client   *http.Client
+
+	lock sync.Mutex
+	// delivery log, the oldest entries are dropped
+	deliveries []*Delivery
+	// time of the last delivered notification by webhook, monitor and state change, entries older than the
+	// de-duplication window are pruned
+	lastNotified map[string]time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type compiledWebhook struct {
+	Webhook
+	template *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		var encoded bytes.Buffer
+		encoder := json.NewEncoder(&encoded)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(value)
+		return strings.TrimSuffix(encoded.String(), "\n"), err
+	},
+}
+
+// Sends notifications about monitor state change to all interested webhooks, returns right away
+func (notifier *Notifier) Notify(transition monitor.Transition) {
+	notificationId := notificationId(transition)
+	for _, webhook := range notifier.webhooks {
+		if !webhook.accepts(transition.To) {
+			continue
+		}
+		delivery := notifier.newDelivery(notificationId, webhook.Name, transition)
+		if delivery.Status == DEDUPLICATED_STATUS {
+			continue
+		}
+		notifier.wg.Add(1)
+		go func(webhook compiledWebhook, delivery *Delivery) {
+			defer notifier.wg.Done()
+			notifier.deliver(webhook, delivery, transition)
+		}(webhook, delivery)
+	}
+}
+
+// Returns the delivery log, the latest first
+func (notifier *Notifier) Deliveries() []Delivery {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	deliveries := make([]Delivery, len(notifier.deliveries))
+	for i, delivery := range notifier.deliveries {
+		deliveries[len(deliveries)-1-i] = *delivery
+	}
+	return deliveries
+}
+
+// Stops retries and waits for deliveries in progress
+func (notifier *Notifier) Stop() {
+	notifier.cancel()
+	notifier.wg.Wait()
+}
+
+// Adds delivery to the log, delivery is marked as deduplicated if the same state change was delivered recently
+func (notifier *Notifier) newDelivery(notificationId string, webhook string, transition monitor.Transition) *Delivery {
+	delivery := &Delivery{
+		Id:        notificationId,
+		Webhook:   webhook,
+		MonitorId: transition.MonitorId,
+		From:      transition.From,
+		To:        transition.To,
+		Status:    PENDING_STATUS,
+		CreatedAt: time.Now(),
+		dedupKey:  webhook + "/" + transition.MonitorId + "/" + string(transition.From) + "/" + string(transition.To),
+	}
+
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	for key, last := range notifier.lastNotified {
+		if delivery.CreatedAt.Sub(last) >= notifier.options.DedupWindow {
+			delete(notifier.lastNotified, key)
+		}
+	}
+	if _, found := notifier.lastNotified[delivery.dedupKey]; found {
+		delivery.Status = DEDUPLICATED_STATUS
+		delivery.CompletedAt = &delivery.CreatedAt
+	}
+
+	notifier.deliveries = append(notifier.deliveries, delivery)
+	if len(notifier.deliveries) > notifier.options.LogLength {
+		notifier.deliveries = notifier.deliveries[len(notifier.deliveries)-notifier.options.LogLength:]
+	}
+	return delivery
+}
+
+func (notifier *Notifier) deliver(webhook compiledWebhook, delivery *Delivery, transition monitor.Transition) {
+	payload, err := webhook.render(transition)
+	if err != nil {
+		notifier.complete(delivery, 0, 0, err)
+		return
+	}
+
+	backoff := notifier.options.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		statusCode, err := notifier.post(webhook, delivery.Id, payload)
+		if err == nil || !retryable(statusCode) || attempt >= notifier.options.MaxAttempts {
+			notifier.complete(delivery, attempt, statusCode, err)
+			return
+		}
+		notifier.update(delivery, attempt, statusCode, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-notifier.ctx.Done():
+			notifier.complete(delivery, attempt, statusCode, fmt.Errorf("stopped while retrying: %w", err))
+			return
+		}
+		backoff *= 2
+		if backoff > notifier.options.MaxBackoff {
+			backoff = notifier.options.MaxBackoff
+		}
+	}
+}
+
+// Posts payload to the webhook, returns error for non 2xx responses
+func (notifier *Notifier) post(webhook compiledWebhook, notificationId string, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(notifier.ctx, notifier.options.RequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Idempotency-Key", notificationId)
+	for name, value := range webhook.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("webhook responded with %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+func (notifier *Notifier) update(delivery *Delivery, attempts int, statusCode int, err error) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	delivery.Attempts = attempts
+	delivery.StatusCode = statusCode
+	delivery.Error = err.Error()
+}
+
+func (notifier *Notifier) complete(delivery *Delivery, attempts int, statusCode int, err error) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	now := time.Now()
+	delivery.Attempts = attempts
+	delivery.StatusCode = statusCode
+	delivery.CompletedAt = &now
+	if err != nil {
+		delivery.Status = FAILED_STATUS
+		delivery.Error = err.Error()
+		log.Printf("Failed to deliver notification %s to webhook %s: %v", delivery.Id, delivery.Webhook, err)
+		return
+	}
+	delivery.Status = DELIVERED_STATUS
+	delivery.Error = ""
+	// the window starts with the state change, not with the end of the retries
+	if notifier.options.DedupWindow > 0 {
+		notifier.lastNotified[delivery.dedupKey] = delivery.CreatedAt
+	}
+}
+
+func (webhook compiledWebhook) accepts(state monitor.State) bool {
+	if len(webhook.States) == 0 {
+		return true
+	}
+	for _, accepted := range webhook.States {
+		if accepted == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Renders payload, rendered template must be a valid JSON
+func (webhook compiledWebhook) render(transition monitor.Transition) ([]byte, error) {
+	var payload bytes.Buffer
+	if err := webhook.template.Execute(&payload, transition); err != nil {
+		return nil, fmt.Errorf("rendering payload: %w", err)
+	}
+	if !json.Valid(payload.Bytes()) {
+		return nil, errors.New("rendered payload is not a valid JSON")
+	}
+	return payload.Bytes(), nil
+}
+
+// Network errors (no status code), too many requests and server errors are retried
+func retryable(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// Notification id is derived from the state change, so the same change always has the same id
+func notificationId(transition monitor.Transition) string {
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s/%s/%s/%d", transition.MonitorId, transition.From, transition.To,
+		transition.Timestamp.UnixNano())))
+	return hex.EncodeToString(hash[:8])
+}
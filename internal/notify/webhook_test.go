@@ -0,0 +1,235 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/monitor"
+)
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// Webhook receiver responding with the given status codes in turn, the last one repeats
+func newTestReceiver(t *testing.T, statusCodes ...int) (*httptest.Server, func() []receivedRequest) {
+	t.Helper()
+	var lock sync.Mutex
+	received := []receivedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		lock.Lock()
+		received = append(received, receivedRequest{header: request.Header.Clone(), body: body, at: time.Now()})
+		statusCode := statusCodes[len(statusCodes)-1]
+		if len(received) <= len(statusCodes) {
+			statusCode = statusCodes[len(received)-1]
+		}
+		lock.Unlock()
+		writer.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []receivedRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]receivedRequest(nil), received...)
+	}
+}
+
+func newTestNotifier(t *testing.T, webhook Webhook, options Options) *Notifier {
+	t.Helper()
+	if options.MaxAttempts == 0 {
+		options.MaxAttempts = 1
+	}
+	options.RequestTimeout = time.Second
+	options.LogLength = 10
+	notifier, err := NewNotifier([]Webhook{webhook}, options, &http.Client{})
+	if err != nil {
+		t.Fatalf("NewNotifier: %v", err)
+	}
+	t.Cleanup(notifier.Stop)
+	return notifier
+}
+
+func testTransition(timestamp time.Time) monitor.Transition {
+	value := 42.5
+	return monitor.Transition{
+		MonitorId:   "m1",
+		MonitorName: "High \"spend\"",
+		From:        monitor.OK_STATE,
+		To:          monitor.ALERT_STATE,
+		Value:       &value,
+		WindowEnd:   timestamp,
+		Timestamp:   timestamp,
+	}
+}
+
+// Waits for the deliveries in progress without stopping retries
+func waitDeliveries(notifier *Notifier) {
+	notifier.wg.Wait()
+}
+
+func TestNotifyRendersTemplate(t *testing.T) {
+	server, received := newTestReceiver(t, http.StatusOK)
+	notifier := newTestNotifier(t, Webhook{
+		Name:     "chat",
+		URL:      server.URL,
+		Template: `{"text": {{json (printf "%s went %s" .MonitorName .To)}}, "value": {{json .Value}}}`,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	}, Options{})
+
+	notifier.Notify(testTransition(time.Now()))
+	waitDeliveries(notifier)
+
+	requests := received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	var payload struct {
+		Text  string  `json:"text"`
+		Value float64 `json:"value"`
+	}
+	if err := json.Unmarshal(requests[0].body, &payload); err != nil {
+		t.Fatalf("payload %s is not a valid JSON: %v", requests[0].body, err)
+	}
+	if want := `High "spend" went ALERT`; payload.Text != want || payload.Value != 42.5 {
+		t.Errorf("payload = %+v, want text %q and value 42.5", payload, want)
+	}
+	if got := requests[0].header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization header = %q", got)
+	}
+	if got := requests[0].header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type header = %q", got)
+	}
+	if deliveries := notifier.Deliveries(); deliveries[0].Status != DELIVERED_STATUS {
+		t.Errorf("delivery = %+v, want delivered", deliveries[0])
+	}
+}
+
+func TestNotifyRetriesServerErrorsWithBackoff(t *testing.T) {
+	server, received := newTestReceiver(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	notifier := newTestNotifier(t, Webhook{Name: "chat", URL: server.URL}, Options{
+		MaxAttempts:    5,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	})
+
+	notifier.Notify(testTransition(time.Now()))
+	waitDeliveries(notifier)
+
+	requests := received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(requests))
+	}
+	// backoff doubles: 20ms, then 40ms
+	for i, minDelay := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if delay := requests[i+1].at.Sub(requests[i].at); delay < minDelay {
+			t.Errorf("attempt %d came after %v, want at least %v", i+2, delay, minDelay)
+		}
+	}
+	key := requests[0].header.Get("Idempotency-Key")
+	if key == "" {
+		t.Fatal("Idempotency-Key header is missing")
+	}
+	for i, request := range requests {
+		if got := request.header.Get("Idempotency-Key"); got != key {
+			t.Errorf("attempt %d has Idempotency-Key %q, want %q", i+1, got, key)
+		}
+	}
+
+	delivery := notifier.Deliveries()[0]
+	if delivery.Status != DELIVERED_STATUS || delivery.Attempts != 3 || delivery.Id != key {
+		t.Errorf("delivery = %+v, want delivered in 3 attempts with id %s", delivery, key)
+	}
+}
+
+func TestNotifyDoesNotRetryClientErrors(t *testing.T) {
+	server, received := newTestReceiver(t, http.StatusBadRequest)
+	notifier := newTestNotifier(t, Webhook{Name: "chat", URL: server.URL}, Options{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+
+	notifier.Notify(testTransition(time.Now()))
+	waitDeliveries(notifier)
+
+	if requests := received(); len(requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(requests))
+	}
+	if delivery := notifier.Deliveries()[0]; delivery.Status != FAILED_STATUS || delivery.StatusCode != http.StatusBadRequest {
+		t.Errorf("delivery = %+v, want failed with 400", delivery)
+	}
+}
+
+func TestNotifyDeduplicatesWithinWindow(t *testing.T) {
+	server, received := newTestReceiver(t, http.StatusOK)
+	notifier := newTestNotifier(t, Webhook{Name: "chat", URL: server.URL}, Options{DedupWindow: time.Hour})
+
+	now := time.Now()
+	notifier.Notify(testTransition(now))
+	waitDeliveries(notifier)
+	// flapping back into the same state
+	notifier.Notify(testTransition(now.Add(time.Second)))
+	waitDeliveries(notifier)
+
+	if requests := received(); len(requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(requests))
+	}
+	deliveries := notifier.Deliveries()
+	if len(deliveries) != 2 || deliveries[0].Status != DEDUPLICATED_STATUS || deliveries[1].Status != DELIVERED_STATUS {
+		t.Errorf("deliveries = %+v, want deduplicated after delivered", deliveries)
+	}
+
+	// another state change is not a duplicate
+	transition := testTransition(now.Add(2 * time.Second))
+	transition.From, transition.To = monitor.ALERT_STATE, monitor.OK_STATE
+	notifier.Notify(transition)
+	waitDeliveries(notifier)
+	if requests := received(); len(requests) != 2 {
+		t.Errorf("got %d requests, want 2", len(requests))
+	}
+}
+
+func TestNotifyFailedDeliveryDoesNotSuppressNext(t *testing.T) {
+	server, received := newTestReceiver(t, http.StatusBadRequest, http.StatusOK)
+	notifier := newTestNotifier(t, Webhook{Name: "chat", URL: server.URL}, Options{DedupWindow: time.Hour})
+
+	now := time.Now()
+	notifier.Notify(testTransition(now))
+	waitDeliveries(notifier)
+	notifier.Notify(testTransition(now.Add(time.Second)))
+	waitDeliveries(notifier)
+
+	if requests := received(); len(requests) != 2 {
+		t.Errorf("got %d requests, want 2", len(requests))
+	}
+	deliveries := notifier.Deliveries()
+	if deliveries[0].Status != DELIVERED_STATUS || deliveries[1].Status != FAILED_STATUS {
+		t.Errorf("deliveries = %+v, want delivered after failed", deliveries)
+	}
+}
+
+func TestNotifyPrunesExpiredDedupEntries(t *testing.T) {
+	server, _ := newTestReceiver(t, http.StatusOK)
+	notifier := newTestNotifier(t, Webhook{Name: "chat", URL: server.URL}, Options{DedupWindow: 10 * time.Millisecond})
+
+	notifier.Notify(testTransition(time.Now()))
+	waitDeliveries(notifier)
+	time.Sleep(20 * time.Millisecond)
+	transition := testTransition(time.Now())
+	transition.MonitorId = "m2"
+	notifier.Notify(transition)
+	waitDeliveries(notifier)
+
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	if _, found := notifier.lastNotified["chat/m1/OK/ALERT"]; found || len(notifier.lastNotified) != 1 {
+		t.Errorf("lastNotified = %v, want only the entry of m2", notifier.lastNotified)
+	}
+}
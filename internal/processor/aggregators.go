@@ -2,8 +2,13 @@ package processor
 
 // Aggregator functions, used to aggregate batches of time-partitioned data as a final step of data-point preparation.
 // We support several types of aggregators here. Potentially, we can make complicated custom aggregators as well.
+//
+// Records are first reduced into AggregateState, which can be computed on parts of the data (for ex. per shard)
+// and merged. Aggregator then turns the merged state into the final data point.
 
 import (
+	"errors"
+	"fmt"
 	"time"
 	"valery-datadog-datastream-demo/internal/data"
 )
@@ -14,39 +19,54 @@ const (
 	AVG_AGGREGATOR   = "Avg"
 )
 
-func FromRequestAggregator(aggregator string) Aggregator {
+var ErrUnknownAggregator = errors.New("unknown aggregator")
+
+// Count is the default aggregator
+func FromRequestAggregator(aggregator string) (Aggregator, error) {
 	switch aggregator {
 	case SUM_AGGREGATOR:
-		return SumAggregator
+		return SumAggregator, nil
 	case AVG_AGGREGATOR:
-		return AvgAggregator
-	case COUNT_AGGREGATOR:
-		return CountAggregator
+		return AvgAggregator, nil
+	case COUNT_AGGREGATOR, "":
+		return CountAggregator, nil
 	default:
-		return CountAggregator
+		return nil, fmt.Errorf("%w %q", ErrUnknownAggregator, aggregator)
 	}
 }
 
-type Aggregator func(time.Time, []*data.MetricRecord) data.TimeDataPoint
+type Aggregator func(time.Time, *AggregateState) data.TimeDataPoint
 
-func CountAggregator(timestamp time.Time, metrics []*data.MetricRecord) data.TimeDataPoint {
-	return data.NewTimeDataPoint(timestamp, float64(len(metrics)))
+func NewAggregateState() *AggregateState {
+	return &AggregateState{}
 }
 
-func SumAggregator(timestamp time.Time, metrics []*data.MetricRecord) data.TimeDataPoint {
-	var sum = 0.0
-	for _, m := range metrics {
-		sum += m.MetricValue()
-	}
-	return data.NewTimeDataPoint(timestamp, roundTo2DecimalPoints(sum))
+// Partial aggregate of a batch of metric records
+type AggregateState struct {
+	Count int
+	Sum   float64
 }
 
-func AvgAggregator(timestamp time.Time, metrics []*data.MetricRecord) data.TimeDataPoint {
-	var sum = 0.0
-	for _, m := range metrics {
-		sum += m.MetricValue()
-	}
-	return data.NewTimeDataPoint(timestamp, roundTo2DecimalPoints(sum/float64(len(metrics))))
+func (state *AggregateState) Add(metric *data.MetricRecord) {
+	state.Count++
+	state.Sum += metric.MetricValue()
+}
+
+func (state *AggregateState) Merge(other *AggregateState) {
+	state.Count += other.Count
+	state.Sum += other.Sum
+}
+
+func CountAggregator(timestamp time.Time, state *AggregateState) data.TimeDataPoint {
+	return data.NewTimeDataPoint(timestamp, float64(state.Count))
+}
+
+func SumAggregator(timestamp time.Time, state *AggregateState) data.TimeDataPoint {
+	return data.NewTimeDataPoint(timestamp, roundTo2DecimalPoints(state.Sum))
+}
+
+func AvgAggregator(timestamp time.Time, state *AggregateState) data.TimeDataPoint {
+	return data.NewTimeDataPoint(timestamp, roundTo2DecimalPoints(state.Sum/float64(state.Count)))
 }
 
 func roundTo2DecimalPoints(value float64) float64 {
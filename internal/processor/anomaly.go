@@ -0,0 +1,207 @@
+package processor
+
+// Anomaly detection on query results. Detector computes the expected value band for every data point and flags
+// points outside of it. The score is the distance from the expected value in standard deviations.
+//
+// Two detectors are supported:
+// * zscore   - rolling z-score, expected value and deviation are the mean and standard deviation of the previous
+//              N values
+// * seasonal - classical seasonal decomposition: trend is the centered moving average over the season, seasonal
+//              component is the average detrended value of the same season position (for ex. day of week on
+//              daily data), deviation is estimated from residuals using median absolute deviation
+//
+// Season positions are counted by data points, so seasonal detector expects series without gaps (use fill).
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+const (
+	ZSCORE_ANOMALY   = "zscore"
+	SEASONAL_ANOMALY = "seasonal"
+)
+
+const (
+	DEFAULT_ANOMALY_WINDOW    = 20
+	DEFAULT_ANOMALY_SEASON    = 7
+	DEFAULT_ANOMALY_THRESHOLD = 3.0
+)
+
+var ErrInvalidAnomaly = errors.New("invalid anomaly detection")
+
+// Creates anomaly detector from request, returns nil if anomaly detection is not requested
+func FromRequestAnomaly(anomaly *data.AnomalyRequest) (SeriesFunction, error) {
+	if anomaly == nil {
+		return nil, nil
+	}
+	threshold := anomaly.Threshold
+	if threshold == 0 {
+		threshold = DEFAULT_ANOMALY_THRESHOLD
+	}
+	if threshold < 0 {
+		return nil, fmt.Errorf("%w: threshold must be positive", ErrInvalidAnomaly)
+	}
+
+	switch anomaly.Algorithm {
+	case ZSCORE_ANOMALY, "":
+		window := anomaly.Window
+		if window == 0 {
+			window = DEFAULT_ANOMALY_WINDOW
+		}
+		if window < 2 {
+			return nil, fmt.Errorf("%w: window must be at least 2 points", ErrInvalidAnomaly)
+		}
+		return ZScoreDetector(window, threshold), nil
+	case SEASONAL_ANOMALY:
+		season := anomaly.Season
+		if season == 0 {
+			season = DEFAULT_ANOMALY_SEASON
+		}
+		if season < 2 {
+			return nil, fmt.Errorf("%w: season must be at least 2 points", ErrInvalidAnomaly)
+		}
+		return SeasonalDetector(season, threshold), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown algorithm %q", ErrInvalidAnomaly, anomaly.Algorithm)
+	}
+}
+
+// Compares every value with the mean and standard deviation of the previous window values
+func ZScoreDetector(window int, threshold float64) SeriesFunction {
+	return func(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+		detected := append([]data.TimeDataPoint{}, dataPoints...)
+		previous := []float64{}
+		for i, point := range dataPoints {
+			if !point.HasValue() {
+				continue
+			}
+			if len(previous) >= 2 {
+				expected := mean(previous)
+				setAnomalyBand(&detected[i], expected, standardDeviation(previous, expected), threshold)
+			}
+			previous = append(previous, *point.Value)
+			if len(previous) > window {
+				previous = previous[1:]
+			}
+		}
+		return detected
+	}
+}
+
+func SeasonalDetector(season int, threshold float64) SeriesFunction {
+	return func(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+		detected := append([]data.TimeDataPoint{}, dataPoints...)
+		// at least two full seasons are needed to tell seasonality from trend
+		if len(dataPoints) < 2*season {
+			return detected
+		}
+
+		trend := seasonalTrend(dataPoints, season)
+
+		// seasonal component: average detrended value per season position, centered around zero
+		seasonalSums := make([]float64, season)
+		seasonalCounts := make([]int, season)
+		for i, point := range dataPoints {
+			if point.HasValue() {
+				seasonalSums[i%season] += *point.Value - trend[i]
+				seasonalCounts[i%season]++
+			}
+		}
+		seasonal := make([]float64, season)
+		for position := range seasonal {
+			if seasonalCounts[position] > 0 {
+				seasonal[position] = seasonalSums[position] / float64(seasonalCounts[position])
+			}
+		}
+		seasonalMean := mean(seasonal)
+		for position := range seasonal {
+			seasonal[position] -= seasonalMean
+		}
+
+		// deviation of residuals, median absolute deviation is not skewed by the anomalies themselves
+		residuals := []float64{}
+		for i, point := range dataPoints {
+			if point.HasValue() {
+				residuals = append(residuals, *point.Value-trend[i]-seasonal[i%season])
+			}
+		}
+		if len(residuals) == 0 {
+			return detected
+		}
+		residualMedian := median(residuals)
+		deviations := make([]float64, len(residuals))
+		for i, residual := range residuals {
+			deviations[i] = math.Abs(residual - residualMedian)
+		}
+		sigma := 1.4826 * median(deviations)
+
+		for i, point := range dataPoints {
+			if point.HasValue() {
+				setAnomalyBand(&detected[i], trend[i]+seasonal[i%season]+residualMedian, sigma, threshold)
+			}
+		}
+		return detected
+	}
+}
+
+// Centered moving average over the season, edges of the series take the nearest computed trend value
+func seasonalTrend(dataPoints []data.TimeDataPoint, season int) []float64 {
+	trend := make([]float64, len(dataPoints))
+	computed := make([]bool, len(dataPoints))
+	half := season / 2
+	for i := half; i+season-half <= len(dataPoints); i++ {
+		values := []float64{}
+		for _, point := range dataPoints[i-half : i-half+season] {
+			if point.HasValue() {
+				values = append(values, *point.Value)
+			}
+		}
+		if len(values) > 0 {
+			trend[i] = mean(values)
+			computed[i] = true
+		}
+	}
+
+	// gaps and the end of the series take the last computed value, the beginning - the first computed one
+	first, last := -1, -1
+	for i := range trend {
+		if computed[i] {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		} else if last >= 0 {
+			trend[i] = trend[last]
+		}
+	}
+	for i := 0; i < first; i++ {
+		trend[i] = trend[first]
+	}
+	return trend
+}
+
+// Sets expected value band and anomaly score of the data point with value
+func setAnomalyBand(point *data.TimeDataPoint, expected float64, sigma float64, threshold float64) {
+	point.Lower = floatPtr(expected - threshold*sigma)
+	point.Upper = floatPtr(expected + threshold*sigma)
+	if sigma == 0 {
+		// no deviation at all - any different value is an anomaly, but the score is undefined
+		point.Anomaly = *point.Value != expected
+		return
+	}
+	score := (*point.Value - expected) / sigma
+	point.AnomalyScore = floatPtr(score)
+	point.Anomaly = math.Abs(score) > threshold
+}
+
+// Sample standard deviation of values around their average
+func standardDeviation(values []float64, average float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += (value - average) * (value - average)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
@@ -0,0 +1,96 @@
+package processor
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestZScoreDetector(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		window    int
+		values    []float64
+		anomalies []bool
+	}{
+		// the first two values have no band, the window is never filled
+		{"window longer than the series", 100, []float64{10, 11, 10, 11, 10, 40}, []bool{false, false, false, false, false, true}},
+		{"sliding window", 3, []float64{10, 11, 10, 11, 10, 40, 41, 40, 41}, []bool{false, false, false, false, false, true, false, false, false}},
+		// no deviation: any other value is an anomaly
+		{"constant values", 5, []float64{7, 7, 7, 8}, []bool{false, false, false, true}},
+		{"single value", 5, []float64{7}, []bool{false}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			detected := ZScoreDetector(test.window, 3)(testDailySeries(test.values...))
+			for i, point := range detected {
+				if point.Anomaly != test.anomalies[i] {
+					t.Errorf("point %d (%v): anomaly = %v, want %v", i, test.values[i], point.Anomaly, test.anomalies[i])
+				}
+				if hasBand := point.Lower != nil && point.Upper != nil; hasBand != (i >= 2) {
+					t.Errorf("point %d: band %v - %v", i, point.Lower, point.Upper)
+				}
+			}
+		})
+	}
+
+	// expected value and deviation of the previous values
+	detected := ZScoreDetector(2, 2)(testDailySeries(1, 3, 8))
+	if math.Abs(*detected[2].Lower-(2-2*math.Sqrt2)) > 1e-9 || math.Abs(*detected[2].Upper-(2+2*math.Sqrt2)) > 1e-9 ||
+		math.Abs(*detected[2].AnomalyScore-6/math.Sqrt2) > 1e-9 {
+		t.Errorf("band %v - %v, score %v", *detected[2].Lower, *detected[2].Upper, *detected[2].AnomalyScore)
+	}
+}
+
+func TestSeasonalDetector(t *testing.T) {
+	// season of 4 points with some noise and a spike
+	values := []float64{}
+	for i := 0; i < 28; i++ {
+		values = append(values, []float64{10, 20, 30, 20}[i%4]+float64(i%3)-1)
+	}
+	spike := 13
+	values[spike] += 40
+
+	detected := SeasonalDetector(4, 3)(testDailySeries(values...))
+	for i, point := range detected {
+		if point.AnomalyScore == nil || point.Lower == nil || point.Upper == nil {
+			t.Fatalf("point %d has no band or score", i)
+		}
+		if math.Abs(*point.AnomalyScore) >= *detected[spike].AnomalyScore && i != spike {
+			t.Errorf("point %d: score %v, the spike has %v", i, *point.AnomalyScore, *detected[spike].AnomalyScore)
+		}
+		// the spike shifts the trend of the points within half a season
+		if nearSpike := i >= spike-2 && i <= spike+2; point.Anomaly && !nearSpike || i == spike && !point.Anomaly {
+			t.Errorf("point %d (%v): anomaly = %v", i, values[i], point.Anomaly)
+		}
+	}
+
+	// season longer than the series, at least two seasons are needed
+	for _, season := range []int{15, 100} {
+		for i, point := range SeasonalDetector(season, 3)(testDailySeries(values...)) {
+			if point.Anomaly || point.AnomalyScore != nil || point.Lower != nil {
+				t.Errorf("season %d, point %d: %+v, want no band", season, i, point)
+			}
+		}
+	}
+
+	// gaps keep no band
+	withGap := testDailySeries(values...)
+	withGap[5] = data.TimeDataPoint{Timestamp: withGap[5].Timestamp}
+	if point := SeasonalDetector(4, 3)(withGap)[5]; point.Lower != nil || point.Anomaly {
+		t.Errorf("point without value: %+v", point)
+	}
+}
+
+func TestFromRequestAnomalyErrors(t *testing.T) {
+	for _, request := range []data.AnomalyRequest{
+		{Algorithm: "prophet"},
+		{Algorithm: ZSCORE_ANOMALY, Window: 1},
+		{Algorithm: SEASONAL_ANOMALY, Season: 1},
+		{Threshold: -1},
+	} {
+		if _, err := FromRequestAnomaly(&request); !errors.Is(err, ErrInvalidAnomaly) {
+			t.Errorf("%+v: error = %v, want %v", request, err, ErrInvalidAnomaly)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package processor
+
+// Period-over-period comparison. The same query is executed for the time range shifted back by the comparison
+// offset, and every data point gets the value of the partition the offset earlier together with absolute and
+// percentage deltas.
+//
+// Offsets are either the previous period (the length of the queried time range), a named calendar offset (day,
+// week, month, quarter, year) or an interval such as "3d", "2w", "1mo". Calendar offsets are applied to the wall
+// clock of the partitioner's timezone, so "day" over a daylight saving time change is still the same hour.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+const (
+	PREVIOUS_PERIOD_COMPARISON = "period"
+	DAY_COMPARISON             = "day"
+	WEEK_COMPARISON            = "week"
+	MONTH_COMPARISON           = "month"
+	QUARTER_COMPARISON         = "quarter"
+	YEAR_COMPARISON            = "year"
+)
+
+var ErrInvalidComparison = errors.New("invalid comparison")
+
+// Shifts time back by the comparison offset
+type TimeShift struct {
+	count    int
+	unit     intervalUnit
+	duration time.Duration // exact offset of the previous period comparison
+	location *time.Location
+}
+
+// Creates time shift from request's compareTo, returns nil if there is no comparison. Previous period is the
+// length of the queried time range
+func FromRequestCompareTo(compareTo string, timeRange TimeRange, location *time.Location) (*TimeShift, error) {
+	var count int
+	var unit intervalUnit
+	switch compareTo {
+	case "":
+		return nil, nil
+	case PREVIOUS_PERIOD_COMPARISON:
+		if timeRange.IsEmpty() {
+			return nil, fmt.Errorf("%w: previous period of an unbounded time range", ErrInvalidComparison)
+		}
+		return &TimeShift{duration: timeRange.To.Sub(timeRange.From), location: location}, nil
+	case DAY_COMPARISON:
+		count, unit = 1, DAY
+	case WEEK_COMPARISON:
+		count, unit = 1, WEEK
+	case MONTH_COMPARISON:
+		count, unit = 1, MONTH
+	case QUARTER_COMPARISON:
+		count, unit = 3, MONTH
+	case YEAR_COMPARISON:
+		count, unit = 12, MONTH
+	default:
+		var err error
+		count, unit, err = parseScale(compareTo)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown compareTo %q", ErrInvalidComparison, compareTo)
+		}
+	}
+	return &TimeShift{count: count, unit: unit, location: location}, nil
+}
+
+// Returns timestamp shifted back by the offset
+func (shift TimeShift) Back(timestamp time.Time) time.Time {
+	if shift.duration != 0 {
+		return timestamp.Add(-shift.duration)
+	}
+	local := timestamp.In(shift.location)
+	switch shift.unit {
+	case MINUTE:
+		return timestamp.Add(-time.Duration(shift.count) * time.Minute)
+	case HOUR:
+		return timestamp.Add(-time.Duration(shift.count) * time.Hour)
+	case DAY:
+		return local.AddDate(0, 0, -shift.count)
+	case WEEK:
+		return local.AddDate(0, 0, -7*shift.count)
+	default:
+		return addMonths(local, -shift.count)
+	}
+}
+
+// Shifts wall clock time by months, the day is clamped to the end of the target month, so that a month before
+// March 31 is February 28 rather than March 3
+func addMonths(local time.Time, months int) time.Time {
+	year, month, day := local.Date()
+	hour, minute, second := local.Clock()
+	if lastDay := time.Date(year, month+time.Month(months)+1, 0, 0, 0, 0, 0, local.Location()).Day(); day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month+time.Month(months), day, hour, minute, second, local.Nanosecond(), local.Location())
+}
+
+// Time range shifted back by the offset, unbounded sides stay unbounded
+func (shift TimeShift) BackRange(timeRange TimeRange) TimeRange {
+	shifted := TimeRange{}
+	if !timeRange.From.IsZero() {
+		shifted.From = shift.Back(timeRange.From)
+	}
+	if !timeRange.To.IsZero() {
+		shifted.To = shift.Back(timeRange.To)
+	}
+	return shifted
+}
+
+// Adds values of the previous series to the current data points. Data point is matched with the partition
+// which contains its timestamp shifted back by the offset
+func CompareSeries(current []data.TimeDataPoint, previous []data.TimeDataPoint, partitioner TimePartitioner, shift TimeShift) []data.TimeDataPoint {
+	previousByTimestamp := make(map[int64]data.TimeDataPoint, len(previous))
+	for _, point := range previous {
+		previousByTimestamp[point.Timestamp] = point
+	}
+
+	compared := make([]data.TimeDataPoint, len(current))
+	for i, point := range current {
+		compared[i] = point
+		pKey := partitioner.PartitionKey(shift.Back(time.UnixMilli(point.Timestamp)))
+		previousPoint, found := previousByTimestamp[pKey.UnixMilli()]
+		if !found || !previousPoint.HasValue() {
+			continue
+		}
+		compared[i].CompareValue = previousPoint.Value
+		if !point.HasValue() {
+			continue
+		}
+		delta := *point.Value - *previousPoint.Value
+		compared[i].Delta = floatPtr(delta)
+		if *previousPoint.Value != 0 {
+			compared[i].DeltaPercent = floatPtr(delta / math.Abs(*previousPoint.Value) * 100)
+		}
+	}
+	return compared
+}
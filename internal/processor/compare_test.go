@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestTimeShiftBack(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	at := func(year int, month time.Month, day int, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, newYork)
+	}
+	for _, test := range []struct {
+		compareTo string
+		timestamp time.Time
+		want      time.Time
+	}{
+		{MONTH_COMPARISON, at(2023, time.January, 31, 10), at(2022, time.December, 31, 10)},
+		{MONTH_COMPARISON, at(2023, time.March, 31, 10), at(2023, time.February, 28, 10)},
+		{MONTH_COMPARISON, at(2024, time.March, 30, 10), at(2024, time.February, 29, 10)},
+		{"1mo", at(2023, time.May, 31, 0), at(2023, time.April, 30, 0)},
+		{QUARTER_COMPARISON, at(2023, time.May, 31, 0), at(2023, time.February, 28, 0)},
+		{YEAR_COMPARISON, at(2024, time.February, 29, 0), at(2023, time.February, 28, 0)},
+		// the same wall clock hour across daylight saving time, hours are exact
+		{DAY_COMPARISON, at(2023, time.March, 13, 9), at(2023, time.March, 12, 9)},
+		{WEEK_COMPARISON, at(2023, time.November, 8, 9), at(2023, time.November, 1, 9)},
+		{"6h", at(2023, time.March, 12, 9), at(2023, time.March, 12, 3)},
+	} {
+		shift, err := FromRequestCompareTo(test.compareTo, TimeRange{}, newYork)
+		if err != nil {
+			t.Fatalf("%s: error = %v", test.compareTo, err)
+		}
+		if got := shift.Back(test.timestamp); !got.Equal(test.want) {
+			t.Errorf("%s before %v = %v, want %v", test.compareTo, test.timestamp, got, test.want)
+		}
+	}
+
+	previousPeriod := TimeRange{From: at(2023, time.March, 1, 0), To: at(2023, time.March, 8, 0)}
+	shift, err := FromRequestCompareTo(PREVIOUS_PERIOD_COMPARISON, previousPeriod, newYork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := shift.BackRange(previousPeriod), (TimeRange{From: previousPeriod.From.Add(-7 * 24 * time.Hour), To: previousPeriod.From}); got != want {
+		t.Errorf("previous period = %v, want %v", got, want)
+	}
+	if _, err := FromRequestCompareTo(PREVIOUS_PERIOD_COMPARISON, TimeRange{}, newYork); err == nil {
+		t.Errorf("previous period of an unbounded range is accepted")
+	}
+}
+
+func TestCompareSeries(t *testing.T) {
+	daily := NewTimePartitioner(1, DAY, time.UTC, time.Sunday)
+	shift, err := FromRequestCompareTo(MONTH_COMPARISON, TimeRange{}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2023, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	current := []data.TimeDataPoint{
+		data.NewTimeDataPoint(day(time.March, 30), 15),
+		data.NewTimeDataPoint(day(time.March, 31), 30),
+		data.NewEmptyTimeDataPoint(day(time.April, 1)),
+		data.NewTimeDataPoint(day(time.April, 2), 5),
+	}
+	previous := []data.TimeDataPoint{
+		data.NewTimeDataPoint(day(time.February, 28), 20),
+		data.NewTimeDataPoint(day(time.March, 1), 8),
+		data.NewTimeDataPoint(day(time.March, 2), 0),
+	}
+
+	type comparison struct{ compareValue, delta, deltaPercent interface{} }
+	want := []comparison{
+		// both last days of March are compared with the last day of February
+		{20.0, -5.0, -25.0},
+		{20.0, 10.0, 50.0},
+		{8.0, nil, nil},
+		// no percentage of zero
+		{0.0, 5.0, nil},
+	}
+	value := func(value *float64) interface{} {
+		if value == nil {
+			return nil
+		}
+		return *value
+	}
+	compared := CompareSeries(current, previous, daily, *shift)
+	got := make([]comparison, len(compared))
+	for i, point := range compared {
+		got[i] = comparison{value(point.CompareValue), value(point.Delta), value(point.DeltaPercent)}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("comparisons = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+package processor
+
+// Gap fillers, applied to aggregated data points to produce every time partition of the queried range.
+// Aggregation only emits partitions which contain records, fillers add the missing ones and decide what their
+// value is. Partitions without data are marked as filled, so clients can tell "no data" from a real zero.
+
+import (
+	"errors"
+	"fmt"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+const (
+	NONE_FILL     = "none"
+	ZERO_FILL     = "zero"
+	NULL_FILL     = "null"
+	PREVIOUS_FILL = "previous"
+	LINEAR_FILL   = "linear"
+)
+
+// Max number of data points gap filling may produce for a single query
+const MAX_FILLED_POINTS = 100_000
+
+var ErrInvalidFill = errors.New("invalid fill")
+
+// Takes sorted data points of the time range partitioned by partitioner and returns data points with gaps filled
+type Filler func(dataPoints []data.TimeDataPoint, timeRange TimeRange, partitioner TimePartitioner) ([]data.TimeDataPoint, error)
+
+// Empty fill means no gap filling
+func FromRequestFill(fill string) (Filler, error) {
+	switch fill {
+	case NONE_FILL, "":
+		return NoneFiller, nil
+	case ZERO_FILL:
+		return ZeroFiller, nil
+	case NULL_FILL:
+		return NullFiller, nil
+	case PREVIOUS_FILL:
+		return PreviousFiller, nil
+	case LINEAR_FILL:
+		return LinearFiller, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown fill %q", ErrInvalidFill, fill)
+	}
+}
+
+func NoneFiller(dataPoints []data.TimeDataPoint, timeRange TimeRange, partitioner TimePartitioner) ([]data.TimeDataPoint, error) {
+	return dataPoints, nil
+}
+
+func ZeroFiller(dataPoints []data.TimeDataPoint, timeRange TimeRange, partitioner TimePartitioner) ([]data.TimeDataPoint, error) {
+	filled, err := fillGaps(dataPoints, timeRange, partitioner)
+	if err != nil {
+		return nil, err
+	}
+	for i := range filled {
+		if !filled[i].HasValue() {
+			filled[i].Value = floatPtr(0)
+		}
+	}
+	return filled, nil
+}
+
+func NullFiller(dataPoints []data.TimeDataPoint, timeRange TimeRange, partitioner TimePartitioner) ([]data.TimeDataPoint, error) {
+	return fillGaps(dataPoints, timeRange, partitioner)
+}
+
+// Carries the last known value forward, partitions before the first value stay null
+func PreviousFiller(dataPoints []data.TimeDataPoint, timeRange TimeRange, partitioner TimePartitioner) ([]data.TimeDataPoint, error) {
+	filled, err := fillGaps(dataPoints, timeRange, partitioner)
+	if err != nil {
+		return nil, err
+	}
+	var previous *float64
+	for i := range filled {
+		if filled[i].HasValue() {
+			previous = filled[i].Value
+		} else if previous != nil {
+			filled[i].Value = floatPtr(*previous)
+		}
+	}
+	return filled, nil
+}
+
+// Interpolates values linearly by time between known values, partitions before the first and after the last
+// value stay null
+func LinearFiller(dataPoints []data.TimeDataPoint, timeRange TimeRange, partitioner TimePartitioner) ([]data.TimeDataPoint, error) {
+	filled, err := fillGaps(dataPoints, timeRange, partitioner)
+	if err != nil {
+		return nil, err
+	}
+	previous := -1
+	for i := range filled {
+		if !filled[i].HasValue() {
+			continue
+		}
+		if previous >= 0 && i-previous > 1 {
+			from, to := filled[previous], filled[i]
+			slope := (*to.Value - *from.Value) / float64(to.Timestamp-from.Timestamp)
+			for j := previous + 1; j < i; j++ {
+				filled[j].Value = floatPtr(roundTo2DecimalPoints(*from.Value + slope*float64(filled[j].Timestamp-from.Timestamp)))
+			}
+		}
+		previous = i
+	}
+	return filled, nil
+}
+
+// Returns a data point for every partition of the time range, partitions without data have null values.
+// Data points are kept as they are if the time range is not bounded (there is no data at all).
+func fillGaps(dataPoints []data.TimeDataPoint, timeRange TimeRange, partitioner TimePartitioner) ([]data.TimeDataPoint, error) {
+	if timeRange.IsEmpty() {
+		return dataPoints, nil
+	}
+	if partitioner.countPartitions(timeRange, MAX_FILLED_POINTS+1) > MAX_FILLED_POINTS {
+		return nil, fmt.Errorf("%w: more than %d data points in the time range, use a coarser scale",
+			ErrInvalidFill, MAX_FILLED_POINTS)
+	}
+
+	filled := []data.TimeDataPoint{}
+	i := 0
+	for pStart := partitioner.PartitionKey(timeRange.From); pStart.Before(timeRange.To); pStart = partitioner.NextPartition(pStart) {
+		pKey := pStart.UnixMilli()
+		// skip data points outside of the range, there shouldn't be any
+		for i < len(dataPoints) && dataPoints[i].Timestamp < pKey {
+			i++
+		}
+		if i < len(dataPoints) && dataPoints[i].Timestamp == pKey {
+			filled = append(filled, dataPoints[i])
+			i++
+		} else {
+			filled = append(filled, data.NewEmptyTimeDataPoint(pStart))
+		}
+	}
+	return filled, nil
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+// Values of the data points, nil for data points without value, and which of them are filled
+func pointValues(dataPoints []data.TimeDataPoint) ([]interface{}, []bool) {
+	values := make([]interface{}, len(dataPoints))
+	filled := make([]bool, len(dataPoints))
+	for i, point := range dataPoints {
+		if point.HasValue() {
+			values[i] = *point.Value
+		}
+		filled[i] = point.Filled
+	}
+	return values, filled
+}
+
+func TestFillers(t *testing.T) {
+	day := func(day int) time.Time {
+		return time.Date(2023, time.March, day, 0, 0, 0, 0, time.UTC)
+	}
+	month := func(month time.Month) time.Time {
+		return time.Date(2023, month, 1, 0, 0, 0, 0, time.UTC)
+	}
+	daily := NewTimePartitioner(1, DAY, time.UTC, time.Sunday)
+	monthly := NewTimePartitioner(1, MONTH, time.UTC, time.Sunday)
+	// leading, middle and trailing gap
+	days := TimeRange{From: day(1), To: day(6)}
+	dailyPoints := []data.TimeDataPoint{data.NewTimeDataPoint(day(2), 10), data.NewTimeDataPoint(day(4), 20)}
+	gaps := []bool{true, false, true, false, true}
+
+	for i, test := range []struct {
+		fill        string
+		dataPoints  []data.TimeDataPoint
+		timeRange   TimeRange
+		partitioner TimePartitioner
+		values      []interface{}
+		filled      []bool
+	}{
+		{NONE_FILL, dailyPoints, days, daily, []interface{}{10.0, 20.0}, []bool{false, false}},
+		{ZERO_FILL, dailyPoints, days, daily, []interface{}{0.0, 10.0, 0.0, 20.0, 0.0}, gaps},
+		{NULL_FILL, dailyPoints, days, daily, []interface{}{nil, 10.0, nil, 20.0, nil}, gaps},
+		{PREVIOUS_FILL, dailyPoints, days, daily, []interface{}{nil, 10.0, 10.0, 20.0, 20.0}, gaps},
+		{LINEAR_FILL, dailyPoints, days, daily, []interface{}{nil, 10.0, 15.0, 20.0, nil}, gaps},
+		// interpolated by time, February is shorter than January
+		{LINEAR_FILL, []data.TimeDataPoint{data.NewTimeDataPoint(month(1), 10), data.NewTimeDataPoint(month(3), 69)},
+			TimeRange{From: month(1), To: month(4)}, monthly, []interface{}{10.0, 41.0, 69.0}, []bool{false, true, false}},
+		// no data in the range
+		{ZERO_FILL, nil, TimeRange{From: day(1), To: day(3)}, daily, []interface{}{0.0, 0.0}, []bool{true, true}},
+		{LINEAR_FILL, nil, TimeRange{From: day(1), To: day(3)}, daily, []interface{}{nil, nil}, []bool{true, true}},
+		// unbounded range, data points are kept
+		{ZERO_FILL, dailyPoints, TimeRange{}, daily, []interface{}{10.0, 20.0}, []bool{false, false}},
+	} {
+		t.Run(fmt.Sprint(i, " ", test.fill), func(t *testing.T) {
+			filler, err := FromRequestFill(test.fill)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filled, err := filler(test.dataPoints, test.timeRange, test.partitioner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values, flags := pointValues(filled)
+			if !reflect.DeepEqual(values, test.values) || !reflect.DeepEqual(flags, test.filled) {
+				t.Errorf("values = %v, filled %v, want %v, filled %v", values, flags, test.values, test.filled)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package processor
+
+// Forecasting of query results with Holt-Winters (triple exponential smoothing). Series is decomposed into
+// level, trend and seasonal component, which are smoothed with alpha, beta and gamma factors, and extended
+// N partitions into the future. Seasonality is either additive (value = level + trend + season) or
+// multiplicative (value = (level + trend) * season).
+//
+// Smoothing factors which are not given are fitted by a grid search minimizing squared one-step-ahead errors.
+// Prediction intervals are based on the deviation of in-sample one-step-ahead errors, widened with the forecast
+// horizon as for the additive model.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+const (
+	ADDITIVE_FORECAST       = "additive"
+	MULTIPLICATIVE_FORECAST = "multiplicative"
+)
+
+const (
+	DEFAULT_FORECAST_SEASON     = 7
+	DEFAULT_FORECAST_CONFIDENCE = 0.95
+	MAX_FORECAST_POINTS         = 1000
+)
+
+// Smoothing factors tried when they are not given in the request
+var forecastFactorGrid = []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.7, 0.9}
+
+var ErrInvalidForecast = errors.New("invalid forecast")
+
+// Appends forecast data points to the series partitioned by partitioner
+type Forecaster func(dataPoints []data.TimeDataPoint, partitioner TimePartitioner) ([]data.TimeDataPoint, error)
+
+// Creates forecaster from request, returns nil if forecast is not requested
+func FromRequestForecast(forecast *data.ForecastRequest) (Forecaster, error) {
+	if forecast == nil {
+		return nil, nil
+	}
+	if forecast.Points < 1 || forecast.Points > MAX_FORECAST_POINTS {
+		return nil, fmt.Errorf("%w: number of points must be between 1 and %d", ErrInvalidForecast, MAX_FORECAST_POINTS)
+	}
+
+	model := holtWinters{
+		season: forecast.Season,
+		alpha:  forecast.Alpha,
+		beta:   forecast.Beta,
+		gamma:  forecast.Gamma,
+	}
+	switch forecast.Method {
+	case ADDITIVE_FORECAST, "":
+	case MULTIPLICATIVE_FORECAST:
+		model.multiplicative = true
+	default:
+		return nil, fmt.Errorf("%w: unknown method %q", ErrInvalidForecast, forecast.Method)
+	}
+	if model.season == 0 {
+		model.season = DEFAULT_FORECAST_SEASON
+	}
+	if model.season < 2 {
+		return nil, fmt.Errorf("%w: season must be at least 2 points", ErrInvalidForecast)
+	}
+	for _, factor := range []float64{model.alpha, model.beta, model.gamma} {
+		if factor < 0 || factor > 1 {
+			return nil, fmt.Errorf("%w: smoothing factors must be between 0 and 1", ErrInvalidForecast)
+		}
+	}
+
+	confidence := forecast.Confidence
+	if confidence == 0 {
+		confidence = DEFAULT_FORECAST_CONFIDENCE
+	}
+	if confidence <= 0 || confidence >= 1 {
+		return nil, fmt.Errorf("%w: confidence must be between 0 and 1", ErrInvalidForecast)
+	}
+	// two-sided quantile of the normal distribution
+	z := math.Sqrt2 * math.Erfinv(confidence)
+
+	return func(dataPoints []data.TimeDataPoint, partitioner TimePartitioner) ([]data.TimeDataPoint, error) {
+		return model.forecast(dataPoints, partitioner, forecast.Points, z)
+	}, nil
+}
+
+type holtWinters struct {
+	multiplicative bool
+	season         int
+
+	// smoothing factors of level, trend and seasonal component, zero means fitted
+	alpha, beta, gamma float64
+}
+
+// State of the model after smoothing the series
+type holtWintersFit struct {
+	level, trend float64
+	seasonal     []float64 // by season position
+	sse          float64   // sum of squared one-step-ahead errors
+	errorsCount  int
+}
+
+func (model holtWinters) forecast(dataPoints []data.TimeDataPoint, partitioner TimePartitioner, points int, z float64) ([]data.TimeDataPoint, error) {
+	values := make([]float64, len(dataPoints))
+	present := make([]bool, len(dataPoints))
+	for i, point := range dataPoints {
+		if point.HasValue() {
+			values[i] = *point.Value
+			present[i] = true
+			if model.multiplicative && values[i] <= 0 {
+				return nil, fmt.Errorf("%w: multiplicative method requires positive values", ErrInvalidForecast)
+			}
+		}
+	}
+	if len(values) < 2*model.season {
+		return nil, fmt.Errorf("%w: at least %d data points (two seasons) are needed", ErrInvalidForecast, 2*model.season)
+	}
+
+	fitted, alpha, beta, gamma, ok := model.fitBest(values, present)
+	if !ok {
+		return nil, fmt.Errorf("%w: not enough data points with values in the first two seasons, or the model diverges",
+			ErrInvalidForecast)
+	}
+	sigma := 0.0
+	if fitted.errorsCount > 1 {
+		sigma = math.Sqrt(fitted.sse / float64(fitted.errorsCount-1))
+	}
+
+	forecasted := append([]data.TimeDataPoint{}, dataPoints...)
+	timestamp := partitioner.PartitionKey(time.UnixMilli(dataPoints[len(dataPoints)-1].Timestamp))
+	variance := 0.0
+	for h := 1; h <= points; h++ {
+		timestamp = partitioner.NextPartition(timestamp)
+		position := (len(values) + h - 1) % model.season
+		value := fitted.level + float64(h)*fitted.trend
+		if model.multiplicative {
+			value *= fitted.seasonal[position]
+		} else {
+			value += fitted.seasonal[position]
+		}
+
+		// variance of h-step-ahead error relative to one-step-ahead one
+		coefficient := 1.0
+		if h > 1 {
+			coefficient = alpha * (1 + float64(h-1)*beta)
+			if (h-1)%model.season == 0 {
+				coefficient += gamma
+			}
+		}
+		variance += coefficient * coefficient
+		width := z * sigma * math.Sqrt(variance)
+
+		// JSON has no infinities and NaN
+		if !isFinite(value-width, value+width) {
+			return nil, fmt.Errorf("%w: forecast is out of the float64 range", ErrInvalidForecast)
+		}
+		point := data.NewTimeDataPoint(timestamp, value)
+		point.Forecast = true
+		point.Lower = floatPtr(value - width)
+		point.Upper = floatPtr(value + width)
+		forecasted = append(forecasted, point)
+	}
+	return forecasted, nil
+}
+
+// Fits the model, smoothing factors which are not given are picked from the grid by the least squared error
+func (model holtWinters) fitBest(values []float64, present []bool) (holtWintersFit, float64, float64, float64, bool) {
+	candidates := func(factor float64) []float64 {
+		if factor > 0 {
+			return []float64{factor}
+		}
+		return forecastFactorGrid
+	}
+
+	var best holtWintersFit
+	var bestAlpha, bestBeta, bestGamma float64
+	found := false
+	for _, alpha := range candidates(model.alpha) {
+		for _, beta := range candidates(model.beta) {
+			for _, gamma := range candidates(model.gamma) {
+				fit, ok := model.fit(values, present, alpha, beta, gamma)
+				if ok && (!found || fit.sse < best.sse) {
+					best, bestAlpha, bestBeta, bestGamma, found = fit, alpha, beta, gamma, true
+				}
+			}
+		}
+	}
+	return best, bestAlpha, bestBeta, bestGamma, found
+}
+
+// Smooths the series. Initial level and trend come from the first two seasons, initial seasonal component from
+// the first season. Values which are missing are replaced by the one-step-ahead forecast
+func (model holtWinters) fit(values []float64, present []bool, alpha float64, beta float64, gamma float64) (holtWintersFit, bool) {
+	season := model.season
+	firstMean, firstOk := meanPresent(values[:season], present[:season])
+	secondMean, secondOk := meanPresent(values[season:2*season], present[season:2*season])
+	if !firstOk || !secondOk {
+		return holtWintersFit{}, false
+	}
+
+	fit := holtWintersFit{
+		level:    firstMean,
+		trend:    (secondMean - firstMean) / float64(season),
+		seasonal: make([]float64, season),
+	}
+	for i := 0; i < season; i++ {
+		value := firstMean
+		if present[i] {
+			value = values[i]
+		}
+		if model.multiplicative {
+			fit.seasonal[i] = value / firstMean
+		} else {
+			fit.seasonal[i] = value - firstMean
+		}
+	}
+
+	for i := season; i < len(values); i++ {
+		position := i % season
+		predicted := fit.level + fit.trend
+		if model.multiplicative {
+			predicted *= fit.seasonal[position]
+		} else {
+			predicted += fit.seasonal[position]
+		}
+		if !present[i] {
+			fit.level += fit.trend
+			continue
+		}
+
+		fit.sse += (values[i] - predicted) * (values[i] - predicted)
+		fit.errorsCount++
+
+		previousLevel := fit.level
+		if model.multiplicative {
+			fit.level = alpha*values[i]/fit.seasonal[position] + (1-alpha)*(fit.level+fit.trend)
+			fit.trend = beta*(fit.level-previousLevel) + (1-beta)*fit.trend
+			fit.seasonal[position] = gamma*values[i]/fit.level + (1-gamma)*fit.seasonal[position]
+		} else {
+			fit.level = alpha*(values[i]-fit.seasonal[position]) + (1-alpha)*(fit.level+fit.trend)
+			fit.trend = beta*(fit.level-previousLevel) + (1-beta)*fit.trend
+			fit.seasonal[position] = gamma*(values[i]-fit.level) + (1-gamma)*fit.seasonal[position]
+		}
+	}
+	// multiplicative model diverges once level or a seasonal factor gets close to zero
+	if !isFinite(fit.level, fit.trend, fit.sse) || !isFinite(fit.seasonal...) {
+		return holtWintersFit{}, false
+	}
+	return fit, true
+}
+
+func meanPresent(values []float64, present []bool) (float64, bool) {
+	sum, count := 0.0, 0
+	for i, value := range values {
+		if present[i] {
+			sum += value
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
+
+func isFinite(values ...float64) bool {
+	for _, value := range values {
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return false
+		}
+	}
+	return true
+}
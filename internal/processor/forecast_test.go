@@ -0,0 +1,120 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+// Daily data points with the given values starting at 1970-01-01
+func testDailySeries(values ...float64) []data.TimeDataPoint {
+	dataPoints := make([]data.TimeDataPoint, len(values))
+	for i, value := range values {
+		dataPoints[i] = data.NewTimeDataPoint(time.Unix(int64(i)*24*60*60, 0).UTC(), value)
+	}
+	return dataPoints
+}
+
+func TestDivergingMultiplicativeForecastIsRejected(t *testing.T) {
+	daily := NewTimePartitioner(1, DAY, time.UTC, time.Sunday)
+	forecaster, err := FromRequestForecast(&data.ForecastRequest{Points: 3, Method: MULTIPLICATIVE_FORECAST, Season: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, values := range [][]float64{
+		// level drops close to zero
+		{1e300, 1e300, 1e300, 1e300, 1e-300, 1e-300},
+		// squared errors overflow
+		{1e308, 1e308, 1e308, 1e308},
+	} {
+		forecasted, err := forecaster(testDailySeries(values...), daily)
+		if !errors.Is(err, ErrInvalidForecast) {
+			t.Errorf("%v: error = %v, want %v", values, err, ErrInvalidForecast)
+		}
+		if _, err := json.Marshal(forecasted); err != nil {
+			t.Errorf("%v: json.Marshal error = %v", values, err)
+		}
+	}
+}
+
+func TestForecastContinuesSeasonalSeries(t *testing.T) {
+	monthly := NewTimePartitioner(1, MONTH, time.UTC, time.Sunday)
+	month := func(i int) time.Time {
+		return time.Date(2022, time.January+time.Month(i), 1, 0, 0, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		method string
+		value  func(position int) float64
+	}{
+		{ADDITIVE_FORECAST, func(position int) float64 { return 100 + []float64{-10, 5, 20, -15}[position] }},
+		{MULTIPLICATIVE_FORECAST, func(position int) float64 { return 100 * []float64{0.5, 1.5, 1.2, 0.8}[position] }},
+	} {
+		dataPoints := []data.TimeDataPoint{}
+		for i := 0; i < 12; i++ {
+			dataPoints = append(dataPoints, data.NewTimeDataPoint(month(i), test.value(i%4)))
+		}
+		forecaster, err := FromRequestForecast(&data.ForecastRequest{Points: 6, Method: test.method, Season: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		forecasted, err := forecaster(dataPoints, monthly)
+		if err != nil {
+			t.Fatalf("%s: error = %v", test.method, err)
+		}
+		if len(forecasted) != 18 {
+			t.Fatalf("%s: %d data points, want 18", test.method, len(forecasted))
+		}
+		for i, point := range forecasted[12:] {
+			want := test.value((12 + i) % 4)
+			if point.Timestamp != month(12+i).UnixMilli() || !point.Forecast || math.Abs(*point.Value-want) > 1e-9 {
+				t.Errorf("%s: forecast %d = %+v, value %v, want %v at %v", test.method, i, point, *point.Value, want, month(12+i))
+			}
+			// the series is fitted without errors, so the interval has no width
+			if math.Abs(*point.Lower-want) > 1e-9 || math.Abs(*point.Upper-want) > 1e-9 {
+				t.Errorf("%s: forecast %d interval %v - %v, want %v", test.method, i, *point.Lower, *point.Upper, want)
+			}
+		}
+	}
+}
+
+func TestForecastErrors(t *testing.T) {
+	daily := NewTimePartitioner(1, DAY, time.UTC, time.Sunday)
+	withoutSeason := testDailySeries(1, 2, 3, 4, 5, 6, 7, 8)
+	for i := 4; i < 8; i++ {
+		withoutSeason[i] = data.TimeDataPoint{Timestamp: withoutSeason[i].Timestamp}
+	}
+	for _, test := range []struct {
+		name       string
+		request    data.ForecastRequest
+		dataPoints []data.TimeDataPoint
+	}{
+		{"season longer than the data", data.ForecastRequest{Points: 3, Season: 10}, testDailySeries(1, 2, 3, 4, 5, 6, 7, 8)},
+		{"less than two seasons", data.ForecastRequest{Points: 3, Season: 5}, testDailySeries(1, 2, 3, 4, 5, 6, 7, 8)},
+		{"second season without values", data.ForecastRequest{Points: 3, Season: 4}, withoutSeason},
+		{"multiplicative with zero", data.ForecastRequest{Points: 3, Season: 2, Method: MULTIPLICATIVE_FORECAST}, testDailySeries(1, 2, 0, 4)},
+	} {
+		forecaster, err := FromRequestForecast(&test.request)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if _, err := forecaster(test.dataPoints, daily); !errors.Is(err, ErrInvalidForecast) {
+			t.Errorf("%s: error = %v, want %v", test.name, err, ErrInvalidForecast)
+		}
+	}
+
+	for _, request := range []data.ForecastRequest{
+		{Points: 0},
+		{Points: MAX_FORECAST_POINTS + 1},
+		{Points: 1, Season: 1},
+		{Points: 1, Method: "arima"},
+		{Points: 1, Alpha: 1.5},
+		{Points: 1, Confidence: 1},
+	} {
+		if _, err := FromRequestForecast(&request); !errors.Is(err, ErrInvalidForecast) {
+			t.Errorf("%+v: error = %v, want %v", request, err, ErrInvalidForecast)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package processor
+
+// Formulas combine data points of several named sub-queries arithmetically, for ex. "a / b * 100".
+// Formula supports +, -, *, /, unary minus, parentheses, numbers and sub-query names. It is evaluated per
+// timestamp present in any of the sub-query results:
+// * if a sub-query has no value at the timestamp (no data point or null value) the result has no value
+// * division by zero and results out of the float64 range (infinities, NaN) have no value as well
+// Sub-queries are partitioned by the same time partitioner, so their timestamps are aligned.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+var ErrInvalidFormula = errors.New("invalid formula")
+
+// Parentheses and unary minuses nested deeper are rejected, parser and evaluation recurse per level
+const MAX_FORMULA_DEPTH = 100
+
+// Parsed formula expression
+type Formula struct {
+	root      formulaNode
+	variables []string
+}
+
+// Parses formula expression, errors point to the position (1-based) in the expression
+func ParseFormula(expression string) (*Formula, error) {
+	parser := &formulaParser{expression: expression}
+	parser.next()
+	root, err := parser.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if parser.token.kind != endToken {
+		return nil, parser.errorf("unexpected %q", parser.token.text)
+	}
+
+	variables := []string{}
+	for name := range parser.variables {
+		variables = append(variables, name)
+	}
+	sort.Strings(variables)
+	return &Formula{root: root, variables: variables}, nil
+}
+
+// Names of the sub-queries formula refers to, sorted
+func (formula *Formula) Variables() []string {
+	return formula.variables
+}
+
+// Evaluates formula for every timestamp present in the series, series are keyed by sub-query name and sorted
+func (formula *Formula) Evaluate(series map[string][]data.TimeDataPoint) []data.TimeDataPoint {
+	// align data points of all series by timestamp
+	aligned := make(map[int64]map[string]data.TimeDataPoint)
+	for name, dataPoints := range series {
+		for _, point := range dataPoints {
+			points, found := aligned[point.Timestamp]
+			if !found {
+				points = make(map[string]data.TimeDataPoint)
+				aligned[point.Timestamp] = points
+			}
+			points[name] = point
+		}
+	}
+
+	dataPoints := make([]data.TimeDataPoint, 0, len(aligned))
+	for timestamp, points := range aligned {
+		point := data.TimeDataPoint{Timestamp: timestamp}
+		values := make(map[string]float64)
+		complete := true
+		for _, name := range formula.variables {
+			variablePoint, found := points[name]
+			point.Filled = point.Filled || variablePoint.Filled
+			if !found || !variablePoint.HasValue() {
+				complete = false
+				continue
+			}
+			values[name] = *variablePoint.Value
+		}
+		if complete {
+			// JSON has no infinities and NaN
+			if value, ok := formula.root.evaluate(values); ok && !math.IsInf(value, 0) && !math.IsNaN(value) {
+				point.Value = floatPtr(value)
+			}
+		}
+		dataPoints = append(dataPoints, point)
+	}
+
+	sort.Slice(dataPoints, func(i, j int) bool {
+		return dataPoints[i].Timestamp < dataPoints[j].Timestamp
+	})
+	return dataPoints
+}
+
+// *** Expression tree ***
+
+// Evaluates the node, returns false if the value is undefined (division by zero)
+type formulaNode interface {
+	evaluate(values map[string]float64) (float64, bool)
+}
+
+type numberNode float64
+
+func (node numberNode) evaluate(values map[string]float64) (float64, bool) {
+	return float64(node), true
+}
+
+type variableNode string
+
+func (node variableNode) evaluate(values map[string]float64) (float64, bool) {
+	value, found := values[string(node)]
+	return value, found
+}
+
+type negateNode struct {
+	operand formulaNode
+}
+
+func (node negateNode) evaluate(values map[string]float64) (float64, bool) {
+	value, ok := node.operand.evaluate(values)
+	return -value, ok
+}
+
+type binaryNode struct {
+	operator    byte
+	left, right formulaNode
+}
+
+func (node binaryNode) evaluate(values map[string]float64) (float64, bool) {
+	left, ok := node.left.evaluate(values)
+	if !ok {
+		return 0, false
+	}
+	right, ok := node.right.evaluate(values)
+	if !ok {
+		return 0, false
+	}
+	switch node.operator {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	default:
+		if right == 0 {
+			return 0, false
+		}
+		return left / right, true
+	}
+}
+
+// *** Parser ***
+
+type formulaTokenKind int
+
+const (
+	endToken formulaTokenKind = iota
+	numberToken
+	identifierToken
+	operatorToken
+)
+
+type formulaToken struct {
+	kind     formulaTokenKind
+	text     string
+	position int
+}
+
+// Recursive descent parser:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = factor { ("*" | "/") factor }
+//	factor     = "-" factor | number | identifier | "(" expression ")"
+type formulaParser struct {
+	expression string
+	offset     int
+	token      formulaToken
+	variables  map[string]bool
+	err        error
+	depth      int // nesting of parentheses and unary minuses
+}
+
+func (parser *formulaParser) parseExpression() (formulaNode, error) {
+	left, err := parser.parseTerm()
+	for err == nil && parser.isOperator("+", "-") {
+		operator := parser.token.text[0]
+		parser.next()
+		var right formulaNode
+		right, err = parser.parseTerm()
+		left = binaryNode{operator: operator, left: left, right: right}
+	}
+	return left, err
+}
+
+func (parser *formulaParser) parseTerm() (formulaNode, error) {
+	left, err := parser.parseFactor()
+	for err == nil && parser.isOperator("*", "/") {
+		operator := parser.token.text[0]
+		parser.next()
+		var right formulaNode
+		right, err = parser.parseFactor()
+		left = binaryNode{operator: operator, left: left, right: right}
+	}
+	return left, err
+}
+
+func (parser *formulaParser) parseFactor() (formulaNode, error) {
+	if parser.err != nil {
+		return nil, parser.err
+	}
+	token := parser.token
+	switch token.kind {
+	case numberToken:
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, parser.errorf("invalid number %q", token.text)
+		}
+		parser.next()
+		return numberNode(value), nil
+	case identifierToken:
+		if parser.variables == nil {
+			parser.variables = make(map[string]bool)
+		}
+		parser.variables[token.text] = true
+		parser.next()
+		return variableNode(token.text), nil
+	case operatorToken:
+		if token.text == "-" || token.text == "(" {
+			if parser.depth++; parser.depth > MAX_FORMULA_DEPTH {
+				return nil, parser.errorf("formula is nested deeper than %d levels", MAX_FORMULA_DEPTH)
+			}
+			defer func() { parser.depth-- }()
+		}
+		if token.text == "-" {
+			parser.next()
+			operand, err := parser.parseFactor()
+			return negateNode{operand: operand}, err
+		}
+		if token.text == "(" {
+			parser.next()
+			node, err := parser.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if !parser.isOperator(")") {
+				return nil, parser.errorf("expected \")\"")
+			}
+			parser.next()
+			return node, nil
+		}
+		return nil, parser.errorf("unexpected %q", token.text)
+	default:
+		return nil, parser.errorf("unexpected end of formula")
+	}
+}
+
+func (parser *formulaParser) isOperator(operators ...string) bool {
+	if parser.token.kind != operatorToken {
+		return false
+	}
+	for _, operator := range operators {
+		if parser.token.text == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the next token into parser.token
+func (parser *formulaParser) next() {
+	for parser.offset < len(parser.expression) && (parser.expression[parser.offset] == ' ' || parser.expression[parser.offset] == '\t') {
+		parser.offset++
+	}
+	start := parser.offset
+	if start == len(parser.expression) {
+		parser.token = formulaToken{kind: endToken, position: start}
+		return
+	}
+
+	kind := operatorToken
+	char := parser.expression[start]
+	switch {
+	case isDigit(char) || char == '.':
+		kind = numberToken
+		for parser.offset < len(parser.expression) && (isDigit(parser.expression[parser.offset]) || parser.expression[parser.offset] == '.') {
+			parser.offset++
+		}
+	case isLetter(char):
+		kind = identifierToken
+		for parser.offset < len(parser.expression) && (isLetter(parser.expression[parser.offset]) || isDigit(parser.expression[parser.offset])) {
+			parser.offset++
+		}
+	case char == '+' || char == '-' || char == '*' || char == '/' || char == '(' || char == ')':
+		parser.offset++
+	default:
+		parser.token = formulaToken{kind: operatorToken, text: string(char), position: start}
+		parser.err = parser.errorf("unexpected character %q", char)
+		parser.offset++
+		return
+	}
+	parser.token = formulaToken{kind: kind, text: parser.expression[start:parser.offset], position: start}
+}
+
+func (parser *formulaParser) errorf(format string, args ...interface{}) error {
+	if parser.err != nil {
+		return parser.err
+	}
+	return fmt.Errorf("%w at position %d: %s", ErrInvalidFormula, parser.token.position+1, fmt.Sprintf(format, args...))
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isLetter(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char == '_'
+}
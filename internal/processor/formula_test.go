@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestParseFormulaNestingDepth(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		expression string
+		valid      bool
+	}{
+		{"parentheses at the limit", strings.Repeat("(", MAX_FORMULA_DEPTH) + "a" + strings.Repeat(")", MAX_FORMULA_DEPTH), true},
+		{"parentheses over the limit", strings.Repeat("(", MAX_FORMULA_DEPTH+1) + "a" + strings.Repeat(")", MAX_FORMULA_DEPTH+1), false},
+		{"unary minuses over the limit", strings.Repeat("-", MAX_FORMULA_DEPTH+1) + "a", false},
+		{"unclosed parentheses", strings.Repeat("(", 1_000_000), false},
+		{"long flat expression", "a" + strings.Repeat("+(-a)", 1000), true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseFormula(test.expression)
+			if test.valid && err != nil {
+				t.Errorf("ParseFormula error = %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidFormula) {
+				t.Errorf("ParseFormula error = %v, want %v", err, ErrInvalidFormula)
+			}
+		})
+	}
+}
+
+func TestFormulaResultsOutOfRangeHaveNoValue(t *testing.T) {
+	series := map[string][]data.TimeDataPoint{
+		"a": {{Timestamp: 1, Value: floatPtr(1e200)}},
+		"b": {{Timestamp: 1, Value: floatPtr(0)}},
+	}
+	for expression, want := range map[string]*float64{
+		"a / 100":             floatPtr(1e198),
+		"a * a":               nil,
+		"-a * a":              nil,
+		"a * a - a * a":       nil,
+		"a / b":               nil,
+		"b / b":               nil,
+		"a * 10000000000 * a": nil,
+	} {
+		formula, err := ParseFormula(expression)
+		if err != nil {
+			t.Fatalf("%s: ParseFormula error = %v", expression, err)
+		}
+		got := formula.Evaluate(series)
+		if len(got) != 1 || (got[0].Value == nil) != (want == nil) || (want != nil && *got[0].Value != *want) {
+			t.Errorf("%s = %+v, want value %v", expression, got, want)
+		}
+		if _, err := json.Marshal(got); err != nil {
+			t.Errorf("%s: json.Marshal error = %v", expression, err)
+		}
+	}
+
+	// literal out of the float64 range
+	if _, err := ParseFormula("a * " + strings.Repeat("9", 400)); !errors.Is(err, ErrInvalidFormula) {
+		t.Errorf("ParseFormula error = %v, want %v", err, ErrInvalidFormula)
+	}
+}
@@ -0,0 +1,271 @@
+package processor
+
+// Series functions, applied one after another to the sorted aggregated data points (after gap filling).
+// Every function takes the whole series and returns a new one of the same length, data points without value
+// stay without value. Functions that look back (diff, rate, percent change) use the last data point with value.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+const (
+	MOVING_AVERAGE_FUNCTION = "movingAverage" // args: window size N (points)
+	MOVING_MEDIAN_FUNCTION  = "movingMedian"  // args: window size N (points)
+	CUMSUM_FUNCTION         = "cumsum"
+	DIFF_FUNCTION           = "diff"
+	RATE_FUNCTION           = "rate" // change per second
+	PERCENT_CHANGE_FUNCTION = "percentChange"
+	CLAMP_FUNCTION          = "clamp"    // args: min, max
+	CLAMP_MIN_FUNCTION      = "clampMin" // args: bottom bound
+	CLAMP_MAX_FUNCTION      = "clampMax" // args: top bound
+	LOG_FUNCTION            = "log"      // args: optional base, 10 by default
+
+	MAX_MOVING_WINDOW = 1000 // points
+)
+
+var ErrInvalidFunction = errors.New("invalid function")
+
+type SeriesFunction func(dataPoints []data.TimeDataPoint) []data.TimeDataPoint
+
+// Creates the chain of series functions from request, functions are applied in the request order
+func FromRequestFunctions(functions []data.FunctionRequest) ([]SeriesFunction, error) {
+	seriesFunctions := make([]SeriesFunction, len(functions))
+	for i, function := range functions {
+		seriesFunction, err := fromRequestFunction(function)
+		if err != nil {
+			return nil, err
+		}
+		seriesFunctions[i] = seriesFunction
+	}
+	return seriesFunctions, nil
+}
+
+func fromRequestFunction(function data.FunctionRequest) (SeriesFunction, error) {
+	args := function.Args
+	switch function.Name {
+	case MOVING_AVERAGE_FUNCTION, MOVING_MEDIAN_FUNCTION:
+		if len(args) != 1 || args[0] < 1 || args[0] > MAX_MOVING_WINDOW || args[0] != math.Trunc(args[0]) {
+			return nil, fmt.Errorf("%w: %s expects window size as an integer from 1 to %d", ErrInvalidFunction,
+				function.Name, MAX_MOVING_WINDOW)
+		}
+		if function.Name == MOVING_AVERAGE_FUNCTION {
+			return MovingAverage(int(args[0])), nil
+		}
+		return MovingMedian(int(args[0])), nil
+	case CUMSUM_FUNCTION:
+		return CumulativeSum, noArgs(function)
+	case DIFF_FUNCTION:
+		return Difference, noArgs(function)
+	case RATE_FUNCTION:
+		return Rate, noArgs(function)
+	case PERCENT_CHANGE_FUNCTION:
+		return PercentChange, noArgs(function)
+	case CLAMP_FUNCTION:
+		if len(args) != 2 || args[0] > args[1] {
+			return nil, fmt.Errorf("%w: %s expects min and max, min must not be greater than max", ErrInvalidFunction, function.Name)
+		}
+		return ClampFunction(args[0], args[1]), nil
+	case CLAMP_MIN_FUNCTION:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%w: %s expects bottom bound", ErrInvalidFunction, function.Name)
+		}
+		return ClampFunction(args[0], math.Inf(1)), nil
+	case CLAMP_MAX_FUNCTION:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%w: %s expects top bound", ErrInvalidFunction, function.Name)
+		}
+		return ClampFunction(math.Inf(-1), args[0]), nil
+	case LOG_FUNCTION:
+		base := 10.0
+		if len(args) == 1 {
+			base = args[0]
+		}
+		if len(args) > 1 || base <= 0 || base == 1 {
+			return nil, fmt.Errorf("%w: %s expects optional positive base other than 1", ErrInvalidFunction, function.Name)
+		}
+		return LogFunction(base), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown function %q", ErrInvalidFunction, function.Name)
+	}
+}
+
+func noArgs(function data.FunctionRequest) error {
+	if len(function.Args) != 0 {
+		return fmt.Errorf("%w: %s takes no arguments", ErrInvalidFunction, function.Name)
+	}
+	return nil
+}
+
+func ApplyFunctions(dataPoints []data.TimeDataPoint, functions []SeriesFunction) []data.TimeDataPoint {
+	for _, function := range functions {
+		dataPoints = function(dataPoints)
+	}
+	return dataPoints
+}
+
+// Mean of the values of the last N data points (the point itself included), data points without value are skipped.
+// Result has no value if there are no values in the window.
+func MovingAverage(window int) SeriesFunction {
+	return func(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+		sum, count := 0.0, 0
+		return mapSeries(dataPoints, func(i int, point data.TimeDataPoint) *float64 {
+			if point.HasValue() {
+				sum += *point.Value
+				count++
+			}
+			if left := i - window; left >= 0 && dataPoints[left].HasValue() {
+				sum -= *dataPoints[left].Value
+				count--
+			}
+			if count == 0 {
+				// drop the rounding error accumulated by the running sum
+				sum = 0
+				return nil
+			}
+			return floatPtr(sum / float64(count))
+		})
+	}
+}
+
+// Median of the values of the last N data points, same as MovingAverage. Values of the window are kept sorted.
+func MovingMedian(window int) SeriesFunction {
+	return func(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+		// the function is reused for every series of the request, so the window itself is kept
+		capacity := window
+		if capacity > len(dataPoints) {
+			capacity = len(dataPoints)
+		}
+		sorted := make([]float64, 0, capacity)
+		return mapSeries(dataPoints, func(i int, point data.TimeDataPoint) *float64 {
+			if point.HasValue() {
+				at := sort.SearchFloat64s(sorted, *point.Value)
+				sorted = append(sorted, 0)
+				copy(sorted[at+1:], sorted[at:])
+				sorted[at] = *point.Value
+			}
+			if left := i - window; left >= 0 && dataPoints[left].HasValue() {
+				at := sort.SearchFloat64s(sorted, *dataPoints[left].Value)
+				sorted = append(sorted[:at], sorted[at+1:]...)
+			}
+			if len(sorted) == 0 {
+				return nil
+			}
+			return floatPtr(sortedMedian(sorted))
+		})
+	}
+}
+
+func CumulativeSum(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+	sum := 0.0
+	return mapValues(dataPoints, func(value float64) *float64 {
+		sum += value
+		return floatPtr(sum)
+	})
+}
+
+func Difference(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+	return mapWithPrevious(dataPoints, func(previous data.TimeDataPoint, point data.TimeDataPoint) *float64 {
+		return floatPtr(*point.Value - *previous.Value)
+	})
+}
+
+func Rate(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+	return mapWithPrevious(dataPoints, func(previous data.TimeDataPoint, point data.TimeDataPoint) *float64 {
+		seconds := float64(point.Timestamp-previous.Timestamp) / 1000
+		return floatPtr((*point.Value - *previous.Value) / seconds)
+	})
+}
+
+// Change relative to the previous value in percents, there is no value if previous value is zero
+func PercentChange(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+	return mapWithPrevious(dataPoints, func(previous data.TimeDataPoint, point data.TimeDataPoint) *float64 {
+		if *previous.Value == 0 {
+			return nil
+		}
+		return floatPtr((*point.Value - *previous.Value) / math.Abs(*previous.Value) * 100)
+	})
+}
+
+func ClampFunction(min float64, max float64) SeriesFunction {
+	return func(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+		return mapValues(dataPoints, func(value float64) *float64 {
+			return floatPtr(math.Max(min, math.Min(max, value)))
+		})
+	}
+}
+
+// Logarithm of the value, there is no value for non-positive values
+func LogFunction(base float64) SeriesFunction {
+	return func(dataPoints []data.TimeDataPoint) []data.TimeDataPoint {
+		return mapValues(dataPoints, func(value float64) *float64 {
+			if value <= 0 {
+				return nil
+			}
+			return floatPtr(math.Log(value) / math.Log(base))
+		})
+	}
+}
+
+// *** Helpers ***
+
+// Returns a copy of the series with values replaced by the result of valueFunc
+func mapSeries(dataPoints []data.TimeDataPoint, valueFunc func(i int, point data.TimeDataPoint) *float64) []data.TimeDataPoint {
+	mapped := make([]data.TimeDataPoint, len(dataPoints))
+	for i, point := range dataPoints {
+		mapped[i] = point
+		mapped[i].Value = valueFunc(i, point)
+	}
+	return mapped
+}
+
+// Maps values of the data points which have them
+func mapValues(dataPoints []data.TimeDataPoint, valueFunc func(value float64) *float64) []data.TimeDataPoint {
+	return mapSeries(dataPoints, func(i int, point data.TimeDataPoint) *float64 {
+		if !point.HasValue() {
+			return nil
+		}
+		return valueFunc(*point.Value)
+	})
+}
+
+// Maps data points with value together with the previous data point with value, the first one has no value
+func mapWithPrevious(dataPoints []data.TimeDataPoint, valueFunc func(previous data.TimeDataPoint, point data.TimeDataPoint) *float64) []data.TimeDataPoint {
+	previous := -1
+	return mapSeries(dataPoints, func(i int, point data.TimeDataPoint) *float64 {
+		if !point.HasValue() {
+			return nil
+		}
+		var value *float64
+		if previous >= 0 {
+			value = valueFunc(dataPoints[previous], point)
+		}
+		previous = i
+		return value
+	})
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	return sortedMedian(sorted)
+}
+
+func sortedMedian(sorted []float64) float64 {
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
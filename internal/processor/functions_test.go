@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestMovingWindowFunctionsMatchWindowValues(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	dataPoints := make([]data.TimeDataPoint, 500)
+	for i := range dataPoints {
+		dataPoints[i].Timestamp = int64(i) * 60_000
+		// gaps, runs of equal values and a long gap in the middle
+		if random.Intn(4) > 0 && (i < 200 || i > 260) {
+			dataPoints[i].Value = floatPtr(float64(random.Intn(20)) + random.Float64()*float64(random.Intn(2)))
+		}
+	}
+
+	for _, window := range []int{1, 2, 7, 50, len(dataPoints), MAX_MOVING_WINDOW} {
+		averages := MovingAverage(window)(dataPoints)
+		medians := MovingMedian(window)(dataPoints)
+		for i, point := range dataPoints {
+			values := []float64{}
+			for j := i; j >= 0 && j > i-window; j-- {
+				if dataPoints[j].HasValue() {
+					values = append(values, *dataPoints[j].Value)
+				}
+			}
+			if averages[i].Timestamp != point.Timestamp || medians[i].Timestamp != point.Timestamp {
+				t.Fatalf("window %d, point %d: timestamps changed", window, i)
+			}
+			if len(values) == 0 {
+				if averages[i].HasValue() || medians[i].HasValue() {
+					t.Fatalf("window %d, point %d: value in an empty window", window, i)
+				}
+				continue
+			}
+			if !averages[i].HasValue() || math.Abs(*averages[i].Value-mean(values)) > 1e-9 {
+				t.Fatalf("window %d, point %d: movingAverage = %v, want %v", window, i, averages[i].Value, mean(values))
+			}
+			if !medians[i].HasValue() || *medians[i].Value != median(values) {
+				t.Fatalf("window %d, point %d: movingMedian = %v, want %v", window, i, medians[i].Value, median(values))
+			}
+		}
+	}
+}
+
+func TestMovingWindowSize(t *testing.T) {
+	for _, test := range []struct {
+		window float64
+		valid  bool
+	}{
+		{1, true},
+		{MAX_MOVING_WINDOW, true},
+		{0, false},
+		{2.5, false},
+		{MAX_MOVING_WINDOW + 1, false},
+		{1e18, false},
+	} {
+		for _, name := range []string{MOVING_AVERAGE_FUNCTION, MOVING_MEDIAN_FUNCTION} {
+			_, err := fromRequestFunction(data.FunctionRequest{Name: name, Args: []float64{test.window}})
+			if test.valid && err != nil {
+				t.Errorf("%s(%v) error = %v", name, test.window, err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidFunction) {
+				t.Errorf("%s(%v) error = %v, want %v", name, test.window, err, ErrInvalidFunction)
+			}
+		}
+	}
+}
+
+func TestMovingWindowFunctionsAreReusable(t *testing.T) {
+	series := func(values ...float64) []data.TimeDataPoint {
+		dataPoints := make([]data.TimeDataPoint, len(values))
+		for i, value := range values {
+			dataPoints[i] = data.TimeDataPoint{Timestamp: int64(i), Value: floatPtr(value)}
+		}
+		return dataPoints
+	}
+	for name, test := range map[string]struct {
+		function SeriesFunction
+		want     []float64
+	}{
+		"movingMedian":  {MovingMedian(5), []float64{1, 1.5, 2, 2.5, 3, 4}},
+		"movingAverage": {MovingAverage(5), []float64{1, 1.5, 2, 2.5, 3, 4}},
+	} {
+		// a short series first, as for the groups or sub-queries of a single request
+		test.function(series(1, 2))
+		got := test.function(series(1, 2, 3, 4, 5, 6))
+		for i, want := range test.want {
+			if !got[i].HasValue() || *got[i].Value != want {
+				t.Errorf("%s: point %d = %v, want %v", name, i, got[i].Value, want)
+			}
+		}
+	}
+}
@@ -23,27 +23,61 @@ package processor
 // After metrics retrieved we apply partition by time (using one of our static time partitioners) and aggregation.
 //
 // For filter search (/getFilters) we are using Trie data structure to be able to quickly retrieve all availble tag:value pairs. The complexity of this step is O(sn + tn) where sn - length of search term and tn - combined length of all tag:value strings that exist in our dataset.
+//
+// All of the above is split into N shards by record id (see metricShard). Ingestion goes to a single shard, while
+// queries fan out to all shards, each shard returns partial aggregate states per time partition and the processor
+// merges them before producing final data points.
 
 import (
+	"context"
+	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 	"valery-datadog-datastream-demo/internal/data"
 )
 
 // Provide data to external users (for ex. - API handlers)
 type MetricDataProvider interface {
-	GetMetricDataPoints(filters []*data.Tag, timePartition TimePartitioner, aggregator Aggregator) []data.TimeDataPoint
+	GetMetricDataPoints(ctx context.Context, filters []*data.Tag, timeRange TimeRange, timePartition TimePartitioner, aggregator Aggregator) ([]data.TimeDataPoint, QueryStats, error)
+	GetMetricSeries(ctx context.Context, filters []*data.Tag, groupBy []string, timeRange TimeRange, timePartition TimePartitioner, aggregator Aggregator) ([]Series, QueryStats, error)
+	CountMetricSeries(ctx context.Context, filters []*data.Tag, groupBy []string, timeRange TimeRange, limit int) (int, error)
+	GetMetricRecords(ctx context.Context, filters []*data.Tag, timeRange TimeRange, order RecordOrder, after *RecordKey, limit int) (RecordsPage, error)
 	GetMetricTagFilters(searchTerm string) []string
+	GetMetricTimeRange() TimeRange
+	GetMetricValue(filters []*data.Tag, timeRange TimeRange, aggregator Aggregator) (float64, bool)
+	SubscribeRecords(listener RecordListener) (unsubscribe func())
+}
+
+// Called for every record indexed by Process, must be cheap as it runs on the ingestion path
+type RecordListener func(metricRecord *data.MetricRecord, tags data.Tags)
+
+// Statistics of a single query execution
+type QueryStats struct {
+	RecordsScanned int // records matching the filters
+}
+
+// Durable log of the ingested records (write-ahead log). Records are appended before they are indexed.
+type RecordLog interface {
+	Append(dataRecord []string) (uint64, error)
 }
 
 var _ MetricDataProvider = (*InMemoryMetricStreamProcessor)(nil)
 
 var _ data.StreamProcessor = (*InMemoryMetricStreamProcessor)(nil)
 
-func NewInMemoryMetricStreamProcessor() *InMemoryMetricStreamProcessor {
+func NewInMemoryMetricStreamProcessor(shardCount int) *InMemoryMetricStreamProcessor {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	shards := make([]*metricShard, shardCount)
+	for i := range shards {
+		shards[i] = newMetricShard()
+	}
 	return &InMemoryMetricStreamProcessor{
-		allMetrics:    data.NewMetrics(),
-		taggedMetrics: make(map[string]map[string]*data.Metrics),
-		tagFilters:    NewTrieNode(),
+		shards:           shards,
+		queryParallelism: runtime.NumCPU(),
 	}
 }
 
@@ -52,70 +86,205 @@ func NewInMemoryMetricStreamProcessor() *InMemoryMetricStreamProcessor {
 // * Uses metadata to build indexes on data stream
 // * Uses aggregators to aggregate incoming metrics into displayable data points
 type InMemoryMetricStreamProcessor struct {
+	// sequence number of the last indexed record, updated atomically (first field to be 64-bit aligned)
+	recordSequence uint64
+
+	// ingestion holds the lock for reading, so records are indexed in parallel, while snapshots hold it exclusively
+	// to see all shards in a state consistent with the record log
+	ingestLock sync.RWMutex
 
-	// all metrics time series for general layout
-	allMetrics *data.Metrics
+	shards []*metricShard
 
-	// nested map for tagged metrics: tagName -> tagValue -> TaggedMetrics
-	taggedMetrics map[string]map[string]*data.Metrics
+	// max number of goroutines a single query may keep busy at the same time
+	queryParallelism int
 
-	tagFilters *TrieNode
+	// optional write-ahead log and sequence number of the last logged record that was indexed
+	recordLog    RecordLog
+	sequenceLock sync.Mutex
+	lastSequence uint64
+
+	// listeners of the live records, by subscription id
+	listenersLock  sync.RWMutex
+	listeners      map[int]RecordListener
+	lastListenerId int
+}
+
+// Makes processor append every accepted record to the log before indexing it
+func (mp *InMemoryMetricStreamProcessor) SetRecordLog(recordLog RecordLog) {
+	mp.ingestLock.Lock()
+	defer mp.ingestLock.Unlock()
+	mp.recordLog = recordLog
 }
 
-// Process incoming data stream, build indices based on tags
+// Limits number of goroutines a single query may keep busy, so that one big query can't starve the others
+func (mp *InMemoryMetricStreamProcessor) SetQueryParallelism(queryParallelism int) {
+	if queryParallelism < 1 {
+		queryParallelism = 1
+	}
+	mp.queryParallelism = queryParallelism
+}
+
+// Sequence number of the last indexed record that came through the record log
+func (mp *InMemoryMetricStreamProcessor) LastSequence() uint64 {
+	mp.sequenceLock.Lock()
+	defer mp.sequenceLock.Unlock()
+	return mp.lastSequence
+}
+
+// Process incoming data stream, build indices based on tags. Safe to call concurrently.
 func (mp *InMemoryMetricStreamProcessor) Process(dataRecord []string) error {
+	started := time.Now()
 	metricRecord, tags, err := data.FromCsvDataRecord(dataRecord)
 	if err != nil {
+		rowsRejected.With(INVALID_ROW_REASON).Inc()
 		return err
 	}
 
-	// based on tag names and values specified for the data record - populate nested metric data-storage
-	for tagName, tag := range tags {
-		tagValueMap, found := mp.taggedMetrics[tagName]
-		if !found {
-			tagValueMap = make(map[string]*data.Metrics)
-		}
+	mp.ingestLock.RLock()
+	defer mp.ingestLock.RUnlock()
 
-		taggedMetrics, found := tagValueMap[tag.Value()]
-		if !found {
-			taggedMetrics = data.NewMetrics()
+	// record is accepted - make it durable before indexing
+	if mp.recordLog != nil {
+		sequence, err := mp.recordLog.Append(dataRecord)
+		if err != nil {
+			rowsRejected.With(LOG_FAILED_REASON).Inc()
+			return err
 		}
-		taggedMetrics.AddRecord(metricRecord)
-		tagValueMap[tag.Value()] = taggedMetrics
-		mp.taggedMetrics[tagName] = tagValueMap
+		mp.advanceSequence(sequence)
+	}
+
+	mp.index(metricRecord, tags)
+	mp.notifyListeners(metricRecord, tags)
+	rowsIngested.Inc()
+	ingestDuration.ObserveSince(started)
+	return nil
+}
 
-		// and also update metric tag-filters storage
-		filterStr := tag.AsFilter()
-		mp.tagFilters.AddWord(filterStr)
+// Registers listener of the records coming through Process, returned function removes the listener
+func (mp *InMemoryMetricStreamProcessor) SubscribeRecords(listener RecordListener) func() {
+	mp.listenersLock.Lock()
+	defer mp.listenersLock.Unlock()
+	if mp.listeners == nil {
+		mp.listeners = make(map[int]RecordListener)
 	}
+	mp.lastListenerId++
+	id := mp.lastListenerId
+	mp.listeners[id] = listener
 
-	// add metric to the total collection
-	mp.allMetrics.AddRecord(metricRecord)
+	return func() {
+		mp.listenersLock.Lock()
+		defer mp.listenersLock.Unlock()
+		delete(mp.listeners, id)
+	}
+}
 
-	return nil // no errors, we are done
+func (mp *InMemoryMetricStreamProcessor) notifyListeners(metricRecord *data.MetricRecord, tags data.Tags) {
+	mp.listenersLock.RLock()
+	defer mp.listenersLock.RUnlock()
+	for _, listener := range mp.listeners {
+		listener(metricRecord, tags)
+	}
+}
+
+// Indexes record which was read back from the record log during recovery
+func (mp *InMemoryMetricStreamProcessor) Replay(sequence uint64, dataRecord []string) error {
+	metricRecord, tags, err := data.FromCsvDataRecord(dataRecord)
+	if err != nil {
+		return err
+	}
+
+	mp.ingestLock.RLock()
+	defer mp.ingestLock.RUnlock()
+
+	mp.index(metricRecord, tags)
+	mp.advanceSequence(sequence)
+	rowsReplayed.Inc()
+	return nil
+}
+
+func (mp *InMemoryMetricStreamProcessor) advanceSequence(sequence uint64) {
+	mp.sequenceLock.Lock()
+	defer mp.sequenceLock.Unlock()
+	if sequence > mp.lastSequence {
+		mp.lastSequence = sequence
+	}
+}
+
+// Numbers the record in the ingest order and adds it to the indexes of its shard
+func (mp *InMemoryMetricStreamProcessor) index(metricRecord *data.MetricRecord, tags data.Tags) {
+	metricRecord.SetSequence(atomic.AddUint64(&mp.recordSequence, 1))
+	mp.shardFor(metricRecord).index(metricRecord, tags)
+}
+
+func (mp *InMemoryMetricStreamProcessor) shardFor(metricRecord *data.MetricRecord) *metricShard {
+	return mp.shards[uint(metricRecord.Id())%uint(len(mp.shards))]
 }
 
 // Returns key-value pairs of tagName:tagValue - available for filtering in the current data-set
 func (mp *InMemoryMetricStreamProcessor) GetMetricTagFilters(searchTerm string) []string {
-	filters := mp.tagFilters.GetWordsInSubtrie(searchTerm)
+	// the same tag:value pair may be present in several shards
+	seen := make(map[string]bool)
+	filters := []string{}
+	for _, shard := range mp.shards {
+		for _, filter := range shard.getMetricTagFilters(searchTerm) {
+			if !seen[filter] {
+				seen[filter] = true
+				filters = append(filters, filter)
+			}
+		}
+	}
 	// todo: we might also add remaining tag:value pairs here
+	// shards and tries list the filters in no particular order
+	sort.Strings(filters)
 	return filters
 }
 
-// Fetch data from the internal data structures, use indices to filter and aggregator to aggregate and prepare data points
-// we only implement filtering for now.
-func (mp *InMemoryMetricStreamProcessor) GetMetricDataPoints(filters []*data.Tag, timePartition TimePartitioner, aggregate Aggregator) []data.TimeDataPoint {
-	// 1. We need to choose data to partition or aggregate
-	metrics := mp.getInputMetrics(filters)
+// Returns time range covered by all metric records
+func (mp *InMemoryMetricStreamProcessor) GetMetricTimeRange() TimeRange {
+	dataRange := TimeRange{}
+	for _, shard := range mp.shards {
+		dataRange = dataRange.Union(shard.getDataRange())
+	}
+	return dataRange
+}
 
-	// 2. Partition by time
-	partitionedMetrics := timePartition(metrics.MetricRecords())
+// Fetch data from the internal data structures, use indices to filter and aggregator to aggregate and prepare data points.
+// Only records within time range are taken into account, empty time range means all records.
+// Cancelled query stops early and returns the context error.
+func (mp *InMemoryMetricStreamProcessor) GetMetricDataPoints(ctx context.Context, filters []*data.Tag, timeRange TimeRange, timePartition TimePartitioner, aggregate Aggregator) ([]data.TimeDataPoint, QueryStats, error) {
+	defer queryDuration.With(DATA_POINTS_QUERY).ObserveSince(time.Now())
+	limiter := newQueryLimiter(mp.queryParallelism)
+
+	// 1. Scatter: every shard filters its metrics, partitions them by time and computes partial aggregates
+	shardPartials := make([]map[time.Time]*AggregateState, len(mp.shards))
+	shardScanned := make([]int, len(mp.shards))
+	var wg sync.WaitGroup
+	for i, shard := range mp.shards {
+		wg.Add(1)
+		go func(i int, shard *metricShard) {
+			defer wg.Done()
+			shardPartials[i], shardScanned[i] = shard.getPartialAggregates(ctx, filters, timeRange, timePartition, limiter)
+		}(i, shard)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, QueryStats{}, err
+	}
+
+	// 2. Gather: merge partial aggregates of the same time partition
+	stats := QueryStats{}
+	merged := make(map[time.Time]*AggregateState)
+	for i, partials := range shardPartials {
+		mergePartitions(merged, partials)
+		stats.RecordsScanned += shardScanned[i]
+	}
+	recordsScanned.With(DATA_POINTS_QUERY).Add(float64(stats.RecordsScanned))
 
 	// 3. aggregate using aggregator function
-	dataPoints := make([]data.TimeDataPoint, len(partitionedMetrics))
+	dataPoints := make([]data.TimeDataPoint, len(merged))
 	i := 0
-	for pKey, partition := range partitionedMetrics {
-		dataPoints[i] = aggregate(pKey, partition)
+	for pKey, state := range merged {
+		dataPoints[i] = aggregate(pKey, state)
 		i++
 	}
 
@@ -123,68 +292,46 @@ func (mp *InMemoryMetricStreamProcessor) GetMetricDataPoints(filters []*data.Tag
 	sort.Slice(dataPoints, func(i, j int) bool {
 		return dataPoints[i].Timestamp < dataPoints[j].Timestamp
 	})
-	return dataPoints
-}
-
-func (mp *InMemoryMetricStreamProcessor) getInputMetrics(filters []*data.Tag) *data.Metrics {
-	// by default we take an empty set of metrics
-	metrics := data.NewMetrics()
-
-	if len(filters) == 0 {
-		// if no filters specified - we use all metrics for aggregation
-		metrics = mp.allMetrics
-	} else if len(filters) == 1 {
-		// if only one filter is specified - we can simply use pre-partitioned time series
-		filterTag := filters[0]
-		tagValueMap, found := mp.taggedMetrics[filterTag.Name()]
-		if found {
-			metrics, _ = tagValueMap[filterTag.Value()]
-		}
-	} else {
-		// there are multiple filters specified which means we have to merge filtering results
-		// gather time series to be merged
-		filterTagMetrics := make([]*data.Metrics, len(filters))
-		for i, filterTag := range filters {
-			// if at least one of tags (name->value->...) does not have any data - filtering is not necessary
-			// as we'll get empty result in the end anyway
-			tagValueMap, found := mp.taggedMetrics[filterTag.Name()]
-			if !found {
-				return metrics
-			}
-			tagMetrics, found := tagValueMap[filterTag.Value()]
-			if !found {
-				return metrics
-			}
-			filterTagMetrics[i] = tagMetrics
-		}
-		// we pick the smallest set of metrics
-		minLenMetrics := pickWithMinLength(filterTagMetrics)
-
-		// and we merge
-		merged := data.NewMetrics()
-		for _, m := range minLenMetrics.MetricRecords() {
-			addToMerged := true
-			for _, fm := range filterTagMetrics {
-				if !fm.IsRecordPresent(m.Id()) {
-					addToMerged = false
-					break
-				}
-			}
-			if addToMerged {
-				merged.AddRecord(m)
-			}
-		}
-		metrics = merged
-	}
-	return metrics
+	return dataPoints, stats, nil
 }
 
-func pickWithMinLength(metrics []*data.Metrics) *data.Metrics {
-	minLen := metrics[0]
-	for _, m := range metrics {
-		if m.Len() < minLen.Len() {
-			minLen = m
-		}
+// Aggregates all filtered records within time range into a single value, returns false if there are no records
+func (mp *InMemoryMetricStreamProcessor) GetMetricValue(filters []*data.Tag, timeRange TimeRange, aggregate Aggregator) (float64, bool) {
+	defer queryDuration.With(VALUE_QUERY).ObserveSince(time.Now())
+	limiter := newQueryLimiter(mp.queryParallelism)
+
+	shardStates := make([]*AggregateState, len(mp.shards))
+	var wg sync.WaitGroup
+	for i, shard := range mp.shards {
+		wg.Add(1)
+		go func(i int, shard *metricShard) {
+			defer wg.Done()
+			shardStates[i] = shard.getAggregate(filters, timeRange, limiter)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	merged := NewAggregateState()
+	for _, state := range shardStates {
+		merged.Merge(state)
 	}
-	return minLen
+	if merged.Count == 0 {
+		return 0, false
+	}
+	return *aggregate(timeRange.From, merged).Value, true
+}
+
+// Counting semaphore bounding the number of goroutines of a single query doing actual work
+type queryLimiter chan struct{}
+
+func newQueryLimiter(parallelism int) queryLimiter {
+	return make(queryLimiter, parallelism)
+}
+
+func (limiter queryLimiter) acquire() {
+	limiter <- struct{}{}
+}
+
+func (limiter queryLimiter) release() {
+	<-limiter
 }
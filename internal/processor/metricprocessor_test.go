@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestShardedProcessorMatchesSingleShard(t *testing.T) {
+	records := testCsvRecords(500)
+	single := newTestProcessor(t, 1, records)
+	for _, shardCount := range []int{2, 7} {
+		sharded := newTestProcessor(t, shardCount, records)
+
+		for _, searchTerm := range []string{"", "gender", "location:", "location:New", "product_category:O", "unknown"} {
+			want := single.GetMetricTagFilters(searchTerm)
+			if !sort.StringsAreSorted(want) {
+				t.Errorf("%q: filters of 1 shard are not sorted: %v", searchTerm, want)
+			}
+			if got := sharded.GetMetricTagFilters(searchTerm); !reflect.DeepEqual(got, want) {
+				t.Errorf("%q: filters of %d shards = %v, want %v", searchTerm, shardCount, got, want)
+			}
+		}
+
+		if got, want := sharded.GetMetricTimeRange(), single.GetMetricTimeRange(); got != want {
+			t.Errorf("time range of %d shards = %v, want %v", shardCount, got, want)
+		}
+
+		daily := NewTimePartitioner(1, DAY, time.UTC, time.Sunday)
+		for _, filters := range [][]string{nil, {"gender:F"}, {"location:Chicago", "!product_category:Office"}} {
+			t.Run(fmt.Sprint(shardCount, " shards ", filters), func(t *testing.T) {
+				for name, aggregator := range map[string]Aggregator{"sum": SumAggregator, "count": CountAggregator} {
+					want, wantStats, err := single.GetMetricDataPoints(context.Background(), data.FromRequestFilters(filters), TimeRange{}, daily, aggregator)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, gotStats, err := sharded.GetMetricDataPoints(context.Background(), data.FromRequestFilters(filters), TimeRange{}, daily, aggregator)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(got, want) || gotStats != wantStats {
+						t.Errorf("%s: data points differ from 1 shard", name)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Record ids are not unique, so filters must match the tags of every record rather than the ids in the tag indexes
+func TestFiltersMatchRecordScan(t *testing.T) {
+	records := testCsvRecords(500)
+	yearly := NewTimePartitioner(12, MONTH, time.UTC, time.Sunday)
+	for _, filters := range [][]string{
+		{"!product_category:Office"},
+		{"gender:F", "location:Chicago"},
+		{"location:Chicago", "!product_category:Office"},
+		{"gender:M", "!location:Chicago", "!product_category:Apparel"},
+	} {
+		tags := data.FromRequestFilters(filters)
+		wantCount, wantSum := 0.0, 0.0
+		for _, record := range records {
+			m, _, err := data.FromCsvDataRecord(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matchesFilters(m, tags) {
+				wantCount++
+				wantSum += m.MetricValue()
+			}
+		}
+
+		for _, shardCount := range []int{1, 3} {
+			mp := newTestProcessor(t, shardCount, records)
+			for aggregator, want := range map[string]float64{"count": wantCount, "sum": wantSum} {
+				dataPoints, _, err := mp.GetMetricDataPoints(context.Background(), tags, TimeRange{}, yearly,
+					map[string]Aggregator{"count": CountAggregator, "sum": SumAggregator}[aggregator])
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := 0.0
+				for _, point := range dataPoints {
+					got += *point.Value
+				}
+				if math.Abs(got-want) > 1e-9 {
+					t.Errorf("%v, %d shards: %s = %v, want %v", filters, shardCount, aggregator, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCountMetricSeriesMatchesSeries(t *testing.T) {
+	mp := newTestProcessor(t, 3, testCsvRecords(500))
+	daily := NewTimePartitioner(1, DAY, time.UTC, time.Sunday)
+	timeRange := TimeRange{From: time.Date(2019, time.January, 3, 0, 0, 0, 0, time.UTC), To: time.Date(2019, time.January, 6, 0, 0, 0, 0, time.UTC)}
+	for _, test := range []struct {
+		filters []string
+		groupBy []string
+	}{
+		{nil, []string{"location"}},
+		{nil, []string{"location", "gender", "product_category"}},
+		{[]string{"gender:F"}, []string{"product_category"}},
+		{[]string{"!location:Chicago"}, []string{"location", "gender"}},
+	} {
+		filters := data.FromRequestFilters(test.filters)
+		series, _, err := mp.GetMetricSeries(context.Background(), filters, test.groupBy, timeRange, daily, CountAggregator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// series of records without some of the tags are not counted
+		want := 0
+		for _, s := range series {
+			complete := true
+			for _, name := range test.groupBy {
+				complete = complete && s.Tags[name] != ""
+			}
+			if complete {
+				want++
+			}
+		}
+		if count, err := mp.CountMetricSeries(context.Background(), filters, test.groupBy, timeRange, 1000); err != nil || count != want {
+			t.Errorf("%v by %v: count = %d, %v, want %d", test.filters, test.groupBy, count, err, want)
+		}
+		// counting stops right over the limit
+		if count, err := mp.CountMetricSeries(context.Background(), filters, test.groupBy, timeRange, want-2); err != nil || count != want-1 {
+			t.Errorf("%v by %v: count with limit %d = %d, %v, want %d", test.filters, test.groupBy, want-2, count, err, want-1)
+		}
+	}
+}
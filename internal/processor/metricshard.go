@@ -0,0 +1,202 @@
+package processor
+
+// Shard of the metric processor. Records are assigned to shards by record id, so all records with the same id
+// (and therefore all their tags) live in the same shard and filter intersections can be computed per shard.
+// Each shard has its own indexes, tag-filters trie and lock, so ingestion and queries run in parallel across shards.
+
+import (
+	"context"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func newMetricShard() *metricShard {
+	return &metricShard{
+		allMetrics:    data.NewMetrics(),
+		taggedMetrics: make(map[string]map[string]*data.Metrics),
+		tagFilters:    NewTrieNode(),
+	}
+}
+
+type metricShard struct {
+	lock sync.RWMutex
+
+	// all metrics time series for general layout
+	allMetrics *data.Metrics
+
+	// nested map for tagged metrics: tagName -> tagValue -> TaggedMetrics
+	taggedMetrics map[string]map[string]*data.Metrics
+
+	tagFilters *TrieNode
+
+	// time range covered by the shard records
+	dataRange TimeRange
+}
+
+func (shard *metricShard) index(metricRecord *data.MetricRecord, tags data.Tags) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	// based on tag names and values specified for the data record - populate nested metric data-storage
+	for tagName, tag := range tags {
+		shard.addTaggedRecord(tagName, tag.Value(), metricRecord)
+	}
+
+	shard.addRecord(metricRecord)
+}
+
+// Adds metric to the total collection. Not synchronized, callers hold the shard lock
+func (shard *metricShard) addRecord(metricRecord *data.MetricRecord) {
+	shard.allMetrics.AddRecord(metricRecord)
+	shard.dataRange = shard.dataRange.Extend(metricRecord.Timestamp())
+}
+
+func (shard *metricShard) getDataRange() TimeRange {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.dataRange
+}
+
+// Not synchronized, callers hold the shard lock
+func (shard *metricShard) addTaggedRecord(tagName string, tagValue string, metricRecord *data.MetricRecord) {
+	tagValueMap, found := shard.taggedMetrics[tagName]
+	if !found {
+		tagValueMap = make(map[string]*data.Metrics)
+	}
+
+	taggedMetrics, found := tagValueMap[tagValue]
+	if !found {
+		taggedMetrics = data.NewMetrics()
+
+		// and also update metric tag-filters storage
+		shard.tagFilters.AddWord(tagName + ":" + tagValue)
+	}
+	taggedMetrics.AddRecord(metricRecord)
+	tagValueMap[tagValue] = taggedMetrics
+	shard.taggedMetrics[tagName] = tagValueMap
+}
+
+func (shard *metricShard) getMetricTagFilters(searchTerm string) []string {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.tagFilters.GetWordsInSubtrie(searchTerm)
+}
+
+// Filters and partitions shard records by time and reduces every partition to a mergeable aggregate state,
+// also returns the number of filtered records
+func (shard *metricShard) getPartialAggregates(ctx context.Context, filters []*data.Tag, timeRange TimeRange, timePartition TimePartitioner, limiter queryLimiter) (map[time.Time]*AggregateState, int) {
+	limiter.acquire()
+	records := shard.getInputRecords(filters)
+	limiter.release()
+
+	return parallelPartitionByTime(ctx, records, timeRange, timePartition, limiter), len(records)
+}
+
+// Filters shard records within time range and reduces them into a single aggregate state
+func (shard *metricShard) getAggregate(filters []*data.Tag, timeRange TimeRange, limiter queryLimiter) *AggregateState {
+	limiter.acquire()
+	defer limiter.release()
+
+	state := NewAggregateState()
+	for _, m := range shard.getInputRecords(filters) {
+		if timeRange.Contains(m.Timestamp()) {
+			state.Add(m)
+		}
+	}
+	return state
+}
+
+// Returns filtered records of the shard. Records are only ever appended to the indexes, so the returned slice
+// stays valid after the shard lock is released.
+func (shard *metricShard) getInputRecords(filters []*data.Tag) []*data.MetricRecord {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.getInputMetrics(filters).MetricRecords()
+}
+
+func (shard *metricShard) getInputMetrics(filters []*data.Tag) *data.Metrics {
+	included := []*data.Tag{}
+	excluded := []*data.Tag{}
+	for _, filter := range filters {
+		if filter.Excluded() {
+			excluded = append(excluded, filter)
+		} else {
+			included = append(included, filter)
+		}
+	}
+	metrics := shard.getIncludedMetrics(included)
+	if len(excluded) == 0 {
+		return metrics
+	}
+
+	// drop records having any of the excluded tags, ids are not unique so records are matched by their own tags
+	remaining := data.NewMetrics()
+	for _, m := range metrics.MetricRecords() {
+		if matchesFilters(m, excluded) {
+			remaining.AddRecord(m)
+		}
+	}
+	return remaining
+}
+
+func (shard *metricShard) getIncludedMetrics(filters []*data.Tag) *data.Metrics {
+	// by default we take an empty set of metrics
+	metrics := data.NewMetrics()
+
+	if len(filters) == 0 {
+		// if no filters specified - we use all metrics for aggregation
+		metrics = shard.allMetrics
+	} else if len(filters) == 1 {
+		// if only one filter is specified - we can simply use pre-partitioned time series
+		filterTag := filters[0]
+		tagValueMap, found := shard.taggedMetrics[filterTag.Name()]
+		if found {
+			if tagMetrics, found := tagValueMap[filterTag.Value()]; found {
+				metrics = tagMetrics
+			}
+		}
+	} else {
+		// there are multiple filters specified which means we have to merge filtering results
+		// gather time series to be merged
+		filterTagMetrics := make([]*data.Metrics, len(filters))
+		for i, filterTag := range filters {
+			// if at least one of tags (name->value->...) does not have any data - filtering is not necessary
+			// as we'll get empty result in the end anyway
+			tagValueMap, found := shard.taggedMetrics[filterTag.Name()]
+			if !found {
+				return metrics
+			}
+			tagMetrics, found := tagValueMap[filterTag.Value()]
+			if !found {
+				return metrics
+			}
+			filterTagMetrics[i] = tagMetrics
+		}
+		filterIntersections.Inc()
+		defer filterIntersectionDuration.ObserveSince(time.Now())
+
+		// we pick the smallest set of metrics
+		minLenMetrics := pickWithMinLength(filterTagMetrics)
+
+		// and we merge, records sharing an id may have different tags so they are matched by their own tags
+		merged := data.NewMetrics()
+		for _, m := range minLenMetrics.MetricRecords() {
+			if matchesFilters(m, filters) {
+				merged.AddRecord(m)
+			}
+		}
+		metrics = merged
+	}
+	return metrics
+}
+
+func pickWithMinLength(metrics []*data.Metrics) *data.Metrics {
+	minLen := metrics[0]
+	for _, m := range metrics {
+		if m.Len() < minLen.Len() {
+			minLen = m
+		}
+	}
+	return minLen
+}
@@ -1,80 +1,516 @@
 package processor
 
 // Functions to partition metrics data by time into chunks to prepare them for aggregation.
-// This step as well as aggregation can benefit from parallelization.
+// Partitioning is done together with the first step of aggregation: records are reduced right away into
+// mergeable aggregate states of their time partitions. This lets us partition chunks of the input in parallel
+// (see parallelPartitionByTime) and merge per-chunk results afterwards.
+//
+// Time partitions are consecutive intervals of N units (minutes, hours, days, weeks, months) aligned to the
+// wall clock of the requested timezone:
+// * minutes and hours are aligned to the start of the day, so "15m" or "6h" partitions start at 00:00
+// * N days, N weeks and N months are counted from 1970-01-01, weeks start on the requested week day
+// * quarters and years are 3 and 12 months
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"valery-datadog-datastream-demo/internal/data"
 )
 
+// Number of records partitioned by a single worker
+const partitionChunkSize = 8192
+
 const (
-	DAILY_SCALE   = "Daily"
-	WEEKLY_SCALE  = "Weekly"
-	MONTHLY_SCALE = "Monthly"
+	MINUTELY_SCALE  = "Minutely"
+	HOURLY_SCALE    = "Hourly"
+	DAILY_SCALE     = "Daily"
+	WEEKLY_SCALE    = "Weekly"
+	MONTHLY_SCALE   = "Monthly"
+	QUARTERLY_SCALE = "Quarterly"
+	YEARLY_SCALE    = "Yearly"
+	AUTO_SCALE      = "auto"
 )
 
-// Currently we support only static time partitioning but potentially we could implement dynamic ones based
-// on data interval and desired number of data-points.
-func FromRequestScale(scale string) TimePartitioner {
-	switch scale {
-	case DAILY_SCALE:
-		return DailyTimePartitioner
-	case WEEKLY_SCALE:
-		return WeeklyTimePartitioner
-	case MONTHLY_SCALE:
-		return MonthlyTimePartitioner
+// Longest interval of a scale, longer ones would not fit time.Duration or take ages to walk through
+const MAX_SCALE_YEARS = 10
+
+// Points budget of the auto scale if request does not specify one
+const DEFAULT_MAX_POINTS = 300
+
+// Intervals auto scale chooses from, from the finest to the coarsest
+var autoScaleIntervals = []string{
+	"1m", "5m", "10m", "15m", "30m", "1h", "2h", "3h", "6h", "12h",
+	"1d", "2d", "1w", "2w", "1mo", "1q", "1y", "2y", "5y", "10y",
+}
+
+type intervalUnit int
+
+const (
+	MINUTE intervalUnit = iota
+	HOUR
+	DAY
+	WEEK
+	MONTH
+)
+
+// interval suffixes accepted in the scale, for ex. "15m", "6h", "3d", "2w", "2mo", "1y"
+var intervalUnitSuffixes = []struct {
+	suffix     string
+	unit       intervalUnit
+	multiplier int
+}{
+	// "mo" goes before "m" so that it is matched first
+	{"mo", MONTH, 1},
+	{"m", MINUTE, 1},
+	{"h", HOUR, 1},
+	{"d", DAY, 1},
+	{"w", WEEK, 1},
+	{"q", MONTH, 3},
+	{"y", MONTH, 12},
+}
+
+var (
+	ErrInvalidScale     = errors.New("invalid scale")
+	ErrInvalidTimezone  = errors.New("invalid timezone")
+	ErrInvalidWeekStart = errors.New("invalid week start")
+	ErrInvalidTimeRange = errors.New("invalid time range")
+)
+
+// Creates time partitioner from request parameters. Scale is either one of the named scales, an arbitrary
+// interval or "auto", empty scale means monthly. Timezone is an IANA name, UTC by default. Week start is the name
+// of the week day, Sunday by default ("ISO" is accepted as an alias of Monday).
+//
+// Auto scale is the dynamic partitioner: it picks the finest interval which keeps the number of partitions within
+// queried time range under request's max points, so that charts stay readable both for a week and for several years.
+func FromRequestScale(request data.GetDataRequest, timeRange TimeRange) (TimePartitioner, error) {
+	location := time.UTC
+	if request.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(request.Timezone)
+		if err != nil {
+			return TimePartitioner{}, fmt.Errorf("%w: unknown timezone %q", ErrInvalidTimezone, request.Timezone)
+		}
+	}
+
+	weekday, err := parseWeekday(request.WeekStart)
+	if err != nil {
+		return TimePartitioner{}, err
+	}
+
+	if request.Scale == AUTO_SCALE {
+		return autoTimePartitioner(timeRange, request.MaxPoints, location, weekday), nil
+	}
+
+	count, unit, err := parseScale(request.Scale)
+	if err != nil {
+		return TimePartitioner{}, err
+	}
+	return NewTimePartitioner(count, unit, location, weekday), nil
+}
+
+func autoTimePartitioner(timeRange TimeRange, maxPoints int, location *time.Location, weekStart time.Weekday) TimePartitioner {
+	if maxPoints <= 0 {
+		maxPoints = DEFAULT_MAX_POINTS
+	}
+	// charts can't use more points than gaps filling produces anyway
+	if maxPoints > MAX_FILLED_POINTS {
+		maxPoints = MAX_FILLED_POINTS
+	}
+	var partitioner TimePartitioner
+	for _, interval := range autoScaleIntervals {
+		count, unit, _ := parseScale(interval)
+		partitioner = NewTimePartitioner(count, unit, location, weekStart)
+		if timeRange.IsEmpty() || partitioner.countPartitions(timeRange, maxPoints+1) <= maxPoints {
+			break
+		}
+	}
+	return partitioner
+}
+
+func NewTimePartitioner(count int, unit intervalUnit, location *time.Location, weekStart time.Weekday) TimePartitioner {
+	return TimePartitioner{
+		count:     count,
+		unit:      unit,
+		location:  location,
+		weekStart: weekStart,
+	}
+}
+
+// Splits time into partitions of count units
+type TimePartitioner struct {
+	count     int
+	unit      intervalUnit
+	location  *time.Location
+	weekStart time.Weekday
+}
+
+// Returns the start of the time partition given timestamp belongs to, used as a partition key
+func (p TimePartitioner) PartitionKey(timestamp time.Time) time.Time {
+	local := timestamp.In(p.location)
+	year, month, day := local.Date()
+
+	switch p.unit {
+	case MINUTE:
+		minuteOfDay := local.Hour()*60 + local.Minute()
+		return time.Date(year, month, day, 0, minuteOfDay-minuteOfDay%p.count, 0, 0, p.location)
+	case HOUR:
+		hour := local.Hour()
+		return time.Date(year, month, day, hour-hour%p.count, 0, 0, 0, p.location)
+	case DAY:
+		days := daysSinceEpoch(year, month, day)
+		return time.Date(year, month, day-floorMod(days, p.count), 0, 0, 0, 0, p.location)
+	case WEEK:
+		// go back to the week start day first, then to the start of N-weeks partition
+		day -= floorMod(int(local.Weekday())-int(p.weekStart), 7)
+		weeks := floorDiv(daysSinceEpoch(year, month, day)-int(p.weekStart-time.Thursday), 7)
+		return time.Date(year, month, day-7*floorMod(weeks, p.count), 0, 0, 0, 0, p.location)
+	default:
+		months := year*12 + int(month) - 1
+		return time.Date(year, month-time.Month(floorMod(months, p.count)), 1, 0, 0, 0, 0, p.location)
+	}
+}
+
+// Returns the start of the time partition which follows the partition starting at partitionStart
+func (p TimePartitioner) NextPartition(partitionStart time.Time) time.Time {
+	local := partitionStart.In(p.location)
+	year, month, day := local.Date()
+
+	switch p.unit {
+	case MINUTE, HOUR:
+		// partitions restart every day, so the last one of the day may be shorter. Wall clock hour which is
+		// repeated when daylight saving time ends belongs to a single partition, so we step over it
+		for cursor := local.Add(p.Duration()); ; cursor = cursor.Add(p.Duration()) {
+			if next := p.PartitionKey(cursor); next.After(partitionStart) {
+				return next
+			}
+		}
+	case DAY:
+		return time.Date(year, month, day+p.count, 0, 0, 0, 0, p.location)
+	case WEEK:
+		return time.Date(year, month, day+7*p.count, 0, 0, 0, 0, p.location)
+	default:
+		return time.Date(year, month+time.Month(p.count), 1, 0, 0, 0, 0, p.location)
+	}
+}
+
+// Nominal length of the partition (calendar partitions may be shorter or longer)
+func (p TimePartitioner) Duration() time.Duration {
+	switch p.unit {
+	case MINUTE:
+		return time.Duration(p.count) * time.Minute
+	case HOUR:
+		return time.Duration(p.count) * time.Hour
+	case DAY:
+		return time.Duration(p.count) * 24 * time.Hour
+	case WEEK:
+		return time.Duration(p.count) * 7 * 24 * time.Hour
+	default:
+		return time.Duration(p.count) * 30 * 24 * time.Hour
+	}
+}
+
+func (p TimePartitioner) Location() *time.Location {
+	return p.location
+}
+
+// Interval in the scale format, for ex. "15m", "1d", "2w", "1q"
+func (p TimePartitioner) Interval() string {
+	switch p.unit {
+	case MINUTE:
+		return strconv.Itoa(p.count) + "m"
+	case HOUR:
+		return strconv.Itoa(p.count) + "h"
+	case DAY:
+		return strconv.Itoa(p.count) + "d"
+	case WEEK:
+		return strconv.Itoa(p.count) + "w"
+	}
+	if p.count%12 == 0 {
+		return strconv.Itoa(p.count/12) + "y"
+	}
+	if p.count%3 == 0 {
+		return strconv.Itoa(p.count/3) + "q"
+	}
+	return strconv.Itoa(p.count) + "mo"
+}
+
+// Counts partitions overlapping the time range, stops counting at limit. No partition is longer than twice its
+// nominal length (the wall clock hour repeated when daylight saving time ends, 31 days month), so ranges far over
+// the limit are cut off right away. Calendar partitions are counted arithmetically, minutes and hours are counted by
+// whole days and walked only in the days which are cut by the range or don't have 24 hours.
+func (p TimePartitioner) countPartitions(timeRange TimeRange, limit int) int {
+	if !timeRange.From.Before(timeRange.To) || limit <= 0 {
+		return 0
+	}
+	if timeRange.To.Sub(timeRange.From)/(2*p.Duration()) >= time.Duration(limit) {
+		return limit
+	}
+
+	count := 0
+	switch p.unit {
+	case MINUTE, HOUR:
+		partitionMinutes := int(p.Duration() / time.Minute)
+		partitionsPerDay := (24*60 + partitionMinutes - 1) / partitionMinutes
+		for pStart := p.PartitionKey(timeRange.From); pStart.Before(timeRange.To) && count < limit; {
+			local := pStart.In(p.location)
+			year, month, day := local.Date()
+			nextDay := time.Date(year, month, day+1, 0, 0, 0, 0, p.location)
+			if local.Hour() == 0 && local.Minute() == 0 && nextDay.Sub(pStart) == 24*time.Hour && !nextDay.After(timeRange.To) {
+				count += partitionsPerDay
+				pStart = nextDay
+			} else {
+				count++
+				pStart = p.NextPartition(pStart)
+			}
+		}
+	default:
+		// the partition of the last instant of the range is the last one
+		count = p.calendarPartitionIndex(timeRange.To.Add(-time.Nanosecond)) - p.calendarPartitionIndex(timeRange.From) + 1
+	}
+	if count > limit {
+		count = limit
+	}
+	return count
+}
+
+// Index of the day, week or month partition timestamp belongs to, counted from the partition of 1970-01-01
+func (p TimePartitioner) calendarPartitionIndex(timestamp time.Time) int {
+	local := timestamp.In(p.location)
+	year, month, day := local.Date()
+	switch p.unit {
+	case DAY:
+		return floorDiv(daysSinceEpoch(year, month, day), p.count)
+	case WEEK:
+		// the same week numbering as of PartitionKey
+		day -= floorMod(int(local.Weekday())-int(p.weekStart), 7)
+		return floorDiv(floorDiv(daysSinceEpoch(year, month, day)-int(p.weekStart-time.Thursday), 7), p.count)
 	default:
-		return MonthlyTimePartitioner
+		return floorDiv(year*12+int(month)-1, p.count)
+	}
+}
+
+// *** Time range ***
+
+// Creates time range from request's epoch milliseconds, zero value means unbounded
+func FromRequestTimeRange(from int64, to int64) (TimeRange, error) {
+	timeRange := TimeRange{}
+	if from != 0 {
+		timeRange.From = time.UnixMilli(from).UTC()
+	}
+	if to != 0 {
+		timeRange.To = time.UnixMilli(to).UTC()
 	}
+	if from != 0 && to != 0 && !timeRange.From.Before(timeRange.To) {
+		return TimeRange{}, fmt.Errorf("%w: start must be before the end", ErrInvalidTimeRange)
+	}
+	return timeRange, nil
 }
 
-type TimePartitioner func([]*data.MetricRecord) map[time.Time][]*data.MetricRecord
+// Time range [From, To), zero From or To means the range is not bounded on that side
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+}
 
-func MonthlyTimePartitioner(inputMetrics []*data.MetricRecord) map[time.Time][]*data.MetricRecord {
-	return partitionByTime(inputMetrics, startOfTheMonth)
+func (r TimeRange) Contains(timestamp time.Time) bool {
+	return (r.From.IsZero() || !timestamp.Before(r.From)) && (r.To.IsZero() || timestamp.Before(r.To))
 }
 
-func WeeklyTimePartitioner(inputMetrics []*data.MetricRecord) map[time.Time][]*data.MetricRecord {
-	return partitionByTime(inputMetrics, startOfTheWeek)
+// Range is empty if it is not bounded on either side
+func (r TimeRange) IsEmpty() bool {
+	return r.From.IsZero() || r.To.IsZero()
 }
 
-func DailyTimePartitioner(inputMetrics []*data.MetricRecord) map[time.Time][]*data.MetricRecord {
-	return partitionByTime(inputMetrics, startOfTheDay)
+// Returns the smallest range which contains both r and timestamp
+func (r TimeRange) Extend(timestamp time.Time) TimeRange {
+	if r.From.IsZero() || timestamp.Before(r.From) {
+		r.From = timestamp
+	}
+	if r.To.IsZero() || !timestamp.Before(r.To) {
+		r.To = timestamp.Add(time.Nanosecond)
+	}
+	return r
 }
 
-func partitionByTime(inputMetrics []*data.MetricRecord, partitionKey timePartitionKey) map[time.Time][]*data.MetricRecord {
-	partitioned := make(map[time.Time][]*data.MetricRecord)
+// Returns the smallest range which contains both ranges, unbounded sides are ignored
+func (r TimeRange) Union(other TimeRange) TimeRange {
+	if !other.From.IsZero() {
+		r = r.Extend(other.From)
+	}
+	if !other.To.IsZero() {
+		r = r.Extend(other.To.Add(-time.Nanosecond))
+	}
+	return r
+}
+
+// Fills unbounded sides of the range from the other range
+func (r TimeRange) BoundedBy(other TimeRange) TimeRange {
+	if r.From.IsZero() {
+		r.From = other.From
+	}
+	if r.To.IsZero() {
+		r.To = other.To
+	}
+	return r
+}
+
+// Partitions records within time range by time and reduces every partition into aggregate state
+func partitionByTime(inputMetrics []*data.MetricRecord, timeRange TimeRange, partitioner TimePartitioner) map[time.Time]*AggregateState {
+	partitioned := make(map[time.Time]*AggregateState)
 	for _, m := range inputMetrics {
-		pKey := partitionKey(m.Timestamp())
+		if !timeRange.Contains(m.Timestamp()) {
+			continue
+		}
+		pKey := partitioner.PartitionKey(m.Timestamp())
 
-		partition, found := partitioned[pKey]
+		state, found := partitioned[pKey]
 		if !found {
-			partition = make([]*data.MetricRecord, 0)
+			state = NewAggregateState()
+			partitioned[pKey] = state
 		}
-		partition = append(partition, m)
-		partitioned[pKey] = partition
+		state.Add(m)
 	}
 	return partitioned
 }
 
-type timePartitionKey func(time.Time) time.Time
+// Splits records into chunks and partitions them in parallel, every chunk is processed by a separate worker
+// into its own partial states which are merged in the end. Workers take slots from the query limiter, so that
+// a single query can't occupy more goroutines than its parallelism limit. No more chunks are started once
+// the query is cancelled, the result is incomplete then.
+func parallelPartitionByTime(ctx context.Context, inputMetrics []*data.MetricRecord, timeRange TimeRange, partitioner TimePartitioner, limiter queryLimiter) map[time.Time]*AggregateState {
+	defer partitionDuration.ObserveSince(time.Now())
+	if len(inputMetrics) <= partitionChunkSize {
+		limiter.acquire()
+		defer limiter.release()
+		return partitionByTime(inputMetrics, timeRange, partitioner)
+	}
+
+	chunksCount := (len(inputMetrics) + partitionChunkSize - 1) / partitionChunkSize
+	chunkPartials := make([]map[time.Time]*AggregateState, chunksCount)
+	var wg sync.WaitGroup
+	for i := 0; i < chunksCount && ctx.Err() == nil; i++ {
+		chunk := inputMetrics[i*partitionChunkSize:]
+		if len(chunk) > partitionChunkSize {
+			chunk = chunk[:partitionChunkSize]
+		}
+		limiter.acquire()
+		wg.Add(1)
+		go func(i int, chunk []*data.MetricRecord) {
+			defer wg.Done()
+			defer limiter.release()
+			chunkPartials[i] = partitionByTime(chunk, timeRange, partitioner)
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	partitioned := make(map[time.Time]*AggregateState)
+	for _, partials := range chunkPartials {
+		mergePartitions(partitioned, partials)
+	}
+	return partitioned
+}
+
+// Merges partial aggregate states of src into dst
+func mergePartitions(dst map[time.Time]*AggregateState, src map[time.Time]*AggregateState) {
+	for pKey, state := range src {
+		if dstState, found := dst[pKey]; found {
+			dstState.Merge(state)
+		} else {
+			dst[pKey] = state
+		}
+	}
+}
+
+// *** Request parameters parsing ***
+
+func parseScale(scale string) (int, intervalUnit, error) {
+	switch scale {
+	case MINUTELY_SCALE:
+		return 1, MINUTE, nil
+	case HOURLY_SCALE:
+		return 1, HOUR, nil
+	case DAILY_SCALE:
+		return 1, DAY, nil
+	case WEEKLY_SCALE:
+		return 1, WEEK, nil
+	case MONTHLY_SCALE, "":
+		return 1, MONTH, nil
+	case QUARTERLY_SCALE:
+		return 3, MONTH, nil
+	case YEARLY_SCALE:
+		return 12, MONTH, nil
+	}
+
+	for _, s := range intervalUnitSuffixes {
+		if !strings.HasSuffix(scale, s.suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(strings.TrimSuffix(scale, s.suffix))
+		if err != nil || count < 1 {
+			break
+		}
+		if (s.unit == MINUTE && count > 24*60) || (s.unit == HOUR && count > 24) {
+			return 0, 0, fmt.Errorf("%w: %q is longer than a day, use days instead", ErrInvalidScale, scale)
+		}
+		// compared before multiplying, so that the count can't overflow
+		if count > maxIntervalCount(s.unit)/s.multiplier {
+			return 0, 0, fmt.Errorf("%w: %q is longer than %d years", ErrInvalidScale, scale, MAX_SCALE_YEARS)
+		}
+		return count * s.multiplier, s.unit, nil
+	}
+	return 0, 0, fmt.Errorf("%w: unknown scale %q", ErrInvalidScale, scale)
+}
+
+// Number of units in the longest interval of a scale
+func maxIntervalCount(unit intervalUnit) int {
+	switch unit {
+	case MINUTE:
+		return 24 * 60
+	case HOUR:
+		return 24
+	case DAY:
+		return MAX_SCALE_YEARS * 366
+	case WEEK:
+		return MAX_SCALE_YEARS * 366 / 7
+	default:
+		return MAX_SCALE_YEARS * 12
+	}
+}
+
+func parseWeekday(weekStart string) (time.Weekday, error) {
+	if weekStart == "" {
+		return time.Sunday, nil
+	}
+	if strings.EqualFold(weekStart, "ISO") {
+		return time.Monday, nil
+	}
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if strings.EqualFold(weekStart, weekday.String()) {
+			return weekday, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown day %q", ErrInvalidWeekStart, weekStart)
+}
+
+// *** Calendar helpers ***
 
-func startOfTheMonth(timestamp time.Time) time.Time {
-	year, month, _ := timestamp.Date()
-	return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+// Number of days between 1970-01-01 and the given date
+func daysSinceEpoch(year int, month time.Month, day int) int {
+	return int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
 }
 
-func startOfTheWeek(timestamp time.Time) time.Time {
-	// count days back until we reach the first day of the week
-	for timestamp.Weekday() > 0 {
-		timestamp = timestamp.AddDate(0, 0, -1)
+func floorDiv(a int, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
 	}
-	year, month, day := timestamp.Date()
-	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return a / b
 }
 
-func startOfTheDay(timestamp time.Time) time.Time {
-	year, month, day := timestamp.Date()
-	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+func floorMod(a int, b int) int {
+	return a - floorDiv(a, b)*b
 }
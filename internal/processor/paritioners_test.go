@@ -0,0 +1,191 @@
+package processor
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", name, err)
+	}
+	return location
+}
+
+// Reference count: every partition walked one by one
+func walkPartitions(p TimePartitioner, timeRange TimeRange, limit int) int {
+	count := 0
+	for pStart := p.PartitionKey(timeRange.From); pStart.Before(timeRange.To) && count < limit; pStart = p.NextPartition(pStart) {
+		count++
+	}
+	return count
+}
+
+func TestCountPartitionsMatchesWalk(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	locations := []*time.Location{time.UTC, mustLoadLocation(t, "America/New_York"), mustLoadLocation(t, "Australia/Lord_Howe"), mustLoadLocation(t, "Asia/Kolkata")}
+	intervals := []string{"1m", "7m", "15m", "1h", "5h", "12h", "1d", "3d", "1w", "2w", "1mo", "1q", "5y"}
+	spans := []time.Duration{time.Hour, 25 * time.Hour, 40 * 24 * time.Hour, 400 * 24 * time.Hour}
+	base := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, location := range locations {
+		for _, interval := range intervals {
+			count, unit, _ := parseScale(interval)
+			for _, weekStart := range []time.Weekday{time.Sunday, time.Monday} {
+				p := NewTimePartitioner(count, unit, location, weekStart)
+				for _, span := range spans {
+					from := base.Add(time.Duration(random.Int63n(int64(730 * 24 * time.Hour))))
+					timeRange := TimeRange{From: from, To: from.Add(span)}
+					for _, limit := range []int{1, 100, 5000} {
+						if got, want := p.countPartitions(timeRange, limit), walkPartitions(p, timeRange, limit); got != want {
+							t.Errorf("%s %s week start %s, %v - %v, limit %d: countPartitions = %d, want %d",
+								location, interval, weekStart, timeRange.From, timeRange.To, limit, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCountPartitionsOfHugeRangeIsCutOff(t *testing.T) {
+	p := NewTimePartitioner(1, MINUTE, time.UTC, time.Sunday)
+	timeRange := TimeRange{From: time.Date(2, time.January, 1, 0, 0, 0, 0, time.UTC), To: time.Now()}
+
+	if got := p.countPartitions(timeRange, MAX_FILLED_POINTS+1); got != MAX_FILLED_POINTS+1 {
+		t.Errorf("countPartitions = %d, want the limit %d", got, MAX_FILLED_POINTS+1)
+	}
+	if _, err := ZeroFiller(nil, timeRange, p); !errors.Is(err, ErrInvalidFill) {
+		t.Errorf("ZeroFiller error = %v, want %v", err, ErrInvalidFill)
+	}
+}
+
+func TestAutoScaleClampsMaxPoints(t *testing.T) {
+	timeRange := TimeRange{From: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	for _, maxPoints := range []int{MAX_FILLED_POINTS, math.MaxInt} {
+		partitioner, err := FromRequestScale(data.GetDataRequest{Scale: AUTO_SCALE, MaxPoints: maxPoints}, timeRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a minute scale would give ~5M points
+		if interval := partitioner.Interval(); interval != "1h" {
+			t.Errorf("max points %d: interval = %s, want 1h", maxPoints, interval)
+		}
+	}
+}
+
+func TestPartitionKeyAndNextPartition(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		timezone  string
+		scale     string
+		weekStart string
+		timestamp string
+		key       string
+		next      string
+	}{
+		// daylight saving time in New York starts on 2023-03-12 at 02:00 and ends on 2023-11-05 at 02:00
+		{"day of 23 hours", "America/New_York", "1d", "", "2023-03-12T12:00:00-04:00", "2023-03-12T00:00:00-05:00", "2023-03-13T00:00:00-04:00"},
+		{"day of 25 hours", "America/New_York", "1d", "", "2023-11-05T12:00:00-05:00", "2023-11-05T00:00:00-04:00", "2023-11-06T00:00:00-05:00"},
+		{"hour before the skipped one", "America/New_York", "1h", "", "2023-03-12T01:30:00-05:00", "2023-03-12T01:00:00-05:00", "2023-03-12T03:00:00-04:00"},
+		{"hour after the skipped one", "America/New_York", "1h", "", "2023-03-12T03:30:00-04:00", "2023-03-12T03:00:00-04:00", "2023-03-12T04:00:00-04:00"},
+		{"first of the repeated hours", "America/New_York", "1h", "", "2023-11-05T01:30:00-04:00", "2023-11-05T01:00:00-04:00", "2023-11-05T02:00:00-05:00"},
+		{"second of the repeated hours", "America/New_York", "1h", "", "2023-11-05T01:30:00-05:00", "2023-11-05T01:00:00-04:00", "2023-11-05T02:00:00-05:00"},
+		{"6 hours with the skipped hour", "America/New_York", "6h", "", "2023-03-12T05:00:00-04:00", "2023-03-12T00:00:00-05:00", "2023-03-12T06:00:00-04:00"},
+		{"15 minutes in the repeated hour", "America/New_York", "15m", "", "2023-11-05T01:50:00-05:00", "2023-11-05T01:45:00-04:00", "2023-11-05T02:00:00-05:00"},
+		{"half hour offset", "Asia/Kolkata", "1h", "", "2023-01-01T00:45:00+05:30", "2023-01-01T00:00:00+05:30", "2023-01-01T01:00:00+05:30"},
+		{"day of half hour offset", "Asia/Kolkata", "1d", "", "2022-12-31T20:00:00Z", "2023-01-01T00:00:00+05:30", "2023-01-02T00:00:00+05:30"},
+
+		// 2023-01-01 is a Sunday
+		{"Sunday week", "America/New_York", "1w", "Sunday", "2023-01-04T10:00:00-05:00", "2023-01-01T00:00:00-05:00", "2023-01-08T00:00:00-05:00"},
+		{"ISO week", "America/New_York", "1w", "ISO", "2023-01-04T10:00:00-05:00", "2023-01-02T00:00:00-05:00", "2023-01-09T00:00:00-05:00"},
+		{"Sunday in Sunday week", "America/New_York", "1w", "Sunday", "2023-01-08T10:00:00-05:00", "2023-01-08T00:00:00-05:00", "2023-01-15T00:00:00-05:00"},
+		{"Sunday in ISO week", "America/New_York", "1w", "ISO", "2023-01-08T10:00:00-05:00", "2023-01-02T00:00:00-05:00", "2023-01-09T00:00:00-05:00"},
+		{"week of the year change", "Europe/Berlin", "1w", "Monday", "2021-01-01T12:00:00+01:00", "2020-12-28T00:00:00+01:00", "2021-01-04T00:00:00+01:00"},
+		{"week with daylight saving time start", "America/New_York", "1w", "", "2023-03-14T10:00:00-04:00", "2023-03-12T00:00:00-05:00", "2023-03-19T00:00:00-04:00"},
+
+		// UTC timestamps fall into the next month or quarter already
+		{"last hour of a month", "America/New_York", "1mo", "", "2023-03-31T23:30:00-04:00", "2023-03-01T00:00:00-05:00", "2023-04-01T00:00:00-04:00"},
+		{"first instant of a month", "America/New_York", "1mo", "", "2023-04-01T00:00:00-04:00", "2023-04-01T00:00:00-04:00", "2023-05-01T00:00:00-04:00"},
+		{"last hour of a quarter", "America/New_York", "1q", "", "2023-03-31T23:30:00-04:00", "2023-01-01T00:00:00-05:00", "2023-04-01T00:00:00-04:00"},
+		{"last hour of a year quarter", "America/New_York", "1q", "", "2023-12-31T20:00:00-05:00", "2023-10-01T00:00:00-04:00", "2024-01-01T00:00:00-05:00"},
+		{"month ahead of UTC", "Asia/Tokyo", "1mo", "", "2023-01-31T16:00:00Z", "2023-02-01T00:00:00+09:00", "2023-03-01T00:00:00+09:00"},
+		{"year", "America/New_York", "1y", "", "2023-12-31T20:00:00-05:00", "2023-01-01T00:00:00-05:00", "2024-01-01T00:00:00-05:00"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := FromRequestScale(data.GetDataRequest{Scale: test.scale, Timezone: test.timezone, WeekStart: test.weekStart}, TimeRange{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			timestamp, err := time.Parse(time.RFC3339, test.timestamp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := p.PartitionKey(timestamp)
+			if got := key.Format(time.RFC3339); got != test.key {
+				t.Errorf("PartitionKey = %s, want %s", got, test.key)
+			}
+			next := p.NextPartition(key)
+			if got := next.Format(time.RFC3339); got != test.next {
+				t.Errorf("NextPartition = %s, want %s", got, test.next)
+			}
+			// partitions follow each other without gaps
+			if before := p.PartitionKey(next.Add(-time.Nanosecond)); !before.Equal(key) {
+				t.Errorf("partition of the instant before the next one is %s", before.Format(time.RFC3339))
+			}
+			if !p.PartitionKey(next).Equal(next) {
+				t.Errorf("next partition %s is not a partition start", next.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestFromRequestScaleErrors(t *testing.T) {
+	for _, test := range []struct {
+		request  data.GetDataRequest
+		sentinel error
+	}{
+		{data.GetDataRequest{Scale: "1d", Timezone: "Mars/Olympus_Mons"}, ErrInvalidTimezone},
+		{data.GetDataRequest{Scale: "1w", WeekStart: "Funday"}, ErrInvalidWeekStart},
+		{data.GetDataRequest{Scale: "1fortnight"}, ErrInvalidScale},
+		{data.GetDataRequest{Scale: "25h"}, ErrInvalidScale},
+		{data.GetDataRequest{Scale: "11y"}, ErrInvalidScale},
+		{data.GetDataRequest{Scale: "3661d"}, ErrInvalidScale},
+		// durations overflowing to zero and counts overflowing when multiplied
+		{data.GetDataRequest{Scale: "70368744177664mo"}, ErrInvalidScale},
+		{data.GetDataRequest{Scale: "9223372036854775807d"}, ErrInvalidScale},
+		{data.GetDataRequest{Scale: "768614336404564650y"}, ErrInvalidScale},
+		{data.GetDataRequest{Scale: "3074457345618258603q"}, ErrInvalidScale},
+	} {
+		if _, err := FromRequestScale(test.request, TimeRange{}); !errors.Is(err, test.sentinel) {
+			t.Errorf("%+v: error = %v, want %v", test.request, err, test.sentinel)
+		}
+	}
+}
+
+func TestLongestScalesFillGaps(t *testing.T) {
+	timeRange := TimeRange{
+		From: time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for _, scale := range []string{"10y", "40q", "120mo", "522w", "3660d"} {
+		p, err := FromRequestScale(data.GetDataRequest{Scale: scale}, timeRange)
+		if err != nil {
+			t.Fatalf("%s: error = %v", scale, err)
+		}
+		filled, err := ZeroFiller(nil, timeRange, p)
+		if err != nil {
+			t.Fatalf("%s: ZeroFiller error = %v", scale, err)
+		}
+		if want := walkPartitions(p, timeRange, MAX_FILLED_POINTS); len(filled) != want || want < 20 {
+			t.Errorf("%s: %d data points, want %d", scale, len(filled), want)
+		}
+	}
+}
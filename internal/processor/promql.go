@@ -0,0 +1,457 @@
+package processor
+
+// Parser of the PromQL subset served by the Prometheus compatible API:
+// * selectors with label matchers: online_spent{location="Chicago",gender!="F",product_category=~"Nest.*"}
+// * range selectors inside rate and increase: rate(online_spent{location="Chicago"}[1h])
+// * aggregations: sum, avg, count, min and max, optionally by (label, ...)
+// Errors point to the position (1-based) in the query, as errors of formulas and query strings do.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPromQL = errors.New("invalid PromQL")
+
+// Parentheses and aggregations nested deeper are rejected, parser and evaluation recurse per level
+const MAX_PROMQL_DEPTH = 100
+
+const (
+	EQUAL_MATCHER          = "="
+	NOT_EQUAL_MATCHER      = "!="
+	REGEX_MATCHER          = "=~"
+	NOT_REGEX_MATCHER      = "!~"
+	METRIC_NAME_LABEL      = "__name__"
+	PROM_RATE_FUNCTION     = "rate"
+	PROM_INCREASE_FUNCTION = "increase"
+	SUM_AGGREGATION        = "sum"
+	AVG_AGGREGATION        = "avg"
+	COUNT_AGGREGATION      = "count"
+	MIN_AGGREGATION        = "min"
+	MAX_AGGREGATION        = "max"
+	BY_CLAUSE              = "by"
+	WITHOUT_CLAUSE         = "without"
+)
+
+var promAggregations = map[string]bool{
+	SUM_AGGREGATION:   true,
+	AVG_AGGREGATION:   true,
+	COUNT_AGGREGATION: true,
+	MIN_AGGREGATION:   true,
+	MAX_AGGREGATION:   true,
+}
+
+// *** Expression tree ***
+
+type promNode interface{}
+
+type promSelector struct {
+	matchers []*promMatcher
+	// range of the range selector, zero for instant selectors
+	window time.Duration
+}
+
+type promMatcher struct {
+	name  string
+	op    string
+	value string
+	regex *regexp.Regexp
+}
+
+type promFunction struct {
+	name string
+	arg  *promSelector
+}
+
+type promAggregation struct {
+	op  string
+	by  []string
+	arg promNode
+}
+
+// Label value of series without the label is ""
+func (matcher *promMatcher) matches(value string) bool {
+	switch matcher.op {
+	case EQUAL_MATCHER:
+		return value == matcher.value
+	case NOT_EQUAL_MATCHER:
+		return value != matcher.value
+	case REGEX_MATCHER:
+		return matcher.regex.MatchString(value)
+	default:
+		return !matcher.regex.MatchString(value)
+	}
+}
+
+// Parses PromQL expression, errors point to the position (1-based) in the expression
+func parsePromQL(expression string) (promNode, error) {
+	parser := &promParser{expression: expression}
+	parser.next()
+	node, err := parser.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if parser.token.kind != promEnd {
+		return nil, parser.errorf("unexpected %q", parser.token.text)
+	}
+	if selector, ok := node.(*promSelector); ok && selector.window > 0 {
+		return nil, fmt.Errorf("%w: range vector can't be the result of the query, use rate or increase", ErrInvalidPromQL)
+	}
+	return node, nil
+}
+
+// *** Parser ***
+
+type promTokenKind int
+
+const (
+	promEnd promTokenKind = iota
+	promIdentifier
+	promString
+	promDuration
+	promPunctuation
+)
+
+type promToken struct {
+	kind     promTokenKind
+	text     string
+	position int
+}
+
+// Recursive descent parser:
+//
+//	expression  = aggregation | function | selector | "(" expression ")"
+//	aggregation = op [ "by" labels ] "(" expression ")" [ "by" labels ]
+//	function    = ("rate" | "increase") "(" selector ")"
+//	selector    = [ name ] [ "{" [ matcher { "," matcher } [ "," ] ] "}" ] [ "[" duration "]" ]
+//	matcher     = label ( "=" | "!=" | "=~" | "!~" ) string
+//	labels      = "(" [ label { "," label } ] ")"
+type promParser struct {
+	expression string
+	offset     int
+	token      promToken
+	err        error
+	depth      int // nesting of expressions
+}
+
+func (parser *promParser) parseExpression() (promNode, error) {
+	if parser.err != nil {
+		return nil, parser.err
+	}
+	if parser.depth++; parser.depth > MAX_PROMQL_DEPTH {
+		return nil, parser.errorf("query is nested deeper than %d levels", MAX_PROMQL_DEPTH)
+	}
+	defer func() { parser.depth-- }()
+	token := parser.token
+	switch {
+	case parser.isPunctuation("("):
+		parser.next()
+		node, err := parser.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := parser.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case parser.isPunctuation("{"):
+		return parser.parseSelector("")
+	case token.kind == promIdentifier:
+		parser.next()
+		if promAggregations[token.text] && (parser.isPunctuation("(") || parser.isIdentifier(BY_CLAUSE, WITHOUT_CLAUSE)) {
+			return parser.parseAggregation(token.text)
+		}
+		if parser.isPunctuation("(") {
+			return parser.parseFunction(token)
+		}
+		return parser.parseSelector(token.text)
+	case token.kind == promEnd:
+		return nil, parser.errorf("unexpected end of query")
+	default:
+		return nil, parser.errorf("unexpected %q", token.text)
+	}
+}
+
+func (parser *promParser) parseAggregation(op string) (promNode, error) {
+	aggregation := &promAggregation{op: op}
+	if parser.isIdentifier(BY_CLAUSE, WITHOUT_CLAUSE) {
+		by, err := parser.parseGrouping()
+		if err != nil {
+			return nil, err
+		}
+		aggregation.by = by
+	}
+	if err := parser.expect("("); err != nil {
+		return nil, err
+	}
+	arg, err := parser.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if selector, ok := arg.(*promSelector); ok && selector.window > 0 {
+		return nil, fmt.Errorf("%w: %s takes an instant vector, use rate or increase of the range vector", ErrInvalidPromQL, op)
+	}
+	aggregation.arg = arg
+	if err := parser.expect(")"); err != nil {
+		return nil, err
+	}
+	if parser.isIdentifier(BY_CLAUSE, WITHOUT_CLAUSE) {
+		if aggregation.by != nil {
+			return nil, parser.errorf("aggregation has more than one grouping")
+		}
+		by, err := parser.parseGrouping()
+		if err != nil {
+			return nil, err
+		}
+		aggregation.by = by
+	}
+	return aggregation, nil
+}
+
+// Parses "by (label, ...)", "without" is not supported
+func (parser *promParser) parseGrouping() ([]string, error) {
+	if parser.token.text == WITHOUT_CLAUSE {
+		return nil, parser.errorf("\"without\" is not supported, use \"by\"")
+	}
+	parser.next()
+	if err := parser.expect("("); err != nil {
+		return nil, err
+	}
+	by := []string{}
+	for !parser.isPunctuation(")") {
+		if parser.token.kind != promIdentifier {
+			return nil, parser.errorf("expected label name")
+		}
+		by = append(by, parser.token.text)
+		parser.next()
+		if !parser.isPunctuation(")") {
+			if err := parser.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	parser.next()
+	return by, nil
+}
+
+func (parser *promParser) parseFunction(name promToken) (promNode, error) {
+	if name.text != PROM_RATE_FUNCTION && name.text != PROM_INCREASE_FUNCTION {
+		return nil, fmt.Errorf("%w at position %d: unknown function %q, expected rate or increase", ErrInvalidPromQL, name.position+1, name.text)
+	}
+	parser.next()
+	argPosition := parser.token.position
+	arg, err := parser.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	selector, ok := arg.(*promSelector)
+	if !ok || selector.window == 0 {
+		return nil, fmt.Errorf("%w at position %d: %s takes a range vector selector, for ex. metric[5m]", ErrInvalidPromQL, argPosition+1, name.text)
+	}
+	if err := parser.expect(")"); err != nil {
+		return nil, err
+	}
+	return &promFunction{name: name.text, arg: selector}, nil
+}
+
+// Parses selector after the metric name (if it has one)
+func (parser *promParser) parseSelector(metricName string) (promNode, error) {
+	selector := &promSelector{}
+	if metricName != "" {
+		selector.matchers = append(selector.matchers, &promMatcher{name: METRIC_NAME_LABEL, op: EQUAL_MATCHER, value: metricName})
+	}
+	if parser.isPunctuation("{") {
+		parser.next()
+		for !parser.isPunctuation("}") {
+			matcher, err := parser.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			selector.matchers = append(selector.matchers, matcher)
+			if !parser.isPunctuation("}") {
+				if err := parser.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		parser.next()
+	}
+	if len(selector.matchers) == 0 {
+		return nil, parser.errorf("selector needs a metric name or a label matcher")
+	}
+
+	if parser.isPunctuation("[") {
+		parser.next()
+		if parser.token.kind != promDuration {
+			return nil, parser.errorf("expected duration, for ex. 5m")
+		}
+		window, err := ParsePromDuration(parser.token.text)
+		if err != nil || window <= 0 {
+			return nil, parser.errorf("invalid duration %q", parser.token.text)
+		}
+		selector.window = window
+		parser.next()
+		if err := parser.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	return selector, nil
+}
+
+func (parser *promParser) parseMatcher() (*promMatcher, error) {
+	if parser.token.kind != promIdentifier {
+		return nil, parser.errorf("expected label name")
+	}
+	matcher := &promMatcher{name: parser.token.text}
+	parser.next()
+	if !parser.isPunctuation(EQUAL_MATCHER, NOT_EQUAL_MATCHER, REGEX_MATCHER, NOT_REGEX_MATCHER) {
+		return nil, parser.errorf("expected one of \"=\", \"!=\", \"=~\", \"!~\"")
+	}
+	matcher.op = parser.token.text
+	parser.next()
+	if parser.token.kind != promString {
+		return nil, parser.errorf("expected quoted label value")
+	}
+	value, err := unquotePromString(parser.token.text)
+	if err != nil {
+		return nil, parser.errorf("invalid string %s", parser.token.text)
+	}
+	matcher.value = value
+	if matcher.op == REGEX_MATCHER || matcher.op == NOT_REGEX_MATCHER {
+		// PromQL regular expressions are anchored
+		if matcher.regex, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, parser.errorf("invalid regular expression %q: %v", value, err)
+		}
+	}
+	parser.next()
+	return matcher, nil
+}
+
+func (parser *promParser) expect(punctuation string) error {
+	if !parser.isPunctuation(punctuation) {
+		return parser.errorf("expected %q", punctuation)
+	}
+	parser.next()
+	return nil
+}
+
+func (parser *promParser) isPunctuation(punctuations ...string) bool {
+	return parser.token.kind == promPunctuation && containsString(punctuations, parser.token.text)
+}
+
+func (parser *promParser) isIdentifier(identifiers ...string) bool {
+	return parser.token.kind == promIdentifier && containsString(identifiers, parser.token.text)
+}
+
+// Reads the next token into parser.token
+func (parser *promParser) next() {
+	expression := parser.expression
+	for parser.offset < len(expression) && strings.ContainsRune(" \t\r\n", rune(expression[parser.offset])) {
+		parser.offset++
+	}
+	start := parser.offset
+	if start == len(expression) {
+		parser.token = promToken{kind: promEnd, position: start}
+		return
+	}
+
+	kind := promPunctuation
+	char := expression[start]
+	switch {
+	case isLetter(char):
+		kind = promIdentifier
+		for parser.offset < len(expression) && (isLetter(expression[parser.offset]) || isDigit(expression[parser.offset]) || expression[parser.offset] == ':') {
+			parser.offset++
+		}
+	case isDigit(char):
+		kind = promDuration
+		for parser.offset < len(expression) && (isLetter(expression[parser.offset]) || isDigit(expression[parser.offset])) {
+			parser.offset++
+		}
+	case char == '"' || char == '\'' || char == '`':
+		kind = promString
+		parser.offset++
+		for parser.offset < len(expression) && expression[parser.offset] != char {
+			if expression[parser.offset] == '\\' && char != '`' {
+				parser.offset++
+			}
+			parser.offset++
+		}
+		if parser.offset >= len(expression) {
+			parser.token = promToken{kind: promString, text: expression[start:], position: start}
+			parser.err = parser.errorf("unterminated string")
+			parser.offset = len(expression)
+			return
+		}
+		parser.offset++
+	case strings.HasPrefix(expression[start:], "!=") || strings.HasPrefix(expression[start:], "=~") || strings.HasPrefix(expression[start:], "!~"):
+		parser.offset += 2
+	case strings.ContainsRune("{}()[],=", rune(char)):
+		parser.offset++
+	default:
+		parser.token = promToken{kind: promPunctuation, text: string(char), position: start}
+		parser.err = parser.errorf("unexpected character %q", char)
+		parser.offset++
+		return
+	}
+	parser.token = promToken{kind: kind, text: expression[start:parser.offset], position: start}
+}
+
+func (parser *promParser) errorf(format string, args ...interface{}) error {
+	if parser.err != nil {
+		return parser.err
+	}
+	return fmt.Errorf("%w at position %d: %s", ErrInvalidPromQL, parser.token.position+1, fmt.Sprintf(format, args...))
+}
+
+// Single quoted strings have the escapes of double quoted ones, backquoted strings have none
+func unquotePromString(quoted string) (string, error) {
+	if quoted[0] == '\'' {
+		unquoted := strings.ReplaceAll(quoted[1:len(quoted)-1], `\'`, `'`)
+		quoted = `"` + strings.ReplaceAll(unquoted, `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(quoted)
+}
+
+var (
+	promDurationPattern = regexp.MustCompile(`^(\d+(ms|s|m|h|d|w|y))+$`)
+	promDurationPart    = regexp.MustCompile(`(\d+)(ms|s|m|h|d|w|y)`)
+)
+
+// Parses Prometheus duration such as "5m", "1h30m", "2w"
+func ParsePromDuration(duration string) (time.Duration, error) {
+	if !promDurationPattern.MatchString(duration) {
+		return 0, fmt.Errorf("invalid duration %q", duration)
+	}
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+	var total time.Duration
+	for _, part := range promDurationPart.FindAllStringSubmatch(duration, -1) {
+		count, err := strconv.ParseInt(part[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", duration)
+		}
+		total += time.Duration(count) * units[part[2]]
+	}
+	return total, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
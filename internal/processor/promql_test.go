@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+func TestParsePromQLNestingDepth(t *testing.T) {
+	nested := func(levels int, open string) string {
+		return strings.Repeat(open, levels) + "online_spent" + strings.Repeat(")", levels)
+	}
+	for _, test := range []struct {
+		name  string
+		query string
+		valid bool
+	}{
+		{"parentheses below the limit", nested(MAX_PROMQL_DEPTH-1, "("), true},
+		{"parentheses over the limit", nested(MAX_PROMQL_DEPTH, "("), false},
+		{"aggregations over the limit", nested(MAX_PROMQL_DEPTH, "sum("), false},
+		{"unclosed parentheses", strings.Repeat("(", 1_000_000), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePromQL(test.query)
+			if test.valid && err != nil {
+				t.Errorf("parsePromQL error = %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidPromQL) {
+				t.Errorf("parsePromQL error = %v, want %v", err, ErrInvalidPromQL)
+			}
+		})
+	}
+}
+
+func TestQueryRangeIncreaseMatchesRecords(t *testing.T) {
+	records := testCsvRecords(500)
+	engine := NewPromQLEngine(newTestProcessor(t, 3, records), "online_spent")
+	start := time.Date(2019, time.January, 3, 0, 0, 0, 0, time.UTC)
+	end := start.Add(200 * time.Hour)
+	window := 6 * time.Hour
+
+	series, err := engine.QueryRange(context.Background(), `sum by (location) (increase(online_spent{gender="F"}[6h]))`, start, end, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]map[int64]float64)
+	for _, s := range series {
+		got[s.Labels["location"]] = make(map[int64]float64)
+		for _, point := range s.Points {
+			got[s.Labels["location"]][point.Timestamp.Unix()] = point.Value
+		}
+	}
+
+	// spend of the records in the window before every step, records are on whole hours
+	for _, location := range testLocations {
+		for step := start; !step.After(end); step = step.Add(window) {
+			want := 0.0
+			for _, record := range records {
+				m, _, _ := data.FromCsvDataRecord(record)
+				tags := m.Tags()
+				if tags["gender"].Value() == "F" && tags["location"].Value() == location &&
+					m.Timestamp().After(step.Add(-window)) && !m.Timestamp().After(step) {
+					want += m.MetricValue()
+				}
+			}
+			value, found := got[location][step.Unix()]
+			if want != 0 && !found || math.Abs(value-want) > 1e-9 {
+				t.Errorf("%s at %v: increase = %v (present %v), want %v", location, step, value, found, want)
+			}
+		}
+	}
+}
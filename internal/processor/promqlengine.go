@@ -0,0 +1,403 @@
+package processor
+
+// Evaluation of PromQL range queries (see promql.go) over the processor data. The metric is exposed as a counter:
+// the value of online_spent{...} at time t is the sum of values of the matching records up to t, so
+// increase(online_spent[1d]) is the spend of the last day and rate(online_spent[1d]) the spend per second.
+// Series are the combinations of tag values records have, labels are the tags. Equality matchers are pushed down
+// to the tag indexes, the other matchers are checked against label values of the series. Counters have a minute
+// resolution, records are counted from the start of the minute they fall into.
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+// Max number of steps of a range query, the same as Prometheus has
+const MAX_PROMQL_POINTS = 11000
+
+func NewPromQLEngine(provider MetricDataProvider, metricName string) *PromQLEngine {
+	return &PromQLEngine{provider: provider, metricName: metricName}
+}
+
+type PromQLEngine struct {
+	provider MetricDataProvider
+	// name of the metric in PromQL
+	metricName string
+}
+
+// Result series of the range query
+type PromSeries struct {
+	Labels map[string]string
+	Points []PromPoint
+}
+
+type PromPoint struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// Series during evaluation, values at the query steps
+type promVector struct {
+	labels  map[string]string
+	values  []float64
+	present []bool
+}
+
+// Counter of a single series: cumulative sums at minute timestamps (millis)
+type promCounter struct {
+	labels     map[string]string
+	timestamps []int64
+	sums       []float64
+}
+
+// Evaluates the query at every step from start to end, series without values are left out
+func (engine *PromQLEngine) QueryRange(ctx context.Context, query string, start time.Time, end time.Time, step time.Duration) ([]PromSeries, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("%w: step must be positive", ErrInvalidPromQL)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("%w: end is before start", ErrInvalidPromQL)
+	}
+	if end.Sub(start)/step >= MAX_PROMQL_POINTS {
+		return nil, fmt.Errorf("%w: more than %d points per series, increase the step", ErrInvalidPromQL, MAX_PROMQL_POINTS)
+	}
+	node, err := parsePromQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []time.Time{}
+	for timestamp := start; !timestamp.After(end); timestamp = timestamp.Add(step) {
+		steps = append(steps, timestamp)
+	}
+	vectors, err := engine.evaluate(ctx, node, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []PromSeries{}
+	for _, vector := range vectors {
+		series := PromSeries{Labels: vector.labels, Points: []PromPoint{}}
+		for i, value := range vector.values {
+			if vector.present[i] {
+				series.Points = append(series.Points, PromPoint{Timestamp: steps[i], Value: value})
+			}
+		}
+		if len(series.Points) > 0 {
+			result = append(result, series)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return labelsKey(result[i].Labels) < labelsKey(result[j].Labels)
+	})
+	return result, nil
+}
+
+// Label names of the series matching any of the selectors within time range, or of all series if there are
+// no selectors
+func (engine *PromQLEngine) LabelNames(ctx context.Context, selectors []string, timeRange TimeRange) ([]string, error) {
+	if len(selectors) == 0 {
+		return append([]string{METRIC_NAME_LABEL}, engine.tagNames()...), nil
+	}
+	labelSets, err := engine.labelSets(ctx, selectors, timeRange)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, labels := range labelSets {
+		for name := range labels {
+			names[name] = true
+		}
+	}
+	return sortedKeys(names), nil
+}
+
+// Values of the label of the series matching any of the selectors within time range, or of all series if there
+// are no selectors
+func (engine *PromQLEngine) LabelValues(ctx context.Context, name string, selectors []string, timeRange TimeRange) ([]string, error) {
+	values := make(map[string]bool)
+	if len(selectors) == 0 {
+		if name == METRIC_NAME_LABEL {
+			return []string{engine.metricName}, nil
+		}
+		for _, filter := range engine.provider.GetMetricTagFilters(name + ":") {
+			if value := strings.TrimPrefix(filter, name+":"); value != "" {
+				values[value] = true
+			}
+		}
+		return sortedKeys(values), nil
+	}
+
+	labelSets, err := engine.labelSets(ctx, selectors, timeRange)
+	if err != nil {
+		return nil, err
+	}
+	for _, labels := range labelSets {
+		if value, found := labels[name]; found {
+			values[value] = true
+		}
+	}
+	return sortedKeys(values), nil
+}
+
+func (engine *PromQLEngine) labelSets(ctx context.Context, selectors []string, timeRange TimeRange) ([]map[string]string, error) {
+	labelSets := []map[string]string{}
+	for _, expression := range selectors {
+		node, err := parsePromQL(expression)
+		if err != nil {
+			return nil, err
+		}
+		selector, ok := node.(*promSelector)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not a series selector", ErrInvalidPromQL, expression)
+		}
+		counters, err := engine.selectCounters(ctx, selector, timeRange)
+		if err != nil {
+			return nil, err
+		}
+		for _, counter := range counters {
+			counter.labels[METRIC_NAME_LABEL] = engine.metricName
+			labelSets = append(labelSets, counter.labels)
+		}
+	}
+	return labelSets, nil
+}
+
+func (engine *PromQLEngine) evaluate(ctx context.Context, node promNode, steps []time.Time) ([]*promVector, error) {
+	// selector counters start with the first record, so they read the data up to the last step
+	upToLastStep := TimeRange{To: steps[len(steps)-1].Add(time.Nanosecond)}
+
+	switch node := node.(type) {
+	case *promSelector:
+		counters, err := engine.selectCounters(ctx, node, upToLastStep)
+		if err != nil {
+			return nil, err
+		}
+		vectors := make([]*promVector, len(counters))
+		for i, counter := range counters {
+			vectors[i] = newPromVector(counter.labels, len(steps))
+			vectors[i].labels[METRIC_NAME_LABEL] = engine.metricName
+			for j, timestamp := range steps {
+				vectors[i].values[j], vectors[i].present[j] = counter.valueAt(timestamp)
+			}
+		}
+		return vectors, nil
+
+	case *promFunction:
+		// functions take differences over the window, so the data before the window of the first step is not read.
+		// Counters are partitioned by minute, the range starts at a whole minute to keep the same differences.
+		windows := TimeRange{From: steps[0].Add(-node.arg.window).Truncate(time.Minute), To: upToLastStep.To}
+		counters, err := engine.selectCounters(ctx, node.arg, windows)
+		if err != nil {
+			return nil, err
+		}
+		// functions drop the metric name, as they change the meaning of the value
+		vectors := make([]*promVector, len(counters))
+		for i, counter := range counters {
+			vectors[i] = newPromVector(counter.labels, len(steps))
+			for j, timestamp := range steps {
+				value, present := counter.valueAt(timestamp)
+				if !present {
+					continue
+				}
+				// counters add up cents, the difference is rounded to drop the floating point noise
+				before, _ := counter.valueAt(timestamp.Add(-node.arg.window))
+				value = math.Round((value-before)*100) / 100
+				if node.name == PROM_RATE_FUNCTION {
+					value /= node.arg.window.Seconds()
+				}
+				vectors[i].values[j], vectors[i].present[j] = value, true
+			}
+		}
+		return vectors, nil
+
+	case *promAggregation:
+		args, err := engine.evaluate(ctx, node.arg, steps)
+		if err != nil {
+			return nil, err
+		}
+		return aggregateVectors(node, args, len(steps)), nil
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported expression", ErrInvalidPromQL)
+	}
+}
+
+// Fetches counters of the series matching the selector. Equality matchers of tags filter records by the tag
+// indexes, all matchers are then checked against the series labels, as the indexes match records by id and
+// record ids are not unique.
+func (engine *PromQLEngine) selectCounters(ctx context.Context, selector *promSelector, timeRange TimeRange) ([]*promCounter, error) {
+	tagNames := engine.tagNames()
+	filters := []string{}
+	for _, matcher := range selector.matchers {
+		if matcher.name == METRIC_NAME_LABEL {
+			if !matcher.matches(engine.metricName) {
+				return nil, nil
+			}
+			continue
+		}
+		if matcher.value == "" || !containsString(tagNames, matcher.name) {
+			continue
+		}
+		if matcher.op == EQUAL_MATCHER {
+			filters = append(filters, matcher.name+":"+matcher.value)
+		}
+	}
+
+	minutes := NewTimePartitioner(1, MINUTE, time.UTC, time.Sunday)
+	seriesList, _, err := engine.provider.GetMetricSeries(ctx, data.FromRequestFilters(filters), tagNames, timeRange, minutes, SumAggregator)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := []*promCounter{}
+	for _, series := range seriesList {
+		labels := make(map[string]string)
+		for name, value := range series.Tags {
+			if value != "" {
+				labels[name] = value
+			}
+		}
+		matches := true
+		for _, matcher := range selector.matchers {
+			if matcher.name != METRIC_NAME_LABEL && !matcher.matches(labels[matcher.name]) {
+				matches = false
+				break
+			}
+		}
+		if !matches || len(series.DataPoints) == 0 {
+			continue
+		}
+
+		counter := &promCounter{labels: labels}
+		sum := 0.0
+		for _, point := range series.DataPoints {
+			sum += *point.Value
+			counter.timestamps = append(counter.timestamps, point.Timestamp)
+			counter.sums = append(counter.sums, sum)
+		}
+		counters = append(counters, counter)
+	}
+	return counters, nil
+}
+
+// Names of the tags records have, sorted
+func (engine *PromQLEngine) tagNames() []string {
+	names := make(map[string]bool)
+	for _, filter := range engine.provider.GetMetricTagFilters("") {
+		if name, _, found := strings.Cut(filter, ":"); found {
+			names[name] = true
+		}
+	}
+	return sortedKeys(names)
+}
+
+// Counter value at the time, false if the series has no records up to the time
+func (counter *promCounter) valueAt(timestamp time.Time) (float64, bool) {
+	millis := timestamp.UnixMilli()
+	i := sort.Search(len(counter.timestamps), func(i int) bool {
+		return counter.timestamps[i] > millis
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return counter.sums[i-1], true
+}
+
+// Aggregates series with the same values of the by labels, step by step
+func aggregateVectors(aggregation *promAggregation, args []*promVector, stepsCount int) []*promVector {
+	groups := make(map[string]*promVector)
+	counts := make(map[string][]int)
+	keys := []string{}
+	for _, arg := range args {
+		labels := make(map[string]string)
+		for _, name := range aggregation.by {
+			if value, found := arg.labels[name]; found {
+				labels[name] = value
+			}
+		}
+		key := labelsKey(labels)
+		group, found := groups[key]
+		if !found {
+			group = newPromVector(labels, stepsCount)
+			groups[key] = group
+			counts[key] = make([]int, stepsCount)
+			keys = append(keys, key)
+		}
+
+		for i, value := range arg.values {
+			if !arg.present[i] {
+				continue
+			}
+			count := counts[key][i]
+			switch {
+			case count == 0:
+				group.values[i] = value
+			case aggregation.op == SUM_AGGREGATION || aggregation.op == AVG_AGGREGATION:
+				group.values[i] += value
+			case aggregation.op == MIN_AGGREGATION && value < group.values[i]:
+				group.values[i] = value
+			case aggregation.op == MAX_AGGREGATION && value > group.values[i]:
+				group.values[i] = value
+			}
+			counts[key][i] = count + 1
+			group.present[i] = true
+		}
+	}
+
+	vectors := make([]*promVector, len(keys))
+	for i, key := range keys {
+		group := groups[key]
+		for j, count := range counts[key] {
+			switch {
+			case count == 0:
+			case aggregation.op == AVG_AGGREGATION:
+				group.values[j] /= float64(count)
+			case aggregation.op == COUNT_AGGREGATION:
+				group.values[j] = float64(count)
+			}
+		}
+		vectors[i] = group
+	}
+	return vectors
+}
+
+func newPromVector(labels map[string]string, stepsCount int) *promVector {
+	copied := make(map[string]string, len(labels)+1)
+	for name, value := range labels {
+		copied[name] = value
+	}
+	return &promVector{
+		labels:  copied,
+		values:  make([]float64, stepsCount),
+		present: make([]bool, stepsCount),
+	}
+}
+
+// Identifies label set, labels are sorted by name
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name + "=" + labels[name] + "\x00")
+	}
+	return key.String()
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
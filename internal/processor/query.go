@@ -0,0 +1,316 @@
+package processor
+
+// Compact query strings, which can be pasted into tickets and URLs, for ex.
+//
+//	avg:online.spent{location:Chicago,!gender:F} by {product_category}.rollup(sum, 1w).fill(zero)
+//
+// * "avg:online.spent" - aggregator (avg, sum or count) and metric
+// * "{...}"            - optional filters "tagName:tagValue", "!tagName:tagValue" excludes records, "*" is no filter
+// * "by {...}"         - optional group by tag names
+// * ".rollup(method, interval)" - aggregator and scale, the interval is a scale ("1w", "Daily", "auto") or seconds.
+//   There is a single level of aggregation, so the rollup method replaces the leading aggregator
+// * ".fill(method)"    - gap filling: none, zero, null, previous (or last), linear
+// Query compiles into the fields of getData request. Syntax errors point to the position (1-based) in the query.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Parsed query string, fields have the format of getData request fields, empty ones are not set by the query
+type Query struct {
+	Aggregator string
+	Metric     string
+	Filters    []string
+	GroupBy    []string
+	Scale      string
+	Fill       string
+}
+
+// Aggregators of the query string by their lowercase names
+var queryAggregators = map[string]string{
+	"avg":   AVG_AGGREGATOR,
+	"sum":   SUM_AGGREGATOR,
+	"count": COUNT_AGGREGATOR,
+}
+
+// Parses query string, errors point to the position (1-based) in the query
+func ParseQuery(queryString string) (*Query, error) {
+	parser := &queryParser{query: queryString}
+	query := &Query{}
+
+	parser.skipSpaces()
+	start := parser.offset
+	aggregator := parser.readName()
+	if aggregator == "" {
+		return nil, parser.errorf("expected aggregator")
+	}
+	if query.Aggregator = queryAggregators[strings.ToLower(aggregator)]; query.Aggregator == "" {
+		return nil, parser.errorAt(ErrUnknownAggregator, start, "%q, expected avg, sum or count", aggregator)
+	}
+	if err := parser.expect(':'); err != nil {
+		return nil, err
+	}
+	parser.skipSpaces()
+	metricStart := parser.offset
+	query.Metric = parser.readName()
+	parser.backtrackFunction(metricStart, &query.Metric)
+	if query.Metric == "" {
+		return nil, parser.errorf("expected metric")
+	}
+
+	parser.skipSpaces()
+	if parser.peek() == '{' {
+		filters, err := parser.parseFilters()
+		if err != nil {
+			return nil, err
+		}
+		query.Filters = filters
+	}
+
+	parser.skipSpaces()
+	if strings.HasPrefix(parser.query[parser.offset:], "by") {
+		parser.offset += len("by")
+		groupBy, err := parser.parseGroupBy()
+		if err != nil {
+			return nil, err
+		}
+		query.GroupBy = groupBy
+	}
+
+	for parser.skipSpaces(); parser.peek() == '.'; parser.skipSpaces() {
+		parser.offset++
+		if err := parser.parseFunction(query); err != nil {
+			return nil, err
+		}
+	}
+	if parser.offset < len(parser.query) {
+		return nil, parser.errorf("unexpected %q", string(parser.query[parser.offset]))
+	}
+	return query, nil
+}
+
+// *** Parser ***
+
+type queryParser struct {
+	query  string
+	offset int
+}
+
+// filters = "{" ( "*" | filter { "," filter } ) "}"
+func (parser *queryParser) parseFilters() ([]string, error) {
+	parser.offset++
+	parser.skipSpaces()
+	if parser.peek() == '*' {
+		parser.offset++
+		return nil, parser.expect('}')
+	}
+
+	filters := []string{}
+	for {
+		parser.skipSpaces()
+		start := parser.offset
+		for parser.offset < len(parser.query) && parser.query[parser.offset] != ',' && parser.query[parser.offset] != '}' {
+			parser.offset++
+		}
+		if parser.offset == len(parser.query) {
+			return nil, parser.errorf("expected \"}\"")
+		}
+		// tag values may contain spaces, only the surrounding ones are dropped
+		filter := strings.TrimSpace(parser.query[start:parser.offset])
+		if name, value, found := strings.Cut(strings.TrimPrefix(filter, "!"), ":"); !found || name == "" || value == "" {
+			return nil, parser.errorAt(ErrInvalidQuery, start, "filter %q is not in the tagName:tagValue format", filter)
+		}
+		filters = append(filters, filter)
+
+		separator := parser.query[parser.offset]
+		parser.offset++
+		if separator == '}' {
+			return filters, nil
+		}
+	}
+}
+
+// groupBy = "by" "{" name { "," name } "}"
+func (parser *queryParser) parseGroupBy() ([]string, error) {
+	if err := parser.expect('{'); err != nil {
+		return nil, err
+	}
+	groupBy := []string{}
+	for {
+		parser.skipSpaces()
+		name := parser.readName()
+		if name == "" {
+			return nil, parser.errorf("expected tag name")
+		}
+		groupBy = append(groupBy, name)
+
+		parser.skipSpaces()
+		switch parser.peek() {
+		case ',':
+			parser.offset++
+		case '}':
+			parser.offset++
+			return groupBy, nil
+		default:
+			return nil, parser.errorf("expected \",\" or \"}\"")
+		}
+	}
+}
+
+// function = name "(" arg { "," arg } ")", the leading "." is consumed by the caller
+func (parser *queryParser) parseFunction(query *Query) error {
+	nameStart := parser.offset
+	name := parser.readName()
+	if err := parser.expect('('); err != nil {
+		return err
+	}
+	args := []string{}
+	argPositions := []int{}
+	for {
+		parser.skipSpaces()
+		argPositions = append(argPositions, parser.offset)
+		arg := parser.readName()
+		if arg == "" {
+			return parser.errorf("expected argument")
+		}
+		args = append(args, arg)
+
+		parser.skipSpaces()
+		if parser.peek() == ')' {
+			parser.offset++
+			break
+		}
+		if err := parser.expect(','); err != nil {
+			return err
+		}
+	}
+
+	switch name {
+	case "rollup":
+		if len(args) > 2 {
+			return parser.errorAt(ErrInvalidQuery, argPositions[2], "rollup takes a method and an optional interval")
+		}
+		if query.Aggregator = queryAggregators[strings.ToLower(args[0])]; query.Aggregator == "" {
+			return parser.errorAt(ErrUnknownAggregator, argPositions[0], "%q, expected avg, sum or count", args[0])
+		}
+		if len(args) == 2 {
+			scale, err := rollupScale(args[1])
+			if err != nil {
+				return parser.errorAt(ErrInvalidScale, argPositions[1], "%v", err)
+			}
+			query.Scale = scale
+		}
+	case "fill":
+		if len(args) > 1 {
+			return parser.errorAt(ErrInvalidQuery, argPositions[1], "fill takes a single method")
+		}
+		query.Fill = strings.ToLower(args[0])
+		if query.Fill == "last" {
+			query.Fill = PREVIOUS_FILL
+		}
+		if _, err := FromRequestFill(query.Fill); err != nil {
+			return parser.errorAt(ErrInvalidFill, argPositions[0], "unknown fill %q", args[0])
+		}
+	default:
+		return parser.errorAt(ErrInvalidQuery, nameStart, "unknown function %q, expected rollup or fill", name)
+	}
+	return nil
+}
+
+// Rollup interval is a scale, or a number of seconds as in the Datadog queries
+func rollupScale(interval string) (string, error) {
+	seconds, err := strconv.Atoi(interval)
+	if err != nil {
+		if interval != AUTO_SCALE {
+			if _, _, err := parseScale(interval); err != nil {
+				return "", fmt.Errorf("unknown interval %q", interval)
+			}
+		}
+		return interval, nil
+	}
+	units := []struct {
+		suffix  string
+		seconds int
+	}{
+		{"w", 7 * 24 * 3600},
+		{"d", 24 * 3600},
+		{"h", 3600},
+		{"m", 60},
+	}
+	for _, unit := range units {
+		if seconds > 0 && seconds%unit.seconds == 0 {
+			scale := strconv.Itoa(seconds/unit.seconds) + unit.suffix
+			if _, _, err := parseScale(scale); err != nil {
+				break
+			}
+			return scale, nil
+		}
+	}
+	return "", fmt.Errorf("interval of %d seconds is not a whole number of minutes", seconds)
+}
+
+// Names may contain dots, so a function called right after the metric ("online.spent.rollup(...)") is read as a
+// part of the name, the name is cut before the last dot and the parser moves back to it
+func (parser *queryParser) backtrackFunction(nameStart int, name *string) {
+	end := parser.offset
+	parser.skipSpaces()
+	dot := strings.LastIndexByte(*name, '.')
+	if parser.peek() != '(' || dot < 0 {
+		parser.offset = end
+		return
+	}
+	*name = (*name)[:dot]
+	parser.offset = nameStart + dot
+}
+
+// Reads metric, tag or function name
+func (parser *queryParser) readName() string {
+	start := parser.offset
+	for parser.offset < len(parser.query) && isQueryNameChar(parser.query[parser.offset]) {
+		parser.offset++
+	}
+	return parser.query[start:parser.offset]
+}
+
+func (parser *queryParser) expect(char byte) error {
+	parser.skipSpaces()
+	if parser.peek() != char {
+		return parser.errorf("expected %q", string(char))
+	}
+	parser.offset++
+	return nil
+}
+
+// Returns the current character, 0 at the end of the query
+func (parser *queryParser) peek() byte {
+	if parser.offset == len(parser.query) {
+		return 0
+	}
+	return parser.query[parser.offset]
+}
+
+func (parser *queryParser) skipSpaces() {
+	for parser.offset < len(parser.query) && (parser.query[parser.offset] == ' ' || parser.query[parser.offset] == '\t') {
+		parser.offset++
+	}
+}
+
+func (parser *queryParser) errorf(format string, args ...interface{}) error {
+	if parser.offset == len(parser.query) {
+		return parser.errorAt(ErrInvalidQuery, parser.offset, "unexpected end of query, "+format, args...)
+	}
+	return parser.errorAt(ErrInvalidQuery, parser.offset, format, args...)
+}
+
+func (parser *queryParser) errorAt(sentinel error, offset int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w at position %d: %s", sentinel, offset+1, fmt.Sprintf(format, args...))
+}
+
+func isQueryNameChar(char byte) bool {
+	return isLetter(char) || isDigit(char) || char == '.' || char == '-'
+}
@@ -0,0 +1,50 @@
+package processor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryFunctionsAfterMetric(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  Query
+	}{
+		{"sum:online.spent.rollup(avg, 1w)", Query{Aggregator: AVG_AGGREGATOR, Metric: "online.spent", Scale: "1w"}},
+		{"sum:online.spent .rollup(count).fill(zero)", Query{Aggregator: COUNT_AGGREGATOR, Metric: "online.spent", Fill: "zero"}},
+		{"avg:online.spent.fill (last)", Query{Aggregator: AVG_AGGREGATOR, Metric: "online.spent", Fill: PREVIOUS_FILL}},
+		{"avg:spent.rollup(sum)", Query{Aggregator: SUM_AGGREGATOR, Metric: "spent"}},
+		{"avg:online.spent", Query{Aggregator: AVG_AGGREGATOR, Metric: "online.spent"}},
+		{"avg:online.spent{*} by {gender}.rollup(sum, 1d)", Query{Aggregator: SUM_AGGREGATOR, Metric: "online.spent", GroupBy: []string{"gender"}, Scale: "1d"}},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*query, test.want) {
+				t.Errorf("ParseQuery = %+v, want %+v", *query, test.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		sentinel error
+		message  string
+	}{
+		{"avg:.rollup(sum)", ErrInvalidQuery, "invalid query at position 5: expected metric"},
+		{"avg:online.spent.max(sum)", ErrInvalidQuery, "invalid query at position 18: unknown function \"max\", expected rollup or fill"},
+		{"avg:online.spent.rollup(max)", ErrUnknownAggregator, "unknown aggregator at position 25: \"max\", expected avg, sum or count"},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			_, err := ParseQuery(test.query)
+			if !errors.Is(err, test.sentinel) || err.Error() != test.message {
+				t.Errorf("ParseQuery error = %v, want %s", err, test.message)
+			}
+		})
+	}
+}
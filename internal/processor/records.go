@@ -0,0 +1,243 @@
+package processor
+
+// Raw records drill-down: records matching the filters within a time range (for ex. a bucket of a chart), sorted
+// and paged. Candidates are picked through the tag indexes and matched against their own tags, so the result is
+// exact also for records sharing an id. Every shard keeps only the first page after the cursor in a bounded heap.
+// The ingest sequence of a record breaks ties of the sort, which makes the order total and independent of the
+// sharding, so cursors stay valid across restarts from a snapshot and changes of the shard count.
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+// Record fields records can be sorted by, besides tag names
+const (
+	RECORD_ID_FIELD        = "id"
+	RECORD_TIMESTAMP_FIELD = "timestamp"
+	RECORD_VALUE_FIELD     = "value"
+)
+
+// Sort order of records: by id, timestamp, value or tag name
+type RecordOrder struct {
+	Field      string
+	Descending bool
+}
+
+// Sort key of a record, the value of the order field and the ingest sequence of the record
+type RecordKey struct {
+	Int      int64   `json:"i,omitempty"` // id or timestamp (unix nanos)
+	Float    float64 `json:"f,omitempty"` // value
+	Text     string  `json:"t,omitempty"` // tag value, "" if the record doesn't have the tag
+	Sequence uint64  `json:"n"`
+}
+
+// Page of sorted records
+type RecordsPage struct {
+	Records []*data.MetricRecord
+	Next    *RecordKey // key of the last record of the page if there are more records, nil otherwise
+	Total   int        // records matching the query
+}
+
+type keyedRecord struct {
+	key    RecordKey
+	record *data.MetricRecord
+}
+
+// Records of a shard matching the query: the first page after the cursor and the counts
+type shardRecords struct {
+	page      []keyedRecord
+	total     int // all matching records
+	remaining int // matching records after the cursor
+}
+
+// Returns up to limit records matching the filters within time range, in the given order, starting after the
+// record with the given key (nil for the first page)
+func (mp *InMemoryMetricStreamProcessor) GetMetricRecords(ctx context.Context, filters []*data.Tag, timeRange TimeRange, order RecordOrder, after *RecordKey, limit int) (RecordsPage, error) {
+	defer queryDuration.With(RECORDS_QUERY).ObserveSince(time.Now())
+	limiter := newQueryLimiter(mp.queryParallelism)
+	less := func(a RecordKey, b RecordKey) bool {
+		if order.Descending {
+			return compareRecordKeys(a, b) > 0
+		}
+		return compareRecordKeys(a, b) < 0
+	}
+
+	// 1. Scatter: every shard picks its page of matching records
+	partials := make([]shardRecords, len(mp.shards))
+	var wg sync.WaitGroup
+	for i, shard := range mp.shards {
+		wg.Add(1)
+		go func(i int, shard *metricShard) {
+			defer wg.Done()
+			limiter.acquire()
+			defer limiter.release()
+			partials[i] = shard.getRecords(ctx, filters, timeRange, order.Field, less, after, limit)
+		}(i, shard)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return RecordsPage{}, err
+	}
+
+	// 2. Gather: the page is the first records of the shard pages merged
+	records := []keyedRecord{}
+	page := RecordsPage{}
+	remaining := 0
+	for _, partial := range partials {
+		records = append(records, partial.page...)
+		page.Total += partial.total
+		remaining += partial.remaining
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return less(records[i].key, records[j].key)
+	})
+	recordsScanned.With(RECORDS_QUERY).Add(float64(page.Total))
+
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	page.Records = make([]*data.MetricRecord, len(records))
+	for i, keyed := range records {
+		page.Records[i] = keyed.record
+	}
+	if remaining > len(records) {
+		page.Next = &records[len(records)-1].key
+	}
+	return page, nil
+}
+
+// Matching records of the shard, only the first limit records after the key are kept
+func (shard *metricShard) getRecords(ctx context.Context, filters []*data.Tag, timeRange TimeRange, field string, less func(a RecordKey, b RecordKey) bool, after *RecordKey, limit int) shardRecords {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	// candidates are picked by the included tags only: excluded tag indexes would drop also records which share an id
+	// with an excluded record but don't have the tag themselves
+	included := []*data.Tag{}
+	for _, filter := range filters {
+		if !filter.Excluded() {
+			included = append(included, filter)
+		}
+	}
+
+	result := shardRecords{}
+	page := &recordsHeap{less: less}
+	for i, m := range shard.getIncludedMetrics(included).MetricRecords() {
+		// cancelled query stops early, the caller discards the result
+		if i%partitionChunkSize == 0 && ctx.Err() != nil {
+			break
+		}
+		// tag indexes match records by id, tags of the record itself decide
+		if !timeRange.Contains(m.Timestamp()) || !matchesFilters(m, filters) {
+			continue
+		}
+		result.total++
+		key := newRecordKey(m, field)
+		if after != nil && !less(*after, key) {
+			continue
+		}
+		result.remaining++
+		if page.Len() < limit {
+			heap.Push(page, keyedRecord{key: key, record: m})
+		} else if less(key, page.records[0].key) {
+			page.records[0] = keyedRecord{key: key, record: m}
+			heap.Fix(page, 0)
+		}
+	}
+	result.page = page.records
+	return result
+}
+
+func newRecordKey(m *data.MetricRecord, field string) RecordKey {
+	key := RecordKey{Sequence: m.Sequence()}
+	switch field {
+	case RECORD_ID_FIELD:
+		key.Int = int64(m.Id())
+	case RECORD_TIMESTAMP_FIELD:
+		key.Int = m.Timestamp().UnixNano()
+	case RECORD_VALUE_FIELD:
+		key.Float = m.MetricValue()
+	default:
+		if tag, found := m.Tags()[field]; found {
+			key.Text = tag.Value()
+		}
+	}
+	return key
+}
+
+func matchesFilters(m *data.MetricRecord, filters []*data.Tag) bool {
+	for _, filter := range filters {
+		if !filter.Matches(m.Tags()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Keys are compared by the value of the order field (only one of the values is set), then by ingest sequence
+func compareRecordKeys(a RecordKey, b RecordKey) int {
+	switch {
+	case a.Int != b.Int:
+		return compareInts(a.Int, b.Int)
+	case a.Float != b.Float:
+		if a.Float < b.Float {
+			return -1
+		}
+		return 1
+	case a.Text != b.Text:
+		return strings.Compare(a.Text, b.Text)
+	case a.Sequence < b.Sequence:
+		return -1
+	case a.Sequence > b.Sequence:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Heap of records with the last one in the order on top, so it is the one replaced by a record which comes earlier
+type recordsHeap struct {
+	records []keyedRecord
+	less    func(a RecordKey, b RecordKey) bool
+}
+
+var _ heap.Interface = (*recordsHeap)(nil)
+
+func (h *recordsHeap) Len() int {
+	return len(h.records)
+}
+
+func (h *recordsHeap) Less(i, j int) bool {
+	return h.less(h.records[j].key, h.records[i].key)
+}
+
+func (h *recordsHeap) Swap(i, j int) {
+	h.records[i], h.records[j] = h.records[j], h.records[i]
+}
+
+func (h *recordsHeap) Push(x interface{}) {
+	h.records = append(h.records, x.(keyedRecord))
+}
+
+func (h *recordsHeap) Pop() interface{} {
+	last := h.records[len(h.records)-1]
+	h.records = h.records[:len(h.records)-1]
+	return last
+}
@@ -0,0 +1,169 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+var testLocations = []string{"Chicago", "New York", "California"}
+var testCategories = []string{"Nest-USA", "Apparel", "Office", "Drinkware"}
+
+// CSV row of the dataset layout
+func testCsvRecord(id int, timestamp time.Time, value float64, gender string, location string, category string) []string {
+	record := make([]string, 20)
+	record[0] = strconv.Itoa(id)
+	record[2] = gender
+	record[3] = location
+	record[6] = timestamp.Format(time.RFC3339Nano)
+	record[9] = category
+	record[11] = strconv.FormatFloat(value, 'f', -1, 64)
+	record[13] = "Used"
+	return record
+}
+
+// Deterministic records with repeated ids and values, ingested in the same order into every processor
+func testCsvRecords(count int) [][]string {
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	records := make([][]string, count)
+	for i := range records {
+		gender := "M"
+		// records sharing an id may have different tags
+		if i%3 == 0 {
+			gender = "F"
+		}
+		records[i] = testCsvRecord(i%(count/4+1), start.Add(time.Duration(i*7%(count/2+1))*time.Hour), float64(i%10)*1.5,
+			gender, testLocations[i%len(testLocations)], testCategories[i%len(testCategories)])
+	}
+	return records
+}
+
+func newTestProcessor(t *testing.T, shardCount int, records [][]string) *InMemoryMetricStreamProcessor {
+	t.Helper()
+	mp := NewInMemoryMetricStreamProcessor(shardCount)
+	for _, record := range records {
+		if err := mp.Process(record); err != nil {
+			t.Fatalf("Process(%v): %v", record, err)
+		}
+	}
+	return mp
+}
+
+// Reads all pages and returns the ids, timestamps and values of the records in the page order
+func readAllRecordPages(t *testing.T, mp *InMemoryMetricStreamProcessor, filters []*data.Tag, order RecordOrder, limit int) ([]string, int) {
+	t.Helper()
+	records := []string{}
+	var after *RecordKey
+	total := -1
+	for {
+		page, err := mp.GetMetricRecords(context.Background(), filters, TimeRange{}, order, after, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total >= 0 && page.Total != total {
+			t.Fatalf("total changed between pages: %d, then %d", total, page.Total)
+		}
+		total = page.Total
+		if len(page.Records) > limit {
+			t.Fatalf("page has %d records, limit %d", len(page.Records), limit)
+		}
+		for _, record := range page.Records {
+			records = append(records, fmt.Sprintf("%d/%d/%v", record.Id(), record.Timestamp().Unix(), record.MetricValue()))
+		}
+		if page.Next == nil {
+			return records, total
+		}
+		after = page.Next
+	}
+}
+
+func TestGetMetricRecordsPagesDoNotDependOnSharding(t *testing.T) {
+	records := testCsvRecords(500)
+	single := newTestProcessor(t, 1, records)
+	sharded := newTestProcessor(t, 7, records)
+
+	for _, test := range []struct {
+		filters []string
+		order   RecordOrder
+	}{
+		{nil, RecordOrder{Field: RECORD_TIMESTAMP_FIELD}},
+		{nil, RecordOrder{Field: RECORD_VALUE_FIELD, Descending: true}},
+		{[]string{"gender:F"}, RecordOrder{Field: RECORD_ID_FIELD}},
+		{[]string{"location:Chicago", "!product_category:Office"}, RecordOrder{Field: "product_category"}},
+		{[]string{"gender:M", "location:New York"}, RecordOrder{Field: RECORD_VALUE_FIELD}},
+	} {
+		t.Run(fmt.Sprint(test.filters, test.order), func(t *testing.T) {
+			filters := data.FromRequestFilters(test.filters)
+			want, wantTotal := readAllRecordPages(t, single, filters, test.order, 1000)
+			if wantTotal != len(want) {
+				t.Fatalf("total = %d, read %d records", wantTotal, len(want))
+			}
+			// exact: every record matches by its own tags
+			expected := 0
+			for _, record := range records {
+				metricRecord, _, _ := data.FromCsvDataRecord(record)
+				if matchesFilters(metricRecord, filters) {
+					expected++
+				}
+			}
+			if wantTotal != expected {
+				t.Errorf("total = %d, want %d", wantTotal, expected)
+			}
+
+			for _, limit := range []int{1, 13, 100} {
+				got, total := readAllRecordPages(t, sharded, filters, test.order, limit)
+				if total != wantTotal || !reflect.DeepEqual(got, want) {
+					t.Errorf("limit %d: 7 shards returned %d of %d records, differ from 1 shard", limit, len(got), total)
+				}
+			}
+		})
+	}
+}
+
+func TestGetMetricRecordsCursorSurvivesSnapshotRestore(t *testing.T) {
+	records := testCsvRecords(200)
+	mp := newTestProcessor(t, 3, records)
+	order := RecordOrder{Field: RECORD_VALUE_FIELD}
+	want, _ := readAllRecordPages(t, mp, nil, order, 1000)
+
+	first, err := mp.GetMetricRecords(context.Background(), nil, TimeRange{}, order, nil, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if _, err := mp.WriteSnapshot(&snapshot, SnapshotMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	// restored with another shard count
+	restored := NewInMemoryMetricStreamProcessor(5)
+	if _, err := restored.ReadSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	second, err := restored.GetMetricRecords(context.Background(), nil, TimeRange{}, order, first.Next, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, page := range [][]*data.MetricRecord{first.Records, second.Records} {
+		for _, record := range page {
+			got = append(got, fmt.Sprintf("%d/%d/%v", record.Id(), record.Timestamp().Unix(), record.MetricValue()))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pages across the restore differ from a single read")
+	}
+
+	// records ingested after the restore follow the restored ones
+	if err := restored.Process(testCsvRecord(1, time.Now(), 1.5, "F", "Chicago", "Office")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readAllRecordPages(t, restored, nil, order, 1000); len(got) != len(want)+1 {
+		t.Errorf("got %d records, want %d", len(got), len(want)+1)
+	}
+}
@@ -0,0 +1,200 @@
+package processor
+
+// Series of records grouped by tag values in a single pass. Shards take the tag values from the records themselves,
+// so grouping costs a map lookup per record and group by tag instead of a query per combination of values.
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+// Data points of records with the same values of the group by tags
+type Series struct {
+	Tags       map[string]string // group by tag name -> value, "" if records don't have the tag
+	DataPoints []data.TimeDataPoint
+}
+
+// Partial aggregates of a series, by time partition
+type seriesPartials struct {
+	tagValues  []string
+	partitions map[time.Time]*AggregateState
+}
+
+// Filters records, groups them by the values of the tags, partitions every group by time and aggregates it.
+// Series are sorted by tag values in the group by order, data points by timestamp.
+func (mp *InMemoryMetricStreamProcessor) GetMetricSeries(ctx context.Context, filters []*data.Tag, groupBy []string, timeRange TimeRange, timePartition TimePartitioner, aggregate Aggregator) ([]Series, QueryStats, error) {
+	defer queryDuration.With(SERIES_QUERY).ObserveSince(time.Now())
+	limiter := newQueryLimiter(mp.queryParallelism)
+
+	// 1. Scatter: every shard groups and partitions its filtered records
+	shardPartials := make([]map[string]*seriesPartials, len(mp.shards))
+	shardScanned := make([]int, len(mp.shards))
+	var wg sync.WaitGroup
+	for i, shard := range mp.shards {
+		wg.Add(1)
+		go func(i int, shard *metricShard) {
+			defer wg.Done()
+			limiter.acquire()
+			defer limiter.release()
+			shardPartials[i], shardScanned[i] = shard.getSeriesPartials(ctx, filters, groupBy, timeRange, timePartition)
+		}(i, shard)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, QueryStats{}, err
+	}
+
+	// 2. Gather: merge partial aggregates of the same series
+	stats := QueryStats{}
+	merged := make(map[string]*seriesPartials)
+	for i, partials := range shardPartials {
+		stats.RecordsScanned += shardScanned[i]
+		for key, series := range partials {
+			if mergedSeries, found := merged[key]; found {
+				mergePartitions(mergedSeries.partitions, series.partitions)
+			} else {
+				merged[key] = series
+			}
+		}
+	}
+	recordsScanned.With(SERIES_QUERY).Add(float64(stats.RecordsScanned))
+
+	// 3. Aggregate and sort
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]Series, len(keys))
+	for i, key := range keys {
+		partials := merged[key]
+		series := Series{Tags: make(map[string]string, len(groupBy)), DataPoints: make([]data.TimeDataPoint, 0, len(partials.partitions))}
+		for j, name := range groupBy {
+			series.Tags[name] = partials.tagValues[j]
+		}
+		for pKey, state := range partials.partitions {
+			series.DataPoints = append(series.DataPoints, aggregate(pKey, state))
+		}
+		sort.Slice(series.DataPoints, func(i, j int) bool {
+			return series.DataPoints[i].Timestamp < series.DataPoints[j].Timestamp
+		})
+		result[i] = series
+	}
+	return result, stats, nil
+}
+
+// Counts series of the filtered records which have all the group by tags, counting stops once there are more than
+// limit series. Records are grouped without partitioning them, so the count is cheap to check before GetMetricSeries.
+func (mp *InMemoryMetricStreamProcessor) CountMetricSeries(ctx context.Context, filters []*data.Tag, groupBy []string, timeRange TimeRange, limit int) (int, error) {
+	limiter := newQueryLimiter(mp.queryParallelism)
+
+	shardKeys := make([]map[string]bool, len(mp.shards))
+	var wg sync.WaitGroup
+	for i, shard := range mp.shards {
+		wg.Add(1)
+		go func(i int, shard *metricShard) {
+			defer wg.Done()
+			limiter.acquire()
+			defer limiter.release()
+			shardKeys[i] = shard.getSeriesKeys(ctx, filters, groupBy, timeRange, limit)
+		}(i, shard)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	merged := make(map[string]bool)
+	for _, keys := range shardKeys {
+		for key := range keys {
+			merged[key] = true
+			if len(merged) > limit {
+				return len(merged), nil
+			}
+		}
+	}
+	return len(merged), nil
+}
+
+// Keys of the series of the shard with all the group by tags, at most limit + 1 of them
+func (shard *metricShard) getSeriesKeys(ctx context.Context, filters []*data.Tag, groupBy []string, timeRange TimeRange, limit int) map[string]bool {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	keys := make(map[string]bool)
+	tagValues := make([]string, len(groupBy))
+	for i, m := range shard.getInputMetrics(filters).MetricRecords() {
+		if i%partitionChunkSize == 0 && ctx.Err() != nil {
+			break
+		}
+		if !timeRange.Contains(m.Timestamp()) || !seriesTagValues(m.Tags(), groupBy, tagValues) {
+			continue
+		}
+		keys[strings.Join(tagValues, "\x00")] = true
+		if len(keys) > limit {
+			break
+		}
+	}
+	return keys
+}
+
+// Fills values of the group by tags, returns false if the record doesn't have some of them
+func seriesTagValues(tags data.Tags, groupBy []string, tagValues []string) bool {
+	for j, name := range groupBy {
+		tag, found := tags[name]
+		if !found || tag.Value() == "" {
+			return false
+		}
+		tagValues[j] = tag.Value()
+	}
+	return true
+}
+
+// Groups filtered records of the shard by tag values and partitions every group by time, series are keyed by
+// the joined tag values. Also returns the number of filtered records.
+func (shard *metricShard) getSeriesPartials(ctx context.Context, filters []*data.Tag, groupBy []string, timeRange TimeRange, timePartition TimePartitioner) (map[string]*seriesPartials, int) {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	records := shard.getInputMetrics(filters).MetricRecords()
+	partials := make(map[string]*seriesPartials)
+	tagValues := make([]string, len(groupBy))
+	for i, m := range records {
+		// cancelled query stops early, the result is incomplete then
+		if i%partitionChunkSize == 0 && ctx.Err() != nil {
+			break
+		}
+		if !timeRange.Contains(m.Timestamp()) {
+			continue
+		}
+		tags := m.Tags()
+		for j, name := range groupBy {
+			tagValues[j] = ""
+			if tag, found := tags[name]; found {
+				tagValues[j] = tag.Value()
+			}
+		}
+
+		key := strings.Join(tagValues, "\x00")
+		series, found := partials[key]
+		if !found {
+			series = &seriesPartials{
+				tagValues:  append([]string{}, tagValues...),
+				partitions: make(map[time.Time]*AggregateState),
+			}
+			partials[key] = series
+		}
+		pKey := timePartition.PartitionKey(m.Timestamp())
+		state, found := series.partitions[pKey]
+		if !found {
+			state = NewAggregateState()
+			series.partitions[pKey] = state
+		}
+		state.Add(m)
+	}
+	return partials, len(records)
+}
@@ -0,0 +1,493 @@
+package processor
+
+// Binary snapshots of the processor state, used to restart quickly without reparsing the whole data stream.
+//
+// Snapshot file layout:
+//
+//   magic "DSPS" | format version (uint16) | body length (uint64) | body CRC32 (uint32) | body
+//
+// The body holds snapshot metadata, metric records with their ingest sequences and tag indexes
+// (tagName -> tagValue -> record positions). Record positions are used instead of record ids because ids are not
+// unique in the dataset, tags of the records are restored from the tag indexes too. The layout does not depend on
+// the number of processor shards: records are routed to shards again while restoring, and shard tag-filter tries are
+// rebuilt from the tag indexes as every trie word is a tagName:tagValue pair. A snapshot is only restored if the
+// format version and the checksum match and the source file still starts with the snapshotted content (the file is the
+// same, or rows were appended to it), otherwise the caller is expected to fall back to streaming the data from scratch.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+const SNAPSHOT_FORMAT_VERSION = 6
+
+var snapshotMagic = [4]byte{'D', 'S', 'P', 'S'}
+
+var (
+	ErrSnapshotMagic           = errors.New("not a processor snapshot file")
+	ErrSnapshotVersionMismatch = errors.New("snapshot format version mismatch")
+	ErrSnapshotChecksum        = errors.New("snapshot checksum mismatch")
+	ErrSnapshotSourceChanged   = errors.New("snapshot source file changed")
+)
+
+// Describes the position of the data streams at the moment when snapshot was taken
+type SnapshotMetadata struct {
+	SourceOffset int64          // number of data stream records included into the snapshot
+	Source       SnapshotSource // source file the records were read from
+	WalSequence  uint64         // sequence number of the last write-ahead log record included into the snapshot
+	CreatedAt    time.Time
+}
+
+// Size and CRC32 checksum of the source file when the snapshot was taken. Records after the snapshot are streamed
+// from the source offset, which is only right if the file is the same or rows were appended to it.
+type SnapshotSource struct {
+	Size     int64
+	Checksum uint32
+}
+
+func ReadSnapshotSource(filePath string) (SnapshotSource, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return SnapshotSource{}, err
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return SnapshotSource{}, err
+	}
+	return SnapshotSource{Size: size, Checksum: hash.Sum32()}, nil
+}
+
+// Checks that the file starts with the source content and, if it grew, that the source content ended with a whole
+// row, so that no row read into the snapshot was extended afterwards
+func (source SnapshotSource) CheckPrefixOf(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < source.Size {
+		return fmt.Errorf("%w: %s has %d bytes, snapshot was taken of %d", ErrSnapshotSourceChanged, filePath,
+			info.Size(), source.Size)
+	}
+	hash := crc32.NewIEEE()
+	if _, err := io.CopyN(hash, file, source.Size); err != nil {
+		return err
+	}
+	if hash.Sum32() != source.Checksum {
+		return fmt.Errorf("%w: the first %d bytes of %s differ from the snapshotted ones", ErrSnapshotSourceChanged,
+			source.Size, filePath)
+	}
+	if info.Size() == source.Size {
+		return nil
+	}
+	// an empty source means that the file could not be read when the snapshot was taken
+	last := make([]byte, 1)
+	if source.Size > 0 {
+		if _, err := file.ReadAt(last, source.Size-1); err != nil {
+			return err
+		}
+	}
+	if last[0] != '\n' {
+		return fmt.Errorf("%w: the last row of %s was extended", ErrSnapshotSourceChanged, filePath)
+	}
+	return nil
+}
+
+// Writes snapshot of the processor state to the given file and returns metadata that was written. The file is
+// replaced atomically so that a crash in the middle of writing never leaves a broken snapshot behind.
+func SaveSnapshot(filePath string, mp *InMemoryMetricStreamProcessor, metadata SnapshotMetadata) (SnapshotMetadata, error) {
+	tmpFilePath := filePath + ".tmp"
+	file, err := os.Create(tmpFilePath)
+	if err != nil {
+		return SnapshotMetadata{}, err
+	}
+
+	metadata, err = mp.WriteSnapshot(file, metadata)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilePath)
+		return SnapshotMetadata{}, err
+	}
+	return metadata, os.Rename(tmpFilePath, filePath)
+}
+
+// Restores processor from the snapshot file of the source file. A new processor instance is returned so that a failed
+// restore never leaves a half-populated processor.
+func LoadSnapshot(filePath string, sourceFilePath string, shardCount int) (*InMemoryMetricStreamProcessor, SnapshotMetadata, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, SnapshotMetadata{}, err
+	}
+	defer file.Close()
+
+	mp := NewInMemoryMetricStreamProcessor(shardCount)
+	metadata, err := mp.ReadSnapshot(bufio.NewReader(file))
+	if err != nil {
+		return nil, SnapshotMetadata{}, err
+	}
+	if err := metadata.Source.CheckPrefixOf(sourceFilePath); err != nil {
+		return nil, SnapshotMetadata{}, err
+	}
+	return mp, metadata, nil
+}
+
+// Writes versioned and checksummed snapshot of the processor state. Write-ahead log sequence in the metadata
+// is taken from the processor so that it exactly matches the snapshotted state.
+func (mp *InMemoryMetricStreamProcessor) WriteSnapshot(w io.Writer, metadata SnapshotMetadata) (SnapshotMetadata, error) {
+	// no records are being ingested while the lock is held, so shards can be read without taking their locks
+	mp.ingestLock.Lock()
+	metadata.WalSequence = mp.LastSequence()
+	body := mp.encodeSnapshotBody(metadata)
+	mp.ingestLock.Unlock()
+
+	header := make([]byte, 18)
+	copy(header[:4], snapshotMagic[:])
+	binary.BigEndian.PutUint16(header[4:6], SNAPSHOT_FORMAT_VERSION)
+	binary.BigEndian.PutUint64(header[6:14], uint64(len(body)))
+	binary.BigEndian.PutUint32(header[14:18], crc32.ChecksumIEEE(body))
+
+	if _, err := w.Write(header); err != nil {
+		return SnapshotMetadata{}, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return SnapshotMetadata{}, err
+	}
+	return metadata, nil
+}
+
+// Reads snapshot into an empty processor. Fails if snapshot was written in another format version or
+// if it is corrupted.
+func (mp *InMemoryMetricStreamProcessor) ReadSnapshot(r io.Reader) (SnapshotMetadata, error) {
+	header := make([]byte, 18)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return SnapshotMetadata{}, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	if !bytes.Equal(header[:4], snapshotMagic[:]) {
+		return SnapshotMetadata{}, ErrSnapshotMagic
+	}
+	if version := binary.BigEndian.Uint16(header[4:6]); version != SNAPSHOT_FORMAT_VERSION {
+		return SnapshotMetadata{}, fmt.Errorf("%w: got %d, expected %d", ErrSnapshotVersionMismatch, version, SNAPSHOT_FORMAT_VERSION)
+	}
+	bodyLen := binary.BigEndian.Uint64(header[6:14])
+	checksum := binary.BigEndian.Uint32(header[14:18])
+
+	body, err := io.ReadAll(io.LimitReader(r, int64(bodyLen)))
+	if err != nil {
+		return SnapshotMetadata{}, fmt.Errorf("reading snapshot body: %w", err)
+	}
+	if uint64(len(body)) != bodyLen || crc32.ChecksumIEEE(body) != checksum {
+		return SnapshotMetadata{}, ErrSnapshotChecksum
+	}
+	return mp.decodeSnapshotBody(body)
+}
+
+func (mp *InMemoryMetricStreamProcessor) encodeSnapshotBody(metadata SnapshotMetadata) []byte {
+	enc := &snapshotEncoder{}
+
+	// metadata
+	enc.varint(metadata.SourceOffset)
+	enc.varint(metadata.Source.Size)
+	enc.uvarint(uint64(metadata.Source.Checksum))
+	enc.uvarint(metadata.WalSequence)
+	enc.varint(metadata.CreatedAt.UnixNano())
+
+	// metric records, position of the record in this list is used as its reference in tag indexes
+	positions := make(map[*data.MetricRecord]uint64)
+	recordsCount := 0
+	for _, shard := range mp.shards {
+		recordsCount += len(shard.allMetrics.MetricRecords())
+	}
+	enc.uvarint(uint64(recordsCount))
+	for _, shard := range mp.shards {
+		for _, record := range shard.allMetrics.MetricRecords() {
+			positions[record] = uint64(len(positions))
+			enc.varint(int64(record.Id()))
+			enc.varint(record.Timestamp().UnixNano())
+			enc.string(record.MetricName())
+			enc.uint64(math.Float64bits(record.MetricValue()))
+			enc.uvarint(record.Sequence())
+		}
+	}
+
+	// tag indexes of all shards merged together
+	taggedPositions := make(map[string]map[string][]uint64)
+	for _, shard := range mp.shards {
+		for tagName, tagValueMap := range shard.taggedMetrics {
+			if _, found := taggedPositions[tagName]; !found {
+				taggedPositions[tagName] = make(map[string][]uint64)
+			}
+			for tagValue, metrics := range tagValueMap {
+				for _, record := range metrics.MetricRecords() {
+					taggedPositions[tagName][tagValue] = append(taggedPositions[tagName][tagValue], positions[record])
+				}
+			}
+		}
+	}
+	enc.uvarint(uint64(len(taggedPositions)))
+	for tagName, tagValueMap := range taggedPositions {
+		enc.string(tagName)
+		enc.uvarint(uint64(len(tagValueMap)))
+		for tagValue, recordPositions := range tagValueMap {
+			enc.string(tagValue)
+			enc.uvarint(uint64(len(recordPositions)))
+			for _, position := range recordPositions {
+				enc.uvarint(position)
+			}
+		}
+	}
+
+	return enc.buf.Bytes()
+}
+
+func (mp *InMemoryMetricStreamProcessor) decodeSnapshotBody(body []byte) (SnapshotMetadata, error) {
+	dec := &snapshotDecoder{buf: body}
+
+	metadata := SnapshotMetadata{
+		SourceOffset: dec.varint(),
+		Source:       SnapshotSource{Size: dec.varint(), Checksum: uint32(dec.uvarint())},
+		WalSequence:  dec.uvarint(),
+		CreatedAt:    time.Unix(0, dec.varint()).UTC(),
+	}
+	mp.lastSequence = metadata.WalSequence
+
+	records := make([]*data.MetricRecord, dec.length())
+	for i := range records {
+		id := dec.varint()
+		timestamp := time.Unix(0, dec.varint()).UTC()
+		name := dec.string()
+		value := math.Float64frombits(dec.uint64())
+		records[i] = data.NewMetricRecord(int(id), timestamp, name, value)
+		records[i].SetSequence(dec.uvarint())
+		if records[i].Sequence() > mp.recordSequence {
+			mp.recordSequence = records[i].Sequence()
+		}
+		mp.shardFor(records[i]).addRecord(records[i])
+	}
+
+	tagNamesCount := dec.length()
+	for i := 0; i < tagNamesCount && dec.err == nil; i++ {
+		tagName := dec.string()
+		tagValuesCount := dec.length()
+		for j := 0; j < tagValuesCount && dec.err == nil; j++ {
+			tagValue := dec.string()
+			recordsCount := dec.length()
+			for k := 0; k < recordsCount && dec.err == nil; k++ {
+				position := dec.uvarint()
+				if position >= uint64(len(records)) {
+					dec.fail(fmt.Errorf("record position %d is out of range", position))
+					break
+				}
+				record := records[position]
+				record.SetTag(tagName, tagValue)
+				mp.shardFor(record).addTaggedRecord(tagName, tagValue, record)
+			}
+		}
+	}
+
+	if dec.err == nil && len(dec.buf) > 0 {
+		dec.fail(fmt.Errorf("%d unexpected trailing bytes", len(dec.buf)))
+	}
+	if dec.err != nil {
+		return SnapshotMetadata{}, fmt.Errorf("decoding snapshot: %w", dec.err)
+	}
+	return metadata, nil
+}
+
+// *** Periodic snapshots ***
+
+// Writes processor snapshots periodically and once more when stopped
+func NewSnapshotter(
+	filePath string,
+	mp *InMemoryMetricStreamProcessor,
+	interval time.Duration,
+	metadata func() SnapshotMetadata,
+) *Snapshotter {
+	return &Snapshotter{
+		filePath:  filePath,
+		processor: mp,
+		interval:  interval,
+		metadata:  metadata,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+type Snapshotter struct {
+	filePath   string
+	processor  *InMemoryMetricStreamProcessor
+	interval   time.Duration
+	metadata   func() SnapshotMetadata      // current position of the data streams
+	onSnapshot func(SnapshotMetadata) error // called after each successfully written snapshot
+	mu         sync.Mutex                   // serializes snapshot writes
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// Registers callback which is called with the metadata of every written snapshot, for example to truncate the
+// write-ahead log
+func (s *Snapshotter) OnSnapshot(callback func(SnapshotMetadata) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onSnapshot = callback
+}
+
+// Starts writing snapshots in background
+func (s *Snapshotter) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Snapshot(); err != nil {
+					log.Printf("Failed to write processor snapshot: %v", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops periodic snapshots and writes the final one
+func (s *Snapshotter) Stop() error {
+	close(s.stop)
+	<-s.done
+	return s.Snapshot()
+}
+
+// Writes snapshot right away
+func (s *Snapshotter) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metadata := s.metadata()
+	metadata.CreatedAt = time.Now().UTC()
+	metadata, err := SaveSnapshot(s.filePath, s.processor, metadata)
+	if err != nil || s.onSnapshot == nil {
+		return err
+	}
+	return s.onSnapshot(metadata)
+}
+
+// *** Binary encoding helpers ***
+
+type snapshotEncoder struct {
+	buf     bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (enc *snapshotEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(enc.scratch[:], v)
+	enc.buf.Write(enc.scratch[:n])
+}
+
+func (enc *snapshotEncoder) varint(v int64) {
+	n := binary.PutVarint(enc.scratch[:], v)
+	enc.buf.Write(enc.scratch[:n])
+}
+
+func (enc *snapshotEncoder) uint64(v uint64) {
+	binary.BigEndian.PutUint64(enc.scratch[:8], v)
+	enc.buf.Write(enc.scratch[:8])
+}
+
+func (enc *snapshotEncoder) string(s string) {
+	enc.uvarint(uint64(len(s)))
+	enc.buf.WriteString(s)
+}
+
+// Decoder remembers the first error, all reads after it return zero values
+type snapshotDecoder struct {
+	buf []byte
+	err error
+}
+
+func (dec *snapshotDecoder) fail(err error) {
+	if dec.err == nil {
+		dec.err = err
+	}
+	dec.buf = nil
+}
+
+func (dec *snapshotDecoder) uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(dec.buf)
+	if n <= 0 {
+		dec.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return v
+}
+
+func (dec *snapshotDecoder) varint() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(dec.buf)
+	if n <= 0 {
+		dec.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return v
+}
+
+func (dec *snapshotDecoder) uint64() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	if len(dec.buf) < 8 {
+		dec.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	v := binary.BigEndian.Uint64(dec.buf)
+	dec.buf = dec.buf[8:]
+	return v
+}
+
+// Reads collection length and makes sure it can't be larger than the remaining body
+func (dec *snapshotDecoder) length() int {
+	n := dec.uvarint()
+	if n > uint64(len(dec.buf)) {
+		dec.fail(fmt.Errorf("collection length %d exceeds snapshot size", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (dec *snapshotDecoder) string() string {
+	n := dec.length()
+	if dec.err != nil {
+		return ""
+	}
+	s := string(dec.buf[:n])
+	dec.buf = dec.buf[n:]
+	return s
+}
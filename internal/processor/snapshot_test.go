@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"valery-datadog-datastream-demo/internal/data"
+)
+
+// Processor snapshot of the first snapshotted records and its source file in a temporary directory
+func writeTestSnapshot(t *testing.T, records [][]string, snapshotted int) (string, string, *InMemoryMetricStreamProcessor) {
+	t.Helper()
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "dataset.csv")
+	writeTestSource(t, sourcePath, os.O_CREATE|os.O_TRUNC, append([][]string{make([]string, 20)}, records[:snapshotted]...))
+	source, err := ReadSnapshotSource(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := newTestProcessor(t, 3, records[:snapshotted])
+	snapshotPath := filepath.Join(dir, "processor.snapshot")
+	if _, err := SaveSnapshot(snapshotPath, mp, SnapshotMetadata{SourceOffset: int64(snapshotted), Source: source}); err != nil {
+		t.Fatal(err)
+	}
+	return snapshotPath, sourcePath, mp
+}
+
+func writeTestSource(t *testing.T, sourcePath string, flag int, rows [][]string) {
+	t.Helper()
+	file, err := os.OpenFile(sourcePath, flag|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	if err := writer.WriteAll(rows); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSnapshotRestoresProcessor(t *testing.T) {
+	snapshotPath, sourcePath, mp := writeTestSnapshot(t, testCsvRecords(100), 100)
+	source, err := ReadSnapshotSource(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, metadata, err := LoadSnapshot(snapshotPath, sourcePath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.SourceOffset != 100 || metadata.Source != source {
+		t.Errorf("metadata = %+v, want source %+v", metadata, source)
+	}
+	if got, want := restored.GetMetricTimeRange(), mp.GetMetricTimeRange(); got != want {
+		t.Errorf("time range = %v, want %v", got, want)
+	}
+}
+
+func TestLoadSnapshotResumesAppendedSource(t *testing.T) {
+	records := testCsvRecords(120)
+	snapshotPath, sourcePath, _ := writeTestSnapshot(t, records, 100)
+	writeTestSource(t, sourcePath, os.O_APPEND, records[100:])
+	// modification time changes too, only the content matters
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(sourcePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, metadata, err := LoadSnapshot(snapshotPath, sourcePath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.NewFileDataStreamFromOffset(sourcePath, metadata.SourceOffset, 1).Stream(restored)
+
+	order := RecordOrder{Field: RECORD_VALUE_FIELD}
+	want, wantTotal := readAllRecordPages(t, newTestProcessor(t, 1, records), nil, order, 1000)
+	got, total := readAllRecordPages(t, restored, nil, order, 1000)
+	if total != wantTotal || !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %d records %v, want %d records %v", total, got, wantTotal, want)
+	}
+}
+
+func TestLoadSnapshotFallsBack(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		change   func(t *testing.T, snapshotPath string, sourcePath string)
+		sentinel error
+	}{
+		{"format version mismatch", func(t *testing.T, snapshotPath string, sourcePath string) {
+			updateFile(t, snapshotPath, func(content []byte) {
+				binary.BigEndian.PutUint16(content[4:6], SNAPSHOT_FORMAT_VERSION-1)
+			})
+		}, ErrSnapshotVersionMismatch},
+		{"corrupted body", func(t *testing.T, snapshotPath string, sourcePath string) {
+			updateFile(t, snapshotPath, func(content []byte) {
+				content[len(content)-1] ^= 0xFF
+			})
+		}, ErrSnapshotChecksum},
+		{"truncated body", func(t *testing.T, snapshotPath string, sourcePath string) {
+			content, _ := os.ReadFile(snapshotPath)
+			if err := os.WriteFile(snapshotPath, content[:len(content)-10], 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrSnapshotChecksum},
+		{"source rows changed", func(t *testing.T, snapshotPath string, sourcePath string) {
+			updateFile(t, sourcePath, func(content []byte) {
+				content[len(content)-2] ^= 0x01
+			})
+		}, ErrSnapshotSourceChanged},
+		{"source rows removed", func(t *testing.T, snapshotPath string, sourcePath string) {
+			if err := os.Truncate(sourcePath, 100); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrSnapshotSourceChanged},
+		{"last source row extended", func(t *testing.T, snapshotPath string, sourcePath string) {
+			content, _ := os.ReadFile(sourcePath)
+			content = append(content[:len(content)-1], []byte("0,extra\n")...)
+			if err := os.WriteFile(sourcePath, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrSnapshotSourceChanged},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			snapshotPath, sourcePath, _ := writeTestSnapshot(t, testCsvRecords(100), 100)
+			test.change(t, snapshotPath, sourcePath)
+			mp, _, err := LoadSnapshot(snapshotPath, sourcePath, 2)
+			if !errors.Is(err, test.sentinel) || mp != nil {
+				t.Errorf("LoadSnapshot = %v, %v, want error %v", mp, err, test.sentinel)
+			}
+		})
+	}
+}
+
+func updateFile(t *testing.T, filePath string, update func(content []byte)) {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(content)
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,448 @@
+package wal
+
+// Append-only write-ahead log for data records ingested through live streams. Every accepted record is appended
+// to the log before it gets indexed by the metric processor, so that records which are not yet covered by a
+// processor snapshot survive a crash.
+//
+// The log is split into segment files named after the sequence number of their first entry. Each entry is framed as
+//
+//   payload length (uint32) | CRC32 of sequence + payload (uint32) | sequence (uint64) | payload
+//
+// where payload is the list of record fields. A torn write at the end of the last segment (for example after a crash)
+// is detected by the checksum and cut off when the log is opened. Segments which are fully covered by a snapshot
+// are removed with TruncateBefore.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines when appended entries are flushed to the disk
+type SyncPolicy string
+
+const (
+	SYNC_ALWAYS   SyncPolicy = "always"   // fsync after every append
+	SYNC_INTERVAL SyncPolicy = "interval" // fsync periodically in background
+	SYNC_NEVER    SyncPolicy = "never"    // leave it to the OS
+)
+
+const (
+	segmentFileExt    = ".wal"
+	entryHeaderLength = 16
+	maxPayloadLength  = 16 << 20
+)
+
+var (
+	ErrCorruptedSegment = errors.New("corrupted WAL segment")
+	ErrLogFailed        = errors.New("WAL failed")
+)
+
+// Syncs segment file to disk, replaced in tests to simulate failing disks
+var syncFile = (*os.File).Sync
+
+type Options struct {
+	SegmentMaxBytes int64 // active segment is rolled over once it grows beyond this size
+	SyncPolicy      SyncPolicy
+	SyncInterval    time.Duration // used with SYNC_INTERVAL policy
+	MinSequence     uint64        // first sequence number to use if the log is empty
+}
+
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch SyncPolicy(policy) {
+	case SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NEVER:
+		return SyncPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown WAL sync policy %q", policy)
+	}
+}
+
+type segment struct {
+	firstSequence uint64
+	filePath      string
+}
+
+type Log struct {
+	mu           sync.Mutex
+	dirPath      string
+	options      Options
+	segments     []segment // sorted by first sequence, the last one is active
+	active       *os.File
+	activeSize   int64
+	nextSequence uint64
+	dirty        bool  // there are appended entries which were not synced yet
+	failed       error // set once the active segment couldn't be restored after a failed write or sync, appends are refused
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// Opens the log in the given directory, creating it if necessary. Torn entries at the end of the last segment are
+// truncated.
+func Open(dirPath string, options Options) (*Log, error) {
+	if err := os.MkdirAll(dirPath, 0o755); err != nil {
+		return nil, err
+	}
+	if options.MinSequence == 0 {
+		options.MinSequence = 1
+	}
+
+	segments, err := listSegments(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dirPath:  dirPath,
+		options:  options,
+		segments: segments,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if len(segments) == 0 {
+		if err := l.createSegment(options.MinSequence); err != nil {
+			return nil, err
+		}
+	} else if err := l.openLastSegment(); err != nil {
+		return nil, err
+	}
+
+	if options.SyncPolicy == SYNC_INTERVAL && options.SyncInterval > 0 {
+		go l.syncPeriodically()
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// Appends record to the log and returns its sequence number
+func (l *Log) Append(record []string) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failed != nil {
+		return 0, l.failed
+	}
+	if l.activeSize >= l.options.SegmentMaxBytes && l.options.SegmentMaxBytes > 0 {
+		if err := l.rollSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	sequence := l.nextSequence
+	entry := encodeEntry(sequence, record)
+	if _, err := l.active.Write(entry); err != nil {
+		// cut off whatever part of the entry made it to the file so that the segment stays readable
+		if cutErr := l.cutOffLocked("torn entry"); cutErr != nil {
+			return 0, cutErr
+		}
+		return 0, err
+	}
+	if l.options.SyncPolicy == SYNC_ALWAYS {
+		if err := syncFile(l.active); err != nil {
+			// the record is rejected, so it must not be replayed on restart either
+			if cutErr := l.cutOffLocked("unsynced entry"); cutErr != nil {
+				return 0, cutErr
+			}
+			if syncErr := syncFile(l.active); syncErr != nil {
+				l.failed = fmt.Errorf("%w: syncing after unsynced entry: %v", ErrLogFailed, syncErr)
+				return 0, l.failed
+			}
+			return 0, err
+		}
+	} else {
+		l.dirty = true
+	}
+	l.activeSize += int64(len(entry))
+	l.nextSequence++
+	return sequence, nil
+}
+
+// Truncates the active segment back to the size of its complete entries and seeks to its end. If that fails the next
+// entries would follow a broken one and get lost on recovery, so the log is marked failed.
+func (l *Log) cutOffLocked(entry string) error {
+	if err := l.active.Truncate(l.activeSize); err != nil {
+		l.failed = fmt.Errorf("%w: truncating %s: %v", ErrLogFailed, entry, err)
+		return l.failed
+	}
+	if _, err := l.active.Seek(l.activeSize, io.SeekStart); err != nil {
+		l.failed = fmt.Errorf("%w: seeking after %s: %v", ErrLogFailed, entry, err)
+		return l.failed
+	}
+	return nil
+}
+
+// Calls apply for every record with sequence number >= fromSequence in the log order
+func (l *Log) Replay(fromSequence uint64, apply func(sequence uint64, record []string) error) error {
+	l.mu.Lock()
+	segments := append([]segment(nil), l.segments...)
+	l.mu.Unlock()
+
+	for i, seg := range segments {
+		// skip segments which end before the requested sequence
+		if i+1 < len(segments) && segments[i+1].firstSequence <= fromSequence {
+			continue
+		}
+		_, err := readSegment(seg.filePath, func(sequence uint64, record []string) error {
+			if sequence < fromSequence {
+				return nil
+			}
+			return apply(sequence, record)
+		})
+		if err != nil {
+			return fmt.Errorf("replaying %s: %w", seg.filePath, err)
+		}
+	}
+	return nil
+}
+
+// Removes segments which contain only entries with sequence numbers < sequence. Active segment is rolled over
+// first so that it can be removed as well.
+func (l *Log) TruncateBefore(sequence uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.activeSize > 0 && l.nextSequence <= sequence {
+		if err := l.rollSegment(); err != nil {
+			return err
+		}
+	}
+
+	removed := 0
+	for removed+1 < len(l.segments) && l.segments[removed+1].firstSequence <= sequence {
+		if err := os.Remove(l.segments[removed].filePath); err != nil {
+			return err
+		}
+		removed++
+	}
+	l.segments = l.segments[removed:]
+	return nil
+}
+
+// Sequence number that will be assigned to the next appended record
+func (l *Log) NextSequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextSequence
+}
+
+// Flushes appended entries to the disk
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncLocked()
+}
+
+func (l *Log) Close() error {
+	close(l.stop)
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.syncLocked()
+	if closeErr := l.active.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (l *Log) syncLocked() error {
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return syncFile(l.active)
+}
+
+func (l *Log) syncPeriodically() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Sync(); err != nil {
+				log.Printf("Failed to sync WAL segment: %v", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Validates the last segment, cuts off the torn tail if there is one and opens it for appending
+func (l *Log) openLastSegment() error {
+	last := l.segments[len(l.segments)-1]
+	nextSequence := last.firstSequence
+	validSize, err := readSegment(last.filePath, func(sequence uint64, _ []string) error {
+		nextSequence = sequence + 1
+		return nil
+	})
+	if errors.Is(err, ErrCorruptedSegment) {
+		log.Printf("Truncating torn tail of WAL segment %s at offset %d: %v", last.filePath, validSize, err)
+	} else if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(last.filePath, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.active = file
+	l.activeSize = validSize
+	l.nextSequence = nextSequence
+	if l.nextSequence < l.options.MinSequence {
+		l.nextSequence = l.options.MinSequence
+	}
+	return nil
+}
+
+func (l *Log) rollSegment() error {
+	if err := syncFile(l.active); err != nil {
+		return err
+	}
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return l.createSegment(l.nextSequence)
+}
+
+func (l *Log) createSegment(firstSequence uint64) error {
+	filePath := filepath.Join(l.dirPath, fmt.Sprintf("%020d%s", firstSequence, segmentFileExt))
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, segment{firstSequence: firstSequence, filePath: filePath})
+	l.active = file
+	l.activeSize = 0
+	l.nextSequence = firstSequence
+	return nil
+}
+
+func listSegments(dirPath string) ([]segment, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	segments := []segment{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentFileExt) {
+			continue
+		}
+		firstSequence, err := strconv.ParseUint(strings.TrimSuffix(name, segmentFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{firstSequence: firstSequence, filePath: filepath.Join(dirPath, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstSequence < segments[j].firstSequence
+	})
+	return segments, nil
+}
+
+// Reads entries of the segment one by one. Returns size of the valid part of the segment and
+// ErrCorruptedSegment if the segment has a torn or damaged entry.
+func readSegment(filePath string, apply func(sequence uint64, record []string) error) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := int64(0)
+	for offset < int64(len(content)) {
+		sequence, record, entryLength, err := decodeEntry(content[offset:])
+		if err != nil {
+			return offset, fmt.Errorf("%w: %v at offset %d", ErrCorruptedSegment, err, offset)
+		}
+		if err := apply(sequence, record); err != nil {
+			return offset, err
+		}
+		offset += int64(entryLength)
+	}
+	return offset, nil
+}
+
+// *** Entry encoding ***
+
+func encodeEntry(sequence uint64, record []string) []byte {
+	payload := make([]byte, 0, 64)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(scratch, uint64(len(record)))
+	payload = append(payload, scratch[:n]...)
+	for _, field := range record {
+		n = binary.PutUvarint(scratch, uint64(len(field)))
+		payload = append(payload, scratch[:n]...)
+		payload = append(payload, field...)
+	}
+
+	entry := make([]byte, entryHeaderLength+len(payload))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(entry[8:16], sequence)
+	copy(entry[entryHeaderLength:], payload)
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(entry[8:]))
+	return entry
+}
+
+func decodeEntry(buf []byte) (uint64, []string, int, error) {
+	if len(buf) < entryHeaderLength {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	payloadLength := int(binary.BigEndian.Uint32(buf[0:4]))
+	if payloadLength > maxPayloadLength {
+		return 0, nil, 0, fmt.Errorf("entry payload length %d is too large", payloadLength)
+	}
+	entryLength := entryHeaderLength + payloadLength
+	if len(buf) < entryLength {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(buf[8:entryLength]) != binary.BigEndian.Uint32(buf[4:8]) {
+		return 0, nil, 0, errors.New("entry checksum mismatch")
+	}
+	sequence := binary.BigEndian.Uint64(buf[8:16])
+
+	payload := buf[entryHeaderLength:entryLength]
+	fieldsCount, n := binary.Uvarint(payload)
+	if n <= 0 || fieldsCount > uint64(len(payload)) {
+		return 0, nil, 0, errors.New("malformed entry payload")
+	}
+	payload = payload[n:]
+	record := make([]string, fieldsCount)
+	for i := range record {
+		fieldLength, n := binary.Uvarint(payload)
+		if n <= 0 || fieldLength > uint64(len(payload)-n) {
+			return 0, nil, 0, errors.New("malformed entry payload")
+		}
+		record[i] = string(payload[n : n+int(fieldLength)])
+		payload = payload[n+int(fieldLength):]
+	}
+	return sequence, record, entryLength, nil
+}
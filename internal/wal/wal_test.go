@@ -0,0 +1,209 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func openTestLog(t *testing.T, dirPath string, segmentMaxBytes int64) *Log {
+	t.Helper()
+	l, err := Open(dirPath, Options{SegmentMaxBytes: segmentMaxBytes, SyncPolicy: SYNC_NEVER})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return l
+}
+
+func appendTestRecords(t *testing.T, l *Log, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if _, err := l.Append([]string{"record", strconv.Itoa(i)}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func replayAll(t *testing.T, l *Log, fromSequence uint64) ([]uint64, error) {
+	t.Helper()
+	sequences := []uint64{}
+	err := l.Replay(fromSequence, func(sequence uint64, record []string) error {
+		if want := []string{"record", strconv.Itoa(int(sequence - 1))}; !reflect.DeepEqual(record, want) {
+			t.Errorf("record %d = %v, want %v", sequence, record, want)
+		}
+		sequences = append(sequences, sequence)
+		return nil
+	})
+	return sequences, err
+}
+
+func sequenceRange(from uint64, to uint64) []uint64 {
+	sequences := []uint64{}
+	for sequence := from; sequence <= to; sequence++ {
+		sequences = append(sequences, sequence)
+	}
+	return sequences
+}
+
+func TestOpenTruncatesTornTail(t *testing.T) {
+	dirPath := t.TempDir()
+	l := openTestLog(t, dirPath, 0)
+	appendTestRecords(t, l, 5)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// cut the last entry in the middle, as a crash during the write would
+	segments, _ := listSegments(dirPath)
+	last := segments[len(segments)-1].filePath
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openTestLog(t, dirPath, 0)
+	defer l.Close()
+	if got := l.NextSequence(); got != 5 {
+		t.Errorf("NextSequence() = %d, want 5", got)
+	}
+	sequences, err := replayAll(t, l, 1)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if want := sequenceRange(1, 4); !reflect.DeepEqual(sequences, want) {
+		t.Errorf("replayed %v, want %v", sequences, want)
+	}
+
+	// the torn entry is gone, new entries follow the last complete one
+	if sequence, err := l.Append([]string{"record", "4"}); err != nil || sequence != 5 {
+		t.Fatalf("Append = %d, %v, want 5", sequence, err)
+	}
+	sequences, err = replayAll(t, l, 1)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if want := sequenceRange(1, 5); !reflect.DeepEqual(sequences, want) {
+		t.Errorf("replayed %v, want %v", sequences, want)
+	}
+}
+
+func TestReplayFailsOnCorruptedMiddleSegment(t *testing.T) {
+	dirPath := t.TempDir()
+	// every entry rolls the segment over
+	l := openTestLog(t, dirPath, 1)
+	appendTestRecords(t, l, 3)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := listSegments(dirPath)
+	if len(segments) != 3 {
+		t.Fatalf("got %d segments, want 3", len(segments))
+	}
+	middle := segments[1].filePath
+	content, err := os.ReadFile(middle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)-1] ^= 0xff
+	if err := os.WriteFile(middle, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the last segment is repaired on open, damage elsewhere is reported by replay
+	l = openTestLog(t, dirPath, 1)
+	defer l.Close()
+	sequences, err := replayAll(t, l, 1)
+	if !errors.Is(err, ErrCorruptedSegment) {
+		t.Fatalf("Replay error = %v, want %v", err, ErrCorruptedSegment)
+	}
+	if want := []uint64{1}; !reflect.DeepEqual(sequences, want) {
+		t.Errorf("replayed %v before the error, want %v", sequences, want)
+	}
+}
+
+func TestTruncateBeforeKeepsUnreplayedSegments(t *testing.T) {
+	dirPath := t.TempDir()
+	// two entries per segment
+	l := openTestLog(t, dirPath, 2*int64(len(encodeEntry(1, []string{"record", "0"})))-1)
+	defer l.Close()
+	appendTestRecords(t, l, 7)
+
+	// entry 4 shares its segment with entry 3, which is covered already, the segment has to stay
+	if err := l.TruncateBefore(4); err != nil {
+		t.Fatal(err)
+	}
+	sequences, err := replayAll(t, l, 4)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if want := sequenceRange(4, 7); !reflect.DeepEqual(sequences, want) {
+		t.Errorf("replayed %v, want %v", sequences, want)
+	}
+	sequences, _ = replayAll(t, l, 1)
+	if want := sequenceRange(3, 7); !reflect.DeepEqual(sequences, want) {
+		t.Errorf("log holds %v, want %v", sequences, want)
+	}
+
+	// everything covered: the active segment is rolled over and removed, numbering goes on
+	if err := l.TruncateBefore(8); err != nil {
+		t.Fatal(err)
+	}
+	sequences, _ = replayAll(t, l, 1)
+	if len(sequences) != 0 {
+		t.Errorf("log holds %v, want nothing", sequences)
+	}
+	if got := l.NextSequence(); got != 8 {
+		t.Errorf("NextSequence() = %d, want 8", got)
+	}
+}
+
+func TestFailedSyncRemovesEntry(t *testing.T) {
+	dirPath := t.TempDir()
+	l, err := Open(dirPath, Options{SyncPolicy: SYNC_ALWAYS})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer l.Close()
+	appendTestRecords(t, l, 3)
+
+	syncErr := errors.New("disk failed")
+	failures := 1
+	syncFile = func(file *os.File) error {
+		if failures > 0 {
+			failures--
+			return syncErr
+		}
+		return file.Sync()
+	}
+	defer func() { syncFile = (*os.File).Sync }()
+
+	if _, err := l.Append([]string{"record", "rejected"}); !errors.Is(err, syncErr) {
+		t.Fatalf("Append error = %v, want %v", err, syncErr)
+	}
+	// the rejected entry is neither replayed nor does it take a sequence number
+	if sequence, err := l.Append([]string{"record", "3"}); err != nil || sequence != 4 {
+		t.Fatalf("Append = %d, %v, want 4", sequence, err)
+	}
+	sequences, err := replayAll(t, l, 1)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if want := sequenceRange(1, 4); !reflect.DeepEqual(sequences, want) {
+		t.Errorf("replayed %v, want %v", sequences, want)
+	}
+
+	// the log is failed if not even the removal of the entry can be synced
+	failures = 2
+	if _, err := l.Append([]string{"record", "rejected"}); !errors.Is(err, ErrLogFailed) {
+		t.Fatalf("Append error = %v, want %v", err, ErrLogFailed)
+	}
+	if _, err := l.Append([]string{"record", "4"}); !errors.Is(err, ErrLogFailed) {
+		t.Errorf("Append after failure error = %v, want %v", err, ErrLogFailed)
+	}
+}